@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// AdminCommand set of flags and command to show and change admins info of the site at runtime,
+// for admin store allowing changes (bolt)
+type AdminCommand struct {
+	Site        string        `short:"s" long:"site" env:"SITE" default:"remark" description:"site name"`
+	Admins      []string      `long:"admin" description:"set admin ids, replaces the current list"`
+	Moderators  []string      `long:"moderator" description:"set moderator ids, replaces the current list"`
+	Email       string        `long:"email" description:"set admin email"`
+	Rotate      bool          `long:"rotate" description:"rotate secret key of the site"`
+	Key         string        `long:"key" description:"new secret key for rotation, random if not set"`
+	Grace       time.Duration `long:"grace" default:"24h" description:"previous key valid after rotation for"`
+	Delete      bool          `long:"delete" description:"delete admins info of the site, defaults used after"`
+	AdminPasswd string        `long:"admin-passwd" env:"ADMIN_PASSWD" required:"true" description:"admin basic auth password"`
+	CommonOpts
+}
+
+// Execute runs admin with AdminCommand parameters, entry point for "admin" command.
+// Shows admins info of the site with GET /admin/sites/{site} if no changes requested,
+// changes it with PUT /admin/sites/{site} or removes with DELETE /admin/sites/{site}.
+// Key of the site rotated with POST /admin/sites/{site}/rotate
+func (ac *AdminCommand) Execute(args []string) error {
+	resetEnv("SECRET", "ADMIN_PASSWD")
+	siteURL := fmt.Sprintf("%s/api/v1/admin/sites/%s", ac.RemarkURL, url.PathEscape(ac.Site))
+
+	if ac.Delete {
+		log.Printf("[INFO] delete admins info of site %s", ac.Site)
+		_, err := ac.send(http.MethodDelete, siteURL, nil)
+		return err
+	}
+
+	if ac.Rotate {
+		log.Printf("[INFO] rotate key of site %s, grace period %v", ac.Site, ac.Grace)
+		req, err := json.Marshal(map[string]string{"key": ac.Key, "grace": ac.Grace.String()})
+		if err != nil {
+			return errors.Wrap(err, "can't marshal rotation request")
+		}
+		body, err := ac.send(http.MethodPost, siteURL+"/rotate", bytes.NewReader(req))
+		if err != nil {
+			return err
+		}
+		log.Printf("[INFO] key of site %s rotated, %s", ac.Site, strings.TrimSpace(body))
+		return nil
+	}
+
+	changes := map[string]interface{}{}
+	if ac.Admins != nil {
+		changes["admins"] = ac.Admins
+	}
+	if ac.Moderators != nil {
+		changes["moderators"] = ac.Moderators
+	}
+	if ac.Email != "" {
+		changes["email"] = ac.Email
+	}
+
+	if len(changes) == 0 {
+		body, err := ac.send(http.MethodGet, siteURL, nil)
+		if err != nil {
+			return err
+		}
+		log.Printf("[INFO] site %s, %s", ac.Site, strings.TrimSpace(body))
+		return nil
+	}
+
+	log.Printf("[INFO] change admins info of site %s", ac.Site)
+	req, err := json.Marshal(changes)
+	if err != nil {
+		return errors.Wrap(err, "can't marshal changes")
+	}
+	body, err := ac.send(http.MethodPut, siteURL, bytes.NewReader(req))
+	if err != nil {
+		return err
+	}
+	log.Printf("[INFO] site %s changed, %s", ac.Site, strings.TrimSpace(body))
+	return nil
+}
+
+// send makes request with admin's basic auth and returns response body
+func (ac *AdminCommand) send(method, reqURL string, body io.Reader) (string, error) {
+	return adminRequest(method, reqURL, ac.AdminPasswd, body)
+}
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	flags "github.com/jessevdk/go-flags"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdmin_Execute(t *testing.T) {
+	var lastReq string
+	var lastBody map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.True(t, strings.HasPrefix(r.URL.Path, "/api/v1/admin/sites/remark"), r.URL.Path)
+		user, passwd, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "admin", user)
+		if passwd != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		lastReq, lastBody = r.Method+" "+r.URL.Path, nil
+		if r.Method == http.MethodPut || r.Method == http.MethodPost {
+			body, err := ioutil.ReadAll(r.Body)
+			require.NoError(t, err)
+			require.NoError(t, json.Unmarshal(body, &lastBody))
+		}
+		_, _ = w.Write([]byte(`{"site":"remark","admins":["a1"],"moderators":[],"email":"admin@example.com"}`))
+	}))
+	defer ts.Close()
+
+	execute := func(args ...string) error {
+		cmd := AdminCommand{}
+		cmd.SetCommon(CommonOpts{RemarkURL: ts.URL, SharedSecret: "123456"})
+		p := flags.NewParser(&cmd, flags.Default)
+		_, err := p.ParseArgs(append([]string{"--site=remark"}, args...))
+		require.Nil(t, err)
+		return cmd.Execute(nil)
+	}
+
+	assert.NoError(t, execute("--admin-passwd=secret"))
+	assert.Equal(t, "GET /api/v1/admin/sites/remark", lastReq, "no changes, show only")
+
+	assert.NoError(t, execute("--admin-passwd=secret", "--admin=a1", "--admin=a2", "--email=new@example.com"))
+	assert.Equal(t, "PUT /api/v1/admin/sites/remark", lastReq)
+	assert.Equal(t, map[string]interface{}{"admins": []interface{}{"a1", "a2"}, "email": "new@example.com"}, lastBody)
+
+	assert.NoError(t, execute("--admin-passwd=secret", "--moderator="))
+	assert.Equal(t, map[string]interface{}{"moderators": []interface{}{""}}, lastBody)
+
+	assert.NoError(t, execute("--admin-passwd=secret", "--rotate", "--key=new-key", "--grace=72h"))
+	assert.Equal(t, "POST /api/v1/admin/sites/remark/rotate", lastReq)
+	assert.Equal(t, map[string]interface{}{"key": "new-key", "grace": "72h0m0s"}, lastBody)
+	assert.NoError(t, execute("--admin-passwd=secret", "--rotate"))
+	assert.Equal(t, map[string]interface{}{"key": "", "grace": "24h0m0s"}, lastBody, "random key, default grace")
+
+	assert.NoError(t, execute("--admin-passwd=secret", "--delete"))
+	assert.Equal(t, "DELETE /api/v1/admin/sites/remark", lastReq)
+
+	assert.EqualError(t, execute("--admin-passwd=bad"), `error response "401 Unauthorized", `)
+}
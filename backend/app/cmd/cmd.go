@@ -4,6 +4,7 @@ package cmd
 
 import (
 	"bytes"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -90,6 +91,31 @@ func resetEnv(envs ...string) {
 	}
 }
 
+// adminRequest makes request with admin's basic auth and returns response body
+func adminRequest(method, reqURL, passwd string, body io.Reader) (string, error) {
+	req, err := http.NewRequest(method, reqURL, body)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to make request for %s", reqURL)
+	}
+	req.SetBasicAuth("admin", passwd)
+
+	client := http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", errors.Wrapf(err, "request failed for %s", reqURL)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return "", responseError(resp)
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrapf(err, "can't read response from %s", reqURL)
+	}
+	return string(respBody), nil
+}
+
 // responseError returns error with status and response body
 func responseError(resp *http.Response) error {
 	body, e := ioutil.ReadAll(resp.Body)
@@ -4,9 +4,11 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
 	"syscall"
@@ -15,12 +17,17 @@ import (
 
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/globalsign/mgo"
+	"github.com/go-pkgz/auth"
 	"github.com/go-pkgz/auth/token"
 	"github.com/go-pkgz/mongo"
 	flags "github.com/jessevdk/go-flags"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark/backend/app/notify"
+	"github.com/umputun/remark/backend/app/store"
+	"github.com/umputun/remark/backend/app/store/service"
 )
 
 func TestServerApp(t *testing.T) {
@@ -139,6 +146,41 @@ func TestServerApp_WithMongo(t *testing.T) {
 	app.Wait()
 }
 
+func TestServerApp_WithSQLite(t *testing.T) {
+	sqliteFile := "/tmp/18087/remark.sqlite"
+	os.Remove(sqliteFile)
+	defer os.RemoveAll("/tmp/18087")
+	app, ctx := prepServerApp(t, 500*time.Millisecond, func(o ServerCommand) ServerCommand {
+		o.Port = 18087
+		o.Store.Type = "sqlite"
+		o.Store.SQLite.File = sqliteFile
+		return o
+	})
+
+	go func() { _ = app.run(ctx) }()
+	time.Sleep(100 * time.Millisecond) // let server start
+
+	client := http.Client{Timeout: 5 * time.Second}
+	req, err := http.NewRequest("POST", "http://localhost:18087/api/v1/comment",
+		strings.NewReader(`{"text": "test 123", "locator":{"url": "https://radio-t.com/blah1", "site": "remark"}}`))
+	require.Nil(t, err)
+	req.SetBasicAuth("admin", "password")
+	resp, err := client.Do(req)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp, err = http.Get("http://localhost:18087/api/v1/find?site=remark&url=https://radio-t.com/blah1")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Contains(t, string(body), "test 123")
+
+	app.Wait()
+}
+
 func TestServerApp_WithSSL(t *testing.T) {
 	opts := ServerCommand{}
 	opts.SetCommon(CommonOpts{RemarkURL: "https://localhost:18443", SharedSecret: "123456"})
@@ -236,6 +278,191 @@ func TestServerApp_Failed(t *testing.T) {
 	_, err = opts.newServerApp()
 	assert.EqualError(t, err, "failed to make data store engine: unsupported store type blah")
 	t.Log(err)
+
+	opts.Store.Type = "postgres"
+	_, err = opts.newServerApp()
+	assert.EqualError(t, err, "failed to make data store engine: no postgres URL provided")
+}
+
+func TestServerCommand_NotifyTypes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slack/auth.test":
+			_, _ = w.Write([]byte(`{"ok": true, "user": "remark42"}`))
+		case "/_matrix/client/r0/account/whoami":
+			_, _ = w.Write([]byte(`{"user_id": "@remark42:example.com"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	opts := ServerCommand{}
+	p := flags.NewParser(&opts, flags.Default)
+	_, err := p.ParseArgs([]string{"--notify.type=slack", "--notify.type=matrix", "--notify.type=blah"})
+	assert.NotNil(t, err, "blah is invalid type")
+
+	opts = ServerCommand{}
+	p = flags.NewParser(&opts, flags.Default)
+	_, err = p.ParseArgs([]string{"--notify.type=slack", "--notify.type=matrix", "--notify.slack.token=xoxb-123",
+		"--notify.slack.chan=#remark", "--notify.slack.api=" + ts.URL + "/slack/", "--notify.matrix.token=syt-123",
+		"--notify.matrix.room=!room:example.com", "--notify.matrix.api=" + ts.URL, "--notify.queue-db=/tmp/notify-types.db",
+		"--notify.slack.site=site-a", "--notify.slack.site=site-b", "--notify.matrix.filter=admin-replies"})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"slack", "matrix"}, opts.Notify.Type)
+	assert.Equal(t, []string{"site-a", "site-b"}, opts.Notify.Slack.Sites)
+	assert.Equal(t, "all", opts.Notify.Slack.Filter)
+	assert.Equal(t, 0, len(opts.Notify.Matrix.Sites))
+	assert.Equal(t, "admin-replies", opts.Notify.Matrix.Filter)
+	defer os.Remove("/tmp/notify-types.db")
+
+	svc, err := opts.makeNotify(&service.DataStore{})
+	require.Nil(t, err)
+	assert.NotEqual(t, notify.NopService, svc)
+	svc.Close()
+
+	opts.Notify.Matrix.API = ts.URL + "/bad"
+	_, err = opts.makeNotify(&service.DataStore{})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "failed to create matrix notification destination")
+}
+
+func TestServerCommand_EmailAuth(t *testing.T) {
+	opts := ServerCommand{}
+	p := flags.NewParser(&opts, flags.Default)
+	_, err := p.ParseArgs([]string{"--auth.email.enable", "--notify.email.host=127.0.0.1",
+		"--notify.email.from=remark@example.com"})
+	require.Nil(t, err)
+	assert.Equal(t, 15*time.Minute, opts.Auth.Email.TTL)
+	assert.Equal(t, 3, opts.Auth.Email.AddrLimit)
+	assert.Equal(t, 10, opts.Auth.Email.IPLimit)
+	assert.Equal(t, 25, opts.Auth.Email.Port)
+	assert.Equal(t, "", opts.Auth.Email.Host)
+
+	authenticator := auth.NewService(auth.Opts{})
+	providers, err := opts.addAuthProviders(authenticator, &service.DataStore{})
+	require.Nil(t, err, "notify.email smtp used")
+	require.Equal(t, 1, len(providers))
+	assert.Equal(t, "email", providers[0].Name())
+	assert.Equal(t, 0, len(authenticator.Providers()))
+
+	opts = ServerCommand{}
+	p = flags.NewParser(&opts, flags.Default)
+	_, err = p.ParseArgs([]string{"--auth.email.enable", "--auth.email.host=smtp.example.com", "--auth.email.ttl=5m",
+		"--auth.email.addr-limit=1", "--auth.email.ip-limit=2", "--auth.dev"})
+	require.Nil(t, err)
+	assert.Equal(t, "smtp.example.com", opts.Auth.Email.Host)
+	_, err = opts.addAuthProviders(auth.NewService(auth.Opts{}), &service.DataStore{})
+	assert.EqualError(t, err, "failed to make email auth sender: empty from address")
+
+	opts.Auth.Email.From = "remark@example.com"
+	authenticator = auth.NewService(auth.Opts{})
+	providers, err = opts.addAuthProviders(authenticator, &service.DataStore{})
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(providers))
+	assert.Equal(t, 1, len(authenticator.Providers()), "dev provider")
+
+	opts.Auth.Email.Enable = false
+	providers, err = opts.addAuthProviders(auth.NewService(auth.Opts{}), &service.DataStore{})
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(providers))
+}
+
+func TestServerCommand_AnonymousAuth(t *testing.T) {
+	opts := ServerCommand{}
+	p := flags.NewParser(&opts, flags.Default)
+	_, err := p.ParseArgs([]string{"--auth.anon.enable", "--auth.anon.vote=site-a", "--auth.anon.strict=site-a",
+		"--auth.anon.strict=site-b"})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"site-a"}, opts.Auth.Anonymous.Vote)
+	assert.Equal(t, []string{"site-a", "site-b"}, opts.Auth.Anonymous.Strict)
+	assert.Equal(t, 500, opts.Auth.Anonymous.MaxCommentSize)
+	assert.Equal(t, time.Minute, opts.Auth.Anonymous.Interval)
+
+	providers, err := opts.addAuthProviders(auth.NewService(auth.Opts{}), &service.DataStore{})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(providers))
+	assert.Equal(t, "anonymous", providers[0].Name())
+}
+
+func TestServerCommand_BoltAdminStore(t *testing.T) {
+	defer os.RemoveAll("/tmp/remark-admin")
+	opts := ServerCommand{}
+	opts.SetCommon(CommonOpts{RemarkURL: "https://remark.example.com", SharedSecret: "123456"})
+	p := flags.NewParser(&opts, flags.Default)
+	_, err := p.ParseArgs([]string{"--admin.type=bolt", "--admin.bolt.file=/tmp/remark-admin/admin.db",
+		"--admin.shared.id=a1", "--admin.shared.moderator=m1"})
+	require.Nil(t, err)
+
+	adminStore, err := opts.makeAdminStore()
+	require.Nil(t, err)
+	key, err := adminStore.Key("remark")
+	require.Nil(t, err)
+	assert.Equal(t, "123456", key, "shared secret as default key")
+	assert.Equal(t, []string{"a1"}, adminStore.Admins("remark"))
+	assert.Equal(t, []string{"m1"}, adminStore.Moderators("remark"))
+	assert.Equal(t, "admin@remark.example.com", adminStore.Email("remark"))
+	assert.FileExists(t, "/tmp/remark-admin/admin.db")
+	require.Nil(t, adminStore.(io.Closer).Close())
+}
+
+func TestServerCommand_Registry(t *testing.T) {
+	defer os.RemoveAll("/tmp/remark-registry")
+	opts := ServerCommand{}
+	opts.SetCommon(CommonOpts{RemarkURL: "https://remark.example.com", SharedSecret: "123456"})
+	p := flags.NewParser(&opts, flags.Default)
+	_, err := p.ParseArgs([]string{"--site=remark", "--store.bolt.path=/tmp/remark-registry",
+		"--registry.enable", "--registry.file=/tmp/remark-registry/reg/sites.db"})
+	require.Nil(t, err)
+
+	reg, err := opts.makeRegistry()
+	require.Nil(t, err)
+	_, err = reg.Add("blog")
+	require.Nil(t, err)
+	_, err = reg.SetDisabled("remark", true)
+	require.Nil(t, err)
+
+	eng, err := opts.makeDataStore(reg)
+	require.Nil(t, err)
+	_, err = eng.Count(store.Locator{SiteID: "blog", URL: "https://example.com/post"})
+	assert.Nil(t, err, "registered site opened")
+	_, err = eng.Count(store.Locator{SiteID: "remark", URL: "https://example.com/post"})
+	assert.EqualError(t, err, `site "remark" closed`, "disabled site not opened")
+	_, err = os.Stat("/tmp/remark-registry/remark.db")
+	assert.True(t, os.IsNotExist(err))
+
+	app := serverApp{ServerCommand: &opts, dataService: &service.DataStore{Interface: eng, Registry: reg}}
+	ids, err := app.siteIDs()
+	require.Nil(t, err)
+	assert.Equal(t, []string{"blog"}, ids)
+	require.Nil(t, eng.Close())
+	require.Nil(t, reg.Close())
+
+	opts.Registry.Enable = false
+	reg, err = opts.makeRegistry()
+	require.Nil(t, err)
+	assert.Nil(t, reg, "registry disabled")
+}
+
+func TestServerCommand_OIDCAuth(t *testing.T) {
+	opts := ServerCommand{}
+	p := flags.NewParser(&opts, flags.Default)
+	_, err := p.ParseArgs([]string{"--auth.oidc.cid=cid", "--auth.oidc.issuer=https://sso.example.com/realms/corp"})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"profile", "email"}, opts.Auth.OIDC.Scopes)
+	assert.Equal(t, "oidc", opts.Auth.OIDC.Name)
+
+	providers, err := opts.addAuthProviders(auth.NewService(auth.Opts{}), &service.DataStore{})
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(providers), "no secret, provider skipped")
+
+	_, err = p.ParseArgs([]string{"--auth.oidc.cid=cid", "--auth.oidc.csec=csec", "--auth.oidc.name=corp",
+		"--auth.oidc.issuer=https://sso.example.com/realms/corp", "--auth.oidc.scopes=profile"})
+	require.Nil(t, err)
+	providers, err = opts.addAuthProviders(auth.NewService(auth.Opts{}), &service.DataStore{})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(providers))
+	assert.Equal(t, "corp", providers[0].Name())
 }
 
 func TestServerApp_Shutdown(t *testing.T) {
@@ -398,7 +625,8 @@ func prepServerApp(t *testing.T, duration time.Duration, fn func(o ServerCommand
 	cmd.Auth.Facebook.CSEC, cmd.Auth.Facebook.CID = "csec", "cid"
 	cmd.Auth.Yandex.CSEC, cmd.Auth.Yandex.CID = "csec", "cid"
 	cmd.BackupLocation = "/tmp"
-	cmd.Notify.Type = "telegram"
+	cmd.Notify.Type = []string{"telegram"}
+	cmd.Notify.QueueDB = fmt.Sprintf("/tmp/%d/notify.db", cmd.Port)
 	cmd.Notify.Telegram.API = "http://127.0.0.1:12340/"
 	cmd.Notify.Telegram.Token = "blah"
 	cmd = fn(cmd)
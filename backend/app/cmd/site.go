@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SiteCommand set of flags and command to list, create, rename, disable and delete sites at runtime,
+// for server with sites registry enabled
+type SiteCommand struct {
+	Site        string `short:"s" long:"site" env:"SITE" default:"remark" description:"site name"`
+	Create      bool   `long:"create" description:"register new site"`
+	Rename      string `long:"rename" description:"rename the site to the given id"`
+	Disable     bool   `long:"disable" description:"disable the site"`
+	Enable      bool   `long:"enable" description:"enable disabled site"`
+	Delete      bool   `long:"delete" description:"delete the site with all comments"`
+	AdminPasswd string `long:"admin-passwd" env:"ADMIN_PASSWD" required:"true" description:"admin basic auth password"`
+	CommonOpts
+}
+
+// Execute runs site with SiteCommand parameters, entry point for "site" command.
+// Lists all registered sites with GET /admin/registry if no action requested, registers site with POST /admin/registry,
+// renames, disables or enables it with PUT /admin/registry/{site} and removes with DELETE /admin/registry/{site}
+func (sc *SiteCommand) Execute(args []string) error {
+	resetEnv("SECRET", "ADMIN_PASSWD")
+	if sc.Disable && sc.Enable {
+		return errors.New("can't disable and enable the site at the same time")
+	}
+	registryURL := fmt.Sprintf("%s/api/v1/admin/registry", sc.RemarkURL)
+	siteURL := fmt.Sprintf("%s/%s", registryURL, url.PathEscape(sc.Site))
+
+	switch {
+	case sc.Create:
+		log.Printf("[INFO] create site %s", sc.Site)
+		body, err := sc.send(http.MethodPost, registryURL, map[string]interface{}{"site": sc.Site})
+		if err != nil {
+			return err
+		}
+		log.Printf("[INFO] site %s created, %s", sc.Site, body)
+		return nil
+	case sc.Delete:
+		log.Printf("[INFO] delete site %s", sc.Site)
+		_, err := adminRequest(http.MethodDelete, siteURL, sc.AdminPasswd, nil)
+		return err
+	}
+
+	changes := map[string]interface{}{}
+	if sc.Rename != "" {
+		changes["site"] = sc.Rename
+	}
+	if sc.Disable || sc.Enable {
+		changes["disabled"] = sc.Disable
+	}
+	if len(changes) == 0 {
+		body, err := adminRequest(http.MethodGet, registryURL, sc.AdminPasswd, nil)
+		if err != nil {
+			return err
+		}
+		log.Printf("[INFO] sites %s", strings.TrimSpace(body))
+		return nil
+	}
+
+	log.Printf("[INFO] change site %s", sc.Site)
+	body, err := sc.send(http.MethodPut, siteURL, changes)
+	if err != nil {
+		return err
+	}
+	log.Printf("[INFO] site %s changed, %s", sc.Site, body)
+	return nil
+}
+
+// send makes request with json body and returns response body
+func (sc *SiteCommand) send(method, reqURL string, req map[string]interface{}) (string, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return "", errors.Wrap(err, "can't marshal request")
+	}
+	body, err := adminRequest(method, reqURL, sc.AdminPasswd, bytes.NewReader(data))
+	return strings.TrimSpace(body), err
+}
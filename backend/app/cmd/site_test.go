@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	flags "github.com/jessevdk/go-flags"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSite_Execute(t *testing.T) {
+	var lastReq string
+	var lastBody map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.True(t, strings.HasPrefix(r.URL.Path, "/api/v1/admin/registry"), r.URL.Path)
+		user, passwd, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "admin", user)
+		if passwd != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		lastReq, lastBody = r.Method+" "+r.URL.Path, nil
+		if r.Method == http.MethodPut || r.Method == http.MethodPost {
+			body, err := ioutil.ReadAll(r.Body)
+			require.NoError(t, err)
+			require.NoError(t, json.Unmarshal(body, &lastBody))
+		}
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusCreated)
+		}
+		_, _ = w.Write([]byte(`{"site":"blog","disabled":false}`))
+	}))
+	defer ts.Close()
+
+	execute := func(args ...string) error {
+		cmd := SiteCommand{}
+		cmd.SetCommon(CommonOpts{RemarkURL: ts.URL, SharedSecret: "123456"})
+		p := flags.NewParser(&cmd, flags.Default)
+		_, err := p.ParseArgs(append([]string{"--site=blog", "--admin-passwd=secret"}, args...))
+		require.Nil(t, err)
+		return cmd.Execute(nil)
+	}
+
+	assert.NoError(t, execute())
+	assert.Equal(t, "GET /api/v1/admin/registry", lastReq, "no action, list only")
+
+	assert.NoError(t, execute("--create"))
+	assert.Equal(t, "POST /api/v1/admin/registry", lastReq)
+	assert.Equal(t, map[string]interface{}{"site": "blog"}, lastBody)
+
+	assert.NoError(t, execute("--rename=blog2", "--disable"))
+	assert.Equal(t, "PUT /api/v1/admin/registry/blog", lastReq)
+	assert.Equal(t, map[string]interface{}{"site": "blog2", "disabled": true}, lastBody)
+	assert.NoError(t, execute("--enable"))
+	assert.Equal(t, map[string]interface{}{"disabled": false}, lastBody)
+
+	assert.NoError(t, execute("--delete"))
+	assert.Equal(t, "DELETE /api/v1/admin/registry/blog", lastReq)
+
+	lastReq = ""
+	assert.EqualError(t, execute("--disable", "--enable"), "can't disable and enable the site at the same time")
+	assert.Empty(t, lastReq)
+	assert.EqualError(t, execute("--admin-passwd=bad"), `error response "401 Unauthorized", `)
+}
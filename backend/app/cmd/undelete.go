@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+// UndeleteCommand set of flags and command for restore of soft-deleted comment
+type UndeleteCommand struct {
+	Site        string `short:"s" long:"site" env:"SITE" default:"remark" description:"site name"`
+	URL         string `long:"post" required:"true" description:"post url"`
+	ID          string `long:"id" required:"true" description:"comment id"`
+	AdminPasswd string `long:"admin-passwd" env:"ADMIN_PASSWD" required:"true" description:"admin basic auth password"`
+	CommonOpts
+}
+
+// Execute runs undelete with UndeleteCommand parameters, entry point for "undelete" command
+// Restores soft-deleted comment with PUT /admin/undelete/{id}?site=siteID&url=post-url
+func (uc *UndeleteCommand) Execute(args []string) error {
+	log.Printf("[INFO] undelete comment %s, site %s", uc.ID, uc.Site)
+	resetEnv("SECRET", "ADMIN_PASSWD")
+
+	undeleteURL := fmt.Sprintf("%s/api/v1/admin/undelete/%s?site=%s&url=%s", uc.RemarkURL, url.PathEscape(uc.ID),
+		url.QueryEscape(uc.Site), url.QueryEscape(uc.URL))
+	req, err := http.NewRequest(http.MethodPut, undeleteURL, nil)
+	if err != nil {
+		return errors.Wrapf(err, "failed to make undelete request for comment %s", uc.ID)
+	}
+	req.SetBasicAuth("admin", uc.AdminPasswd)
+
+	client := http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "undelete request failed for comment %s", uc.ID)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	log.Printf("[INFO] comment %s restored", uc.ID)
+	return nil
+}
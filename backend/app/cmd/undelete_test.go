@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	flags "github.com/jessevdk/go-flags"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUndelete_Execute(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/admin/undelete/comment-1", r.URL.Path)
+		assert.Equal(t, "PUT", r.Method)
+		assert.Equal(t, "remark", r.URL.Query().Get("site"))
+		assert.Equal(t, "https://example.com/post?p=1", r.URL.Query().Get("url"))
+		user, passwd, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "admin", user)
+		if passwd != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	cmd := UndeleteCommand{}
+	cmd.SetCommon(CommonOpts{RemarkURL: ts.URL, SharedSecret: "123456"})
+	p := flags.NewParser(&cmd, flags.Default)
+	_, err := p.ParseArgs([]string{"--site=remark", "--post=https://example.com/post?p=1", "--id=comment-1",
+		"--admin-passwd=secret"})
+	require.Nil(t, err)
+	assert.NoError(t, cmd.Execute(nil))
+
+	cmd.AdminPasswd = "bad"
+	assert.EqualError(t, cmd.Execute(nil), `error response "401 Unauthorized", `)
+}
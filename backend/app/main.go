@@ -16,12 +16,15 @@ import (
 
 // Opts with all cli commands and flags
 type Opts struct {
-	ServerCmd  cmd.ServerCommand  `command:"server"`
-	ImportCmd  cmd.ImportCommand  `command:"import"`
-	BackupCmd  cmd.BackupCommand  `command:"backup"`
-	RestoreCmd cmd.RestoreCommand `command:"restore"`
-	AvatarCmd  cmd.AvatarCommand  `command:"avatar"`
-	CleanupCmd cmd.CleanupCommand `command:"cleanup"`
+	ServerCmd   cmd.ServerCommand   `command:"server"`
+	ImportCmd   cmd.ImportCommand   `command:"import"`
+	BackupCmd   cmd.BackupCommand   `command:"backup"`
+	RestoreCmd  cmd.RestoreCommand  `command:"restore"`
+	AvatarCmd   cmd.AvatarCommand   `command:"avatar"`
+	CleanupCmd  cmd.CleanupCommand  `command:"cleanup"`
+	UndeleteCmd cmd.UndeleteCommand `command:"undelete"`
+	AdminCmd    cmd.AdminCommand    `command:"admin"`
+	SiteCmd     cmd.SiteCommand     `command:"site"`
 
 	RemarkURL    string `long:"url" env:"REMARK_URL" required:"true" description:"url to remark"`
 	SharedSecret string `long:"secret" env:"SECRET" required:"true" description:"shared secret key"`
@@ -0,0 +1,262 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/umputun/remark/backend/app/store"
+)
+
+// Digest implements notify.Destination for digests of new comments sent by email to subscribers of posts.
+// Templates can be customized per site with {site}.txt and {site}.html files in templates directory,
+// built-in ones used for sites without them.
+type Digest struct {
+	mailer       *mailer
+	keys         KeyStore
+	remarkURL    string
+	templatesDir string
+}
+
+// DigestScheduler periodically checks subscriptions of the site and submits digest of new comments
+// to each subscriber once per subscription's period
+type DigestScheduler struct {
+	Store    DigestStore
+	Notifier *Service
+	SiteID   string
+	Duration time.Duration // interval of checks
+}
+
+// DigestStore defines the minimal interface to get subscriptions and comments of subscribed posts
+type DigestStore interface {
+	Subscriptions(siteID, userID string) ([]store.Subscription, error)
+	MarkDigestSent(locator store.Locator, userID string, sentAt time.Time) error
+	Find(locator store.Locator, sort string) ([]store.Comment, error)
+}
+
+// digestMessage is the data passed to digest templates
+type digestMessage struct {
+	SiteID      string
+	UserID      string
+	Count       int
+	Posts       []digestPost
+	Unsubscribe string
+}
+
+// digestPost is the post with new comments, in order of creation
+type digestPost struct {
+	URL      string
+	Comments []digestComment
+}
+
+type digestComment struct {
+	ID        string
+	Link      string
+	From      string
+	Orig      string
+	Text      htmltemplate.HTML
+	Timestamp time.Time
+}
+
+var digestTextTmpl = template.Must(template.New("text").Parse(`{{.Count}} new comments on posts you follow
+{{range .Posts}}
+{{.URL}}
+{{range .Comments}}
+{{.From}} at {{.Timestamp.Format "02 Jan 06 15:04"}}:
+{{.Orig}}
+{{.Link}}
+{{end}}{{end}}
+To stop receiving digests open {{.Unsubscribe}}
+`))
+
+var digestHTMLTmpl = htmltemplate.Must(htmltemplate.New("html").Parse(`<!DOCTYPE html>
+<html>
+<body>
+<p>{{.Count}} new comments on posts you follow</p>
+{{range .Posts}}<h3><a href="{{.URL}}">{{.URL}}</a></h3>
+{{range .Comments}}<p><b>{{.From}}</b> <small>{{.Timestamp.Format "02 Jan 06 15:04"}}</small></p>
+<div>{{.Text}}</div>
+<p><a href="{{.Link}}">Reply</a></p>
+{{end}}{{end}}<p><small><a href="{{.Unsubscribe}}">Unsubscribe</a> from all digests</small></p>
+</body>
+</html>
+`))
+
+// NewDigest makes digest notifier. Empty templatesDir means built-in templates for all sites
+func NewDigest(params SMTPParams, keys KeyStore, remarkURL, templatesDir string) (*Digest, error) {
+	m, err := newMailer(params)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[DEBUG] create new digest notifier, templates=%q", templatesDir)
+	return &Digest{mailer: m, keys: keys, remarkURL: strings.TrimSuffix(remarkURL, "/"), templatesDir: templatesDir}, nil
+}
+
+// Send digest email to subscriber, with comments grouped by post
+func (d *Digest) Send(ctx context.Context, req request) error {
+	if req.event != EventDigest || req.email == "" || len(req.comments) == 0 {
+		return nil
+	}
+
+	key, err := d.keys.Key(req.siteID)
+	if err != nil {
+		return errors.Wrapf(err, "can't get key for site %s", req.siteID)
+	}
+	textTmpl, htmlTmpl, err := d.templates(req.siteID)
+	if err != nil {
+		return err
+	}
+
+	msg := digestMessage{SiteID: req.siteID, UserID: req.user.ID, Count: len(req.comments),
+		Unsubscribe: fmt.Sprintf("%s/api/v1/subscriptions/unsubscribe?site=%s&user=%s&tkn=%s", d.remarkURL,
+			url.QueryEscape(req.siteID), url.QueryEscape(req.user.ID), UnsubscribeToken(key, UnsubscribeDigest, req.siteID, req.user.ID)),
+	}
+	posts := map[string]int{} // url to index in msg.Posts
+	for _, c := range req.comments {
+		i, ok := posts[c.Locator.URL]
+		if !ok {
+			i = len(msg.Posts)
+			posts[c.Locator.URL] = i
+			msg.Posts = append(msg.Posts, digestPost{URL: c.Locator.URL})
+		}
+		msg.Posts[i].Comments = append(msg.Posts[i].Comments, digestComment{
+			ID:        c.ID,
+			Link:      c.Locator.URL + uiNav + c.ID,
+			From:      c.User.Name,
+			Orig:      c.Orig,
+			Text:      htmltemplate.HTML(c.Text), // comment's html sanitized on creation
+			Timestamp: c.Timestamp,
+		})
+	}
+
+	body, err := d.mailer.compose(req.email, fmt.Sprintf("%d new comments on %s", msg.Count, req.siteID),
+		textTmpl, htmlTmpl, msg)
+	if err != nil {
+		return err
+	}
+	log.Printf("[DEBUG] send digest to %s, comments %d", req.user.ID, msg.Count)
+	return errors.Wrapf(d.mailer.send(ctx, req.email, body), "can't send digest to %s", req.email)
+}
+
+// templates returns site's own templates if exist in templates directory, built-in otherwise
+func (d *Digest) templates(siteID string) (*template.Template, *htmltemplate.Template, error) {
+	textTmpl, htmlTmpl := digestTextTmpl, digestHTMLTmpl
+	if d.templatesDir == "" {
+		return textTmpl, htmlTmpl, nil
+	}
+	base := filepath.Join(d.templatesDir, filepath.Base(siteID))
+	if _, err := os.Stat(base + ".txt"); err == nil {
+		if textTmpl, err = template.ParseFiles(base + ".txt"); err != nil {
+			return nil, nil, errors.Wrapf(err, "can't parse digest template for %s", siteID)
+		}
+	}
+	if _, err := os.Stat(base + ".html"); err == nil {
+		if htmlTmpl, err = htmltemplate.ParseFiles(base + ".html"); err != nil {
+			return nil, nil, errors.Wrapf(err, "can't parse digest html template for %s", siteID)
+		}
+	}
+	return textTmpl, htmlTmpl, nil
+}
+
+// Accepts digests only
+func (d *Digest) Accepts(event Event) bool {
+	return event == EventDigest
+}
+
+func (d *Digest) String() string {
+	return "digest"
+}
+
+// Do runs periodic checks of due subscriptions until ctx canceled
+func (ds DigestScheduler) Do(ctx context.Context) {
+	log.Printf("[INFO] activate digests for %s, duration %s", ds.SiteID, ds.Duration)
+	tick := time.NewTicker(ds.Duration)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			n, err := ds.send(time.Now())
+			if err != nil {
+				log.Printf("[WARN] digests for %s failed, %s", ds.SiteID, err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("[INFO] submitted %d digests for %s", n, ds.SiteID)
+			}
+		case <-ctx.Done():
+			log.Printf("[WARN] terminated digests for %s", ds.SiteID)
+			return
+		}
+	}
+}
+
+// send submits digests for all subscriptions due at the given time and marks them as sent.
+// New comments of all due subscriptions of the subscriber combined in a single digest. Returns number of digests.
+func (ds DigestScheduler) send(now time.Time) (int, error) {
+	subs, err := ds.Store.Subscriptions(ds.SiteID, "")
+	if err != nil {
+		return 0, errors.Wrapf(err, "can't get subscriptions for %s", ds.SiteID)
+	}
+
+	type subscriber struct{ userID, email string }
+	due := map[subscriber][]store.Subscription{}
+	order := []subscriber{}
+	for _, sub := range subs {
+		if now.Sub(sub.LastSent) < digestPeriod(sub.Period) {
+			continue
+		}
+		key := subscriber{userID: sub.UserID, email: sub.Email}
+		if _, ok := due[key]; !ok {
+			order = append(order, key)
+		}
+		due[key] = append(due[key], sub)
+	}
+
+	count := 0
+	for _, key := range order {
+		comments := []store.Comment{}
+		for _, sub := range due[key] {
+			cc, e := ds.Store.Find(sub.Locator, "+time")
+			if e != nil {
+				return count, errors.Wrapf(e, "can't get comments for %s", sub.Locator.URL)
+			}
+			for _, c := range cc {
+				if c.Deleted || c.Pending || c.Shadow || c.User.ID == sub.UserID {
+					continue
+				}
+				if c.Timestamp.After(sub.LastSent) && !c.Timestamp.After(now) {
+					comments = append(comments, c)
+				}
+			}
+		}
+
+		if len(comments) > 0 {
+			ds.Notifier.SubmitDigest(ds.SiteID, store.User{ID: key.userID}, key.email, comments)
+			count++
+		}
+		for _, sub := range due[key] {
+			if e := ds.Store.MarkDigestSent(sub.Locator, sub.UserID, now); e != nil {
+				return count, errors.Wrapf(e, "can't update subscription of %s to %s", sub.UserID, sub.Locator.URL)
+			}
+		}
+	}
+	return count, nil
+}
+
+// digestPeriod returns duration of subscription's period, daily if unknown
+func digestPeriod(period string) time.Duration {
+	if period == store.DigestWeekly {
+		return 7 * 24 * time.Hour
+	}
+	return 24 * time.Hour
+}
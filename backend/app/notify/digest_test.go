@@ -0,0 +1,245 @@
+package notify
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark/backend/app/store"
+)
+
+func TestDigest_Send(t *testing.T) {
+	srv := newMockSMTP(t, nil, false)
+	defer srv.close()
+
+	d, err := NewDigest(SMTPParams{Host: "127.0.0.1", Port: srv.port(), From: "remark@example.com"},
+		mockKeyStore{"radio-t": "secret", "other": "secret"}, "https://remark.example.com/", "")
+	require.NoError(t, err)
+	assert.Equal(t, "digest", d.String())
+	assert.True(t, d.Accepts(EventDigest))
+	assert.False(t, d.Accepts(EventCreate))
+
+	ts := time.Date(2019, 1, 20, 12, 0, 0, 0, time.UTC)
+	loc1 := store.Locator{SiteID: "radio-t", URL: "http://example.org/1"}
+	loc2 := store.Locator{SiteID: "radio-t", URL: "http://example.org/2"}
+	comments := []store.Comment{
+		{ID: "c1", Locator: loc1, Orig: "first", Text: "<p>first</p>", User: store.User{Name: "user2"}, Timestamp: ts},
+		{ID: "c2", Locator: loc2, Orig: "second", Text: "<p>second</p>", User: store.User{Name: "user3"}, Timestamp: ts},
+		{ID: "c3", Locator: loc1, Orig: "third", Text: "<p>third</p>", User: store.User{Name: "user3"}, Timestamp: ts},
+	}
+	req := request{event: EventDigest, siteID: "radio-t", user: store.User{ID: "user1"}, email: "user1@example.com",
+		comments: comments}
+	require.NoError(t, d.Send(context.Background(), req))
+
+	msgs := srv.messages()
+	require.Equal(t, 1, len(msgs))
+	assert.Equal(t, "user1@example.com", msgs[0].to)
+	assert.Contains(t, msgs[0].data, "Subject: 3 new comments on radio-t\r\n")
+	assert.Contains(t, msgs[0].text, "http://example.org/1\r\n\r\nuser2 at 20 Jan 19 12:00:\r\nfirst\r\n"+
+		"http://example.org/1#remark42__comment-c1\r\n\r\nuser3 at 20 Jan 19 12:00:\r\nthird\r\n", "grouped by post")
+	assert.Contains(t, msgs[0].text, "To stop receiving digests open "+
+		"https://remark.example.com/api/v1/subscriptions/unsubscribe?site=radio-t&user=user1&tkn="+
+		UnsubscribeToken("secret", UnsubscribeDigest, "radio-t", "user1"))
+
+	// site's own templates
+	dir, err := ioutil.TempDir("", "digest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(dir+"/radio-t.txt", []byte("custom {{.Count}} for {{.UserID}}"), 0600))
+	d.templatesDir = dir
+	require.NoError(t, d.Send(context.Background(), req))
+	msgs = srv.messages()
+	require.Equal(t, 2, len(msgs))
+	assert.Contains(t, msgs[1].text, "custom 3 for user1")
+	assert.Contains(t, msgs[1].text, "Unsubscribe</a> from all digests", "built-in html template")
+
+	req.siteID = "other"
+	require.NoError(t, d.Send(context.Background(), req))
+	msgs = srv.messages()
+	require.Equal(t, 3, len(msgs))
+	assert.NotContains(t, msgs[2].text, "custom", "built-in template for other sites")
+
+	require.NoError(t, ioutil.WriteFile(dir+"/radio-t.html", []byte("{{.Bad"), 0600))
+	req.siteID = "radio-t"
+	err = d.Send(context.Background(), req)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "can't parse digest html template for radio-t")
+
+	// skipped
+	for _, r := range []request{
+		{event: EventCreate, siteID: "radio-t", comment: comments[0]},
+		{event: EventDigest, siteID: "radio-t", user: store.User{ID: "user1"}, comments: comments},
+		{event: EventDigest, siteID: "radio-t", user: store.User{ID: "user1"}, email: "user1@example.com"},
+	} {
+		require.NoError(t, d.Send(context.Background(), r))
+	}
+	assert.Equal(t, 3, len(srv.messages()))
+
+	_, err = NewDigest(SMTPParams{}, mockKeyStore{}, "", "")
+	assert.NotNil(t, err)
+}
+
+func TestDigestScheduler_Send(t *testing.T) {
+	now := time.Date(2019, 1, 20, 12, 0, 0, 0, time.UTC)
+	loc1 := store.Locator{SiteID: "radio-t", URL: "http://example.org/1"}
+	loc2 := store.Locator{SiteID: "radio-t", URL: "http://example.org/2"}
+	ds := &mockDigestStore{
+		subs: []store.Subscription{
+			{Locator: loc1, UserID: "user1", Email: "u1@example.com", Period: store.DigestDaily, LastSent: now.Add(-25 * time.Hour)},
+			{Locator: loc2, UserID: "user1", Email: "u1@example.com", Period: store.DigestDaily, LastSent: now.Add(-24 * time.Hour)},
+			{Locator: loc1, UserID: "user2", Email: "u2@example.com", Period: store.DigestWeekly, LastSent: now.Add(-25 * time.Hour)},
+			{Locator: loc2, UserID: "user3", Email: "u3@example.com", Period: store.DigestDaily, LastSent: now.Add(-25 * time.Hour)},
+		},
+		comments: map[string][]store.Comment{
+			loc1.URL: {
+				{ID: "c1", Locator: loc1, User: store.User{ID: "user2"}, Timestamp: now.Add(-26 * time.Hour)}, // already sent
+				{ID: "c2", Locator: loc1, User: store.User{ID: "user2"}, Timestamp: now.Add(-time.Hour)},
+				{ID: "c3", Locator: loc1, User: store.User{ID: "user1"}, Timestamp: now.Add(-time.Hour)}, // own
+				{ID: "c4", Locator: loc1, User: store.User{ID: "user2"}, Timestamp: now.Add(-time.Hour), Deleted: true},
+				{ID: "c5", Locator: loc1, User: store.User{ID: "user2"}, Timestamp: now.Add(-time.Hour), Pending: true},
+				{ID: "c6", Locator: loc1, User: store.User{ID: "user2"}, Timestamp: now.Add(-time.Hour), Shadow: true},
+			},
+			loc2.URL: {
+				{ID: "c7", Locator: loc2, User: store.User{ID: "user3"}, Timestamp: now.Add(-time.Hour)},
+			},
+		},
+	}
+	dest := &mockEventsDest{events: []Event{EventDigest}}
+	s := NewService(nil, ServiceParams{}, dest)
+	defer s.Close()
+
+	sched := DigestScheduler{Store: ds, Notifier: s, SiteID: "radio-t", Duration: time.Hour}
+	n, err := sched.send(now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n, "user2 weekly not due, user3 has only own comments")
+
+	time.Sleep(200 * time.Millisecond)
+	sent := dest.get()
+	require.Equal(t, 1, len(sent))
+	assert.Equal(t, EventDigest, sent[0].event)
+	assert.Equal(t, "radio-t", sent[0].siteID)
+	assert.Equal(t, "user1", sent[0].user.ID)
+	assert.Equal(t, "u1@example.com", sent[0].email)
+	ids := []string{}
+	for _, c := range sent[0].comments {
+		ids = append(ids, c.ID)
+	}
+	assert.Equal(t, []string{"c2", "c7"}, ids)
+
+	subs := ds.get()
+	assert.True(t, now.Equal(subs[0].LastSent))
+	assert.True(t, now.Equal(subs[1].LastSent))
+	assert.True(t, now.Add(-25*time.Hour).Equal(subs[2].LastSent), "not due")
+	assert.True(t, now.Equal(subs[3].LastSent), "due without new comments")
+
+	n, err = sched.send(now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 0, n, "nothing due")
+
+	ds.err = errors.New("failed")
+	_, err = sched.send(now.Add(time.Hour))
+	assert.EqualError(t, err, "can't get subscriptions for radio-t: failed")
+}
+
+func TestDigestScheduler_UnsubscribedWhileSent(t *testing.T) {
+	now := time.Date(2019, 1, 20, 12, 0, 0, 0, time.UTC)
+	loc := store.Locator{SiteID: "radio-t", URL: "http://example.org/1"}
+	ds := &mockDigestStore{
+		subs: []store.Subscription{
+			{Locator: loc, UserID: "user1", Email: "u1@example.com", Period: store.DigestDaily, LastSent: now.Add(-25 * time.Hour)},
+			{Locator: loc, UserID: "user2", Email: "u2@example.com", Period: store.DigestDaily, LastSent: now.Add(-25 * time.Hour)},
+		},
+		comments: map[string][]store.Comment{
+			loc.URL: {{ID: "c1", Locator: loc, User: store.User{ID: "user3"}, Timestamp: now.Add(-time.Hour)}},
+		},
+	}
+	ds.onFind = func() { ds.unsubscribe("user1") }
+
+	sched := DigestScheduler{Store: ds, Notifier: NopService, SiteID: "radio-t", Duration: time.Hour}
+	_, err := sched.send(now)
+	require.NoError(t, err)
+
+	subs := ds.get()
+	require.Equal(t, 1, len(subs), "unsubscribed not restored")
+	assert.Equal(t, "user2", subs[0].UserID)
+	assert.True(t, now.Equal(subs[0].LastSent))
+}
+
+func TestDigestScheduler_Do(t *testing.T) {
+	ds := &mockDigestStore{}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	DigestScheduler{Store: ds, Notifier: NopService, SiteID: "radio-t", Duration: 10 * time.Millisecond}.Do(ctx)
+	assert.True(t, ds.calls() > 1)
+}
+
+type mockDigestStore struct {
+	lock     sync.Mutex
+	subs     []store.Subscription
+	comments map[string][]store.Comment
+	err      error
+	listed   int
+	onFind   func() // called on each Find, before the lock
+}
+
+func (m *mockDigestStore) Subscriptions(siteID, userID string) ([]store.Subscription, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.listed++
+	return append([]store.Subscription{}, m.subs...), m.err
+}
+
+func (m *mockDigestStore) MarkDigestSent(locator store.Locator, userID string, sentAt time.Time) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for i, s := range m.subs {
+		if s.Locator == locator && s.UserID == userID {
+			m.subs[i].LastSent = sentAt
+		}
+	}
+	return nil
+}
+
+// unsubscribe removes user's subscriptions, like user unsubscribed while digest sent
+func (m *mockDigestStore) unsubscribe(userID string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	subs := []store.Subscription{}
+	for _, s := range m.subs {
+		if s.UserID != userID {
+			subs = append(subs, s)
+		}
+	}
+	m.subs = subs
+}
+
+func (m *mockDigestStore) Find(locator store.Locator, sortFld string) ([]store.Comment, error) {
+	if m.onFind != nil {
+		m.onFind()
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	res := append([]store.Comment{}, m.comments[locator.URL]...)
+	sort.Slice(res, func(i, j int) bool { return res[i].Timestamp.Before(res[j].Timestamp) })
+	return res, nil
+}
+
+func (m *mockDigestStore) get() []store.Subscription {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]store.Subscription{}, m.subs...)
+}
+
+func (m *mockDigestStore) calls() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.listed
+}
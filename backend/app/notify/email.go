@@ -0,0 +1,300 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Email implements notify.Destination for email, sends notifications to admin's email of the comment's site
+type Email struct {
+	*mailer
+	adminStore AdminStore
+}
+
+// SMTPParams defines smtp server and credentials used to send emails
+type SMTPParams struct {
+	Host     string
+	Port     int
+	Username string // auth is skipped if empty
+	Password string
+	TLS      bool // connect with implicit TLS, usually port 465
+	StartTLS bool // upgrade plain connection with STARTTLS, usually port 587
+	From     string
+	Timeout  time.Duration
+}
+
+// AdminStore defines the minimal interface to get admin's email for the site
+type AdminStore interface {
+	Email(siteID string) (email string)
+}
+
+const emailTimeOut = 10 * time.Second
+
+// emailMessage is the data passed to email templates
+type emailMessage struct {
+	From    string
+	To      string // parent comment's user, for replies only
+	URL     string
+	Link    string
+	Orig    string
+	Text    htmltemplate.HTML // rendered and sanitized comment's html
+	Pending bool
+}
+
+var emailTextTmpl = template.Must(template.New("text").Parse(`{{.From}}{{if .To}} replied to {{.To}}{{else}} commented{{end}} on {{.URL}}
+
+{{.Orig}}
+
+{{if .Pending}}Comment is waiting for approval.{{else}}Original comment: {{.Link}}{{end}}
+`))
+
+var emailHTMLTmpl = htmltemplate.Must(htmltemplate.New("html").Parse(`<!DOCTYPE html>
+<html>
+<body>
+<p><b>{{.From}}</b>{{if .To}} replied to <b>{{.To}}</b>{{else}} commented{{end}} on <a href="{{.URL}}">{{.URL}}</a></p>
+<div>{{.Text}}</div>
+<p>{{if .Pending}}<i>Comment is waiting for approval.</i>{{else}}<a href="{{.Link}}">Original comment</a>{{end}}</p>
+</body>
+</html>
+`))
+
+// mailer sends composed messages through smtp server, shared by email based destinations
+type mailer struct {
+	SMTPParams
+	tlsConfig *tls.Config // tls config for TLS and STARTTLS connections, verifies Host by default
+}
+
+// Mailer sends messages composed by caller through smtp server, i.e. login confirmations
+type Mailer struct {
+	m *mailer
+}
+
+// NewMailer makes mailer sending through smtp server
+func NewMailer(params SMTPParams) (*Mailer, error) {
+	m, err := newMailer(params)
+	if err != nil {
+		return nil, err
+	}
+	return &Mailer{m: m}, nil
+}
+
+// Send multipart message with plain text and html versions to the address
+func (m *Mailer) Send(ctx context.Context, to, subject, text, html string) error {
+	msg, err := m.m.message(to, subject, []byte(text), []byte(html))
+	if err != nil {
+		return err
+	}
+	return m.m.send(ctx, to, msg)
+}
+
+func (m *Mailer) String() string {
+	return fmt.Sprintf("mailer: %s:%d", m.m.Host, m.m.Port)
+}
+
+// NewEmail makes email notifier sending through smtp server to admin's email of each site
+func NewEmail(params SMTPParams, adminStore AdminStore) (*Email, error) {
+	m, err := newMailer(params)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[DEBUG] create new email notifier for %s:%d, tls=%v, starttls=%v, timeout=%s",
+		m.Host, m.Port, m.TLS, m.StartTLS, m.Timeout)
+	return &Email{mailer: m, adminStore: adminStore}, nil
+}
+
+func newMailer(params SMTPParams) (*mailer, error) {
+	if params.Host == "" {
+		return nil, errors.New("empty smtp host")
+	}
+	if params.From == "" {
+		return nil, errors.New("empty from address")
+	}
+	res := mailer{SMTPParams: params, tlsConfig: &tls.Config{ServerName: params.Host}}
+	if res.Port == 0 {
+		res.Port = 25
+	}
+	if res.Timeout == 0 {
+		res.Timeout = emailTimeOut
+	}
+	return &res, nil
+}
+
+// Send email to site's admin
+func (e *Email) Send(ctx context.Context, req request) error {
+	to := e.adminStore.Email(req.comment.Locator.SiteID)
+	if to == "" {
+		return errors.Errorf("no admin email for site %s", req.comment.Locator.SiteID)
+	}
+	log.Printf("[DEBUG] send email notification to %s, comment id %s", to, req.comment.ID)
+
+	msg, err := e.buildMessage(req, to)
+	if err != nil {
+		return err
+	}
+	return e.send(ctx, to, msg)
+}
+
+// send message to the given address
+func (m *mailer) send(ctx context.Context, to string, msg []byte) error {
+	client, err := m.client(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = client.Close() }() // closed by quit already on success
+
+	if err = client.Mail(m.From); err != nil {
+		return errors.Wrapf(err, "bad from address %q", m.From)
+	}
+	if err = client.Rcpt(to); err != nil {
+		return errors.Wrapf(err, "bad to address %q", to)
+	}
+	w, err := client.Data()
+	if err != nil {
+		return errors.Wrap(err, "can't make email writer")
+	}
+	if _, err = w.Write(msg); err != nil {
+		return errors.Wrap(err, "can't write email body")
+	}
+	if err = w.Close(); err != nil {
+		return errors.Wrap(err, "can't send email")
+	}
+	return errors.Wrap(client.Quit(), "failed to quit smtp session")
+}
+
+// client connects to smtp server, upgrades connection with STARTTLS and authenticates if configured
+func (m *mailer) client(ctx context.Context) (*smtp.Client, error) {
+	addr := net.JoinHostPort(m.Host, strconv.Itoa(m.Port))
+	dialer := net.Dialer{Timeout: m.Timeout}
+
+	var conn net.Conn
+	var err error
+	if m.TLS {
+		tlsDialer := tls.Dialer{NetDialer: &dialer, Config: m.tlsConfig}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't connect to smtp server %s", addr)
+	}
+
+	deadline := time.Now().Add(m.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err = conn.SetDeadline(deadline); err != nil {
+		_ = conn.Close()
+		return nil, errors.Wrap(err, "can't set smtp deadline")
+	}
+
+	client, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		_ = conn.Close()
+		return nil, errors.Wrapf(err, "can't make smtp client for %s", addr)
+	}
+
+	if m.StartTLS {
+		if err = client.StartTLS(m.tlsConfig); err != nil {
+			_ = client.Close()
+			return nil, errors.Wrap(err, "failed to start tls")
+		}
+	}
+
+	if m.Username != "" {
+		if err = client.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host)); err != nil {
+			_ = client.Close()
+			return nil, errors.Wrapf(err, "failed to auth as %s", m.Username)
+		}
+	}
+	return client, nil
+}
+
+// buildMessage makes multipart email with plain text and html versions for admin
+func (e *Email) buildMessage(req request, to string) ([]byte, error) {
+	data := emailMessage{
+		From:    req.comment.User.Name,
+		URL:     req.comment.Locator.URL,
+		Link:    req.comment.Locator.URL + uiNav + req.comment.ID,
+		Orig:    req.comment.Orig,
+		Text:    htmltemplate.HTML(req.comment.Text), // comment's html sanitized on creation
+		Pending: req.comment.Pending,
+	}
+	if req.comment.ParentID != "" {
+		data.To = req.parent.User.Name
+	}
+
+	subject := fmt.Sprintf("New comment from %s", data.From)
+	if data.Pending {
+		subject = fmt.Sprintf("Comment from %s waiting for approval", data.From)
+	}
+	return e.compose(to, subject, emailTextTmpl, emailHTMLTmpl, data)
+}
+
+// compose makes multipart message with plain text and html versions rendered from templates
+func (m *mailer) compose(to, subject string, textTmpl *template.Template, htmlTmpl *htmltemplate.Template,
+	data interface{}) ([]byte, error) {
+	text, html := bytes.Buffer{}, bytes.Buffer{}
+	if err := textTmpl.Execute(&text, data); err != nil {
+		return nil, errors.Wrap(err, "can't execute text template")
+	}
+	if err := htmlTmpl.Execute(&html, data); err != nil {
+		return nil, errors.Wrap(err, "can't execute html template")
+	}
+	return m.message(to, subject, text.Bytes(), html.Bytes())
+}
+
+// message makes multipart message with plain text and html versions
+func (m *mailer) message(to, subject string, text, html []byte) ([]byte, error) {
+	buf := bytes.Buffer{}
+	mw := multipart.NewWriter(&buf)
+	header := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\n"+
+		"Content-Type: multipart/alternative; boundary=%q\r\n\r\n",
+		m.From, to, mime.QEncoding.Encode("utf-8", subject), time.Now().Format(time.RFC1123Z), mw.Boundary())
+	buf.WriteString(header)
+
+	if err := writePart(mw, "text/plain; charset=utf-8", text); err != nil {
+		return nil, errors.Wrap(err, "can't write text part")
+	}
+	if err := writePart(mw, "text/html; charset=utf-8", html); err != nil {
+		return nil, errors.Wrap(err, "can't write html part")
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, errors.Wrap(err, "can't close multipart writer")
+	}
+	return buf.Bytes(), nil
+}
+
+// writePart adds part with the body encoded as quoted-printable, keeps lines of non-ascii and long texts within
+// smtp limits
+func writePart(mw *multipart.Writer, contentType string, body []byte) error {
+	part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {contentType},
+		"Content-Transfer-Encoding": {"quoted-printable"}})
+	if err != nil {
+		return err
+	}
+	qw := quotedprintable.NewWriter(part)
+	if _, err = qw.Write(body); err != nil {
+		return err
+	}
+	return qw.Close()
+}
+
+func (e *Email) String() string {
+	return fmt.Sprintf("email: %s:%d", e.Host, e.Port)
+}
@@ -0,0 +1,293 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http/httptest"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark/backend/app/store"
+)
+
+func TestEmail_New(t *testing.T) {
+	_, err := NewEmail(SMTPParams{From: "from@example.com"}, mockAdminStore{})
+	assert.EqualError(t, err, "empty smtp host")
+	_, err = NewEmail(SMTPParams{Host: "127.0.0.1"}, mockAdminStore{})
+	assert.EqualError(t, err, "empty from address")
+
+	e, err := NewEmail(SMTPParams{Host: "127.0.0.1", From: "from@example.com"}, mockAdminStore{})
+	require.NoError(t, err)
+	assert.Equal(t, 25, e.Port)
+	assert.Equal(t, emailTimeOut, e.Timeout)
+	assert.Equal(t, "email: 127.0.0.1:25", e.String())
+}
+
+func TestEmail_Send(t *testing.T) {
+	srv := newMockSMTP(t, nil, false)
+	defer srv.close()
+
+	e, err := NewEmail(SMTPParams{Host: "127.0.0.1", Port: srv.port(), From: "remark@example.com", Username: "user",
+		Password: "passwd"}, mockAdminStore{"radio-t": "admin@example.com"})
+	require.NoError(t, err)
+
+	c := store.Comment{ID: "999", Text: "<p>some <b>text</b></p>", Orig: "some **text**", ParentID: "1",
+		Locator: store.Locator{SiteID: "radio-t", URL: "http://example.org"}}
+	c.User.Name = "from"
+	cp := store.Comment{Text: "some parent text"}
+	cp.User.Name = "to"
+
+	require.NoError(t, e.Send(context.Background(), request{comment: c, parent: cp}))
+	msgs := srv.messages()
+	require.Equal(t, 1, len(msgs))
+	assert.Equal(t, "remark@example.com", msgs[0].from)
+	assert.Equal(t, "admin@example.com", msgs[0].to)
+	assert.Equal(t, "\x00user\x00passwd", msgs[0].auth)
+	assert.Contains(t, msgs[0].data, "Subject: New comment from from\r\n")
+	assert.Contains(t, msgs[0].data, "Content-Type: multipart/alternative; boundary=")
+	assert.Contains(t, msgs[0].data, "Content-Transfer-Encoding: quoted-printable\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n"+
+		"from replied to to on http://example.org\r\n\r\n"+
+		"some **text**\r\n\r\nOriginal comment: http://example.org#remark42__comment-999\r\n")
+	assert.Contains(t, msgs[0].text, `<p><b>from</b> replied to <b>to</b> on <a href="http://example.org">http://example.org</a></p>`)
+	assert.Contains(t, msgs[0].text, "<div><p>some <b>text</b></p></div>")
+
+	// no admin email for the site
+	c.Locator.SiteID = "other"
+	assert.EqualError(t, e.Send(context.Background(), request{comment: c}), "no admin email for site other")
+	assert.Equal(t, 1, len(srv.messages()))
+
+	// rejected auth
+	e.Password = "bad"
+	c.Locator.SiteID = "radio-t"
+	err = e.Send(context.Background(), request{comment: c})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "failed to auth as user")
+}
+
+func TestEmail_SendTLS(t *testing.T) {
+	ts := httptest.NewTLSServer(nil) // provides self-signed certificate for 127.0.0.1
+	defer ts.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+
+	for _, startTLS := range []bool{false, true} {
+		srv := newMockSMTP(t, ts.TLS, startTLS)
+		e, err := NewEmail(SMTPParams{Host: "127.0.0.1", Port: srv.port(), From: "remark@example.com", TLS: !startTLS,
+			StartTLS: startTLS, Username: "user", Password: "passwd"}, mockAdminStore{"radio-t": "admin@example.com"})
+		require.NoError(t, err)
+		e.tlsConfig.RootCAs = pool
+
+		c := store.Comment{ID: "999", Text: "some text", Pending: true, Locator: store.Locator{SiteID: "radio-t"}}
+		c.User.Name = "from"
+		require.NoError(t, e.Send(context.Background(), request{comment: c}), "starttls=%v", startTLS)
+		msgs := srv.messages()
+		require.Equal(t, 1, len(msgs))
+		assert.True(t, msgs[0].tls)
+		assert.Contains(t, msgs[0].data, "Subject: Comment from from waiting for approval\r\n")
+		assert.Contains(t, msgs[0].text, "Comment is waiting for approval.")
+		srv.close()
+	}
+}
+
+func TestEmail_SendNoServer(t *testing.T) {
+	e, err := NewEmail(SMTPParams{Host: "127.0.0.1", Port: 4321, From: "remark@example.com"},
+		mockAdminStore{"radio-t": "admin@example.com"})
+	require.NoError(t, err)
+	err = e.Send(context.Background(), request{comment: store.Comment{Locator: store.Locator{SiteID: "radio-t"}}})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "can't connect to smtp server 127.0.0.1:4321")
+}
+
+func TestMailer_Send(t *testing.T) {
+	_, err := NewMailer(SMTPParams{From: "from@example.com"})
+	assert.EqualError(t, err, "empty smtp host")
+
+	srv := newMockSMTP(t, nil, false)
+	defer srv.close()
+	m, err := NewMailer(SMTPParams{Host: "127.0.0.1", Port: srv.port(), From: "remark@example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "mailer: 127.0.0.1:"+strconv.Itoa(srv.port()), m.String())
+
+	require.NoError(t, m.Send(context.Background(), "user@example.com", "Confirm login", "some text ✓", "<p>some html</p>"))
+	msgs := srv.messages()
+	require.Equal(t, 1, len(msgs))
+	assert.Equal(t, "user@example.com", msgs[0].to)
+	assert.Equal(t, "", msgs[0].auth, "no auth without username")
+	assert.Contains(t, msgs[0].data, "Subject: Confirm login\r\n")
+	assert.Contains(t, msgs[0].data, "Content-Type: text/plain; charset=utf-8\r\n\r\nsome text =E2=9C=93\r\n")
+	assert.Contains(t, msgs[0].data, "Content-Type: text/html; charset=utf-8\r\n\r\n<p>some html</p>\r\n")
+	assert.Equal(t, "some text ✓<p>some html</p>", msgs[0].text)
+
+	// long lines wrapped
+	require.NoError(t, m.Send(context.Background(), "user@example.com", "Long", strings.Repeat("x", 1000), ""))
+	msgs = srv.messages()
+	require.Equal(t, 2, len(msgs))
+	assert.Contains(t, msgs[1].data, "\r\n"+strings.Repeat("x", 75)+"=\r\n", "soft line break")
+	assert.Equal(t, strings.Repeat("x", 1000), msgs[1].text)
+}
+
+type mockAdminStore map[string]string
+
+func (m mockAdminStore) Email(siteID string) string { return m[siteID] }
+
+// mockSMTP is a minimal smtp server, accepts AUTH PLAIN with user/passwd only and keeps all received messages
+type mockSMTP struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+	startTLS  bool
+
+	lock sync.Mutex
+	msgs []mockSMTPMessage
+}
+
+type mockSMTPMessage struct {
+	from, to, auth, data string
+	text                 string // decoded bodies of all parts
+	tls                  bool
+}
+
+// newMockSMTP starts plain smtp server if tlsConfig is nil, otherwise TLS or STARTTLS one
+func newMockSMTP(t *testing.T, tlsConfig *tls.Config, startTLS bool) *mockSMTP {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	if tlsConfig != nil && !startTLS {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	res := &mockSMTP{listener: listener, tlsConfig: tlsConfig, startTLS: startTLS}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go res.serve(conn)
+		}
+	}()
+	return res
+}
+
+func (m *mockSMTP) port() int {
+	return m.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (m *mockSMTP) close() {
+	_ = m.listener.Close()
+}
+
+func (m *mockSMTP) messages() []mockSMTPMessage {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]mockSMTPMessage{}, m.msgs...)
+}
+
+func (m *mockSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, isTLS := conn.(*tls.Conn)
+	rd := bufio.NewReader(conn)
+	send := func(s string) { _, _ = conn.Write([]byte(s + "\r\n")) }
+
+	send("220 localhost mock smtp")
+	msg := mockSMTPMessage{tls: isTLS}
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO":
+			send("250-localhost")
+			if m.startTLS && !isTLS {
+				send("250-STARTTLS")
+			}
+			send("250 AUTH PLAIN")
+		case "STARTTLS":
+			send("220 ready to start tls")
+			tlsConn := tls.Server(conn, m.tlsConfig)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			conn, rd, isTLS, msg.tls = tlsConn, bufio.NewReader(tlsConn), true, true
+		case "AUTH":
+			parts := strings.Fields(line)
+			auth, _ := base64.StdEncoding.DecodeString(parts[len(parts)-1])
+			if string(auth) != "\x00user\x00passwd" {
+				send("535 authentication failed")
+				continue
+			}
+			msg.auth = string(auth)
+			send("235 authenticated")
+		case "MAIL":
+			msg.from = strings.Trim(strings.TrimPrefix(line, "MAIL FROM:"), "<>")
+			send("250 ok")
+		case "RCPT":
+			msg.to = strings.Trim(strings.TrimPrefix(line, "RCPT TO:"), "<>")
+			send("250 ok")
+		case "DATA":
+			send("354 go ahead")
+			data := strings.Builder{}
+			for {
+				l, err := rd.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			msg.data, msg.text = data.String(), decodeParts(data.String())
+			m.lock.Lock()
+			m.msgs = append(m.msgs, msg)
+			queued := len(m.msgs)
+			m.lock.Unlock()
+			send("250 queued as " + strconv.Itoa(queued))
+		case "QUIT":
+			send("221 bye")
+			return
+		default:
+			send("250 ok")
+		}
+	}
+}
+
+// decodeParts returns bodies of all parts of multipart message, decoded from quoted-printable
+func decodeParts(data string) string {
+	msg, err := mail.ReadMessage(strings.NewReader(data))
+	if err != nil {
+		return ""
+	}
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	res := strings.Builder{}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			return res.String()
+		}
+		body, err := ioutil.ReadAll(part)
+		if err != nil {
+			return res.String()
+		}
+		res.Write(body)
+	}
+}
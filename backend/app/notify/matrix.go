@@ -0,0 +1,151 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-pkgz/repeater"
+	"github.com/pkg/errors"
+)
+
+// Matrix implements notify.Destination for matrix room, messages sent by the user of access token
+type Matrix struct {
+	room      string
+	token     string
+	apiPrefix string
+	timeout   time.Duration
+}
+
+const matrixTimeOut = 5000 * time.Millisecond
+const matrixAPIPrefix = "https://matrix.org"
+
+// NewMatrix makes matrix client for notifications, verifies access token with whoami call.
+// api is the homeserver's base url, like https://matrix.org
+func NewMatrix(token string, room string, timeout time.Duration, api string) (*Matrix, error) {
+	res := Matrix{room: room, token: token, apiPrefix: strings.TrimSuffix(api, "/"), timeout: timeout}
+	if res.apiPrefix == "" {
+		res.apiPrefix = matrixAPIPrefix
+	}
+	if res.timeout == 0 {
+		res.timeout = matrixTimeOut
+	}
+	log.Printf("[DEBUG] create new matrix notifier for room %s, timeout=%s, api=%s", room, res.timeout, res.apiPrefix)
+
+	err := repeater.NewDefault(5, time.Millisecond*250).Do(func() error {
+		whoamiResp := struct {
+			UserID string `json:"user_id"`
+		}{}
+		if err := res.call(context.Background(), "GET", "/account/whoami", nil, &whoamiResp); err != nil {
+			return errors.Wrap(err, "can't initialize matrix notifications")
+		}
+		if whoamiResp.UserID == "" {
+			return errors.New("unexpected matrix response, no user_id")
+		}
+		log.Printf("[DEBUG] matrix notifications as %s", whoamiResp.UserID)
+		return nil
+	})
+
+	return &res, err
+}
+
+// Send to matrix room
+func (m *Matrix) Send(ctx context.Context, req request) error {
+	log.Printf("[DEBUG] send matrix notification to %s, comment id %s", m.room, req.comment.ID)
+	text, formatted := m.buildMessage(req)
+	body := struct {
+		MsgType       string `json:"msgtype"`
+		Body          string `json:"body"`
+		Format        string `json:"format"`
+		FormattedBody string `json:"formatted_body"`
+	}{MsgType: "m.notice", Body: text, Format: "org.matrix.custom.html", FormattedBody: formatted}
+
+	sendResp := struct {
+		EventID string `json:"event_id"`
+	}{}
+	path := fmt.Sprintf("/rooms/%s/send/m.room.message/%s", url.PathEscape(m.room), m.txnID(req))
+	return m.call(ctx, "PUT", path, body, &sendResp)
+}
+
+// txnID makes transaction id of the message from the delivery, or from the comment if sent outside of queue.
+// Homeserver ignores messages with the same id, so retry of delivery doesn't post it twice
+func (m *Matrix) txnID(req request) string {
+	src := req.delivery
+	if src == "" {
+		src = fmt.Sprintf("%s!!%s!!%s!!%s", req.event, req.siteID, req.comment.Locator.URL, req.comment.ID)
+	}
+	h := sha256.Sum256([]byte(src))
+	return hex.EncodeToString(h[:])
+}
+
+// call makes request to client-server api of the homeserver and decodes response to result
+func (m *Matrix) call(ctx context.Context, method, path string, body interface{}, result interface{}) error {
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return errors.Wrap(err, "failed to make matrix body")
+		}
+		rd = bytes.NewReader(b)
+	}
+	r, err := http.NewRequest(method, m.apiPrefix+"/_matrix/client/r0"+path, rd)
+	if err != nil {
+		return errors.Wrap(err, "failed to make matrix request")
+	}
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	r.Header.Set("Authorization", "Bearer "+m.token)
+
+	client := http.Client{Timeout: m.timeout}
+	resp, err := client.Do(r.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "failed to get matrix response")
+	}
+	defer func() {
+		if err = resp.Body.Close(); err != nil {
+			log.Printf("[WARN] can't close request body, %s", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		errResp := struct {
+			ErrCode string `json:"errcode"`
+			Error   string `json:"error"`
+		}{}
+		_ = json.NewDecoder(resp.Body).Decode(&errResp)
+		return errors.Errorf("unexpected matrix status code %d, %s %s", resp.StatusCode, errResp.ErrCode, errResp.Error)
+	}
+	return errors.Wrap(json.NewDecoder(resp.Body).Decode(result), "can't decode matrix response")
+}
+
+// buildMessage makes plain text and html messages from comment, pending comments marked as waiting for approval
+func (m *Matrix) buildMessage(req request) (text, formatted string) {
+	from := req.comment.User.Name
+	if req.comment.ParentID != "" {
+		from += " → " + req.parent.User.Name
+	}
+	link := req.comment.Locator.URL + uiNav + req.comment.ID
+
+	text = fmt.Sprintf("%s\n\n%s\n\n↦ original comment %s", from, html.UnescapeString(req.comment.Orig), link)
+	formatted = fmt.Sprintf("<b>%s</b><br><br>%s<br><br>↦ <a href=\"%s\">original comment</a>",
+		html.EscapeString(from), req.comment.Text, html.EscapeString(link)) // comment's html sanitized on creation
+	if req.comment.Pending {
+		text = fmt.Sprintf("%s\n\n%s\n\nwaiting for approval", from, html.UnescapeString(req.comment.Orig))
+		formatted = fmt.Sprintf("<b>%s</b><br><br>%s<br><br><i>waiting for approval</i>", html.EscapeString(from),
+			req.comment.Text)
+	}
+	return text, formatted
+}
+
+func (m *Matrix) String() string {
+	return "matrix: " + m.room
+}
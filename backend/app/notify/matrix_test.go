@@ -0,0 +1,141 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark/backend/app/store"
+)
+
+func TestMatrix_New(t *testing.T) {
+	ts, _ := mockMatrixServer()
+	defer ts.Close()
+
+	mx, err := NewMatrix("good-token", "!room:example.com", 2*time.Second, ts.URL+"/")
+	assert.NoError(t, err)
+	require.NotNil(t, mx)
+	assert.Equal(t, ts.URL, mx.apiPrefix)
+	assert.Equal(t, "matrix: !room:example.com", mx.String())
+
+	st := time.Now()
+	_, err = NewMatrix("bad-token", "!room:example.com", 2*time.Second, ts.URL)
+	assert.EqualError(t, err, "can't initialize matrix notifications: unexpected matrix status code 401, "+
+		"M_UNKNOWN_TOKEN Unrecognised access token")
+	assert.True(t, time.Since(st) >= 250*5*time.Millisecond)
+
+	_, err = NewMatrix("no-user", "!room:example.com", 2*time.Second, ts.URL)
+	assert.EqualError(t, err, "unexpected matrix response, no user_id")
+
+	mx, err = NewMatrix("good-token", "!room:example.com", 0, ts.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, matrixTimeOut, mx.timeout)
+}
+
+func TestMatrix_Send(t *testing.T) {
+	ts, sent := mockMatrixServer()
+	defer ts.Close()
+
+	mx, err := NewMatrix("good-token", "!room:example.com", 2*time.Second, ts.URL)
+	require.NoError(t, err)
+	c := store.Comment{ID: "999", Orig: "some text", Text: "<p>some text</p>", ParentID: "1",
+		Locator: store.Locator{URL: "https://radio-t.com/p/1"}}
+	c.User.Name = "from"
+	cp := store.Comment{Text: "some parent text"}
+	cp.User.Name = "to"
+
+	require.NoError(t, mx.Send(context.TODO(), request{comment: c, parent: cp, delivery: "1-1"}))
+	require.NoError(t, mx.Send(context.TODO(), request{comment: c, parent: cp, delivery: "1-1"}))
+	require.NoError(t, mx.Send(context.TODO(), request{comment: c, parent: cp, delivery: "2-1"}))
+	require.NoError(t, mx.Send(context.TODO(), request{comment: c, parent: cp}))
+	msgs := sent()
+	require.Equal(t, 4, len(msgs))
+	assert.True(t, strings.HasPrefix(msgs[0].path, "/_matrix/client/r0/rooms/%21room:example.com/send/m.room.message/"),
+		msgs[0].path)
+	assert.Equal(t, msgs[0].path, msgs[1].path, "retry of delivery has the same transaction id")
+	assert.NotEqual(t, msgs[0].path, msgs[2].path, "other delivery")
+	assert.NotEqual(t, msgs[0].path, msgs[3].path, "sent outside of queue")
+	assert.Equal(t, "m.notice", msgs[0].body["msgtype"])
+	assert.Equal(t, "org.matrix.custom.html", msgs[0].body["format"])
+	assert.Equal(t, "from → to\n\nsome text\n\n↦ original comment https://radio-t.com/p/1#remark42__comment-999",
+		msgs[0].body["body"])
+
+	mx.room = "!bad:example.com"
+	err = mx.Send(context.TODO(), request{comment: c, parent: cp})
+	assert.EqualError(t, err, "unexpected matrix status code 403, M_FORBIDDEN not in room")
+}
+
+func TestMatrix_BuildMessage(t *testing.T) {
+	mx := Matrix{}
+	c := store.Comment{ID: "999", Orig: "some text &amp; more", Text: "<p>some text &amp; more</p>", ParentID: "1",
+		Locator: store.Locator{URL: "https://radio-t.com/p/1"}}
+	c.User.Name = "from <b>"
+	cp := store.Comment{Orig: "some parent text"}
+	cp.User.Name = "to"
+
+	text, formatted := mx.buildMessage(request{comment: c, parent: cp})
+	assert.Equal(t, "from <b> → to\n\nsome text & more\n\n↦ original comment https://radio-t.com/p/1#remark42__comment-999", text)
+	assert.Equal(t, "<b>from &lt;b&gt; → to</b><br><br><p>some text &amp; more</p><br><br>"+
+		`↦ <a href="https://radio-t.com/p/1#remark42__comment-999">original comment</a>`, formatted)
+
+	c.Pending, c.ParentID = true, ""
+	text, formatted = mx.buildMessage(request{comment: c})
+	assert.Equal(t, "from <b>\n\nsome text & more\n\nwaiting for approval", text)
+	assert.Equal(t, "<b>from &lt;b&gt;</b><br><br><p>some text &amp; more</p><br><br><i>waiting for approval</i>", formatted)
+}
+
+type mockMatrixMessage struct {
+	path string
+	body map[string]interface{}
+}
+
+// mockMatrixServer mocks matrix homeserver, good-token is the only valid token and !room:example.com the only room
+// bot joined. Returns function to get all sent messages
+func mockMatrixServer() (*httptest.Server, func() []mockMatrixMessage) {
+	var lock sync.Mutex
+	var sent []mockMatrixMessage
+
+	router := chi.NewRouter()
+	router.Get("/_matrix/client/r0/account/whoami", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "Bearer good-token":
+			_, _ = w.Write([]byte(`{"user_id": "@remark42:example.com"}`))
+		case "Bearer no-user":
+			_, _ = w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"errcode": "M_UNKNOWN_TOKEN", "error": "Unrecognised access token"}`))
+		}
+	})
+	router.Put("/_matrix/client/r0/rooms/{room}/send/m.room.message/{txn}", func(w http.ResponseWriter, r *http.Request) {
+		if chi.URLParam(r, "room") != "!room:example.com" && chi.URLParam(r, "room") != "%21room:example.com" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errcode": "M_FORBIDDEN", "error": "not in room"}`))
+			return
+		}
+		msg := mockMatrixMessage{path: r.URL.EscapedPath(), body: map[string]interface{}{}}
+		if err := json.NewDecoder(r.Body).Decode(&msg.body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		lock.Lock()
+		sent = append(sent, msg)
+		lock.Unlock()
+		_, _ = w.Write([]byte(`{"event_id": "$event:example.com"}`))
+	})
+
+	return httptest.NewServer(router), func() []mockMatrixMessage {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]mockMatrixMessage{}, sent...)
+	}
+}
@@ -7,103 +7,464 @@ import (
 	"log"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
 
 	"github.com/umputun/remark/backend/app/store"
 )
 
-// Service delivers notifications to multiple destinations
+// Service delivers notifications to multiple destinations. Each notification persisted in the queue as a delivery
+// per destination's target and retried with exponential backoff. Deliveries failed all attempts kept in dead-letter
+// list for DeadRetention, except of deliveries to users' own targets dropped right away
 type Service struct {
+	ServiceParams
 	dataService  Store
 	destinations []Destination
-	queue        chan request
+	destIDs      []string // unique id of each destination, String() of destinations may be the same
+	wake         chan struct{}
+
+	lock    sync.Mutex
+	sending map[string]bool // ids of destinations with deliveries being sent
+	senders sync.WaitGroup
 
 	closed uint32 // non-zero means closed. uses uint instead of bool for atomic
 	ctx    context.Context
 	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// ServiceParams defines queue and retry policy of the service
+type ServiceParams struct {
+	Queue         Queue         // in-memory queue used if nil
+	Attempts      int           // max attempts before delivery moved to dead-letter list
+	RetryDelay    time.Duration // delay after the first failed attempt, doubled on each next one up to maxRetryDelay
+	DeadRetention time.Duration // deliveries removed from dead-letter list after it
 }
 
-// Destination defines interface for a given destination service, like telegram, email and so on
+// Destination defines interface for a given destination service, like telegram, email and so on.
+// Send makes a single attempt, retries made by the service
 type Destination interface {
 	fmt.Stringer
 	Send(ctx context.Context, req request) error
 }
 
+// Targets is implemented by destinations sending the request to several targets, like few webhook urls.
+// Separate delivery queued for each target and request's target set on sending, so retry of failed target
+// doesn't send it again to others. Destinations without it have a single target
+type Targets interface {
+	Targets(req request) []Target
+}
+
+// Target of the destination, ID is the destination's own
+type Target struct {
+	ID   string
+	User bool // target set by user, like user's webhook, dropped after the last failed attempt
+}
+
+// EventsFilter is implemented by destinations accepting events other than new comments.
+// Destinations without it receive EventCreate only
+type EventsFilter interface {
+	Accepts(event Event) bool
+}
+
 // Store defines the minimal interface accessing stored commens used by notifier
 type Store interface {
 	Get(locator store.Locator, id string) (store.Comment, error)
 }
+
+// Event defines type of the notification
+type Event string
+
+// enum of all events
+const (
+	EventCreate  Event = "comment.create"
+	EventApprove Event = "comment.approve" // comment published after pre-moderation
+	EventUpdate  Event = "comment.update"
+	EventDelete  Event = "comment.delete"
+	EventVote    Event = "comment.vote"
+	EventBlock   Event = "user.block"
+	EventDigest  Event = "user.digest" // new comments of subscribed posts, not included in AllEvents
+)
+
+// AllEvents lists all supported events of comments and users
+var AllEvents = []Event{EventCreate, EventApprove, EventUpdate, EventDelete, EventVote, EventBlock}
+
 type request struct {
-	comment store.Comment
-	parent  store.Comment
+	event    Event
+	siteID   string
+	comment  store.Comment
+	parent   store.Comment
+	user     store.User      // blocked or unblocked user, for EventBlock only
+	ttl      time.Duration   // block duration, 0 for permanent
+	email    string          // subscriber's email, for EventDigest only
+	comments []store.Comment // new comments of subscribed posts, for EventDigest only
+	target   string          // destination's target to send to, all if empty
+	delivery string          // unique id of queued delivery, the same for all attempts
+	created  time.Time       // creation time of queued delivery, the same for all attempts
 }
 
-const defaultQueueSize = 100
+const (
+	defaultAttempts      = 5
+	defaultRetryDelay    = 10 * time.Second
+	defaultDeadRetention = 7 * 24 * time.Hour
+	maxRetryDelay        = time.Hour
+	deadCleanupInterval  = time.Hour
+)
+
 const uiNav = "#remark42__comment-"
 
 // NewService makes notification service routing comments to all destinations.
-func NewService(dataService Store, size int, destinations ...Destination) *Service {
-	if size <= 0 {
-		size = defaultQueueSize
+// Deliveries left in the queue from the previous run sent on start
+func NewService(dataService Store, params ServiceParams, destinations ...Destination) *Service {
+	if params.Queue == nil {
+		params.Queue = NewMemQueue()
+	}
+	if params.Attempts <= 0 {
+		params.Attempts = defaultAttempts
+	}
+	if params.RetryDelay <= 0 {
+		params.RetryDelay = defaultRetryDelay
+	}
+	if params.DeadRetention <= 0 {
+		params.DeadRetention = defaultDeadRetention
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	res := Service{
-		dataService:  dataService,
-		queue:        make(chan request, size),
-		destinations: destinations,
-		ctx:          ctx,
-		cancel:       cancel,
+		ServiceParams: params,
+		dataService:   dataService,
+		destinations:  destinations,
+		destIDs:       make([]string, len(destinations)),
+		sending:       map[string]bool{},
+		wake:          make(chan struct{}, 1),
+		ctx:           ctx,
+		cancel:        cancel,
+		done:          make(chan struct{}),
+	}
+	for i, dest := range destinations {
+		res.destIDs[i] = fmt.Sprintf("%d:%s", i, dest)
 	}
 	if len(destinations) > 0 {
 		go res.do()
+	} else {
+		close(res.done)
 	}
-	log.Printf("[INFO] create notifier service, queue size=%d, destinations=%d", size, len(destinations))
+	log.Printf("[INFO] create notifier service, attempts=%d, retry delay=%s, dead retention=%s, destinations=%d",
+		params.Attempts, params.RetryDelay, params.DeadRetention, len(destinations))
 	return &res
 }
 
-// Submit comment to internal channel if not busy, drop if can't send
+// Submit new comment to the queue
 func (s *Service) Submit(comment store.Comment) {
-	if len(s.destinations) == 0 || atomic.LoadUint32(&s.closed) != 0 {
+	s.SubmitEvent(EventCreate, comment)
+}
+
+// SubmitEvent submits comment's event, like edit, delete or vote. Safe to call on nil service
+func (s *Service) SubmitEvent(event Event, comment store.Comment) {
+	if s == nil || len(s.destinations) == 0 || atomic.LoadUint32(&s.closed) != 0 {
 		return
 	}
 	parentComment := store.Comment{}
-	if s.dataService != nil {
+	if s.dataService != nil && comment.ParentID != "" {
 		if p, err := s.dataService.Get(comment.Locator, comment.ParentID); err == nil {
 			parentComment = p
 		}
 	}
-	select {
-	case s.queue <- request{comment: comment, parent: parentComment}:
-	default:
-		log.Printf("[WARN] can't send comment notification to queue, %+v", comment)
+	s.send(request{event: event, siteID: comment.Locator.SiteID, comment: comment, parent: parentComment})
+}
+
+// SubmitBlock submits block or unblock (user.Blocked=false) of the user on site. Safe to call on nil service
+func (s *Service) SubmitBlock(siteID string, user store.User, ttl time.Duration) {
+	if s == nil || len(s.destinations) == 0 || atomic.LoadUint32(&s.closed) != 0 {
+		return
+	}
+	s.send(request{event: EventBlock, siteID: siteID, user: user, ttl: ttl})
+}
+
+// SubmitDigest submits digest of new comments to the subscriber. Safe to call on nil service
+func (s *Service) SubmitDigest(siteID string, user store.User, email string, comments []store.Comment) {
+	if s == nil || len(s.destinations) == 0 || atomic.LoadUint32(&s.closed) != 0 {
+		return
+	}
+	s.send(request{event: EventDigest, siteID: siteID, user: user, email: email, comments: comments})
+}
+
+// send puts delivery of the request to each target of accepting destinations in the queue and wakes up the sender
+func (s *Service) send(req request) {
+	now := time.Now()
+	for i, dest := range s.destinations {
+		if !accepts(dest, req.event) {
+			continue
+		}
+		if f, ok := dest.(RequestsFilter); ok && !f.Match(req) {
+			continue
+		}
+		for _, target := range targets(dest, req) {
+			d := newDelivery(s.destIDs[i], dest.String(), req, target)
+			d.Created, d.NextTry = now, now
+			if _, err := s.Queue.Put(d); err != nil {
+				log.Printf("[WARN] can't put %s notification for %s to queue, %s", req.event, dest, err)
+			}
+		}
 	}
+	s.notify()
 }
 
-// Close queue channel and wait for completion
+// Failed returns deliveries of the site failed all attempts, i.e. dead-letter list. Safe to call on nil service
+func (s *Service) Failed(siteID string) ([]Delivery, error) {
+	res := []Delivery{}
+	if s == nil || s.Queue == nil {
+		return res, nil
+	}
+	dead, err := s.Queue.Dead()
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dead {
+		if d.SiteID == siteID {
+			res = append(res, d)
+		}
+	}
+	return res, nil
+}
+
+// Replay moves failed delivery from dead-letter list back to the queue, with all attempts reset.
+// Safe to call on nil service
+func (s *Service) Replay(siteID, id string) error {
+	if s == nil || s.Queue == nil {
+		return errors.Errorf("no delivery %s", id)
+	}
+	d, err := s.Queue.Get(id)
+	if err != nil {
+		return err
+	}
+	if d.SiteID != siteID || !d.Dead {
+		return errors.Errorf("no failed delivery %s for site %s", id, siteID)
+	}
+	d.Dead, d.DeadSince, d.Attempts, d.LastError, d.NextTry = false, time.Time{}, 0, "", time.Now()
+	if err = s.Queue.Update(d); err != nil {
+		return err
+	}
+	log.Printf("[INFO] replay delivery %s to %s", id, d.Destination)
+	s.notify()
+	return nil
+}
+
+// Close stops sending, waits for completion and closes the queue. Unsent deliveries kept in the queue
 func (s *Service) Close() {
-	if s.queue != nil {
+	if !atomic.CompareAndSwapUint32(&s.closed, 0, 1) {
+		return
+	}
+	if s.cancel != nil {
 		log.Print("[DEBUG] close notifier")
-		close(s.queue)
 		s.cancel()
-		<-s.ctx.Done()
+		<-s.done
+		if err := s.Queue.Close(); err != nil {
+			log.Printf("[WARN] can't close notification queue, %s", err)
+		}
+	}
+}
+
+// notify wakes up sender, doesn't block if wake-up already pending
+func (s *Service) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
 	}
-	atomic.StoreUint32(&s.closed, 1)
 }
 
+// do sends ready deliveries on each wake-up and at the time of the next retry,
+// removes expired deliveries from dead-letter list periodically
 func (s *Service) do() {
-	for c := range s.queue {
-		var wg sync.WaitGroup
-		wg.Add(len(s.destinations))
-		for _, dest := range s.destinations {
-			go func(d Destination) {
-				if err := d.Send(s.ctx, c); err != nil {
-					log.Printf("[WARN] failed to send to %s, %s", d, err)
+	defer close(s.done)
+	defer s.senders.Wait()
+	cleanup := time.NewTicker(deadCleanupInterval)
+	defer cleanup.Stop()
+	s.cleanDead()
+
+	retry := time.NewTimer(s.sendReady()) // leftovers from the previous run
+	defer retry.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			log.Print("[WARN] terminated notifier")
+			return
+		case <-cleanup.C:
+			s.cleanDead()
+			continue
+		case <-s.wake:
+			if !retry.Stop() {
+				select {
+				case <-retry.C:
+				default:
 				}
-				wg.Done()
-			}(dest)
+			}
+		case <-retry.C:
+		}
+		retry.Reset(s.sendReady())
+	}
+}
+
+// sendReady starts sending of deliveries ready to (re)try and returns delay till the next try. Deliveries sent in order
+// for each destination, destinations in parallel. Destination still sending previous deliveries skipped, it wakes up
+// the sender once done, so slow destination doesn't hold others
+func (s *Service) sendReady() time.Duration {
+	pending, err := s.Queue.Pending()
+	if err != nil {
+		log.Printf("[WARN] can't list notification queue, %s", err)
+		return s.RetryDelay
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	ready, waiting := map[string][]Delivery{}, []Delivery{}
+	for _, d := range pending {
+		switch {
+		case s.sending[d.DestinationID]:
+		case d.NextTry.After(now):
+			waiting = append(waiting, d)
+		default:
+			ready[d.DestinationID] = append(ready[d.DestinationID], d)
+		}
+	}
+
+	for id, deliveries := range ready {
+		dest := s.destination(id)
+		if dest == nil {
+			for _, d := range deliveries {
+				s.failed(d, errors.Errorf("unknown destination %s", id), true)
+			}
+			continue
+		}
+		s.sending[id] = true
+		s.senders.Add(1)
+		go s.sendDeliveries(id, dest, deliveries)
+	}
+	return nextTry(waiting)
+}
+
+// sendDeliveries sends deliveries to the destination one by one and wakes up the sender once done
+func (s *Service) sendDeliveries(id string, dest Destination, deliveries []Delivery) {
+	defer func() {
+		s.lock.Lock()
+		delete(s.sending, id)
+		s.lock.Unlock()
+		s.senders.Done()
+		s.notify()
+	}()
+	for _, d := range deliveries {
+		if s.ctx.Err() != nil {
+			return
+		}
+		err := dest.Send(s.ctx, d.request())
+		if s.ctx.Err() != nil { // interrupted by close, will be sent again on the next start
+			return
+		}
+		if err != nil {
+			s.failed(d, err, false)
+			continue
+		}
+		if e := s.Queue.Delete(d.ID); e != nil {
+			log.Printf("[WARN] can't delete delivery %s from queue, %s", d.ID, e)
+		}
+	}
+}
+
+// destination returns destination by its id, nil if not found
+func (s *Service) destination(id string) Destination {
+	for i, destID := range s.destIDs {
+		if destID == id {
+			return s.destinations[i]
+		}
+	}
+	return nil
+}
+
+// nextTry returns delay till the earliest retry of pending deliveries, maxRetryDelay if nothing pending
+func nextTry(pending []Delivery) time.Duration {
+	res := maxRetryDelay
+	for _, d := range pending {
+		if delay := time.Until(d.NextTry); delay < res {
+			res = delay
+		}
+	}
+	if res < 0 {
+		return 0
+	}
+	return res
+}
+
+// failed schedules the next attempt with exponential backoff or moves delivery to dead-letter list.
+// Delivery to user's target dropped instead, failures of users' webhooks are not for admins
+func (s *Service) failed(d Delivery, err error, dead bool) {
+	d.Attempts++
+	d.LastError = err.Error()
+	d.Dead = dead || d.Attempts >= s.Attempts
+	if d.Dead && d.UserTarget {
+		log.Printf("[WARN] failed to send %s to user's target of %s after %d attempts, dropped, %s",
+			d.ID, d.Destination, d.Attempts, err)
+		if e := s.Queue.Delete(d.ID); e != nil {
+			log.Printf("[WARN] can't delete delivery %s from queue, %s", d.ID, e)
 		}
-		wg.Wait()
+		return
+	}
+	delay := s.RetryDelay
+	for i := 1; i < d.Attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	d.NextTry = time.Now().Add(delay)
+
+	if d.Dead {
+		d.DeadSince = time.Now()
+		log.Printf("[WARN] failed to send %s to %s after %d attempts, moved to dead-letter list, %s",
+			d.ID, d.Destination, d.Attempts, err)
+	} else {
+		log.Printf("[WARN] failed to send %s to %s, attempt %d, retry in %s, %s", d.ID, d.Destination, d.Attempts, delay, err)
+	}
+	if e := s.Queue.Update(d); e != nil {
+		log.Printf("[WARN] can't update delivery %s, %s", d.ID, e)
+	}
+}
+
+// cleanDead removes deliveries kept in dead-letter list longer than DeadRetention
+func (s *Service) cleanDead() {
+	dead, err := s.Queue.Dead()
+	if err != nil {
+		log.Printf("[WARN] can't list dead-letter list, %s", err)
+		return
+	}
+	expired := time.Now().Add(-s.DeadRetention)
+	for _, d := range dead {
+		if !d.DeadSince.Before(expired) {
+			continue
+		}
+		if err = s.Queue.Delete(d.ID); err != nil {
+			log.Printf("[WARN] can't delete expired delivery %s, %s", d.ID, err)
+			continue
+		}
+		log.Printf("[DEBUG] expired delivery %s to %s removed from dead-letter list", d.ID, d.Destination)
+	}
+}
+
+// accepts checks if destination receives the event
+func accepts(d Destination, event Event) bool {
+	if f, ok := d.(EventsFilter); ok {
+		return f.Accepts(event)
+	}
+	return event == EventCreate
+}
+
+// targets of the destination for the request, single one with empty id if destination doesn't have targets
+func targets(d Destination, req request) []Target {
+	if t, ok := d.(Targets); ok {
+		return t.Targets(req)
 	}
-	log.Print("[WARN] terminated notifier")
+	return []Target{{}}
 }
 
 // NopService is do-nothing notifier, without destinations
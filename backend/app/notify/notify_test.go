@@ -6,17 +6,21 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
+	"os"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	bolt "github.com/coreos/bbolt"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
 	"github.com/umputun/remark/backend/app/store"
 )
 
 func TestService_NoDestinations(t *testing.T) {
-	s := NewService(nil, 1)
+	s := NewService(nil, ServiceParams{})
 	assert.NotNil(t, s)
 	s.Submit(store.Comment{ID: "123"})
 	s.Submit(store.Comment{ID: "123"})
@@ -26,7 +30,7 @@ func TestService_NoDestinations(t *testing.T) {
 
 func TestService_WithDestinations(t *testing.T) {
 	d1, d2 := &mockDest{id: 1}, &mockDest{id: 2}
-	s := NewService(nil, 1, d1, d2)
+	s := NewService(nil, ServiceParams{}, d1, d2)
 	assert.NotNil(t, s)
 
 	s.Submit(store.Comment{ID: "100"})
@@ -45,38 +49,42 @@ func TestService_WithDestinations(t *testing.T) {
 	assert.Equal(t, "102", d1.get()[2].comment.ID)
 }
 
-func TestService_WithDrops(t *testing.T) {
+func TestService_NoDrops(t *testing.T) {
 	d1, d2 := &mockDest{id: 1}, &mockDest{id: 2}
-	s := NewService(nil, 1, d1, d2)
+	s := NewService(nil, ServiceParams{}, d1, d2)
 	assert.NotNil(t, s)
 
 	s.Submit(store.Comment{ID: "100"})
 	s.Submit(store.Comment{ID: "101"})
 	time.Sleep(time.Millisecond * 110)
 	s.Submit(store.Comment{ID: "102"})
-	time.Sleep(time.Millisecond * 110)
+	time.Sleep(time.Millisecond * 250)
 	s.Close()
 
 	s.Submit(store.Comment{ID: "111"}) // safe to send after close
 
-	assert.Equal(t, 2, len(d1.get()), "one comment dropped from d1")
-	assert.Equal(t, 2, len(d2.get()), "one comment dropped from d2")
+	assert.Equal(t, 3, len(d1.get()), "nothing dropped from d1")
+	assert.Equal(t, 3, len(d2.get()), "nothing dropped from d2")
 }
 
 func TestService_Many(t *testing.T) {
 	d1, d2 := &mockDest{id: 1}, &mockDest{id: 2}
-	s := NewService(nil, 5, d1, d2)
+	q := NewMemQueue()
+	s := NewService(nil, ServiceParams{Queue: q}, d1, d2)
 	assert.NotNil(t, s)
 
 	for i := 0; i < 10; i++ {
 		s.Submit(store.Comment{ID: fmt.Sprintf("%d", 100+i)})
-		time.Sleep(time.Millisecond * time.Duration(rand.Int31n(200)))
+		time.Sleep(time.Millisecond * time.Duration(rand.Int31n(20)))
 	}
 	s.Close()
 	time.Sleep(time.Millisecond * 10)
 
-	assert.NotEqual(t, 10, len(d1.get()), "some comments dropped from d1")
-	assert.NotEqual(t, 10, len(d2.get()), "some comments dropped from d2")
+	assert.NotEqual(t, 10, len(d1.get()), "not all comments sent to d1 before close")
+	assert.NotEqual(t, 10, len(d2.get()), "not all comments sent to d2 before close")
+	unsent, err := q.Pending()
+	require.NoError(t, err)
+	assert.Equal(t, 20-len(d1.get())-len(d2.get()), len(unsent), "unsent kept in queue")
 
 	assert.True(t, d1.closed)
 	assert.True(t, d2.closed)
@@ -89,7 +97,7 @@ func TestService_WithParent(t *testing.T) {
 	dataStore.data["p1"] = store.Comment{ID: "p1"}
 	dataStore.data["p2"] = store.Comment{ID: "p2"}
 
-	s := NewService(dataStore, 1, dest)
+	s := NewService(dataStore, ServiceParams{}, dest)
 	assert.NotNil(t, s)
 
 	s.Submit(store.Comment{ID: "c1", ParentID: "p1"})
@@ -106,6 +114,215 @@ func TestService_WithParent(t *testing.T) {
 	assert.Equal(t, "", destRes[1].parent.ID)
 }
 
+func TestService_Events(t *testing.T) {
+	d1, d2 := &mockDest{id: 1}, &mockEventsDest{mockDest: mockDest{id: 2}, events: []Event{EventCreate, EventVote, EventBlock}}
+	s := NewService(nil, ServiceParams{}, d1, d2)
+
+	s.Submit(store.Comment{ID: "c1", Locator: store.Locator{SiteID: "radio-t"}})
+	s.SubmitEvent(EventVote, store.Comment{ID: "c1", Locator: store.Locator{SiteID: "radio-t"}})
+	s.SubmitEvent(EventDelete, store.Comment{ID: "c1", Locator: store.Locator{SiteID: "radio-t"}})
+	s.SubmitBlock("radio-t", store.User{ID: "user1", Blocked: true}, time.Hour)
+	time.Sleep(time.Millisecond * 500)
+	s.Close()
+
+	require.Equal(t, 1, len(d1.get()), "new comments only")
+	assert.Equal(t, EventCreate, d1.get()[0].event)
+
+	res := d2.get()
+	require.Equal(t, 3, len(res), "accepted events only")
+	assert.Equal(t, EventCreate, res[0].event)
+	assert.Equal(t, EventVote, res[1].event)
+	assert.Equal(t, "radio-t", res[1].siteID)
+	assert.Equal(t, EventBlock, res[2].event)
+	assert.Equal(t, "radio-t", res[2].siteID)
+	assert.Equal(t, store.User{ID: "user1", Blocked: true}, res[2].user)
+	assert.Equal(t, time.Hour, res[2].ttl)
+}
+
+func TestService_Retry(t *testing.T) {
+	d1, d2 := &mockFailDest{failures: 2}, &mockFailDest{failures: 100}
+	d2.name = "fail"
+	s := NewService(nil, ServiceParams{Attempts: 3, RetryDelay: 10 * time.Millisecond}, d1, d2)
+	defer s.Close()
+
+	s.Submit(store.Comment{ID: "100", Locator: store.Locator{SiteID: "radio-t"}})
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 3, d1.attempts(), "sent on 3rd attempt")
+	assert.Equal(t, 1, len(d1.sent()))
+	assert.Equal(t, 3, d2.attempts(), "all attempts failed")
+	assert.Equal(t, 0, len(d2.sent()))
+
+	failed, err := s.Failed("radio-t")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(failed), "one delivery in dead-letter list")
+	assert.Equal(t, "fail", failed[0].Destination)
+	assert.Equal(t, "100", failed[0].Comment.ID)
+	assert.Equal(t, 3, failed[0].Attempts)
+	assert.Equal(t, "failed attempt 3", failed[0].LastError)
+	assert.True(t, failed[0].Dead)
+
+	failed, err = s.Failed("other")
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(failed))
+
+	assert.EqualError(t, s.Replay("other", failed0ID(t, s)), "no failed delivery "+failed0ID(t, s)+" for site other")
+	assert.NotNil(t, s.Replay("radio-t", "bad-id"))
+
+	d2.setFailures(0)
+	require.NoError(t, s.Replay("radio-t", failed0ID(t, s)))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, len(d2.sent()), "replayed")
+	failed, err = s.Failed("radio-t")
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(failed))
+	pending, err := s.Queue.Pending()
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(pending), "queue empty")
+}
+
+func TestService_Targets(t *testing.T) {
+	dest := &mockTargetsDest{fail: map[string]bool{"t2": true, "t3": true}}
+	route, err := NewRoute(dest, []string{"radio-t"}, FilterAll)
+	require.NoError(t, err)
+	s := NewService(nil, ServiceParams{Attempts: 3, RetryDelay: 10 * time.Millisecond}, route)
+	defer s.Close()
+
+	s.Submit(store.Comment{ID: "100", Locator: store.Locator{SiteID: "radio-t"}})
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, map[string]int{"t1": 1, "t2": 3, "t3": 3}, dest.attempts(), "sent target not sent again")
+
+	failed, err := s.Failed("radio-t")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(failed), "user's target not in dead-letter list")
+	assert.Equal(t, "t3", failed[0].Target)
+	assert.Equal(t, "route(sites=radio-t;filter=all)->mock targets", failed[0].Destination)
+	pending, err := s.Queue.Pending()
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(pending), "user's target dropped")
+}
+
+func TestService_SameNames(t *testing.T) {
+	slow, fast := &mockBlockDest{name: "same", release: make(chan struct{})}, &mockFailDest{name: "same"}
+	s := NewService(nil, ServiceParams{}, slow, fast)
+	defer s.Close()
+
+	s.Submit(store.Comment{ID: "100", Locator: store.Locator{SiteID: "radio-t"}})
+	time.Sleep(50 * time.Millisecond)
+	s.Submit(store.Comment{ID: "101", Locator: store.Locator{SiteID: "radio-t"}})
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, 2, len(fast.sent()), "not held by slow destination")
+	assert.Equal(t, "101", fast.sent()[1].comment.ID)
+	assert.Equal(t, 0, len(slow.sent()))
+
+	close(slow.release)
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, 2, len(slow.sent()), "each destination got own deliveries")
+	assert.Equal(t, "100", slow.sent()[0].comment.ID)
+	assert.Equal(t, "101", slow.sent()[1].comment.ID)
+	assert.Equal(t, 2, len(fast.sent()))
+}
+
+func TestService_DeadRetention(t *testing.T) {
+	s := NewService(nil, ServiceParams{Attempts: 3, DeadRetention: time.Hour})
+	assert.Equal(t, time.Hour, s.DeadRetention)
+	q := s.Queue
+
+	id, err := q.Put(Delivery{Attempts: 2, SiteID: "radio-t"})
+	require.NoError(t, err)
+	d, err := q.Get(id)
+	require.NoError(t, err)
+	s.failed(d, errors.New("failed"), false)
+	d, err = q.Get(id)
+	require.NoError(t, err)
+	assert.True(t, d.Dead)
+	assert.WithinDuration(t, time.Now(), d.DeadSince, time.Second)
+
+	_, err = q.Put(Delivery{Dead: true, DeadSince: time.Now().Add(-2 * time.Hour), SiteID: "radio-t"})
+	require.NoError(t, err)
+	s.cleanDead()
+	dead, err := q.Dead()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(dead), "expired removed")
+	assert.Equal(t, id, dead[0].ID)
+
+	require.NoError(t, s.Replay("radio-t", id))
+	d, err = q.Get(id)
+	require.NoError(t, err)
+	assert.False(t, d.Dead)
+	assert.True(t, d.DeadSince.IsZero())
+}
+
+func TestService_Backoff(t *testing.T) {
+	s := NewService(nil, ServiceParams{Attempts: 100, RetryDelay: time.Second})
+	q := s.Queue
+	for i, delay := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		id, err := q.Put(Delivery{Attempts: i})
+		require.NoError(t, err)
+		d, err := q.Get(id)
+		require.NoError(t, err)
+		s.failed(d, errors.New("failed"), false)
+		d, err = q.Get(id)
+		require.NoError(t, err)
+		assert.Equal(t, i+1, d.Attempts)
+		assert.InDelta(t, float64(time.Now().Add(delay).UnixNano()), float64(d.NextTry.UnixNano()), float64(100*time.Millisecond))
+		assert.False(t, d.Dead)
+	}
+
+	id, err := q.Put(Delivery{Attempts: 50})
+	require.NoError(t, err)
+	d, err := q.Get(id)
+	require.NoError(t, err)
+	s.failed(d, errors.New("failed"), false)
+	d, err = q.Get(id)
+	require.NoError(t, err)
+	assert.InDelta(t, float64(time.Now().Add(maxRetryDelay).UnixNano()), float64(d.NextTry.UnixNano()), float64(100*time.Millisecond))
+}
+
+func TestService_Durable(t *testing.T) {
+	defer os.Remove("/tmp/notify-test.db")
+	q, err := NewBoltQueue("/tmp/notify-test.db", bolt.Options{})
+	require.NoError(t, err)
+	_, err = q.Put(Delivery{DestinationID: "0:mock id=1", Destination: "mock id=1", Event: EventCreate,
+		Comment: store.Comment{ID: "100"}})
+	require.NoError(t, err)
+	_, err = q.Put(Delivery{DestinationID: "1:mock id=1", Destination: "mock id=1", Event: EventCreate, SiteID: "radio-t"})
+	require.NoError(t, err)
+
+	d1 := &mockDest{id: 1}
+	s := NewService(nil, ServiceParams{Queue: q}, d1)
+	time.Sleep(150 * time.Millisecond)
+	require.Equal(t, 1, len(d1.get()), "left from the previous run sent on start")
+	assert.Equal(t, "100", d1.get()[0].comment.ID)
+
+	failed, err := s.Failed("radio-t")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(failed), "unknown destination moved to dead-letter list")
+	assert.Equal(t, "unknown destination 1:mock id=1", failed[0].LastError)
+
+	s.Submit(store.Comment{ID: "101"})
+	time.Sleep(10 * time.Millisecond)
+	s.Close() // interrupts sending
+
+	q, err = NewBoltQueue("/tmp/notify-test.db", bolt.Options{})
+	require.NoError(t, err)
+	defer q.Close()
+	pending, err := q.Pending()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(pending))
+	assert.Equal(t, "101", pending[0].Comment.ID, "interrupted delivery kept")
+	assert.Equal(t, 0, pending[0].Attempts)
+	dead, err := q.Dead()
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(dead))
+}
+
+func failed0ID(t *testing.T, s *Service) string {
+	failed, err := s.Failed("radio-t")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(failed))
+	return failed[0].ID
+}
+
 func TestService_Nop(t *testing.T) {
 	s := NopService
 	s.Submit(store.Comment{})
@@ -113,6 +330,134 @@ func TestService_Nop(t *testing.T) {
 	assert.Equal(t, uint32(1), atomic.LoadUint32(&s.closed))
 }
 
+type mockEventsDest struct {
+	mockDest
+	events []Event
+}
+
+func (m *mockEventsDest) Accepts(event Event) bool {
+	for _, e := range m.events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// mockFailDest fails first failures attempts of each delivery
+type mockFailDest struct {
+	name     string
+	failures int
+	lock     sync.Mutex
+	tries    map[string]int
+	total    int
+	data     []request
+}
+
+func (m *mockFailDest) Send(ctx context.Context, r request) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.tries == nil {
+		m.tries = map[string]int{}
+	}
+	m.tries[r.comment.ID]++
+	m.total++
+	if m.tries[r.comment.ID] <= m.failures {
+		return fmt.Errorf("failed attempt %d", m.tries[r.comment.ID])
+	}
+	m.data = append(m.data, r)
+	return nil
+}
+
+func (m *mockFailDest) setFailures(n int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.failures = n
+}
+
+func (m *mockFailDest) attempts() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.total
+}
+
+func (m *mockFailDest) sent() []request {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]request{}, m.data...)
+}
+
+func (m *mockFailDest) String() string {
+	if m.name == "" {
+		return "mock fail"
+	}
+	return m.name
+}
+
+// mockBlockDest holds sending till release closed
+type mockBlockDest struct {
+	name    string
+	release chan struct{}
+	lock    sync.Mutex
+	data    []request
+}
+
+func (m *mockBlockDest) Send(ctx context.Context, r request) error {
+	select {
+	case <-m.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.data = append(m.data, r)
+	return nil
+}
+
+func (m *mockBlockDest) sent() []request {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]request{}, m.data...)
+}
+
+func (m *mockBlockDest) String() string { return m.name }
+
+// mockTargetsDest has targets t1, t2 and user's t3, fails sending to targets in fail
+type mockTargetsDest struct {
+	fail  map[string]bool
+	lock  sync.Mutex
+	tries map[string]int
+}
+
+func (m *mockTargetsDest) Targets(req request) []Target {
+	return []Target{{ID: "t1"}, {ID: "t2", User: true}, {ID: "t3"}}
+}
+
+func (m *mockTargetsDest) Send(ctx context.Context, r request) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.tries == nil {
+		m.tries = map[string]int{}
+	}
+	m.tries[r.target]++
+	if m.fail[r.target] {
+		return fmt.Errorf("failed %s", r.target)
+	}
+	return nil
+}
+
+func (m *mockTargetsDest) attempts() map[string]int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	res := map[string]int{}
+	for k, v := range m.tries {
+		res[k] = v
+	}
+	return res
+}
+
+func (m *mockTargetsDest) String() string { return "mock targets" }
+
 type mockDest struct {
 	data   []request
 	id     int
@@ -141,7 +486,7 @@ func (m *mockDest) get() []request {
 	copy(res, m.data)
 	return res
 }
-func (m *mockDest) String() string { return fmt.Sprintf("mock id=%d, closed=%v", m.id, m.closed) }
+func (m *mockDest) String() string { return fmt.Sprintf("mock id=%d", m.id) }
 
 type mockStore struct{ data map[string]store.Comment }
 
@@ -0,0 +1,136 @@
+package notify
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/umputun/remark/backend/app/store"
+)
+
+// Queue keeps deliveries until sent, failed ones kept apart in dead-letter list
+type Queue interface {
+	Put(d Delivery) (id string, err error) // add new delivery, returns assigned id
+	Get(id string) (Delivery, error)
+	Update(d Delivery) error // update existing delivery, moves it to or from dead-letter list by Dead flag
+	Delete(id string) error
+	Pending() ([]Delivery, error) // deliveries to send, in order of creation
+	Dead() ([]Delivery, error)    // dead-letter list, in order of creation
+	Close() error
+}
+
+// Delivery is a notification to the single destination, with state of attempts
+type Delivery struct {
+	ID            string          `json:"id"`
+	DestinationID string          `json:"destination_id"` // unique id of the destination, routes delivery on sending
+	Destination   string          `json:"destination"`
+	Event         Event           `json:"event"`
+	SiteID        string          `json:"site"`
+	Comment       store.Comment   `json:"comment"`
+	Parent        store.Comment   `json:"parent"`
+	User          store.User      `json:"user"`
+	TTL           time.Duration   `json:"ttl,omitempty"`
+	Email         string          `json:"email,omitempty"`
+	Comments      []store.Comment `json:"comments,omitempty"`
+	Target        string          `json:"target,omitempty"`      // one of destination's targets, all if empty
+	UserTarget    bool            `json:"user_target,omitempty"` // target set by user, dropped after the last attempt
+	Created       time.Time       `json:"created"`
+	Attempts      int             `json:"attempts"`
+	NextTry       time.Time       `json:"next_try"`
+	LastError     string          `json:"last_error,omitempty"`
+	Dead          bool            `json:"dead,omitempty"` // failed all attempts
+	DeadSince     time.Time       `json:"dead_since,omitempty"`
+}
+
+func newDelivery(destinationID, destination string, req request, target Target) Delivery {
+	return Delivery{DestinationID: destinationID, Destination: destination, Event: req.event, SiteID: req.siteID, Comment: req.comment,
+		Parent: req.parent, User: req.user, TTL: req.ttl, Email: req.email, Comments: req.comments,
+		Target: target.ID, UserTarget: target.User}
+}
+
+func (d Delivery) request() request {
+	return request{event: d.Event, siteID: d.SiteID, comment: d.Comment, parent: d.Parent, user: d.User, ttl: d.TTL,
+		email: d.Email, comments: d.Comments, target: d.Target, created: d.Created,
+		delivery: fmt.Sprintf("%s-%d", d.ID, d.Created.UnixNano())} // ids of memory queue restart from 1
+}
+
+// MemQueue implements Queue in memory, not durable and lost on restart
+type MemQueue struct {
+	lock       sync.Mutex
+	seq        uint64
+	deliveries map[string]Delivery
+}
+
+// NewMemQueue makes empty in-memory queue
+func NewMemQueue() *MemQueue {
+	return &MemQueue{deliveries: map[string]Delivery{}}
+}
+
+// Put delivery to the queue
+func (m *MemQueue) Put(d Delivery) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.seq++
+	d.ID = fmt.Sprintf("%020d", m.seq)
+	m.deliveries[d.ID] = d
+	return d.ID, nil
+}
+
+// Get delivery by id
+func (m *MemQueue) Get(id string) (Delivery, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	d, ok := m.deliveries[id]
+	if !ok {
+		return Delivery{}, errors.Errorf("no delivery %s", id)
+	}
+	return d, nil
+}
+
+// Update existing delivery
+func (m *MemQueue) Update(d Delivery) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.deliveries[d.ID]; !ok {
+		return errors.Errorf("no delivery %s", d.ID)
+	}
+	m.deliveries[d.ID] = d
+	return nil
+}
+
+// Delete delivery, no error if not found
+func (m *MemQueue) Delete(id string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.deliveries, id)
+	return nil
+}
+
+// Pending returns not dead deliveries sorted by id, i.e. creation order
+func (m *MemQueue) Pending() ([]Delivery, error) {
+	return m.list(false), nil
+}
+
+// Dead returns dead deliveries sorted by id, i.e. creation order
+func (m *MemQueue) Dead() ([]Delivery, error) {
+	return m.list(true), nil
+}
+
+func (m *MemQueue) list(dead bool) []Delivery {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	res := []Delivery{}
+	for _, d := range m.deliveries {
+		if d.Dead == dead {
+			res = append(res, d)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+// Close does nothing for in-memory queue
+func (m *MemQueue) Close() error { return nil }
@@ -0,0 +1,148 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/pkg/errors"
+)
+
+// BoltQueue implements durable Queue with boltdb. Deliveries to send kept in "deliveries" bucket,
+// dead-letter list in "dead" bucket, so sending doesn't read it. Key is zero-padded sequence, value - json of Delivery
+type BoltQueue struct {
+	db *bolt.DB
+}
+
+const (
+	deliveriesBucketName = "deliveries"
+	deadBucketName       = "dead"
+)
+
+// NewBoltQueue makes persistent queue in the given file
+func NewBoltQueue(fileName string, options bolt.Options) (*BoltQueue, error) {
+	db, err := bolt.Open(fileName, 0600, &options)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to make boltdb for %s", fileName)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucketName := range []string{deliveriesBucketName, deadBucketName} {
+			if _, e := tx.CreateBucketIfNotExists([]byte(bucketName)); e != nil {
+				return errors.Wrapf(e, "failed to create top level bucket %s", bucketName)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	log.Printf("[INFO] notification queue in %s", fileName)
+	return &BoltQueue{db: db}, nil
+}
+
+// Put delivery to the queue
+func (b *BoltQueue) Put(d Delivery) (id string, err error) {
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(deliveriesBucketName))
+		seq, e := bucket.NextSequence()
+		if e != nil {
+			return errors.Wrap(e, "can't get delivery sequence")
+		}
+		d.ID = fmt.Sprintf("%020d", seq)
+		return b.save(tx, d)
+	})
+	return d.ID, err
+}
+
+// Get delivery by id, pending or dead
+func (b *BoltQueue) Get(id string) (d Delivery, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket([]byte(deliveriesBucketName)).Get([]byte(id))
+		if value == nil {
+			value = tx.Bucket([]byte(deadBucketName)).Get([]byte(id))
+		}
+		if value == nil {
+			return errors.Errorf("no delivery %s", id)
+		}
+		return errors.Wrapf(json.Unmarshal(value, &d), "failed to unmarshal delivery %s", id)
+	})
+	return d, err
+}
+
+// Update existing delivery, moved between buckets if Dead flag changed
+func (b *BoltQueue) Update(d Delivery) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		found := false
+		for _, bucketName := range []string{deliveriesBucketName, deadBucketName} {
+			bucket := tx.Bucket([]byte(bucketName))
+			if bucket.Get([]byte(d.ID)) == nil {
+				continue
+			}
+			found = true
+			if err := bucket.Delete([]byte(d.ID)); err != nil {
+				return errors.Wrapf(err, "failed to delete delivery %s", d.ID)
+			}
+		}
+		if !found {
+			return errors.Errorf("no delivery %s", d.ID)
+		}
+		return b.save(tx, d)
+	})
+}
+
+// Delete delivery, no error if not found
+func (b *BoltQueue) Delete(id string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for _, bucketName := range []string{deliveriesBucketName, deadBucketName} {
+			if err := tx.Bucket([]byte(bucketName)).Delete([]byte(id)); err != nil {
+				return errors.Wrapf(err, "failed to delete delivery %s", id)
+			}
+		}
+		return nil
+	})
+}
+
+// Pending returns deliveries to send in order of creation
+func (b *BoltQueue) Pending() ([]Delivery, error) {
+	return b.list(deliveriesBucketName)
+}
+
+// Dead returns dead-letter list in order of creation
+func (b *BoltQueue) Dead() ([]Delivery, error) {
+	return b.list(deadBucketName)
+}
+
+func (b *BoltQueue) list(bucketName string) (res []Delivery, err error) {
+	res = []Delivery{}
+	err = b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucketName)).ForEach(func(k, v []byte) error {
+			d := Delivery{}
+			if e := json.Unmarshal(v, &d); e != nil {
+				return errors.Wrapf(e, "failed to unmarshal delivery %s", k)
+			}
+			res = append(res, d)
+			return nil
+		})
+	})
+	return res, err
+}
+
+// Close boltdb
+func (b *BoltQueue) Close() error {
+	return errors.Wrap(b.db.Close(), "failed to close notification queue")
+}
+
+// save delivery to the bucket of pending or dead ones
+func (b *BoltQueue) save(tx *bolt.Tx, d Delivery) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return errors.Wrapf(err, "can't marshal delivery %s", d.ID)
+	}
+	bucketName := deliveriesBucketName
+	if d.Dead {
+		bucketName = deadBucketName
+	}
+	return errors.Wrapf(tx.Bucket([]byte(bucketName)).Put([]byte(d.ID), data), "failed to save delivery %s", d.ID)
+}
@@ -0,0 +1,87 @@
+package notify
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark/backend/app/store"
+)
+
+func TestQueue_Mem(t *testing.T) {
+	testQueue(t, NewMemQueue())
+}
+
+func TestQueue_Bolt(t *testing.T) {
+	defer os.Remove("/tmp/notify-queue-test.db")
+	q, err := NewBoltQueue("/tmp/notify-queue-test.db", bolt.Options{})
+	require.NoError(t, err)
+	testQueue(t, q)
+
+	_, err = NewBoltQueue("/dev/null/bad.db", bolt.Options{})
+	assert.NotNil(t, err)
+}
+
+func testQueue(t *testing.T, q Queue) {
+	defer func() { assert.NoError(t, q.Close()) }()
+
+	ts := time.Date(2019, 1, 20, 12, 0, 0, 0, time.UTC)
+	id1, err := q.Put(Delivery{Destination: "d1", Event: EventCreate, SiteID: "radio-t", Created: ts, NextTry: ts,
+		Comment: store.Comment{ID: "c1", Text: "text"}})
+	require.NoError(t, err)
+	id2, err := q.Put(Delivery{Destination: "d2", Event: EventBlock, SiteID: "radio-t", Created: ts, NextTry: ts,
+		User: store.User{ID: "user1", Blocked: true}, TTL: time.Hour})
+	require.NoError(t, err)
+	assert.NotEqual(t, id1, id2)
+
+	d, err := q.Get(id1)
+	require.NoError(t, err)
+	assert.Equal(t, "c1", d.Comment.ID)
+	assert.Equal(t, "text", d.Comment.Text)
+	assert.True(t, ts.Equal(d.NextTry))
+	_, err = q.Get("bad")
+	assert.NotNil(t, err)
+
+	d.Attempts, d.Dead, d.LastError, d.Target = 2, true, "failed", "t1"
+	require.NoError(t, q.Update(d))
+	assert.NotNil(t, q.Update(Delivery{ID: "bad"}), "update of missing delivery")
+
+	pending, err := q.Pending()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(pending), "dead delivery not pending")
+	assert.Equal(t, id2, pending[0].ID)
+	assert.Equal(t, store.User{ID: "user1", Blocked: true}, pending[0].User)
+	assert.Equal(t, time.Hour, pending[0].request().ttl)
+	dead, err := q.Dead()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(dead))
+	assert.Equal(t, id1, dead[0].ID)
+	assert.Equal(t, 2, dead[0].Attempts)
+	assert.Equal(t, "failed", dead[0].LastError)
+	assert.Equal(t, "t1", dead[0].request().target)
+	d, err = q.Get(id1)
+	require.NoError(t, err)
+	assert.True(t, d.Dead, "dead delivery found")
+
+	d.Dead = false
+	require.NoError(t, q.Update(d))
+	pending, err = q.Pending()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(pending), "replayed delivery pending again")
+	assert.Equal(t, id1, pending[0].ID, "in order of creation")
+	assert.Equal(t, id2, pending[1].ID)
+	dead, err = q.Dead()
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(dead))
+
+	require.NoError(t, q.Delete(id1))
+	require.NoError(t, q.Delete(id1), "no error for missing")
+	pending, err = q.Pending()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(pending))
+	assert.Equal(t, id2, pending[0].ID)
+}
@@ -0,0 +1,257 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+
+	"github.com/umputun/remark/backend/app/store"
+)
+
+// Replies implements notify.Destination for comment authors opted-in to be notified about replies.
+// Each notification goes to email and/or webhook of parent comment's author and includes signed unsubscribe link.
+type Replies struct {
+	store     ReplyStore
+	keys      KeyStore
+	mailer    *mailer // nil disables email notifications
+	remarkURL string
+	client    http.Client
+}
+
+// ReplyStore defines the minimal interface to get reply notifications opt-in of the user
+type ReplyStore interface {
+	ReplyNotify(siteID, userID string) (store.ReplyNotify, error)
+}
+
+// KeyStore defines the minimal interface to get site's secret used to sign unsubscribe links
+type KeyStore interface {
+	Key(siteID string) (key string, err error)
+}
+
+const repliesTimeOut = 5 * time.Second
+
+// targets of reply notifications
+const (
+	replyTargetEmail   = "email"
+	replyTargetWebhook = "webhook"
+)
+
+// purposes of unsubscribe links, token of one can't be used for another
+const (
+	UnsubscribeReplies = "replies"
+	UnsubscribeDigest  = "digest"
+)
+
+// replyMessage is the data passed to reply templates and sent to webhooks
+type replyMessage struct {
+	SiteID      string            `json:"site"`
+	URL         string            `json:"url"`
+	Link        string            `json:"link"`
+	ID          string            `json:"id"`
+	ParentID    string            `json:"parent_id"`
+	From        string            `json:"from"`
+	To          string            `json:"to"`
+	Orig        string            `json:"text"`
+	Text        htmltemplate.HTML `json:"-"`
+	Unsubscribe string            `json:"unsubscribe"`
+}
+
+var replyTextTmpl = template.Must(template.New("text").Parse(`{{.From}} replied to your comment on {{.URL}}
+
+{{.Orig}}
+
+Reply: {{.Link}}
+
+To stop receiving notifications about replies open {{.Unsubscribe}}
+`))
+
+var replyHTMLTmpl = htmltemplate.Must(htmltemplate.New("html").Parse(`<!DOCTYPE html>
+<html>
+<body>
+<p><b>{{.From}}</b> replied to your comment on <a href="{{.URL}}">{{.URL}}</a></p>
+<div>{{.Text}}</div>
+<p><a href="{{.Link}}">Reply</a></p>
+<p><small><a href="{{.Unsubscribe}}">Unsubscribe</a> from notifications about replies</small></p>
+</body>
+</html>
+`))
+
+// NewReplies makes reply notifier. Email notifications are disabled if smtp params have no host
+func NewReplies(replyStore ReplyStore, keys KeyStore, params SMTPParams, remarkURL string) (*Replies, error) {
+	res := Replies{store: replyStore, keys: keys, remarkURL: strings.TrimSuffix(remarkURL, "/"),
+		client: publicClient(repliesTimeOut)}
+	if params.Host != "" {
+		m, err := newMailer(params)
+		if err != nil {
+			return nil, err
+		}
+		res.mailer = m
+	}
+	log.Printf("[DEBUG] create new replies notifier, email=%v", res.mailer != nil)
+	return &res, nil
+}
+
+// Targets implements notify.Targets, email and webhook of parent comment's author if opted-in.
+// Webhook is user's target, its failures are not kept in dead-letter list
+func (r *Replies) Targets(req request) []Target {
+	rn, err := r.replyNotify(req)
+	if err != nil {
+		log.Printf("[WARN] %s", err)
+		return []Target{{}} // all targets checked on sending
+	}
+	res := []Target{}
+	if rn.Email != "" && r.mailer != nil {
+		res = append(res, Target{ID: replyTargetEmail})
+	}
+	if rn.Webhook != "" {
+		res = append(res, Target{ID: replyTargetWebhook, User: true})
+	}
+	return res
+}
+
+// Send notification to parent comment's author if opted-in, to request's target or all targets if not set.
+// Skips self-replies, pending and shadow comments
+func (r *Replies) Send(ctx context.Context, req request) error {
+	rn, err := r.replyNotify(req)
+	if err != nil {
+		return err
+	}
+	if rn.Email == "" && rn.Webhook == "" {
+		return nil
+	}
+
+	siteID, userID := req.comment.Locator.SiteID, req.parent.User.ID
+
+	key, err := r.keys.Key(siteID)
+	if err != nil {
+		return errors.Wrapf(err, "can't get key for site %s", siteID)
+	}
+
+	msg := replyMessage{
+		SiteID:   siteID,
+		URL:      req.comment.Locator.URL,
+		Link:     req.comment.Locator.URL + uiNav + req.comment.ID,
+		ID:       req.comment.ID,
+		ParentID: req.comment.ParentID,
+		From:     req.comment.User.Name,
+		To:       req.parent.User.Name,
+		Orig:     req.comment.Orig,
+		Text:     htmltemplate.HTML(req.comment.Text), // comment's html sanitized on creation
+		Unsubscribe: fmt.Sprintf("%s/api/v1/notify/unsubscribe?site=%s&user=%s&tkn=%s", r.remarkURL,
+			url.QueryEscape(siteID), url.QueryEscape(userID), UnsubscribeToken(key, UnsubscribeReplies, siteID, userID)),
+	}
+
+	errs := new(multierror.Error)
+	if rn.Email != "" && r.mailer != nil && (req.target == "" || req.target == replyTargetEmail) {
+		log.Printf("[DEBUG] send reply notification to %s, comment id %s", userID, req.comment.ID)
+		errs = multierror.Append(errs, r.sendEmail(ctx, rn.Email, msg))
+	}
+	if rn.Webhook != "" && (req.target == "" || req.target == replyTargetWebhook) {
+		log.Printf("[DEBUG] send reply webhook for %s, comment id %s", userID, req.comment.ID)
+		errs = multierror.Append(errs, r.sendWebhook(ctx, rn.Webhook, msg))
+	}
+	return errs.ErrorOrNil()
+}
+
+// Accepts implements notify.EventsFilter, new comments and comments approved after pre-moderation
+func (r *Replies) Accepts(event Event) bool {
+	return event == EventCreate || event == EventApprove
+}
+
+// replyNotify returns opt-in of parent comment's author, empty for requests not notified
+func (r *Replies) replyNotify(req request) (store.ReplyNotify, error) {
+	if req.comment.ParentID == "" || req.parent.ID == "" || req.comment.Pending || req.comment.Shadow {
+		return store.ReplyNotify{}, nil
+	}
+	if req.parent.User.ID == req.comment.User.ID {
+		return store.ReplyNotify{}, nil
+	}
+	rn, err := r.store.ReplyNotify(req.comment.Locator.SiteID, req.parent.User.ID)
+	if err != nil {
+		return store.ReplyNotify{}, errors.Wrapf(err, "can't get reply notify for %s", req.parent.User.ID)
+	}
+	return rn, nil
+}
+
+func (r *Replies) sendEmail(ctx context.Context, to string, msg replyMessage) error {
+	body, err := r.mailer.compose(to, fmt.Sprintf("%s replied to your comment", msg.From), replyTextTmpl, replyHTMLTmpl, msg)
+	if err != nil {
+		return err
+	}
+	return errors.Wrapf(r.mailer.send(ctx, to, body), "can't send reply email to %s", to)
+}
+
+func (r *Replies) sendWebhook(ctx context.Context, webhook string, msg replyMessage) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return errors.Wrap(err, "can't marshal reply")
+	}
+	req, err := http.NewRequest("POST", webhook, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrapf(err, "can't make webhook request to %s", webhook)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "webhook %s failed", webhook)
+	}
+	defer func() {
+		if err = resp.Body.Close(); err != nil {
+			log.Printf("[WARN] can't close response body, %s", err)
+		}
+	}()
+	if resp.StatusCode >= 300 {
+		return errors.Errorf("unexpected webhook %s status code %d", webhook, resp.StatusCode)
+	}
+	return nil
+}
+
+// publicClient makes http client connecting to public addresses only, for webhooks set by users.
+// Address checked on each connection after name resolution, so names resolved to internal addresses rejected as well
+func publicClient(timeout time.Duration) http.Client {
+	dialer := net.Dialer{Timeout: timeout, Control: func(network, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+			return errors.Errorf("address %s not allowed", host)
+		}
+		return nil
+	}}
+	// no proxy, it would connect to internal addresses on behalf of the client
+	return http.Client{Timeout: timeout, Transport: &http.Transport{DialContext: dialer.DialContext}}
+}
+
+// isPublicIP checks if ip is not loopback, private, link-local or other special-purpose address
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+func (r *Replies) String() string {
+	return "replies"
+}
+
+// UnsubscribeToken makes token signing user's unsubscribe link of the given purpose with site's secret
+func UnsubscribeToken(key, purpose, siteID, userID string) string {
+	h := hmac.New(sha256.New, []byte(key))
+	_, _ = h.Write([]byte(purpose + "::" + siteID + "::" + userID))
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,221 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark/backend/app/store"
+)
+
+func TestReplies_Send(t *testing.T) {
+	srv := newMockSMTP(t, nil, false)
+	defer srv.close()
+
+	var lock sync.Mutex
+	var received []replyMessage
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bad" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		msg := replyMessage{}
+		require.NoError(t, json.Unmarshal(body, &msg))
+		lock.Lock()
+		received = append(received, msg)
+		lock.Unlock()
+	}))
+	defer ts.Close()
+	webhooks := func() []replyMessage {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]replyMessage{}, received...)
+	}
+
+	rs := mockReplyStore{
+		"user1": {Email: "user1@example.com"},
+		"user2": {Webhook: ts.URL},
+		"user3": {Email: "user3@example.com", Webhook: ts.URL + "/bad"},
+	}
+	r, err := NewReplies(rs, mockKeyStore{"radio-t": "secret"},
+		SMTPParams{Host: "127.0.0.1", Port: srv.port(), From: "remark@example.com"}, "https://remark.example.com/")
+	require.NoError(t, err)
+	assert.Equal(t, "replies", r.String())
+	r.client = http.Client{Timeout: repliesTimeOut} // test server is local, not allowed by public client
+
+	c := store.Comment{ID: "999", ParentID: "1", Text: "<p>some <b>text</b></p>", Orig: "some **text**",
+		Locator: store.Locator{SiteID: "radio-t", URL: "http://example.org"}, User: store.User{ID: "user9", Name: "from"}}
+	cp := store.Comment{ID: "1", Locator: c.Locator, User: store.User{ID: "user1", Name: "to"}}
+
+	// email
+	require.NoError(t, r.Send(context.Background(), request{comment: c, parent: cp}))
+	msgs := srv.messages()
+	require.Equal(t, 1, len(msgs))
+	assert.Equal(t, "user1@example.com", msgs[0].to)
+	assert.Contains(t, msgs[0].data, "Subject: from replied to your comment\r\n")
+	assert.Contains(t, msgs[0].text, "Reply: http://example.org#remark42__comment-999\r\n")
+	unsubscribe := "https://remark.example.com/api/v1/notify/unsubscribe?site=radio-t&user=user1&tkn=" +
+		UnsubscribeToken("secret", UnsubscribeReplies, "radio-t", "user1")
+	assert.Contains(t, msgs[0].text, "To stop receiving notifications about replies open "+unsubscribe)
+
+	// webhook
+	cp.User.ID = "user2"
+	require.NoError(t, r.Send(context.Background(), request{comment: c, parent: cp}))
+	hooks := webhooks()
+	require.Equal(t, 1, len(hooks))
+	assert.Equal(t, "999", hooks[0].ID)
+	assert.Equal(t, "1", hooks[0].ParentID)
+	assert.Equal(t, "some **text**", hooks[0].Orig)
+	assert.Equal(t, "https://remark.example.com/api/v1/notify/unsubscribe?site=radio-t&user=user2&tkn="+
+		UnsubscribeToken("secret", UnsubscribeReplies, "radio-t", "user2"), hooks[0].Unsubscribe)
+
+	// both, webhook failed
+	cp.User.ID = "user3"
+	err = r.Send(context.Background(), request{comment: c, parent: cp})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "unexpected webhook")
+	assert.Equal(t, 2, len(srv.messages()), "email sent")
+
+	// targets, webhook is user's
+	assert.Equal(t, []Target{{ID: replyTargetEmail}, {ID: replyTargetWebhook, User: true}},
+		r.Targets(request{comment: c, parent: cp}))
+	err = r.Send(context.Background(), request{comment: c, parent: cp, target: replyTargetWebhook})
+	require.NotNil(t, err)
+	assert.Equal(t, 2, len(srv.messages()), "email not sent again")
+	require.NoError(t, r.Send(context.Background(), request{comment: c, parent: cp, target: replyTargetEmail}))
+	assert.Equal(t, 3, len(srv.messages()))
+	assert.Equal(t, []Target{}, r.Targets(request{comment: c}), "nothing queued for not a reply")
+
+	// skipped
+	for _, req := range []request{
+		{comment: c}, // not a reply
+		{comment: c, parent: store.Comment{ID: "2", User: store.User{ID: "user4"}}},                 // not opted-in
+		{comment: store.Comment{ID: "3", ParentID: "1", User: store.User{ID: "user3"}}, parent: cp}, // self-reply
+	} {
+		require.NoError(t, r.Send(context.Background(), req))
+	}
+	cp.User.ID = "user1"
+	c.Pending = true
+	require.NoError(t, r.Send(context.Background(), request{comment: c, parent: cp}))
+	c.Pending, c.Shadow = false, true
+	require.NoError(t, r.Send(context.Background(), request{comment: c, parent: cp}))
+	assert.Equal(t, 3, len(srv.messages()))
+	assert.Equal(t, 1, len(webhooks()))
+
+	// store error
+	cp.User.ID = "bad"
+	c.Shadow = false
+	assert.EqualError(t, r.Send(context.Background(), request{comment: c, parent: cp}),
+		"can't get reply notify for bad: failed")
+	assert.Equal(t, []Target{{}}, r.Targets(request{comment: c, parent: cp}), "checked on sending")
+}
+
+func TestReplies_NoEmail(t *testing.T) {
+	r, err := NewReplies(mockReplyStore{"user1": {Email: "user1@example.com"}}, mockKeyStore{}, SMTPParams{}, "")
+	require.NoError(t, err)
+	assert.Nil(t, r.mailer)
+	c := store.Comment{ID: "999", ParentID: "1", User: store.User{ID: "user9"}}
+	assert.NoError(t, r.Send(context.Background(), request{comment: c, parent: store.Comment{ID: "1", User: store.User{ID: "user1"}}}),
+		"email ignored without smtp server")
+
+	_, err = NewReplies(mockReplyStore{}, mockKeyStore{}, SMTPParams{Host: "127.0.0.1"}, "")
+	assert.EqualError(t, err, "empty from address")
+}
+
+func TestReplies_Approved(t *testing.T) {
+	var lock sync.Mutex
+	var received []replyMessage
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg := replyMessage{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&msg))
+		lock.Lock()
+		received = append(received, msg)
+		lock.Unlock()
+	}))
+	defer ts.Close()
+
+	r, err := NewReplies(mockReplyStore{"user1": {Webhook: ts.URL}}, mockKeyStore{"radio-t": "secret"}, SMTPParams{}, "")
+	require.NoError(t, err)
+	r.client = http.Client{Timeout: repliesTimeOut} // test server is local, not allowed by public client
+	assert.True(t, r.Accepts(EventCreate))
+	assert.True(t, r.Accepts(EventApprove))
+	assert.False(t, r.Accepts(EventUpdate))
+
+	loc := store.Locator{SiteID: "radio-t", URL: "http://example.org"}
+	dataStore := &mockStore{data: map[string]store.Comment{"1": {ID: "1", Locator: loc, User: store.User{ID: "user1"}}}}
+	s := NewService(dataStore, ServiceParams{}, r)
+
+	c := store.Comment{ID: "999", ParentID: "1", Pending: true, Locator: loc, User: store.User{ID: "user9"}}
+	s.Submit(c)
+	time.Sleep(time.Millisecond * 200)
+	lock.Lock()
+	assert.Equal(t, 0, len(received), "pending reply not notified")
+	lock.Unlock()
+
+	c.Pending = false
+	s.SubmitEvent(EventApprove, c)
+	time.Sleep(time.Millisecond * 200)
+	s.Close()
+
+	lock.Lock()
+	defer lock.Unlock()
+	require.Equal(t, 1, len(received), "approved reply notified")
+	assert.Equal(t, "999", received[0].ID)
+	assert.Equal(t, "1", received[0].ParentID)
+}
+
+func TestReplies_PrivateWebhook(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("local webhook called")
+	}))
+	defer ts.Close()
+
+	r, err := NewReplies(mockReplyStore{"user1": {Webhook: ts.URL}}, mockKeyStore{"radio-t": "secret"}, SMTPParams{}, "")
+	require.NoError(t, err)
+	c := store.Comment{ID: "999", ParentID: "1", Locator: store.Locator{SiteID: "radio-t"}, User: store.User{ID: "user9"}}
+	err = r.Send(context.Background(), request{comment: c, parent: store.Comment{ID: "1", User: store.User{ID: "user1"}}})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "address 127.0.0.1 not allowed")
+
+	for ip, public := range map[string]bool{"127.0.0.1": false, "10.1.2.3": false, "192.168.1.1": false,
+		"169.254.169.254": false, "::1": false, "fd00::1": false, "0.0.0.0": false, "8.8.8.8": true, "2001:4860::8888": true} {
+		assert.Equal(t, public, isPublicIP(net.ParseIP(ip)), ip)
+	}
+}
+
+func TestReplies_UnsubscribeToken(t *testing.T) {
+	tkn := UnsubscribeToken("secret", UnsubscribeReplies, "radio-t", "user1")
+	assert.Equal(t, 64, len(tkn))
+	assert.Equal(t, tkn, UnsubscribeToken("secret", UnsubscribeReplies, "radio-t", "user1"))
+	assert.NotEqual(t, tkn, UnsubscribeToken("secret2", UnsubscribeReplies, "radio-t", "user1"))
+	assert.NotEqual(t, tkn, UnsubscribeToken("secret", UnsubscribeReplies, "radio-t", "user2"))
+	assert.NotEqual(t, tkn, UnsubscribeToken("secret", UnsubscribeReplies, "other", "user1"))
+	assert.NotEqual(t, tkn, UnsubscribeToken("secret", UnsubscribeDigest, "radio-t", "user1"))
+}
+
+type mockReplyStore map[string]store.ReplyNotify
+
+func (m mockReplyStore) ReplyNotify(siteID, userID string) (store.ReplyNotify, error) {
+	if userID == "bad" {
+		return store.ReplyNotify{}, errors.New("failed")
+	}
+	return m[userID], nil
+}
+
+type mockKeyStore map[string]string
+
+func (m mockKeyStore) Key(siteID string) (string, error) {
+	return m[siteID], nil
+}
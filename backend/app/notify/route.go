@@ -0,0 +1,90 @@
+package notify
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Route limits destination to the given sites and to comments passing the filter. Routed destination has
+// its own name made of the routing and wrapped destination's name
+type Route struct {
+	Destination
+	Sites  []string // all sites if empty
+	Filter Filter   // all comments if empty
+}
+
+// RequestsFilter is implemented by destinations accepting only some of requests, checked before queueing
+type RequestsFilter interface {
+	Match(req request) bool
+}
+
+// Filter defines which comments routed to destination
+type Filter string
+
+// enum of all filters
+const (
+	FilterAll          Filter = "all"
+	FilterTopLevel     Filter = "top-level"     // top-level comments only, no replies
+	FilterAdminReplies Filter = "admin-replies" // replies to comments of admins only
+)
+
+// NewRoute makes destination routed to the sites with filter. Returns destination as is if it's not limited
+func NewRoute(dest Destination, sites []string, filter Filter) (Destination, error) {
+	switch filter {
+	case "", FilterAll, FilterTopLevel, FilterAdminReplies:
+	default:
+		return nil, errors.Errorf("unknown notification filter %q", filter)
+	}
+	if len(sites) == 0 && (filter == "" || filter == FilterAll) {
+		return dest, nil
+	}
+	return &Route{Destination: dest, Sites: sites, Filter: filter}, nil
+}
+
+// Match checks if request's site routed to destination and comment passes the filter
+func (r *Route) Match(req request) bool {
+	if len(r.Sites) > 0 {
+		found := false
+		for _, s := range r.Sites {
+			if s == req.siteID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	switch r.Filter {
+	case FilterTopLevel:
+		return req.comment.ParentID == ""
+	case FilterAdminReplies:
+		return req.comment.ParentID != "" && req.parent.User.Admin
+	}
+	return true
+}
+
+// Accepts events accepted by wrapped destination
+func (r *Route) Accepts(event Event) bool {
+	return accepts(r.Destination, event)
+}
+
+// Targets of wrapped destination
+func (r *Route) Targets(req request) []Target {
+	return targets(r.Destination, req)
+}
+
+// String makes name of the route like route(sites=radio-t,other;filter=top-level)->telegram: channel
+func (r *Route) String() string {
+	rules := []string{}
+	if len(r.Sites) > 0 {
+		rules = append(rules, "sites="+strings.Join(r.Sites, ","))
+	}
+	if r.Filter != "" {
+		rules = append(rules, "filter="+string(r.Filter))
+	}
+	return fmt.Sprintf("route(%s)->%s", strings.Join(rules, ";"), r.Destination)
+}
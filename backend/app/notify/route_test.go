@@ -0,0 +1,94 @@
+package notify
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark/backend/app/store"
+)
+
+func TestRoute_New(t *testing.T) {
+	d := &mockDest{id: 1}
+	r, err := NewRoute(d, nil, FilterAll)
+	require.NoError(t, err)
+	assert.Equal(t, d, r, "not limited, destination as is")
+	r, err = NewRoute(d, nil, "")
+	require.NoError(t, err)
+	assert.Equal(t, d, r)
+
+	r, err = NewRoute(d, []string{"radio-t"}, "")
+	require.NoError(t, err)
+	assert.Equal(t, &Route{Destination: d, Sites: []string{"radio-t"}}, r)
+	assert.Equal(t, "route(sites=radio-t)->mock id=1", r.String())
+
+	r, err = NewRoute(d, []string{"radio-t", "other"}, FilterTopLevel)
+	require.NoError(t, err)
+	assert.Equal(t, "route(sites=radio-t,other;filter=top-level)->mock id=1", r.String())
+	r2, err := NewRoute(d, nil, FilterTopLevel)
+	require.NoError(t, err)
+	assert.Equal(t, "route(filter=top-level)->mock id=1", r2.String())
+	assert.NotEqual(t, r.String(), r2.String(), "routes of the same destination have own names")
+
+	_, err = NewRoute(d, nil, "bad")
+	assert.EqualError(t, err, `unknown notification filter "bad"`)
+}
+
+func TestRoute_Match(t *testing.T) {
+	admin := store.Comment{ID: "p1", User: store.User{ID: "admin", Admin: true}}
+	user := store.Comment{ID: "p2", User: store.User{ID: "user1"}}
+	top := request{siteID: "radio-t", comment: store.Comment{ID: "c1"}}
+	replyAdmin := request{siteID: "radio-t", comment: store.Comment{ID: "c2", ParentID: "p1"}, parent: admin}
+	replyUser := request{siteID: "radio-t", comment: store.Comment{ID: "c3", ParentID: "p2"}, parent: user}
+	other := request{siteID: "other", comment: store.Comment{ID: "c4"}}
+
+	tbl := []struct {
+		route Route
+		req   request
+		res   bool
+	}{
+		{Route{}, top, true},
+		{Route{}, other, true},
+		{Route{Sites: []string{"radio-t", "blah"}}, top, true},
+		{Route{Sites: []string{"radio-t", "blah"}}, other, false},
+		{Route{Filter: FilterTopLevel}, top, true},
+		{Route{Filter: FilterTopLevel}, replyAdmin, false},
+		{Route{Filter: FilterAdminReplies}, top, false},
+		{Route{Filter: FilterAdminReplies}, replyAdmin, true},
+		{Route{Filter: FilterAdminReplies}, replyUser, false},
+		{Route{Sites: []string{"other"}, Filter: FilterTopLevel}, other, true},
+		{Route{Sites: []string{"other"}, Filter: FilterTopLevel}, top, false},
+	}
+	for i, tt := range tbl {
+		assert.Equal(t, tt.res, tt.route.Match(tt.req), "case #%d", i)
+	}
+}
+
+func TestService_Routes(t *testing.T) {
+	d1, d2 := &mockDest{id: 1}, &mockEventsDest{mockDest: mockDest{id: 2}, events: []Event{EventCreate, EventBlock}}
+	r1, err := NewRoute(d1, []string{"site-a"}, FilterAll)
+	require.NoError(t, err)
+	r2, err := NewRoute(d2, []string{"site-b"}, FilterTopLevel)
+	require.NoError(t, err)
+	s := NewService(nil, ServiceParams{}, r1, r2)
+
+	s.Submit(store.Comment{ID: "c1", Locator: store.Locator{SiteID: "site-a"}})
+	s.Submit(store.Comment{ID: "c2", Locator: store.Locator{SiteID: "site-b"}})
+	s.Submit(store.Comment{ID: "c3", ParentID: "c2", Locator: store.Locator{SiteID: "site-b"}})
+	s.SubmitBlock("site-b", store.User{ID: "user1", Blocked: true}, time.Hour)
+	s.SubmitBlock("site-a", store.User{ID: "user1", Blocked: true}, time.Hour)
+	time.Sleep(time.Millisecond * 500)
+	s.Close()
+
+	res := d1.get()
+	require.Equal(t, 1, len(res), "site-a only")
+	assert.Equal(t, "c1", res[0].comment.ID)
+
+	res = d2.get()
+	require.Equal(t, 2, len(res), "top-level comments and accepted events of site-b only")
+	assert.Equal(t, "c2", res[0].comment.ID)
+	assert.Equal(t, EventBlock, res[1].event)
+	assert.Equal(t, "site-b", res[1].siteID)
+}
@@ -0,0 +1,139 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-pkgz/repeater"
+	"github.com/pkg/errors"
+)
+
+// Slack implements notify.Destination for slack channel, messages posted by the bot user
+type Slack struct {
+	channel   string
+	token     string
+	apiPrefix string
+	timeout   time.Duration
+}
+
+const slackTimeOut = 5000 * time.Millisecond
+const slackAPIPrefix = "https://slack.com/api/"
+
+// slackResponse is the common part of all slack web api responses
+type slackResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error"`
+}
+
+// NewSlack makes slack bot for notifications, verifies token with auth.test call
+func NewSlack(token string, channel string, timeout time.Duration, api string) (*Slack, error) {
+	res := Slack{channel: channel, token: token, apiPrefix: api, timeout: timeout}
+	if res.apiPrefix == "" {
+		res.apiPrefix = slackAPIPrefix
+	}
+	if !strings.HasSuffix(res.apiPrefix, "/") {
+		res.apiPrefix += "/"
+	}
+	if res.timeout == 0 {
+		res.timeout = slackTimeOut
+	}
+	log.Printf("[DEBUG] create new slack notifier for channel %s, timeout=%s, api=%s", channel, res.timeout, res.apiPrefix)
+
+	err := repeater.NewDefault(5, time.Millisecond*250).Do(func() error {
+		authResp := struct {
+			slackResponse
+			User string `json:"user"`
+			Team string `json:"team"`
+		}{}
+		if err := res.call(context.Background(), "auth.test", struct{}{}, &authResp); err != nil {
+			return errors.Wrap(err, "can't initialize slack notifications")
+		}
+		log.Printf("[DEBUG] slack notifications as %s in %s", authResp.User, authResp.Team)
+		return nil
+	})
+
+	return &res, err
+}
+
+// Send to slack channel
+func (s *Slack) Send(ctx context.Context, req request) error {
+	log.Printf("[DEBUG] send slack notification to %s, comment id %s", s.channel, req.comment.ID)
+	body := struct {
+		Channel     string `json:"channel"`
+		Text        string `json:"text"`
+		UnfurlLinks bool   `json:"unfurl_links"`
+	}{Channel: s.channel, Text: s.buildMessage(req)}
+	return s.call(ctx, "chat.postMessage", body, &slackResponse{})
+}
+
+// call posts json body to slack web api method and decodes response to result. Slack reports errors with ok=false
+func (s *Slack) call(ctx context.Context, method string, body interface{}, result interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return errors.Wrapf(err, "failed to make slack %s body", method)
+	}
+	r, err := http.NewRequest("POST", s.apiPrefix+method, bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrapf(err, "failed to make slack %s request", method)
+	}
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	r.Header.Set("Authorization", "Bearer "+s.token)
+
+	client := http.Client{Timeout: s.timeout}
+	resp, err := client.Do(r.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "failed to get slack %s response", method)
+	}
+	defer func() {
+		if err = resp.Body.Close(); err != nil {
+			log.Printf("[WARN] can't close request body, %s", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("unexpected slack %s status code %d", method, resp.StatusCode)
+	}
+
+	data := bytes.Buffer{}
+	if _, err = data.ReadFrom(resp.Body); err != nil {
+		return errors.Wrapf(err, "can't read slack %s response", method)
+	}
+	slackResp := slackResponse{}
+	if err = json.Unmarshal(data.Bytes(), &slackResp); err != nil {
+		return errors.Wrapf(err, "can't decode slack %s response", method)
+	}
+	if !slackResp.OK {
+		return errors.Errorf("slack %s failed, %s", method, slackResp.Error)
+	}
+	return errors.Wrapf(json.Unmarshal(data.Bytes(), result), "can't decode slack %s response", method)
+}
+
+// buildMessage makes mrkdwn message text from comment, pending comments marked as waiting for approval
+func (s *Slack) buildMessage(req request) string {
+	from := req.comment.User.Name
+	if req.comment.ParentID != "" {
+		from += " → " + req.parent.User.Name
+	}
+	from = "*" + slackEscape(from) + "*"
+	link := fmt.Sprintf("↦ <%s|original comment>", req.comment.Locator.URL+uiNav+req.comment.ID)
+	if req.comment.Pending {
+		link = "_waiting for approval_"
+	}
+	return fmt.Sprintf("%s\n\n%s\n\n%s", from, slackEscape(req.comment.Orig), link)
+}
+
+// slackEscape escapes control characters of slack's mrkdwn, text is html-unescaped first
+func slackEscape(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(html.UnescapeString(text))
+}
+
+func (s *Slack) String() string {
+	return "slack: " + s.channel
+}
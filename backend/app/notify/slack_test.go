@@ -0,0 +1,115 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark/backend/app/store"
+)
+
+func TestSlack_New(t *testing.T) {
+	ts, _ := mockSlackServer()
+	defer ts.Close()
+
+	sl, err := NewSlack("good-token", "#remark", 2*time.Second, ts.URL)
+	assert.NoError(t, err)
+	require.NotNil(t, sl)
+	assert.Equal(t, ts.URL+"/", sl.apiPrefix)
+	assert.Equal(t, "slack: #remark", sl.String())
+
+	st := time.Now()
+	_, err = NewSlack("bad-token", "#remark", 2*time.Second, ts.URL+"/")
+	assert.EqualError(t, err, "can't initialize slack notifications: slack auth.test failed, invalid_auth")
+	assert.True(t, time.Since(st) >= 250*5*time.Millisecond)
+
+	_, err = NewSlack("good-token", "#remark", 2*time.Second, ts.URL+"/404/")
+	assert.EqualError(t, err, "can't initialize slack notifications: unexpected slack auth.test status code 404")
+
+	sl, err = NewSlack("good-token", "#remark", 0, ts.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, slackTimeOut, sl.timeout)
+}
+
+func TestSlack_Send(t *testing.T) {
+	ts, posted := mockSlackServer()
+	defer ts.Close()
+
+	sl, err := NewSlack("good-token", "#remark", 2*time.Second, ts.URL+"/")
+	require.NoError(t, err)
+	c := store.Comment{ID: "999", Orig: "some text", ParentID: "1", Locator: store.Locator{URL: "https://radio-t.com/p/1"}}
+	c.User.Name = "from"
+	cp := store.Comment{Text: "some parent text"}
+	cp.User.Name = "to"
+
+	require.NoError(t, sl.Send(context.TODO(), request{comment: c, parent: cp}))
+	msgs := posted()
+	require.Equal(t, 1, len(msgs))
+	assert.Equal(t, "#remark", msgs[0]["channel"])
+	assert.Equal(t, "*from → to*\n\nsome text\n\n↦ <https://radio-t.com/p/1#remark42__comment-999|original comment>",
+		msgs[0]["text"])
+
+	sl.channel = "#bad"
+	err = sl.Send(context.TODO(), request{comment: c, parent: cp})
+	assert.EqualError(t, err, "slack chat.postMessage failed, channel_not_found")
+}
+
+func TestSlack_BuildMessage(t *testing.T) {
+	sl := Slack{}
+	c := store.Comment{ID: "999", Orig: "some <text> &amp; more", ParentID: "1",
+		Locator: store.Locator{URL: "https://radio-t.com/p/1"}}
+	c.User.Name = "from"
+	cp := store.Comment{Orig: "some parent text"}
+	cp.User.Name = "to"
+
+	msg := sl.buildMessage(request{comment: c, parent: cp})
+	assert.Equal(t, "*from → to*\n\nsome &lt;text&gt; &amp; more\n\n↦ <https://radio-t.com/p/1#remark42__comment-999|original comment>", msg)
+
+	c.Pending, c.ParentID = true, ""
+	msg = sl.buildMessage(request{comment: c})
+	assert.Equal(t, "*from*\n\nsome &lt;text&gt; &amp; more\n\n_waiting for approval_", msg)
+}
+
+// mockSlackServer mocks slack web api, good-token is the only valid token and #remark the only channel.
+// Returns function to get all posted messages
+func mockSlackServer() (*httptest.Server, func() []map[string]interface{}) {
+	var lock sync.Mutex
+	var posted []map[string]interface{}
+
+	router := chi.NewRouter()
+	router.Post("/auth.test", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer good-token" {
+			_, _ = w.Write([]byte(`{"ok": false, "error": "invalid_auth"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"ok": true, "user": "remark42", "team": "remark42 test"}`))
+	})
+	router.Post("/chat.postMessage", func(w http.ResponseWriter, r *http.Request) {
+		msg := map[string]interface{}{}
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil || msg["channel"] != "#remark" {
+			_, _ = w.Write([]byte(`{"ok": false, "error": "channel_not_found"}`))
+			return
+		}
+		lock.Lock()
+		posted = append(posted, msg)
+		lock.Unlock()
+		_, _ = w.Write([]byte(`{"ok": true, "channel": "C123", "ts": "1503435956.000247"}`))
+	})
+	router.Post("/404/auth.test", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(404)
+	})
+
+	return httptest.NewServer(router), func() []map[string]interface{} {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]map[string]interface{}{}, posted...)
+	}
+}
@@ -83,20 +83,12 @@ func (t *Telegram) Send(ctx context.Context, req request) error {
 	client := http.Client{Timeout: telegramTimeOut}
 	log.Printf("[DEBUG] send telegram notification to %s, comment id %s", t.channelName, req.comment.ID)
 
-	from := req.comment.User.Name
-	if req.comment.ParentID != "" {
-		from += " → " + req.parent.User.Name
-	}
-	from = "*" + from + "*"
-	link := fmt.Sprintf("↦ [original comment](%s)", req.comment.Locator.URL+uiNav+req.comment.ID)
 	u := fmt.Sprintf("%s%s/sendMessage?chat_id=@%s&parse_mode=Markdown&disable_web_page_preview=true",
 		t.apiPrefix, t.token, t.channelName)
 
-	msg := fmt.Sprintf("%s\n\n%s\n\n%s", from, req.comment.Orig, link)
-	msg = html.UnescapeString(msg)
 	body := struct {
 		Text string `json:"text"`
-	}{Text: msg}
+	}{Text: t.buildMessage(req)}
 
 	b, err := json.Marshal(body)
 	if err != nil {
@@ -134,6 +126,22 @@ func (t *Telegram) Send(ctx context.Context, req request) error {
 	return nil
 }
 
+// buildMessage makes markdown message text from comment, pending comments marked as waiting for approval
+func (t *Telegram) buildMessage(req request) string {
+	from := req.comment.User.Name
+	if req.comment.ParentID != "" {
+		from += " → " + req.parent.User.Name
+	}
+	from = "*" + from + "*"
+	link := fmt.Sprintf("↦ [original comment](%s)", req.comment.Locator.URL+uiNav+req.comment.ID)
+	if req.comment.Pending {
+		link = "_waiting for approval_"
+	}
+
+	msg := fmt.Sprintf("%s\n\n%s\n\n%s", from, req.comment.Orig, link)
+	return html.UnescapeString(msg)
+}
+
 func (t *Telegram) String() string {
 	return "telegram: " + t.channelName
 }
@@ -55,6 +55,22 @@ func TestTelegram_Send(t *testing.T) {
 	assert.Equal(t, "telegram: remark_test", tb.String())
 }
 
+func TestTelegram_BuildMessage(t *testing.T) {
+	tb := Telegram{}
+	c := store.Comment{ID: "999", Orig: "some text &amp; more", ParentID: "1",
+		Locator: store.Locator{URL: "https://radio-t.com/p/1"}}
+	c.User.Name = "from"
+	cp := store.Comment{Orig: "some parent text"}
+	cp.User.Name = "to"
+
+	msg := tb.buildMessage(request{comment: c, parent: cp})
+	assert.Equal(t, "*from → to*\n\nsome text & more\n\n↦ [original comment](https://radio-t.com/p/1#remark42__comment-999)", msg)
+
+	c.Pending, c.ParentID = true, ""
+	msg = tb.buildMessage(request{comment: c})
+	assert.Equal(t, "*from*\n\nsome text & more\n\n_waiting for approval_", msg)
+}
+
 func mockTelegramServer() *httptest.Server {
 	router := chi.NewRouter()
 	router.Get("/good-token/getMe", func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,255 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+
+	"github.com/umputun/remark/backend/app/store"
+	adminstore "github.com/umputun/remark/backend/app/store/admin"
+)
+
+const webhookKeyPurpose = "webhook"
+
+// Webhook implements notify.Destination for generic http endpoints. Posts versioned json payload of each event
+// to all urls, signed with HMAC-SHA256 in X-Remark42-Signature header. Signing key derived from the site's key,
+// see WebhookKey, so receivers can't sign users' tokens with it
+type Webhook struct {
+	WebhookParams
+	keys   KeyStore
+	client http.Client
+}
+
+// WebhookParams defines webhook urls, delivery and accepted events
+type WebhookParams struct {
+	URLs    []string
+	Events  []Event // accepted events, AllEvents if empty
+	Timeout time.Duration
+}
+
+const (
+	webhookTimeOut = 5 * time.Second
+	webhookVersion = 1
+)
+
+// webhookPayload is the json body posted to webhooks. Version changed on incompatible changes only
+type webhookPayload struct {
+	Version  int             `json:"version"`
+	Event    Event           `json:"event"`
+	SiteID   string          `json:"site"`
+	Delivery string          `json:"delivery,omitempty"` // the same for all attempts of the delivery
+	Time     time.Time       `json:"time"`               // creation of the delivery, not of the attempt
+	Comment  *webhookComment `json:"comment,omitempty"`
+	Parent   *webhookComment `json:"parent,omitempty"`
+	User     *webhookUser    `json:"user,omitempty"`
+}
+
+type webhookComment struct {
+	ID        string      `json:"id"`
+	ParentID  string      `json:"pid,omitempty"`
+	URL       string      `json:"url"`
+	Link      string      `json:"link"`
+	Text      string      `json:"text"`
+	Orig      string      `json:"orig,omitempty"`
+	User      webhookUser `json:"user"`
+	Score     int         `json:"score"`
+	Timestamp time.Time   `json:"time"`
+	Edited    bool        `json:"edited,omitempty"`
+	Deleted   bool        `json:"deleted,omitempty"`
+	Pending   bool        `json:"pending,omitempty"`
+}
+
+type webhookUser struct {
+	ID       string `json:"id"`
+	Name     string `json:"name,omitempty"`
+	Blocked  bool   `json:"blocked,omitempty"`
+	BlockTTL int64  `json:"block_ttl,omitempty"` // seconds, permanent block if 0
+}
+
+// NewWebhook makes webhook notifier. Keys used to sign requests
+func NewWebhook(params WebhookParams, keys KeyStore) (*Webhook, error) {
+	if len(params.URLs) == 0 {
+		return nil, errors.New("no webhook urls")
+	}
+	for _, u := range params.URLs {
+		if pu, err := url.Parse(u); err != nil || (pu.Scheme != "http" && pu.Scheme != "https") || pu.Host == "" {
+			return nil, errors.Errorf("invalid webhook url %q", u)
+		}
+	}
+	for _, e := range params.Events {
+		if !isEvent(e) {
+			return nil, errors.Errorf("unknown webhook event %q", e)
+		}
+	}
+	if params.Timeout == 0 {
+		params.Timeout = webhookTimeOut
+	}
+	log.Printf("[DEBUG] create new webhook notifier for %d urls, events=%v, timeout=%s",
+		len(params.URLs), params.Events, params.Timeout)
+	return &Webhook{WebhookParams: params, keys: keys, client: http.Client{Timeout: params.Timeout}}, nil
+}
+
+// Accepts implements EventsFilter, all of AllEvents accepted if none configured. Digests never accepted by default,
+// they are for subscribers only
+func (w *Webhook) Accepts(event Event) bool {
+	if len(w.Events) == 0 {
+		return isEvent(event)
+	}
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Targets implements notify.Targets, delivery for each url. Target's id is a hash of url,
+// urls may have secrets not for dead-letter list
+func (w *Webhook) Targets(req request) []Target {
+	res := make([]Target, 0, len(w.URLs))
+	for _, u := range w.URLs {
+		res = append(res, Target{ID: webhookTarget(u)})
+	}
+	return res
+}
+
+// Send event to webhook url of request's target or to all urls if no target
+func (w *Webhook) Send(ctx context.Context, req request) error {
+	key, err := w.keys.Key(req.siteID)
+	if err != nil {
+		return errors.Wrapf(err, "can't get key for site %s", req.siteID)
+	}
+	body, err := json.Marshal(w.payload(req))
+	if err != nil {
+		return errors.Wrap(err, "can't marshal webhook payload")
+	}
+	signature := "sha256=" + WebhookSignature(WebhookKey(key), body)
+
+	errs, sent := new(multierror.Error), 0
+	for i, u := range w.URLs {
+		if req.target != "" && req.target != webhookTarget(u) {
+			continue
+		}
+		log.Printf("[DEBUG] send %s webhook #%d of %s", req.event, i, w)
+		errs = multierror.Append(errs, w.post(ctx, u, req, signature, body))
+		sent++
+	}
+	if sent == 0 {
+		return errors.Errorf("no webhook url for target %s", req.target)
+	}
+	return errs.ErrorOrNil()
+}
+
+func (w *Webhook) post(ctx context.Context, u string, r request, signature string, body []byte) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrapf(err, "can't make webhook request to %s", u)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Remark42-Event", string(r.event))
+	if r.delivery != "" {
+		req.Header.Set("X-Remark42-Delivery", r.delivery)
+	}
+	req.Header.Set("X-Remark42-Signature", signature)
+	resp, err := w.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "webhook %s failed", u)
+	}
+	defer func() {
+		if err = resp.Body.Close(); err != nil {
+			log.Printf("[WARN] can't close response body, %s", err)
+		}
+	}()
+	if resp.StatusCode >= 300 {
+		return errors.Errorf("unexpected webhook %s status code %d", u, resp.StatusCode)
+	}
+	return nil
+}
+
+func (w *Webhook) payload(req request) webhookPayload {
+	res := webhookPayload{Version: webhookVersion, Event: req.event, SiteID: req.siteID, Delivery: req.delivery,
+		Time: req.created}
+	if res.Time.IsZero() { // sent directly, not queued
+		res.Time = time.Now()
+	}
+	if req.event == EventBlock {
+		res.User = &webhookUser{ID: req.user.ID, Name: req.user.Name, Blocked: req.user.Blocked,
+			BlockTTL: int64(req.ttl / time.Second)}
+		return res
+	}
+	res.Comment = webhookCommentOf(req.comment)
+	if req.parent.ID != "" {
+		res.Parent = webhookCommentOf(req.parent)
+	}
+	return res
+}
+
+func webhookCommentOf(c store.Comment) *webhookComment {
+	return &webhookComment{
+		ID:        c.ID,
+		ParentID:  c.ParentID,
+		URL:       c.Locator.URL,
+		Link:      c.Locator.URL + uiNav + c.ID,
+		Text:      c.Text,
+		Orig:      c.Orig,
+		User:      webhookUser{ID: c.User.ID, Name: c.User.Name},
+		Score:     c.Score,
+		Timestamp: c.Timestamp,
+		Edited:    c.Edit != nil,
+		Deleted:   c.Deleted,
+		Pending:   c.Pending,
+	}
+}
+
+// String lists hosts of webhooks only, urls may have secrets
+func (w *Webhook) String() string {
+	hosts := make([]string, 0, len(w.URLs))
+	for _, u := range w.URLs {
+		if pu, err := url.Parse(u); err == nil {
+			hosts = append(hosts, pu.Host)
+		}
+	}
+	return fmt.Sprintf("webhook: %s", strings.Join(hosts, ", "))
+}
+
+// webhookTarget makes target's id of webhook url
+func webhookTarget(u string) string {
+	h := sha256.Sum256([]byte(u))
+	return hex.EncodeToString(h[:8])
+}
+
+// WebhookKey makes key signing webhooks of the site from the site's key, hex encoded HMAC-SHA256 of "webhook"
+func WebhookKey(siteKey string) string {
+	return adminstore.DeriveKey(siteKey, webhookKeyPurpose)
+}
+
+// WebhookSignature makes hex encoded HMAC-SHA256 of the body signed with webhook key
+func WebhookSignature(key string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(key))
+	_, _ = h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func isEvent(event Event) bool {
+	for _, e := range AllEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
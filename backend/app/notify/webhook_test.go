@@ -0,0 +1,186 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark/backend/app/store"
+)
+
+func TestWebhook_New(t *testing.T) {
+	_, err := NewWebhook(WebhookParams{}, mockKeyStore{})
+	assert.EqualError(t, err, "no webhook urls")
+	_, err = NewWebhook(WebhookParams{URLs: []string{"ftp://example.com"}}, mockKeyStore{})
+	assert.EqualError(t, err, `invalid webhook url "ftp://example.com"`)
+	_, err = NewWebhook(WebhookParams{URLs: []string{"https://example.com"}, Events: []Event{"bad"}}, mockKeyStore{})
+	assert.EqualError(t, err, `unknown webhook event "bad"`)
+
+	wh, err := NewWebhook(WebhookParams{URLs: []string{"https://example.com/hook?secret=1", "http://127.0.0.1:8080"}},
+		mockKeyStore{})
+	require.NoError(t, err)
+	assert.Equal(t, webhookTimeOut, wh.Timeout)
+	assert.Equal(t, "webhook: example.com, 127.0.0.1:8080", wh.String())
+	for _, e := range AllEvents {
+		assert.True(t, wh.Accepts(e), "all accepted by default")
+	}
+	assert.False(t, wh.Accepts(EventDigest), "digest not accepted by default")
+
+	wh, err = NewWebhook(WebhookParams{URLs: []string{"https://example.com"}, Events: []Event{EventDelete, EventBlock}},
+		mockKeyStore{})
+	require.NoError(t, err)
+	assert.True(t, wh.Accepts(EventDelete))
+	assert.True(t, wh.Accepts(EventBlock))
+	assert.False(t, wh.Accepts(EventCreate))
+}
+
+func TestWebhook_Send(t *testing.T) {
+	var lock sync.Mutex
+	var received []*http.Request
+	var bodies [][]byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		lock.Lock()
+		received = append(received, r)
+		bodies = append(bodies, body)
+		lock.Unlock()
+	}))
+	defer ts.Close()
+
+	wh, err := NewWebhook(WebhookParams{URLs: []string{ts.URL + "/1", ts.URL + "/2"}}, mockKeyStore{"radio-t": "secret"})
+	require.NoError(t, err)
+
+	c := store.Comment{ID: "999", ParentID: "1", Text: "<p>some text</p>", Orig: "some text", Score: 2,
+		Locator: store.Locator{SiteID: "radio-t", URL: "http://example.org"}, User: store.User{ID: "user1", Name: "from"}}
+	cp := store.Comment{ID: "1", Text: "parent", User: store.User{ID: "user2", Name: "to"}}
+	require.NoError(t, wh.Send(context.Background(), request{event: EventVote, siteID: "radio-t", comment: c, parent: cp}))
+
+	lock.Lock()
+	require.Equal(t, 2, len(received))
+	assert.Equal(t, "/1", received[0].URL.Path)
+	assert.Equal(t, "/2", received[1].URL.Path)
+	assert.Equal(t, "comment.vote", received[0].Header.Get("X-Remark42-Event"))
+	assert.Equal(t, "application/json", received[0].Header.Get("Content-Type"))
+	assert.Equal(t, "sha256="+WebhookSignature(WebhookKey("secret"), bodies[0]), received[0].Header.Get("X-Remark42-Signature"))
+	assert.NotEqual(t, "sha256="+WebhookSignature("secret", bodies[0]), received[0].Header.Get("X-Remark42-Signature"),
+		"not signed with site's key")
+	payload := webhookPayload{}
+	require.NoError(t, json.Unmarshal(bodies[0], &payload))
+	lock.Unlock()
+
+	assert.Equal(t, 1, payload.Version)
+	assert.Equal(t, EventVote, payload.Event)
+	assert.Equal(t, "radio-t", payload.SiteID)
+	require.NotNil(t, payload.Comment)
+	assert.Equal(t, "999", payload.Comment.ID)
+	assert.Equal(t, "http://example.org#remark42__comment-999", payload.Comment.Link)
+	assert.Equal(t, 2, payload.Comment.Score)
+	assert.Equal(t, webhookUser{ID: "user1", Name: "from"}, payload.Comment.User)
+	require.NotNil(t, payload.Parent)
+	assert.Equal(t, "1", payload.Parent.ID)
+	assert.Nil(t, payload.User)
+
+	// block event
+	err = wh.Send(context.Background(), request{event: EventBlock, siteID: "radio-t",
+		user: store.User{ID: "user1", Name: "from", Blocked: true}, ttl: time.Hour})
+	require.NoError(t, err)
+	lock.Lock()
+	require.Equal(t, 4, len(received))
+	payload = webhookPayload{}
+	require.NoError(t, json.Unmarshal(bodies[3], &payload))
+	lock.Unlock()
+	assert.Equal(t, EventBlock, payload.Event)
+	assert.Nil(t, payload.Comment)
+	assert.Equal(t, &webhookUser{ID: "user1", Name: "from", Blocked: true, BlockTTL: 3600}, payload.User)
+}
+
+func TestWebhook_SendTarget(t *testing.T) {
+	var lock sync.Mutex
+	attempts := map[string]int{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		attempts[r.URL.Path]++
+		lock.Unlock()
+		if r.URL.Path == "/bad" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer ts.Close()
+
+	wh, err := NewWebhook(WebhookParams{URLs: []string{ts.URL + "/good", ts.URL + "/bad"}}, mockKeyStore{})
+	require.NoError(t, err)
+	c := store.Comment{ID: "999", Locator: store.Locator{SiteID: "radio-t"}}
+	targets := wh.Targets(request{event: EventCreate, siteID: "radio-t", comment: c})
+	require.Equal(t, 2, len(targets), "target for each url")
+	assert.Equal(t, Target{ID: webhookTarget(ts.URL + "/good")}, targets[0])
+	assert.NotContains(t, targets[0].ID, "good", "url not exposed")
+
+	require.NoError(t, wh.Send(context.Background(), request{event: EventCreate, siteID: "radio-t", comment: c,
+		target: targets[0].ID}))
+	err = wh.Send(context.Background(), request{event: EventCreate, siteID: "radio-t", comment: c, target: targets[1].ID})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "unexpected webhook "+ts.URL+"/bad status code 502")
+	err = wh.Send(context.Background(), request{event: EventCreate, siteID: "radio-t", comment: c, target: "removed"})
+	assert.EqualError(t, err, "no webhook url for target removed")
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, map[string]int{"/good": 1, "/bad": 1}, attempts, "single attempt to the target's url only")
+}
+
+func TestWebhook_Retry(t *testing.T) {
+	var lock sync.Mutex
+	var deliveries []string
+	var payloads []webhookPayload
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload := webhookPayload{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		lock.Lock()
+		defer lock.Unlock()
+		deliveries = append(deliveries, r.Header.Get("X-Remark42-Delivery"))
+		payloads = append(payloads, payload)
+		if len(payloads) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer ts.Close()
+
+	wh, err := NewWebhook(WebhookParams{URLs: []string{ts.URL}}, mockKeyStore{"radio-t": "secret"})
+	require.NoError(t, err)
+	s := NewService(nil, ServiceParams{Attempts: 2, RetryDelay: 50 * time.Millisecond}, wh)
+	s.Submit(store.Comment{ID: "999", Locator: store.Locator{SiteID: "radio-t"}})
+	time.Sleep(300 * time.Millisecond)
+	s.Close()
+
+	lock.Lock()
+	defer lock.Unlock()
+	require.Equal(t, 2, len(payloads), "failed attempt retried")
+	assert.NotEmpty(t, deliveries[0])
+	assert.Equal(t, deliveries[0], deliveries[1], "the same delivery id for all attempts")
+	assert.Equal(t, deliveries[0], payloads[0].Delivery)
+	assert.Equal(t, payloads[0].Delivery, payloads[1].Delivery)
+	assert.True(t, payloads[0].Time.Equal(payloads[1].Time), "time of delivery creation")
+}
+
+func TestWebhook_NoDigest(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("digest posted to webhook")
+	}))
+	defer ts.Close()
+
+	wh, err := NewWebhook(WebhookParams{URLs: []string{ts.URL}}, mockKeyStore{"radio-t": "secret"})
+	require.NoError(t, err)
+	s := NewService(nil, ServiceParams{}, wh)
+	s.SubmitDigest("radio-t", store.User{ID: "user1"}, "user1@example.com", []store.Comment{{ID: "999"}})
+	time.Sleep(100 * time.Millisecond)
+	s.Close()
+}
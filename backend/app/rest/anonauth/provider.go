@@ -0,0 +1,147 @@
+// Package anonauth implements anonymous auth provider, logs user in with the chosen name only. User ID made from
+// hmac of name and ip, prefixed by store.AnonymousPrefix, so the same user from the same ip keeps own comments.
+// Names of site's admins and verified users rejected, logins limited per ip.
+package anonauth
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/didip/tollbooth"
+	"github.com/didip/tollbooth/limiter"
+	"github.com/go-chi/render"
+	"github.com/go-pkgz/auth/token"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/umputun/remark/backend/app/rest"
+	"github.com/umputun/remark/backend/app/store"
+)
+
+// Provider implements auth provider.Provider for anonymous login
+type Provider struct {
+	Params
+	ipLimiter *limiter.Limiter
+}
+
+// Params to make Provider
+type Params struct {
+	URL          string       // root url of remark42, the only allowed redirect after login
+	Issuer       string       // iss claim of user's token
+	Secret       string       // hmac key for user IDs, keeps ips out of them
+	TokenService TokenService // sets tokens, shared with other providers
+	NameChecker  NameChecker  // rejects names reserved on the site
+	IPLimit      int          // max logins from one ip per hour, default 10
+}
+
+// TokenService defines the minimal interface to set and reset tokens
+type TokenService interface {
+	Set(w http.ResponseWriter, claims token.Claims) error
+	Reset(w http.ResponseWriter)
+}
+
+// NameChecker defines the minimal interface to check if name reserved by admin or verified user of the site
+type NameChecker interface {
+	IsReservedName(siteID, name string) (bool, error)
+}
+
+const (
+	providerName   = "anonymous"
+	defaultIPLimit = 10
+)
+
+// New makes anonymous auth provider with rate limiter for ips
+func New(params Params) *Provider {
+	res := Provider{Params: params}
+	if res.IPLimit == 0 {
+		res.IPLimit = defaultIPLimit
+	}
+	res.ipLimiter = tollbooth.NewLimiter(float64(res.IPLimit)/time.Hour.Seconds(),
+		&limiter.ExpirableOptions{DefaultExpirationTTL: time.Hour}).SetBurst(res.IPLimit)
+	log.Printf("[DEBUG] create anonymous auth provider, limit %d per ip", res.IPLimit)
+	return &res
+}
+
+// Name of the provider
+func (p *Provider) Name() string { return providerName }
+
+// LoginHandler sets token for the user with chosen name and redirects back to from url, remark42's own only
+// GET /login?user=name&site=site-id&from=url&session=[0|1]
+func (p *Provider) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	name, err := rest.NormalizeUserName(r.URL.Query().Get("user"))
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "invalid user name")
+		return
+	}
+	siteID := r.URL.Query().Get("site")
+	if siteID == "" {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, errors.New("empty site"), "site required for anonymous login")
+		return
+	}
+
+	from := r.URL.Query().Get("from")
+	if from != "" && !rest.AllowedRedirect(from, p.URL) {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, errors.Errorf("redirect to %q not allowed", from),
+			"invalid from url")
+		return
+	}
+
+	reserved, err := p.NameChecker.IsReservedName(siteID, name)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "can't check user name")
+		return
+	}
+	if reserved {
+		rest.SendErrorJSON(w, r, http.StatusForbidden, errors.Errorf("name %q reserved", name), "user name not allowed")
+		return
+	}
+
+	// counted after validation, rejected logins don't use up the limit
+	if p.ipLimiter.LimitReached(remoteIP(r)) {
+		rest.SendErrorJSON(w, r, http.StatusTooManyRequests, errors.New("too many requests"), "login limit reached for ip")
+		return
+	}
+
+	claims := token.Claims{
+		User: &token.User{
+			ID:   store.AnonymousPrefix + store.HashValue(remoteIP(r)+"!!"+name, p.Secret),
+			Name: name,
+		},
+		StandardClaims: jwt.StandardClaims{
+			Issuer:   p.Issuer,
+			Id:       uuid.New().String(),
+			Audience: siteID,
+		},
+		SessionOnly: r.URL.Query().Get("session") != "" && r.URL.Query().Get("session") != "0",
+	}
+	if err = p.TokenService.Set(w, claims); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "failed to set token")
+		return
+	}
+	log.Printf("[DEBUG] anonymous user %s logged in, site %s", claims.User.ID, siteID)
+
+	if from != "" {
+		http.Redirect(w, r, from, http.StatusTemporaryRedirect)
+		return
+	}
+	render.JSON(w, r, claims.User)
+}
+
+// AuthHandler doesn't do anything for anonymous login as it has no callbacks
+func (p *Provider) AuthHandler(w http.ResponseWriter, r *http.Request) {}
+
+// LogoutHandler removes user's token
+// GET /logout
+func (p *Provider) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	p.TokenService.Reset(w)
+}
+
+func remoteIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
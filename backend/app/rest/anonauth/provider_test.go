@@ -0,0 +1,152 @@
+package anonauth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-pkgz/auth/token"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark/backend/app/store"
+)
+
+func TestProvider_Login(t *testing.T) {
+	p, tokenService := prepProvider()
+
+	resp := login(p, "/login?user=%20anon%20user&site=remark&from=http://remark.example.com/web/iframe.html",
+		"127.0.0.1:1234")
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.Code)
+	assert.Equal(t, "http://remark.example.com/web/iframe.html", resp.Header().Get("Location"))
+	claims := userClaims(t, tokenService, resp)
+	assert.True(t, strings.HasPrefix(claims.User.ID, "anonymous_"), claims.User.ID)
+	assert.Equal(t, "anonymous_"+store.HashValue("127.0.0.1!!anon user", "secret"), claims.User.ID)
+	assert.Equal(t, "anon user", claims.User.Name)
+	assert.Equal(t, "remark", claims.Audience)
+	assert.Equal(t, "remark42", claims.Issuer)
+	assert.NotEmpty(t, claims.Id, "xsrf id")
+	assert.False(t, claims.SessionOnly)
+	user1 := claims.User.ID
+
+	resp = login(p, "/login?user=anon+user&site=remark&session=1", "127.0.0.1:5678")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	claims = userClaims(t, tokenService, resp)
+	assert.Equal(t, user1, claims.User.ID, "same name from the same ip")
+	assert.True(t, claims.SessionOnly)
+	u := token.User{}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &u))
+	assert.Equal(t, *claims.User, u)
+
+	resp = login(p, "/login?user=anon+user&site=remark", "127.0.0.2:1234")
+	assert.NotEqual(t, user1, userClaims(t, tokenService, resp).User.ID, "other ip")
+	resp = login(p, "/login?user=anon+user2&site=remark", "127.0.0.1:1234")
+	assert.NotEqual(t, user1, userClaims(t, tokenService, resp).User.ID, "other name")
+}
+
+func TestProvider_LoginRejected(t *testing.T) {
+	p, _ := prepProvider()
+
+	tbl := []struct {
+		query string
+		code  int
+		err   string
+	}{
+		{"site=remark", http.StatusBadRequest, "empty user name"},
+		{"user=dev%0Auser&site=remark", http.StatusBadRequest, "control characters in user name"},
+		{"user=dev", http.StatusBadRequest, "site required for anonymous login"},
+		{"user=Admin+Name&site=remark", http.StatusForbidden, `name \"Admin Name\" reserved`},
+		{"user=dev&site=bad", http.StatusInternalServerError, "can't check user name"},
+		{"user=dev&site=remark&from=http://evil.example.com/post", http.StatusBadRequest, "invalid from url"},
+		{"user=dev&site=remark&from=//evil.example.com/post", http.StatusBadRequest, "invalid from url"},
+	}
+	for i, tt := range tbl {
+		resp := login(p, "/login?"+tt.query, "127.0.0.1:1234")
+		assert.Equal(t, tt.code, resp.Code, "case #%d", i)
+		assert.Contains(t, resp.Body.String(), tt.err, "case #%d", i)
+		assert.Empty(t, resp.Result().Cookies(), "case #%d", i)
+	}
+}
+
+func TestProvider_LoginLimit(t *testing.T) {
+	p, _ := prepProvider()
+	p.ipLimiter.SetBurst(2)
+
+	for i, name := range []string{"user1", "user2"} {
+		resp := login(p, "/login?site=remark&user="+name, "127.0.0.1:1234")
+		assert.Equal(t, http.StatusOK, resp.Code, "login #%d", i)
+	}
+	resp := login(p, "/login?site=remark&user=Admin+Name", "127.0.0.1:5678")
+	assert.Equal(t, http.StatusForbidden, resp.Code, "rejected before the limit checked")
+	resp = login(p, "/login?site=remark&user=user3", "127.0.0.1:5678")
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code, "new name from the same ip")
+	assert.Contains(t, resp.Body.String(), "login limit reached for ip")
+	assert.Empty(t, resp.Result().Cookies())
+
+	resp = login(p, "/login?site=remark&user=user3", "127.0.0.2:1234")
+	assert.Equal(t, http.StatusOK, resp.Code, "other ip")
+}
+
+func TestProvider_Logout(t *testing.T) {
+	p, _ := prepProvider()
+	assert.Equal(t, "anonymous", p.Name())
+
+	rr := httptest.NewRecorder()
+	p.AuthHandler(rr, httptest.NewRequest("GET", "/callback", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Result().Cookies())
+
+	rr = httptest.NewRecorder()
+	p.LogoutHandler(rr, httptest.NewRequest("GET", "/logout", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, 2, len(rr.Result().Cookies()))
+	assert.Equal(t, "JWT", rr.Result().Cookies()[0].Name)
+	assert.Equal(t, -1, rr.Result().Cookies()[0].MaxAge)
+}
+
+func prepProvider() (*Provider, *token.Service) {
+	tokenService := token.NewService(token.Opts{
+		SecretReader:   token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+		TokenDuration:  time.Minute,
+		CookieDuration: time.Hour,
+	})
+	p := New(Params{URL: "http://remark.example.com", Issuer: "remark42", Secret: "secret", TokenService: tokenService,
+		NameChecker: mockNameChecker{}})
+	return p, tokenService
+}
+
+func login(p *Provider, query, remoteAddr string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", query, nil)
+	req.RemoteAddr = remoteAddr
+	p.LoginHandler(rr, req)
+	return rr
+}
+
+// userClaims parses user's token set in JWT cookie
+func userClaims(t *testing.T, tokenService *token.Service, rr *httptest.ResponseRecorder) token.Claims {
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == "JWT" {
+			claims, err := tokenService.Parse(c.Value)
+			require.NoError(t, err)
+			require.NotNil(t, claims.User)
+			return claims
+		}
+	}
+	t.Fatal("no JWT cookie")
+	return token.Claims{}
+}
+
+// mockNameChecker reserves "admin name" on any site and fails for site "bad"
+type mockNameChecker struct{}
+
+func (mockNameChecker) IsReservedName(siteID, name string) (bool, error) {
+	if siteID == "bad" {
+		return false, errors.New("store failed")
+	}
+	return strings.EqualFold(name, "admin name"), nil
+}
@@ -1,10 +1,14 @@
 package api
 
 import (
+	"context"
 	"errors"
+	"io"
 	"log"
 	"net/http"
 	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi"
@@ -14,38 +18,217 @@ import (
 	R "github.com/go-pkgz/rest"
 	"github.com/go-pkgz/rest/cache"
 
+	"github.com/umputun/remark/backend/app/notify"
 	"github.com/umputun/remark/backend/app/rest"
 	"github.com/umputun/remark/backend/app/store"
+	adminstore "github.com/umputun/remark/backend/app/store/admin"
 	"github.com/umputun/remark/backend/app/store/service"
 )
 
-// admin provides router for all requests available for admin users only
+// admin provides router for all requests available for admin and moderator users only
 type admin struct {
 	dataService   *service.DataStore
 	cache         cache.LoadingCache
 	authenticator *auth.Service
 	readOnlyAge   int
 	migrator      *Migrator
+	notifyService *notify.Service
 }
 
+// superUserID is the id of admin user authorized with basic auth and admin password
+const superUserID = "admin"
+
+// defaultKeyGrace is the time previous key of the site stays valid after rotation, if not set in request
+const defaultKeyGrace = 24 * time.Hour
+
 func (a *admin) routes(middlewares ...func(http.Handler) http.Handler) chi.Router {
 	router := chi.NewRouter()
 	router.Use(middlewares...)
+	router.Use(a.moderatorOnly(router))
+
+	// moderation, allowed to site's moderators and admins
 	router.Delete("/comment/{id}", a.deleteCommentCtrl)
+	router.Put("/undelete/{id}", a.undeleteCommentCtrl)
+	router.Get("/pending", a.pendingCommentsCtrl)
+	router.Put("/pending/{id}", a.approveCommentCtrl)
+	router.Delete("/pending/{id}", a.rejectCommentCtrl)
+	router.Get("/reports", a.reportedCommentsCtrl)
+	router.Delete("/reports/{id}", a.dismissReportsCtrl)
 	router.Put("/user/{userid}", a.setBlockCtrl)
-	router.Delete("/user/{userid}", a.deleteUserCtrl)
 	router.Get("/user/{userid}", a.getUserInfoCtrl)
-	router.Get("/deleteme", a.deleteMeRequestCtrl)
-	router.Put("/verify/{userid}", a.setVerifyCtrl)
+	router.Put("/shadow/{userid}", a.setShadowBanCtrl)
+	router.Get("/shadow", a.shadowBannedCtrl)
 	router.Put("/pin/{id}", a.setPinCtrl)
 	router.Get("/blocked", a.blockedUsersCtrl)
 	router.Put("/readonly", a.setReadOnlyCtrl)
-
-	a.migrator.withRoutes(router) // set migrator routes, i.e. /export and /import
+	router.Get("/search", a.searchCommentsCtrl)
+	router.Get("/revisions/{id}", a.revisionsCtrl)
+	router.Get("/revisions/{id}/diff", a.diffRevisionsCtrl)
+	router.Put("/revisions/{id}", a.revertCommentCtrl)
+
+	// admins only
+	router.Group(func(radmin chi.Router) {
+		radmin.Use(a.adminOnly)
+		radmin.Delete("/user/{userid}", a.deleteUserCtrl)
+		radmin.Get("/deleteme", a.deleteMeRequestCtrl)
+		radmin.Put("/verify/{userid}", a.setVerifyCtrl)
+		radmin.Get("/notify/failed", a.failedDeliveriesCtrl)
+		radmin.Put("/notify/failed/{id}", a.replayDeliveryCtrl)
+		a.migrator.withRoutes(radmin) // set migrator routes, i.e. /export and /import
+
+		// admins info of sites, superuser only
+		radmin.With(a.superUserOnly).Get("/sites", a.listSitesCtrl)
+		radmin.With(a.superUserOnly).Get("/sites/{site}", a.getSiteCtrl)
+		radmin.With(a.superUserOnly).Put("/sites/{site}", a.setSiteCtrl)
+		radmin.With(a.superUserOnly).Post("/sites/{site}/rotate", a.rotateKeyCtrl)
+		radmin.With(a.superUserOnly).Get("/sites/{site}/tokens", a.listTokensCtrl)
+		radmin.With(a.superUserOnly).Post("/sites/{site}/tokens", a.createTokenCtrl)
+		radmin.With(a.superUserOnly).Delete("/sites/{site}/tokens/{id}", a.deleteTokenCtrl)
+
+		// sites registry, superuser only
+		radmin.With(a.superUserOnly).Get("/registry", a.listRegistryCtrl)
+		radmin.With(a.superUserOnly).Post("/registry", a.addSiteCtrl)
+		radmin.With(a.superUserOnly).Put("/registry/{site}", a.changeSiteCtrl)
+		radmin.With(a.superUserOnly).Delete("/registry/{site}", a.removeSiteCtrl)
+		radmin.With(a.superUserOnly).Delete("/sites/{site}", a.deleteSiteCtrl)
+	})
 
 	return router
 }
 
+// apiTokenKey is the context key of api token the request authorized with
+type apiTokenKey struct{}
+
+// apiTokenPrefix starts Authorization header with admin api token
+const apiTokenPrefix = "Token "
+
+// apiTokenAuth middleware authorizes requests with admin api token passed as "Authorization: Token {token}".
+// User of such request has id "token_{id}" and moderator role, the token itself put to the request context.
+// Requests without api token passed to auth middleware
+func (a *admin) apiTokenAuth(auth func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		authNext := auth(next)
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			authHeader := r.Header.Get("Authorization")
+			if !strings.HasPrefix(authHeader, apiTokenPrefix) {
+				authNext.ServeHTTP(w, r)
+				return
+			}
+			tokens, ok := a.dataService.AdminStore.(adminstore.Tokens)
+			if !ok {
+				rest.SendErrorJSON(w, r, http.StatusUnauthorized, errors.New("no api tokens in admin store"),
+					"admin store doesn't support api tokens")
+				return
+			}
+			apiToken, err := tokens.CheckToken(strings.TrimPrefix(authHeader, apiTokenPrefix))
+			if err != nil {
+				rest.SendErrorJSON(w, r, http.StatusUnauthorized, err, "bad api token")
+				return
+			}
+			r = rest.SetUserInfo(r, store.User{ID: "token_" + apiToken.ID, Name: apiToken.Name})
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiTokenKey{}, apiToken)))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// tokenScopes has api token scope required for each moderation route, as "METHOD pattern". Routes not listed,
+// like user's info with ip or comment's revisions, and all admin's routes are not allowed for api tokens
+var tokenScopes = map[string]string{
+	"DELETE /comment/{id}": adminstore.ScopeDelete,
+	"PUT /undelete/{id}":   adminstore.ScopeModerate,
+	"GET /pending":         adminstore.ScopeRead,
+	"PUT /pending/{id}":    adminstore.ScopeModerate,
+	"DELETE /pending/{id}": adminstore.ScopeDelete,
+	"GET /reports":         adminstore.ScopeRead,
+	"DELETE /reports/{id}": adminstore.ScopeModerate,
+	"PUT /user/{userid}":   adminstore.ScopeModerate,
+	"PUT /shadow/{userid}": adminstore.ScopeModerate,
+	"GET /shadow":          adminstore.ScopeRead,
+	"PUT /pin/{id}":        adminstore.ScopeModerate,
+	"GET /blocked":         adminstore.ScopeRead,
+	"PUT /readonly":        adminstore.ScopeModerate,
+	"GET /search":          adminstore.ScopeRead,
+	"PUT /revisions/{id}":  adminstore.ScopeModerate,
+}
+
+// moderatorOnly middleware allows access for admins and moderators of the site from request.
+// Requests with api token allowed for the token's site and routes in token's scopes only
+func (a *admin) moderatorOnly(routes chi.Routes) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if apiToken, ok := r.Context().Value(apiTokenKey{}).(adminstore.APIToken); ok {
+				scope := routeScope(routes, r)
+				if r.URL.Query().Get("site") != apiToken.SiteID || scope == "" || !apiToken.HasScope(scope) {
+					rest.SendErrorJSON(w, r, http.StatusForbidden, errors.New("access denied"), "not allowed for api token")
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			user, err := rest.GetUserInfo(r)
+			if err != nil {
+				rest.SendErrorJSON(w, r, http.StatusUnauthorized, err, "can't get user info")
+				return
+			}
+			if !user.Admin && !a.dataService.IsModerator(r.URL.Query().Get("site"), user.ID) {
+				rest.SendErrorJSON(w, r, http.StatusForbidden, errors.New("access denied"), "moderator role required")
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// routeScope returns api token scope required for the route of request, empty if not allowed for api tokens
+func routeScope(routes chi.Routes, r *http.Request) string {
+	path := r.URL.Path
+	if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePath != "" {
+		path = rctx.RoutePath // path within mounted router
+	}
+	rctx := chi.NewRouteContext()
+	if !routes.Match(rctx, r.Method, path) {
+		return ""
+	}
+	return tokenScopes[r.Method+" "+rctx.RoutePattern()]
+}
+
+// superUserOnly middleware allows access for admin authorized with admin password only, site's admins rejected
+func (a *admin) superUserOnly(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		user, err := rest.GetUserInfo(r)
+		if err != nil {
+			rest.SendErrorJSON(w, r, http.StatusUnauthorized, err, "can't get user info")
+			return
+		}
+		if !user.Admin || user.ID != superUserID {
+			rest.SendErrorJSON(w, r, http.StatusForbidden, errors.New("access denied"), "superuser required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// adminOnly middleware allows access for admins only, moderators rejected
+func (a *admin) adminOnly(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		user, err := rest.GetUserInfo(r)
+		if err != nil {
+			rest.SendErrorJSON(w, r, http.StatusUnauthorized, err, "can't get user info")
+			return
+		}
+		if !user.Admin {
+			rest.SendErrorJSON(w, r, http.StatusForbidden, errors.New("access denied"), "admin role required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
 // DELETE /comment/{id}?site=siteID&url=post-url - removes comment
 func (a *admin) deleteCommentCtrl(w http.ResponseWriter, r *http.Request) {
 
@@ -59,10 +242,103 @@ func (a *admin) deleteCommentCtrl(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	a.cache.Flush(cache.Flusher(locator.SiteID).Scopes(locator.URL, lastCommentsScope))
+	if comment, e := a.dataService.Get(locator, id); e == nil {
+		a.notifyService.SubmitEvent(notify.EventDelete, comment)
+	}
 	render.Status(r, http.StatusOK)
 	render.JSON(w, r, R.JSON{"id": id, "locator": locator})
 }
 
+// PUT /undelete/{id}?site=siteID&url=post-url - restores soft-deleted comment
+func (a *admin) undeleteCommentCtrl(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	locator := store.Locator{SiteID: r.URL.Query().Get("site"), URL: r.URL.Query().Get("url")}
+	log.Printf("[INFO] restore comment %s", id)
+
+	comment, err := a.dataService.RestoreComment(locator, id)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't restore comment")
+		return
+	}
+	a.cache.Flush(cache.Flusher(locator.SiteID).Scopes(locator.URL, lastCommentsScope, comment.User.ID))
+	render.JSON(w, r, R.JSON{"id": id, "locator": locator})
+}
+
+// GET /pending?site=siteID - list of comments waiting for approval, sorted by time
+func (a *admin) pendingCommentsCtrl(w http.ResponseWriter, r *http.Request) {
+	siteID := r.URL.Query().Get("site")
+	comments, err := a.dataService.Pending(siteID)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't get pending comments")
+		return
+	}
+	render.JSON(w, r, comments)
+}
+
+// PUT /pending/{id}?site=siteID&url=post-url - approves pending comment
+func (a *admin) approveCommentCtrl(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	locator := store.Locator{SiteID: r.URL.Query().Get("site"), URL: r.URL.Query().Get("url")}
+	log.Printf("[INFO] approve comment %s", id)
+
+	comment, err := a.dataService.Get(locator, id)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't approve comment")
+		return
+	}
+	reported := len(comment.Reports) > 0 // held by reports, notified when created
+
+	if comment, err = a.dataService.ApproveComment(locator, id); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't approve comment")
+		return
+	}
+	if !reported {
+		a.notifyService.SubmitEvent(notify.EventApprove, comment)
+	}
+	a.cache.Flush(cache.Flusher(locator.SiteID).Scopes(locator.URL, lastCommentsScope, comment.User.ID, locator.SiteID))
+	render.JSON(w, r, R.JSON{"id": id, "locator": locator})
+}
+
+// DELETE /pending/{id}?site=siteID&url=post-url - rejects pending comment
+func (a *admin) rejectCommentCtrl(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	locator := store.Locator{SiteID: r.URL.Query().Get("site"), URL: r.URL.Query().Get("url")}
+	log.Printf("[INFO] reject comment %s", id)
+
+	if err := a.dataService.RejectComment(locator, id); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't reject comment")
+		return
+	}
+	a.cache.Flush(cache.Flusher(locator.SiteID).Scopes(locator.URL))
+	render.JSON(w, r, R.JSON{"id": id, "locator": locator})
+}
+
+// GET /reports?site=siteID - list of reported comments, the most reported first
+func (a *admin) reportedCommentsCtrl(w http.ResponseWriter, r *http.Request) {
+	siteID := r.URL.Query().Get("site")
+	comments, err := a.dataService.Reported(siteID)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't get reported comments")
+		return
+	}
+	render.JSON(w, r, comments)
+}
+
+// DELETE /reports/{id}?site=siteID&url=post-url - dismisses reports, publishes comment hidden by reports
+func (a *admin) dismissReportsCtrl(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	locator := store.Locator{SiteID: r.URL.Query().Get("site"), URL: r.URL.Query().Get("url")}
+	log.Printf("[INFO] dismiss reports for comment %s", id)
+
+	comment, err := a.dataService.DismissReports(locator, id)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't dismiss reports")
+		return
+	}
+	a.cache.Flush(cache.Flusher(locator.SiteID).Scopes(locator.URL, lastCommentsScope, comment.User.ID, locator.SiteID))
+	render.JSON(w, r, R.JSON{"id": id, "locator": locator})
+}
+
 // DELETE /user/{userid}?site=side-id - delete all user comments for requested userid
 func (a *admin) deleteUserCtrl(w http.ResponseWriter, r *http.Request) {
 
@@ -151,6 +427,7 @@ func (a *admin) setBlockCtrl(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	a.cache.Flush(cache.Flusher(siteID).Scopes(userID, siteID, lastCommentsScope))
+	a.notifyService.SubmitBlock(siteID, store.User{ID: userID, Blocked: blockStatus}, ttl)
 	render.JSON(w, r, R.JSON{"user_id": userID, "site_id": siteID, "block": blockStatus})
 }
 
@@ -165,6 +442,89 @@ func (a *admin) blockedUsersCtrl(w http.ResponseWriter, r *http.Request) {
 	render.JSON(w, r, users)
 }
 
+// GET /search?site=siteID&q=query&user=userID&url=post-url&from=time&to=time&limit=N&skip=N - search comments
+func (a *admin) searchCommentsCtrl(w http.ResponseWriter, r *http.Request) {
+	req, err := searchRequest(r)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "bad search request")
+		return
+	}
+	comments, err := a.dataService.Search(req)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't search comments")
+		return
+	}
+	render.JSON(w, r, comments)
+}
+
+// GET /revisions/{id}?site=siteID&url=post-url - list all versions of the comment, the last one is the current
+func (a *admin) revisionsCtrl(w http.ResponseWriter, r *http.Request) {
+	commentID := chi.URLParam(r, "id")
+	locator := store.Locator{SiteID: r.URL.Query().Get("site"), URL: r.URL.Query().Get("url")}
+
+	revs, err := a.dataService.Revisions(locator, commentID)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't get revisions")
+		return
+	}
+	render.JSON(w, r, R.JSON{"id": commentID, "locator": locator, "revisions": revs})
+}
+
+// GET /revisions/{id}/diff?site=siteID&url=post-url&from=0&to=1 - unified diff between two versions of the comment.
+// to is optional and defaults to the current version
+func (a *admin) diffRevisionsCtrl(w http.ResponseWriter, r *http.Request) {
+	commentID := chi.URLParam(r, "id")
+	locator := store.Locator{SiteID: r.URL.Query().Get("site"), URL: r.URL.Query().Get("url")}
+
+	revs, err := a.dataService.Revisions(locator, commentID)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't get revisions")
+		return
+	}
+	from, to := 0, len(revs)-1
+	if v := r.URL.Query().Get("from"); v != "" {
+		if from, err = strconv.Atoi(v); err != nil {
+			rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "bad from revision")
+			return
+		}
+	}
+	if v := r.URL.Query().Get("to"); v != "" {
+		if to, err = strconv.Atoi(v); err != nil {
+			rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "bad to revision")
+			return
+		}
+	}
+
+	diff, err := a.dataService.DiffRevisions(locator, commentID, from, to)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't diff revisions")
+		return
+	}
+	render.JSON(w, r, R.JSON{"id": commentID, "from": from, "to": to, "diff": diff})
+}
+
+// PUT /revisions/{id}?site=siteID&url=post-url&rev=N - roll comment back to revision N
+func (a *admin) revertCommentCtrl(w http.ResponseWriter, r *http.Request) {
+	commentID := chi.URLParam(r, "id")
+	locator := store.Locator{SiteID: r.URL.Query().Get("site"), URL: r.URL.Query().Get("url")}
+
+	rev, err := strconv.Atoi(r.URL.Query().Get("rev"))
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "bad revision")
+		return
+	}
+
+	comment, err := a.dataService.RevertComment(locator, commentID, rev)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't revert comment")
+		return
+	}
+	log.Printf("[INFO] comment %s reverted to revision %d", commentID, rev)
+	a.cache.Flush(cache.Flusher(locator.SiteID).Scopes(locator.URL, lastCommentsScope, comment.User.ID))
+	comment.Revisions = nil
+	render.JSON(w, r, comment)
+}
+
 // PUT /readonly?site=siteID&url=post-url&ro=1 - set or reset read-only status for the post
 func (a *admin) setReadOnlyCtrl(w http.ResponseWriter, r *http.Request) {
 	locator := store.Locator{SiteID: r.URL.Query().Get("site"), URL: r.URL.Query().Get("url")}
@@ -205,6 +565,370 @@ func (a *admin) setVerifyCtrl(w http.ResponseWriter, r *http.Request) {
 	render.JSON(w, r, R.JSON{"user": userID, "verified": verifyStatus})
 }
 
+// PUT /shadow/{userid}?site=siteID&shadow=1 - set or reset shadow-ban status for the user
+func (a *admin) setShadowBanCtrl(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userid")
+	siteID := r.URL.Query().Get("site")
+	banStatus := r.URL.Query().Get("shadow") == "1"
+
+	if err := a.dataService.SetShadowBan(siteID, userID, banStatus); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't set shadow-ban status")
+		return
+	}
+	a.cache.Flush(cache.Flusher(siteID).Scopes(siteID, userID))
+	render.JSON(w, r, R.JSON{"user": userID, "shadow": banStatus})
+}
+
+// GET /shadow?site=siteID - list of shadow-banned user ids
+func (a *admin) shadowBannedCtrl(w http.ResponseWriter, r *http.Request) {
+	siteID := r.URL.Query().Get("site")
+	ids, err := a.dataService.ShadowBanned(siteID)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't get shadow-banned users")
+		return
+	}
+	if ids == nil {
+		ids = []string{}
+	}
+	render.JSON(w, r, ids)
+}
+
+// GET /notify/failed?site=siteID - list of notifications failed all attempts, i.e. dead-letter list
+func (a *admin) failedDeliveriesCtrl(w http.ResponseWriter, r *http.Request) {
+	deliveries, err := a.notifyService.Failed(r.URL.Query().Get("site"))
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "can't get failed notifications")
+		return
+	}
+	render.JSON(w, r, deliveries)
+}
+
+// PUT /notify/failed/{id}?site=siteID - replay failed notification, all attempts reset
+func (a *admin) replayDeliveryCtrl(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	siteID := r.URL.Query().Get("site")
+	if err := a.notifyService.Replay(siteID, id); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't replay notification")
+		return
+	}
+	render.JSON(w, r, R.JSON{"id": id, "site": siteID, "replayed": true})
+}
+
+// GET /sites - list of sites with admins info set in admin store
+func (a *admin) listSitesCtrl(w http.ResponseWriter, r *http.Request) {
+	updater, ok := a.adminUpdater(w, r)
+	if !ok {
+		return
+	}
+	sites, err := updater.Sites()
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "can't get sites")
+		return
+	}
+	render.JSON(w, r, sites)
+}
+
+// GET /sites/{site} - admins, moderators and email of the site, keys not returned
+func (a *admin) getSiteCtrl(w http.ResponseWriter, r *http.Request) {
+	updater, ok := a.adminUpdater(w, r)
+	if !ok {
+		return
+	}
+	info, err := updater.Site(chi.URLParam(r, "site"))
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "can't get site")
+		return
+	}
+	info.Key, info.PrevKey = "", ""
+	render.JSON(w, r, info)
+}
+
+// PUT /sites/{site} - changes admins info of the site, fields missing in the body kept as is.
+// body is {"admins": ["id1", "id2"], "moderators": ["id3"], "email": "admin@example.com"}
+func (a *admin) setSiteCtrl(w http.ResponseWriter, r *http.Request) {
+	updater, ok := a.adminUpdater(w, r)
+	if !ok {
+		return
+	}
+	req := struct {
+		Admins     *[]string `json:"admins"`
+		Moderators *[]string `json:"moderators"`
+		Email      *string   `json:"email"`
+	}{}
+	if err := render.DecodeJSON(http.MaxBytesReader(w, r.Body, hardBodyLimit), &req); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't bind site info")
+		return
+	}
+
+	siteID := chi.URLParam(r, "site")
+	info, err := updater.Site(siteID)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "can't get site")
+		return
+	}
+	if req.Admins != nil {
+		info.Admins = cleanIDs(*req.Admins)
+	}
+	if req.Moderators != nil {
+		info.Moderators = cleanIDs(*req.Moderators)
+	}
+	if req.Email != nil {
+		info.Email = strings.TrimSpace(*req.Email)
+	}
+	if err = updater.SetSite(info); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "can't set site")
+		return
+	}
+	log.Printf("[INFO] site %s set, admins %+v, moderators %+v, email %s", siteID, info.Admins, info.Moderators, info.Email)
+	a.cache.Flush(cache.Flusher(siteID))
+	info.Key, info.PrevKey = "", ""
+	render.JSON(w, r, info)
+}
+
+// POST /sites/{site}/rotate - sets new secret key of the site, random one if key not passed. Tokens signed with
+// the previous key accepted during grace period, 24h by default. IP hashes of older comments marked as stale.
+// body is {"key": "secret", "grace": "72h"}, both optional
+func (a *admin) rotateKeyCtrl(w http.ResponseWriter, r *http.Request) {
+	rotator, ok := a.dataService.AdminStore.(adminstore.Rotator)
+	if !ok {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, errors.New("no key rotation in admin store"),
+			"admin store doesn't support key rotation")
+		return
+	}
+	req := struct {
+		Key   string `json:"key"`
+		Grace string `json:"grace"`
+	}{}
+	if err := render.DecodeJSON(http.MaxBytesReader(w, r.Body, hardBodyLimit), &req); err != nil && err != io.EOF {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't bind rotation request")
+		return
+	}
+	grace := defaultKeyGrace
+	if req.Grace != "" {
+		d, err := time.ParseDuration(req.Grace)
+		if err != nil || d < 0 {
+			rest.SendErrorJSON(w, r, http.StatusBadRequest, errors.New("bad grace duration"), "can't parse grace period")
+			return
+		}
+		grace = d
+	}
+
+	siteID := chi.URLParam(r, "site")
+	info, err := rotator.RotateKey(siteID, strings.TrimSpace(req.Key), grace)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't rotate key")
+		return
+	}
+	a.cache.Flush(cache.Flusher(siteID))
+	render.JSON(w, r, R.JSON{"site": siteID, "key_rotated": info.KeyRotated, "prev_key_expires": info.PrevKeyExpires})
+}
+
+// DELETE /sites/{site} - removes admins info of the site, defaults used after
+func (a *admin) deleteSiteCtrl(w http.ResponseWriter, r *http.Request) {
+	updater, ok := a.adminUpdater(w, r)
+	if !ok {
+		return
+	}
+	siteID := chi.URLParam(r, "site")
+	if err := updater.DeleteSite(siteID); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "can't delete site")
+		return
+	}
+	log.Printf("[INFO] site %s deleted from admin store", siteID)
+	a.cache.Flush(cache.Flusher(siteID))
+	render.JSON(w, r, R.JSON{"site": siteID, "deleted": true})
+}
+
+// GET /sites/{site}/tokens - list of api tokens of the site, tokens themselves not returned
+func (a *admin) listTokensCtrl(w http.ResponseWriter, r *http.Request) {
+	tokens, ok := a.adminTokens(w, r)
+	if !ok {
+		return
+	}
+	res, err := tokens.Tokens(chi.URLParam(r, "site"))
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "can't get api tokens")
+		return
+	}
+	render.JSON(w, r, res)
+}
+
+// POST /sites/{site}/tokens - creates api token of the site, body is {"name": "stats", "scopes": ["read"]}.
+// The token returned once, only hash of it stored
+func (a *admin) createTokenCtrl(w http.ResponseWriter, r *http.Request) {
+	tokens, ok := a.adminTokens(w, r)
+	if !ok {
+		return
+	}
+	req := struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}{}
+	if err := render.DecodeJSON(http.MaxBytesReader(w, r.Body, hardBodyLimit), &req); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't bind api token")
+		return
+	}
+	tkn, info, err := tokens.CreateToken(chi.URLParam(r, "site"), req.Name, req.Scopes)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't create api token")
+		return
+	}
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, struct {
+		adminstore.APIToken
+		Token string `json:"token"`
+	}{APIToken: info, Token: tkn})
+}
+
+// DELETE /sites/{site}/tokens/{id} - revokes api token of the site
+func (a *admin) deleteTokenCtrl(w http.ResponseWriter, r *http.Request) {
+	tokens, ok := a.adminTokens(w, r)
+	if !ok {
+		return
+	}
+	siteID, id := chi.URLParam(r, "site"), chi.URLParam(r, "id")
+	if err := tokens.DeleteToken(siteID, id); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't revoke api token")
+		return
+	}
+	log.Printf("[INFO] api token %s of site %s revoked", id, siteID)
+	render.JSON(w, r, R.JSON{"site": siteID, "id": id, "revoked": true})
+}
+
+// adminTokens returns admin store with api tokens, sends error if the store doesn't support it
+func (a *admin) adminTokens(w http.ResponseWriter, r *http.Request) (adminstore.Tokens, bool) {
+	tokens, ok := a.dataService.AdminStore.(adminstore.Tokens)
+	if !ok {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, errors.New("no api tokens in admin store"),
+			"admin store doesn't support api tokens")
+		return nil, false
+	}
+	return tokens, true
+}
+
+// GET /registry - list of registered sites
+func (a *admin) listRegistryCtrl(w http.ResponseWriter, r *http.Request) {
+	if !a.registryEnabled(w, r) {
+		return
+	}
+	sites, err := a.dataService.Registry.Sites()
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "can't get sites")
+		return
+	}
+	render.JSON(w, r, sites)
+}
+
+// POST /registry - registers new site, body is {"site": "site-id"}
+func (a *admin) addSiteCtrl(w http.ResponseWriter, r *http.Request) {
+	if !a.registryEnabled(w, r) {
+		return
+	}
+	req := struct {
+		SiteID string `json:"site"`
+	}{}
+	if err := render.DecodeJSON(http.MaxBytesReader(w, r.Body, hardBodyLimit), &req); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't bind site")
+		return
+	}
+	site, err := a.dataService.AddSite(req.SiteID)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't add site")
+		return
+	}
+	log.Printf("[INFO] site %s added", site.ID)
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, site)
+}
+
+// PUT /registry/{site} - renames, disables or enables the site, body is {"site": "new-id", "disabled": true},
+// fields missing in the body kept as is
+func (a *admin) changeSiteCtrl(w http.ResponseWriter, r *http.Request) {
+	if !a.registryEnabled(w, r) {
+		return
+	}
+	req := struct {
+		SiteID   *string `json:"site"`
+		Disabled *bool   `json:"disabled"`
+	}{}
+	if err := render.DecodeJSON(http.MaxBytesReader(w, r.Body, hardBodyLimit), &req); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't bind site")
+		return
+	}
+
+	siteID := chi.URLParam(r, "site")
+	if req.Disabled != nil {
+		if _, err := a.dataService.SetSiteDisabled(siteID, *req.Disabled); err != nil {
+			rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't change site")
+			return
+		}
+		log.Printf("[INFO] site %s disabled %v", siteID, *req.Disabled)
+		a.cache.Flush(cache.Flusher(siteID))
+	}
+	if req.SiteID != nil && *req.SiteID != siteID {
+		if _, err := a.dataService.RenameSite(siteID, *req.SiteID); err != nil {
+			rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't rename site")
+			return
+		}
+		log.Printf("[INFO] site %s renamed to %s", siteID, *req.SiteID)
+		a.cache.Flush(cache.Flusher(siteID))
+		siteID = *req.SiteID
+	}
+
+	site, err := a.dataService.Registry.Site(siteID)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't get site")
+		return
+	}
+	render.JSON(w, r, site)
+}
+
+// DELETE /registry/{site} - removes the site with all its comments and admins info
+func (a *admin) removeSiteCtrl(w http.ResponseWriter, r *http.Request) {
+	if !a.registryEnabled(w, r) {
+		return
+	}
+	siteID := chi.URLParam(r, "site")
+	if err := a.dataService.DeleteSite(siteID); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't delete site")
+		return
+	}
+	log.Printf("[INFO] site %s deleted with all data", siteID)
+	a.cache.Flush(cache.Flusher(siteID))
+	render.JSON(w, r, R.JSON{"site": siteID, "deleted": true})
+}
+
+// registryEnabled checks if sites registry enabled, sends error if not
+func (a *admin) registryEnabled(w http.ResponseWriter, r *http.Request) bool {
+	if a.dataService.Registry == nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, errors.New("no sites registry"), "sites registry disabled")
+		return false
+	}
+	return true
+}
+
+// adminUpdater returns admin store allowing changes, sends error if the store is read-only
+func (a *admin) adminUpdater(w http.ResponseWriter, r *http.Request) (adminstore.Updater, bool) {
+	updater, ok := a.dataService.AdminStore.(adminstore.Updater)
+	if !ok {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, errors.New("read-only admin store"),
+			"admin store doesn't support changes")
+		return nil, false
+	}
+	return updater, true
+}
+
+// cleanIDs trims ids and drops empty ones
+func cleanIDs(ids []string) []string {
+	res := []string{}
+	for _, id := range ids {
+		if id = strings.TrimSpace(id); id != "" {
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
 // PUT /pin/{id}?site=siteID&url=post-url&pin=1
 // mark/unmark comment as a special
 func (a *admin) setPinCtrl(w http.ResponseWriter, r *http.Request) {
@@ -225,14 +949,33 @@ func (a *admin) checkBlocked(siteID string, user store.User) bool {
 }
 
 // post-processes comments, hides text of all comments for blocked users,
-// resets score and votes too. Also hides sensitive info for non-admin users
+// resets score and votes too. Also hides sensitive info, pending and shadow comments for non-admin users
 func (a *admin) alterComments(comments []store.Comment, r *http.Request) (res []store.Comment) {
-	res = make([]store.Comment, len(comments))
+	res = make([]store.Comment, 0, len(comments))
 
 	user, err := rest.GetUserInfo(r)
-	isAdmin := err == nil && user.Admin
+	privileged := map[string]bool{} // admin or moderator of the site, by site id
+
+	for _, c := range comments {
+		isAdmin, ok := privileged[c.Locator.SiteID]
+		if !ok {
+			// moderators see comments of their site the same way as admins
+			isAdmin = err == nil && (user.Admin || a.dataService.IsModerator(c.Locator.SiteID, user.ID))
+			privileged[c.Locator.SiteID] = isAdmin
+		}
 
-	for i, c := range comments {
+		// comments waiting for approval visible to admins only
+		if c.Pending && !isAdmin {
+			continue
+		}
+
+		// comments of shadow-banned users visible to admins and the author only, author doesn't know about it
+		if c.Shadow && !isAdmin {
+			if err != nil || user.ID != c.User.ID {
+				continue
+			}
+			c.Shadow = false
+		}
 
 		blocked := a.dataService.IsBlocked(c.Locator.SiteID, c.User.ID)
 		// process blocked users
@@ -252,9 +995,14 @@ func (a *admin) alterComments(comments []store.Comment, r *http.Request) (res []
 		// hide info from non-admins
 		if !isAdmin {
 			c.User.IP = ""
+			c.Reports = nil
+		} else {
+			c.User.IPStale = a.dataService.IsIPStale(c) // ip hashed with the key before rotation, not comparable
 		}
+		c.Revisions = nil // available via revisions api only
+		c.Trash = nil
 
-		res[i] = c
+		res = append(res, c)
 	}
 	return res
 }
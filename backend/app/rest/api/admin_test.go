@@ -7,19 +7,29 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	bolt "github.com/coreos/bbolt"
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/go-pkgz/auth/token"
 	R "github.com/go-pkgz/rest"
+	"github.com/go-pkgz/rest/cache"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/umputun/remark/backend/app/notify"
 	"github.com/umputun/remark/backend/app/store"
+	adminstore "github.com/umputun/remark/backend/app/store/admin"
+	"github.com/umputun/remark/backend/app/store/engine"
+	"github.com/umputun/remark/backend/app/store/registry"
+	"github.com/umputun/remark/backend/app/store/service"
 )
 
 func TestAdmin_Delete(t *testing.T) {
@@ -52,6 +62,265 @@ func TestAdmin_Delete(t *testing.T) {
 	assert.True(t, cr.Deleted)
 }
 
+func TestAdmin_Undelete(t *testing.T) {
+	ts, _, teardown := startupT(t)
+	defer teardown()
+
+	c1 := store.Comment{Text: "test test #1", Locator: store.Locator{SiteID: "radio-t", URL: "https://radio-t.com/blah"}}
+	id1 := addComment(t, c1, ts)
+
+	client := http.Client{}
+	send := func(method, url string) int {
+		req, err := http.NewRequest(method, url, nil)
+		require.Nil(t, err)
+		req.SetBasicAuth("admin", "password")
+		resp, err := client.Do(req)
+		require.Nil(t, err)
+		return resp.StatusCode
+	}
+
+	code := send(http.MethodDelete, ts.URL+"/api/v1/admin/comment/"+id1+"?site=radio-t&url=https://radio-t.com/blah")
+	require.Equal(t, http.StatusOK, code)
+
+	body, code := get(t, ts.URL+"/api/v1/id/"+id1+"?site=radio-t&url=https://radio-t.com/blah")
+	require.Equal(t, http.StatusOK, code)
+	assert.NotContains(t, body, "trash", "deleted payload not exposed")
+	assert.NotContains(t, body, "test test #1")
+
+	code = send(http.MethodPut, ts.URL+"/api/v1/admin/undelete/"+id1+"?site=radio-t&url=https://radio-t.com/blah")
+	require.Equal(t, http.StatusOK, code)
+
+	body, code = get(t, ts.URL+"/api/v1/id/"+id1+"?site=radio-t&url=https://radio-t.com/blah")
+	require.Equal(t, http.StatusOK, code)
+	cr := store.Comment{}
+	require.Nil(t, json.Unmarshal([]byte(body), &cr))
+	assert.Equal(t, "<p>test test #1</p>\n", cr.Text)
+	assert.False(t, cr.Deleted)
+
+	code = send(http.MethodPut, ts.URL+"/api/v1/admin/undelete/"+id1+"?site=radio-t&url=https://radio-t.com/blah")
+	assert.Equal(t, http.StatusBadRequest, code, "not deleted")
+}
+
+func TestAdmin_Pending(t *testing.T) {
+	ts, srv, teardown := startupT(t)
+	defer teardown()
+	srv.DataService.PreModeration = service.PreModeration{Mode: service.PreModAll}
+
+	loc := store.Locator{SiteID: "radio-t", URL: "https://radio-t.com/blah"}
+	id1 := addComment(t, store.Comment{Text: "pending #1", Locator: loc}, ts)
+	id2 := addComment(t, store.Comment{Text: "pending #2", Locator: loc}, ts)
+
+	findIDs := func(body string) (ids []string) {
+		resp := commentsWithInfo{}
+		require.Nil(t, json.Unmarshal([]byte(body), &resp))
+		for _, c := range resp.Comments {
+			ids = append(ids, c.ID)
+		}
+		return ids
+	}
+
+	body, code := get(t, ts.URL+"/api/v1/find?site=radio-t&url=https://radio-t.com/blah&format=plain")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 0, len(findIDs(body)), "pending hidden from public")
+	_, code = get(t, ts.URL+"/api/v1/id/"+id1+"?site=radio-t&url=https://radio-t.com/blah")
+	assert.Equal(t, http.StatusNotFound, code)
+	body, code = getWithAdminAuth(t, ts.URL+"/api/v1/find?site=radio-t&url=https://radio-t.com/blah&format=plain")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{id1, id2}, findIDs(body), "pending visible to admin")
+
+	body, code = getWithAdminAuth(t, ts.URL+"/api/v1/admin/pending?site=radio-t")
+	require.Equal(t, http.StatusOK, code, body)
+	pending := []store.Comment{}
+	require.Nil(t, json.Unmarshal([]byte(body), &pending))
+	require.Equal(t, 2, len(pending))
+	assert.Equal(t, id1, pending[0].ID)
+	assert.True(t, pending[0].Pending)
+	_, code = get(t, ts.URL+"/api/v1/admin/pending?site=radio-t")
+	assert.Equal(t, http.StatusUnauthorized, code, "admin only")
+
+	client := http.Client{}
+	send := func(method, id string) int {
+		req, err := http.NewRequest(method, ts.URL+"/api/v1/admin/pending/"+id+"?site=radio-t&url=https://radio-t.com/blah", nil)
+		require.Nil(t, err)
+		req.SetBasicAuth("admin", "password")
+		resp, err := client.Do(req)
+		require.Nil(t, err)
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, send(http.MethodPut, id1))
+	assert.Equal(t, http.StatusOK, send(http.MethodDelete, id2))
+	assert.Equal(t, http.StatusBadRequest, send(http.MethodPut, id1), "already approved")
+	assert.Equal(t, http.StatusBadRequest, send(http.MethodDelete, id2), "already rejected")
+
+	body, code = get(t, ts.URL+"/api/v1/find?site=radio-t&url=https://radio-t.com/blah&format=plain")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{id1}, findIDs(body), "approved published")
+	body, code = getWithAdminAuth(t, ts.URL+"/api/v1/admin/pending?site=radio-t")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "[]\n", body)
+}
+
+func TestAdmin_Reports(t *testing.T) {
+	ts, srv, teardown := startupT(t)
+	defer teardown()
+	srv.DataService.ReportLimit = 1
+
+	loc := store.Locator{SiteID: "radio-t", URL: "https://radio-t.com/blah"}
+	id1 := addComment(t, store.Comment{Text: "test test #1", Locator: loc}, ts)
+	id2 := addComment(t, store.Comment{Text: "test test #2", Locator: loc}, ts)
+	_, err := srv.DataService.ReportComment(loc, id2, "user1", "spam")
+	require.Nil(t, err)
+
+	body, code := getWithAdminAuth(t, ts.URL+"/api/v1/admin/reports?site=radio-t")
+	require.Equal(t, http.StatusOK, code, body)
+	reported := []store.Comment{}
+	require.Nil(t, json.Unmarshal([]byte(body), &reported))
+	require.Equal(t, 1, len(reported))
+	assert.Equal(t, id2, reported[0].ID)
+	assert.True(t, reported[0].Pending, "hidden by reports")
+	assert.Equal(t, "spam", reported[0].Reports[0].Reason)
+	_, code = get(t, ts.URL+"/api/v1/admin/reports?site=radio-t")
+	assert.Equal(t, http.StatusUnauthorized, code, "admin only")
+
+	_, code = get(t, ts.URL+"/api/v1/id/"+id2+"?site=radio-t&url=https://radio-t.com/blah")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	dismiss := func(id string) int {
+		client := http.Client{}
+		req, err := http.NewRequest(http.MethodDelete, ts.URL+"/api/v1/admin/reports/"+id+"?site=radio-t&url=https://radio-t.com/blah", nil)
+		require.Nil(t, err)
+		req.SetBasicAuth("admin", "password")
+		resp, err := client.Do(req)
+		require.Nil(t, err)
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, dismiss(id2))
+	assert.Equal(t, http.StatusBadRequest, dismiss(id1), "not reported")
+
+	_, code = get(t, ts.URL+"/api/v1/id/"+id2+"?site=radio-t&url=https://radio-t.com/blah")
+	assert.Equal(t, http.StatusOK, code, "published back")
+	body, code = getWithAdminAuth(t, ts.URL+"/api/v1/admin/reports?site=radio-t")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "[]\n", body)
+}
+
+func TestAdmin_ApproveNotify(t *testing.T) {
+	ts, srv, teardown := startupT(t)
+	defer teardown()
+	srv.DataService.ReportLimit = 1
+
+	var lock sync.Mutex
+	var events []string
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload := struct {
+			Event   string `json:"event"`
+			Comment struct {
+				ID string `json:"id"`
+			} `json:"comment"`
+		}{}
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&payload))
+		lock.Lock()
+		events = append(events, payload.Event+":"+payload.Comment.ID)
+		lock.Unlock()
+	}))
+	defer hook.Close()
+	wh, err := notify.NewWebhook(notify.WebhookParams{URLs: []string{hook.URL}, Events: []notify.Event{notify.EventApprove}},
+		srv.DataService.AdminStore)
+	require.Nil(t, err)
+	srv.NotifyService = notify.NewService(srv.DataService, notify.ServiceParams{}, wh)
+	srv.adminService.notifyService = srv.NotifyService
+	defer srv.NotifyService.Close()
+
+	loc := store.Locator{SiteID: "radio-t", URL: "https://radio-t.com/blah"}
+	id1 := addComment(t, store.Comment{Text: "reported", Locator: loc}, ts)
+	_, err = srv.DataService.ReportComment(loc, id1, "user1", "spam")
+	require.Nil(t, err)
+	srv.DataService.PreModeration = service.PreModeration{Mode: service.PreModAll}
+	id2 := addComment(t, store.Comment{Text: "pending", Locator: loc}, ts)
+
+	approve := func(id string) int {
+		req, err := http.NewRequest(http.MethodPut, ts.URL+"/api/v1/admin/pending/"+id+"?site=radio-t&url=https://radio-t.com/blah", nil)
+		require.Nil(t, err)
+		req.SetBasicAuth("admin", "password")
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, approve(id1))
+	assert.Equal(t, http.StatusOK, approve(id2))
+	time.Sleep(200 * time.Millisecond)
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, []string{"comment.approve:" + id2}, events, "comment held by reports notified on creation")
+}
+
+func TestAdmin_ShadowBan(t *testing.T) {
+	ts, _, teardown := startupT(t)
+	defer teardown()
+
+	client := http.Client{}
+	setShadow := func(val int) {
+		req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/api/v1/admin/shadow/dev?site=radio-t&shadow=%d", ts.URL, val), nil)
+		require.Nil(t, err)
+		req.SetBasicAuth("admin", "password")
+		resp, err := client.Do(req)
+		require.Nil(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	loc := store.Locator{SiteID: "radio-t", URL: "https://radio-t.com/blah"}
+	id1 := addComment(t, store.Comment{Text: "test test #1", Locator: loc}, ts)
+	setShadow(1)
+	id2 := addComment(t, store.Comment{Text: "test test #2", Locator: loc}, ts)
+
+	body, code := getWithAdminAuth(t, ts.URL+"/api/v1/admin/shadow?site=radio-t")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "[\"dev\"]\n", body)
+
+	find := func(getFn func(t *testing.T, url string) (string, int)) []store.Comment {
+		body, code := getFn(t, ts.URL+"/api/v1/find?site=radio-t&url=https://radio-t.com/blah&format=plain")
+		require.Equal(t, http.StatusOK, code)
+		resp := commentsWithInfo{}
+		require.Nil(t, json.Unmarshal([]byte(body), &resp))
+		return resp.Comments
+	}
+
+	comments := find(get)
+	require.Equal(t, 1, len(comments), "shadow comment hidden from public")
+	assert.Equal(t, id1, comments[0].ID)
+	comments = find(getWithDevAuth)
+	require.Equal(t, 2, len(comments), "shadow comment visible to the author")
+	assert.Equal(t, id2, comments[1].ID)
+	assert.False(t, comments[1].Shadow, "author doesn't see shadow flag")
+	comments = find(getWithAdminAuth)
+	require.Equal(t, 2, len(comments), "shadow comment visible to admin")
+	assert.True(t, comments[1].Shadow)
+
+	body, code = get(t, ts.URL+"/api/v1/last/10?site=radio-t")
+	require.Equal(t, http.StatusOK, code)
+	last := []store.Comment{}
+	require.Nil(t, json.Unmarshal([]byte(body), &last))
+	require.Equal(t, 1, len(last))
+	assert.Equal(t, id1, last[0].ID)
+	_, code = get(t, ts.URL+"/api/v1/id/"+id2+"?site=radio-t&url=https://radio-t.com/blah")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	body, code = get(t, ts.URL+"/api/v1/count?site=radio-t&url=https://radio-t.com/blah")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `{"count":1,"locator":{"site":"radio-t","url":"https://radio-t.com/blah"}}`+"\n", body)
+
+	body, code = get(t, ts.URL+"/api/v1/rss/post?site=radio-t&url=https://radio-t.com/blah")
+	require.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "test test #1")
+	assert.NotContains(t, body, "test test #2")
+
+	setShadow(0)
+	body, code = getWithAdminAuth(t, ts.URL+"/api/v1/admin/shadow?site=radio-t")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "[]\n", body)
+}
+
 func TestAdmin_DeleteUser(t *testing.T) {
 	ts, srv, teardown := startupT(t)
 	defer teardown()
@@ -653,3 +922,617 @@ func TestAdmin_GetUserInfo(t *testing.T) {
 	_, code = getWithAdminAuth(t, fmt.Sprintf("%s/api/v1/admin/user/userX?site=radio-t&url=https://radio-t.com/blah", ts.URL))
 	assert.Equal(t, 400, code, "no info about user")
 }
+
+func TestAdmin_Search(t *testing.T) {
+	ts, _, teardown := startupT(t)
+	defer teardown()
+
+	addComment(t, store.Comment{Text: "search me", Locator: store.Locator{SiteID: "radio-t", URL: "https://radio-t.com/blah"}}, ts)
+	addComment(t, store.Comment{Text: "not me", Locator: store.Locator{SiteID: "radio-t", URL: "https://radio-t.com/blah"}}, ts)
+
+	res, code := getWithAdminAuth(t, ts.URL+"/api/v1/admin/search?site=radio-t&q=search&user=dev")
+	require.Equal(t, http.StatusOK, code, res)
+	comments := []store.Comment{}
+	require.Nil(t, json.Unmarshal([]byte(res), &comments))
+	require.Equal(t, 1, len(comments))
+	assert.Equal(t, "search me", comments[0].Orig)
+
+	_, code = get(t, ts.URL+"/api/v1/admin/search?site=radio-t&q=search")
+	assert.Equal(t, http.StatusUnauthorized, code, "admin only")
+
+	_, code = getWithAdminAuth(t, ts.URL+"/api/v1/admin/search?site=radio-t&q=search&limit=x")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestAdmin_Revisions(t *testing.T) {
+	ts, _, teardown := startupT(t)
+	defer teardown()
+
+	id := addComment(t, store.Comment{Text: "line 1\nline 2",
+		Locator: store.Locator{SiteID: "radio-t", URL: "https://radio-t.com/blah"}}, ts)
+
+	client := http.Client{}
+	req, err := http.NewRequest(http.MethodPut, ts.URL+"/api/v1/comment/"+id+"?site=radio-t&url=https://radio-t.com/blah",
+		strings.NewReader(`{"text":"line 1\nline 22", "summary":"my edit"}`))
+	require.Nil(t, err)
+	req.Header.Add("X-JWT", devToken)
+	resp, err := client.Do(req)
+	require.Nil(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	res, code := getWithAdminAuth(t, ts.URL+"/api/v1/admin/revisions/"+id+"?site=radio-t&url=https://radio-t.com/blah")
+	require.Equal(t, http.StatusOK, code, res)
+	revs := struct {
+		ID        string           `json:"id"`
+		Revisions []store.Revision `json:"revisions"`
+	}{}
+	require.Nil(t, json.Unmarshal([]byte(res), &revs))
+	assert.Equal(t, id, revs.ID)
+	require.Equal(t, 2, len(revs.Revisions))
+	assert.Equal(t, "line 1\nline 2", revs.Revisions[0].Orig)
+	assert.Equal(t, "line 1\nline 22", revs.Revisions[1].Orig)
+	assert.Equal(t, "my edit", revs.Revisions[1].Summary)
+
+	res, code = getWithAdminAuth(t, ts.URL+"/api/v1/admin/revisions/"+id+"/diff?site=radio-t&url=https://radio-t.com/blah&from=0")
+	require.Equal(t, http.StatusOK, code, res)
+	diff := struct {
+		From int    `json:"from"`
+		To   int    `json:"to"`
+		Diff string `json:"diff"`
+	}{}
+	require.Nil(t, json.Unmarshal([]byte(res), &diff))
+	assert.Equal(t, 0, diff.From)
+	assert.Equal(t, 1, diff.To, "current version by default")
+	assert.Equal(t, "--- revision 0\n+++ revision 1\n@@ -1,2 +1,2 @@\n line 1\n-line 2\n+line 22\n", diff.Diff)
+
+	_, code = getWithAdminAuth(t, ts.URL+"/api/v1/admin/revisions/"+id+"/diff?site=radio-t&url=https://radio-t.com/blah&from=5")
+	assert.Equal(t, http.StatusBadRequest, code)
+	_, code = get(t, ts.URL+"/api/v1/admin/revisions/"+id+"?site=radio-t&url=https://radio-t.com/blah")
+	assert.Equal(t, http.StatusUnauthorized, code, "admin only")
+
+	// public api doesn't expose revisions
+	res, code = get(t, ts.URL+"/api/v1/id/"+id+"?site=radio-t&url=https://radio-t.com/blah")
+	require.Equal(t, http.StatusOK, code)
+	assert.NotContains(t, res, "revisions")
+
+	revert := func(rev string) (string, int) {
+		req, err := http.NewRequest(http.MethodPut,
+			ts.URL+"/api/v1/admin/revisions/"+id+"?site=radio-t&url=https://radio-t.com/blah&rev="+rev, nil)
+		require.Nil(t, err)
+		req.SetBasicAuth("admin", "password")
+		resp, err := client.Do(req)
+		require.Nil(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.Nil(t, err)
+		return string(body), resp.StatusCode
+	}
+
+	res, code = revert("0")
+	require.Equal(t, http.StatusOK, code, res)
+	c := store.Comment{}
+	require.Nil(t, json.Unmarshal([]byte(res), &c))
+	assert.Equal(t, "line 1\nline 2", c.Orig)
+	assert.Equal(t, "reverted to revision 0", c.Edit.Summary)
+	assert.Nil(t, c.Revisions)
+
+	_, code = revert("10")
+	assert.Equal(t, http.StatusBadRequest, code)
+	_, code = revert("bad")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestAdmin_FailedNotifications(t *testing.T) {
+	ts, srv, teardown := startupT(t)
+	defer teardown()
+
+	body, code := getWithAdminAuth(t, ts.URL+"/api/v1/admin/notify/failed?site=radio-t")
+	require.Equal(t, 200, code)
+	assert.Equal(t, "[]\n", body, "no notify service")
+
+	var status int32 = http.StatusInternalServerError
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer hook.Close()
+	wh, err := notify.NewWebhook(notify.WebhookParams{URLs: []string{hook.URL}}, srv.DataService.AdminStore)
+	require.Nil(t, err)
+	srv.NotifyService = notify.NewService(srv.DataService, notify.ServiceParams{Attempts: 2, RetryDelay: 10 * time.Millisecond}, wh)
+	srv.adminService.notifyService = srv.NotifyService
+	defer srv.NotifyService.Close()
+
+	// waitFailed gets dead-letter list once it has expected number of deliveries, each webhook attempt takes up to 200ms
+	waitFailed := func(expected int) (failed []notify.Delivery) {
+		for i := 0; i < 50; i++ {
+			body, code := getWithAdminAuth(t, ts.URL+"/api/v1/admin/notify/failed?site=radio-t")
+			require.Equal(t, 200, code)
+			failed = []notify.Delivery{}
+			require.Nil(t, json.Unmarshal([]byte(body), &failed))
+			if len(failed) == expected {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		return failed
+	}
+
+	id := addComment(t, store.Comment{Text: "test test #1",
+		Locator: store.Locator{SiteID: "radio-t", URL: "https://radio-t.com/blah"}}, ts)
+	failed := waitFailed(1)
+	require.Equal(t, 1, len(failed))
+	assert.Equal(t, id, failed[0].Comment.ID)
+	assert.Equal(t, notify.EventCreate, failed[0].Event)
+	assert.Equal(t, 2, failed[0].Attempts)
+	assert.Contains(t, failed[0].LastError, "status code 500")
+
+	_, code = getWithDevAuth(t, ts.URL+"/api/v1/admin/notify/failed?site=radio-t")
+	assert.Equal(t, 403, code, "admins only")
+
+	replay := func(id string) int {
+		client := http.Client{}
+		req, e := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/api/v1/admin/notify/failed/%s?site=radio-t", ts.URL, id), nil)
+		require.Nil(t, e)
+		req.SetBasicAuth("admin", "password")
+		resp, e := client.Do(req)
+		require.Nil(t, e)
+		return resp.StatusCode
+	}
+	assert.Equal(t, 400, replay("bad-id"))
+
+	atomic.StoreInt32(&status, http.StatusOK)
+	assert.Equal(t, 200, replay(failed[0].ID))
+	assert.Equal(t, 0, len(waitFailed(0)), "replayed successfully")
+}
+
+func TestAdmin_Moderator(t *testing.T) {
+	ts, srv, teardown := startupT(t)
+	defer teardown()
+
+	id := addComment(t, store.Comment{Text: "test test #1",
+		Locator: store.Locator{SiteID: "radio-t", URL: "https://radio-t.com/blah"}}, ts)
+
+	devReq := func(method, path string) int {
+		client := http.Client{}
+		req, err := http.NewRequest(method, ts.URL+"/api/v1/admin"+path, nil)
+		require.Nil(t, err)
+		req.Header.Add("X-JWT", devToken)
+		resp, err := client.Do(req)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, 403, devReq(http.MethodPut, "/pin/"+id+"?site=radio-t&url=https://radio-t.com/blah&pin=1"),
+		"not a moderator")
+
+	srv.DataService.AdminStore = siteModerators{StaticStore: adminstore.NewStaticStore("123456", []string{"a1", "a2"}, nil, ""),
+		moderators: map[string][]string{"radio-t": {"dev"}, "other-site": {"user1"}}}
+	tbl := []struct {
+		method, path string
+		code         int
+	}{
+		{http.MethodPut, "/pin/" + id + "?site=radio-t&url=https://radio-t.com/blah&pin=1", 200},
+		{http.MethodPut, "/readonly?site=radio-t&url=https://radio-t.com/blah&ro=1", 200},
+		{http.MethodPut, "/user/user1?site=radio-t&block=1", 200},
+		{http.MethodGet, "/blocked?site=radio-t", 200},
+		{http.MethodDelete, "/comment/" + id + "?site=radio-t&url=https://radio-t.com/blah", 200},
+		{http.MethodGet, "/export?site=radio-t&mode=stream", 403},
+		{http.MethodPost, "/import?site=radio-t", 403},
+		{http.MethodDelete, "/user/user1?site=radio-t", 403},
+		{http.MethodGet, "/deleteme?token=abc", 403},
+		{http.MethodPut, "/verify/user1?site=radio-t&verified=1", 403},
+		{http.MethodGet, "/notify/failed?site=radio-t", 403},
+		{http.MethodGet, "/blocked?site=other-site", 403},
+	}
+	for i, tt := range tbl {
+		assert.Equal(t, tt.code, devReq(tt.method, tt.path), "case #%d %s %s", i, tt.method, tt.path)
+	}
+}
+
+func TestAdmin_ModeratorView(t *testing.T) {
+	ts, srv, teardown := startupT(t)
+	defer teardown()
+	memCache, err := cache.NewMemoryCache()
+	require.Nil(t, err)
+	srv.Cache = memCache
+	srv.DataService.PreModeration = service.PreModeration{Mode: service.PreModAll}
+
+	id := addComment(t, store.Comment{Text: "pending #1",
+		Locator: store.Locator{SiteID: "radio-t", URL: "https://radio-t.com/blah"}}, ts)
+
+	findIDs := func(body string) (ids []string) {
+		resp := commentsWithInfo{}
+		require.Nil(t, json.Unmarshal([]byte(body), &resp))
+		for _, c := range resp.Comments {
+			ids = append(ids, c.ID)
+		}
+		return ids
+	}
+	findURL := ts.URL + "/api/v1/find?site=radio-t&url=https://radio-t.com/blah&format=plain"
+
+	srv.DataService.AdminStore = siteModerators{StaticStore: adminstore.NewStaticStore("123456", []string{"a1", "a2"}, nil, ""),
+		moderators: map[string][]string{"other-site": {"dev"}}}
+	body, code := getWithDevAuth(t, findURL)
+	require.Equal(t, http.StatusOK, code)
+	assert.Empty(t, findIDs(body), "moderator of other site sees public view")
+
+	srv.DataService.AdminStore = siteModerators{StaticStore: adminstore.NewStaticStore("123456", []string{"a1", "a2"}, nil, ""),
+		moderators: map[string][]string{"radio-t": {"dev"}}}
+	body, code = getWithDevAuth(t, findURL)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{id}, findIDs(body), "pending visible to moderator of the site")
+	_, code = getWithDevAuth(t, ts.URL+"/api/v1/id/"+id+"?site=radio-t&url=https://radio-t.com/blah")
+	assert.Equal(t, http.StatusOK, code)
+
+	body, code = get(t, findURL)
+	require.Equal(t, http.StatusOK, code)
+	assert.Empty(t, findIDs(body), "moderator's view not cached for anonymous")
+	_, code = get(t, ts.URL+"/api/v1/id/"+id+"?site=radio-t&url=https://radio-t.com/blah")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+// siteModerators is admin store with moderators set per site
+type siteModerators struct {
+	*adminstore.StaticStore
+	moderators map[string][]string
+}
+
+func (s siteModerators) Moderators(siteID string) []string { return s.moderators[siteID] }
+
+func TestAdmin_Sites(t *testing.T) {
+	ts, srv, teardown := startupT(t)
+	defer teardown()
+
+	send := func(method, path, body string, admin bool) (string, int) {
+		client := http.Client{}
+		req, err := http.NewRequest(method, ts.URL+"/api/v1/admin"+path, strings.NewReader(body))
+		require.Nil(t, err)
+		if admin {
+			req.SetBasicAuth("admin", "password")
+		} else {
+			req.Header.Add("X-JWT", devToken)
+		}
+		resp, err := client.Do(req)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		require.Nil(t, err)
+		return string(b), resp.StatusCode
+	}
+
+	body, code := send(http.MethodGet, "/sites", "", true)
+	assert.Equal(t, http.StatusBadRequest, code, "static store")
+	assert.Contains(t, body, "admin store doesn't support changes")
+
+	fileName := "/tmp/test-remark-admin.db"
+	defer os.Remove(fileName)
+	bs, err := adminstore.NewBoltStore(fileName, bolt.Options{},
+		adminstore.SiteInfo{Key: "123456", Admins: []string{"a1"}, Email: "admin@remark-42.com"})
+	require.Nil(t, err)
+	defer bs.Close()
+	srv.DataService.AdminStore = bs
+
+	body, code = send(http.MethodGet, "/sites/radio-t", "", true)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `{"site":"radio-t","admins":["a1"],"moderators":null,"email":"admin@remark-42.com",`+
+		`"prev_key_expires":"0001-01-01T00:00:00Z","key_rotated":"0001-01-01T00:00:00Z"}`+"\n", body)
+
+	body, code = send(http.MethodPut, "/sites/radio-t", `{"admins":["a1"," dev ",""],"moderators":["m1"],"key":"new-key"}`, true)
+	assert.Equal(t, http.StatusOK, code, body)
+	assert.Equal(t, `{"site":"radio-t","admins":["a1","dev"],"moderators":["m1"],"email":"admin@remark-42.com",`+
+		`"prev_key_expires":"0001-01-01T00:00:00Z","key_rotated":"0001-01-01T00:00:00Z"}`+"\n", body)
+	key, err := bs.Key("radio-t")
+	require.Nil(t, err)
+	assert.Equal(t, "123456", key, "key can't be changed without rotation")
+
+	body, code = send(http.MethodPut, "/sites/radio-t", `{"email":"new@remark-42.com"}`, true)
+	assert.Equal(t, http.StatusOK, code, body)
+	assert.Equal(t, []string{"a1", "dev"}, bs.Admins("radio-t"), "admins kept")
+	assert.Equal(t, "new@remark-42.com", bs.Email("radio-t"))
+
+	body, code = send(http.MethodPut, "/sites/radio-t", `bad json`, true)
+	assert.Equal(t, http.StatusBadRequest, code, body)
+
+	body, code = send(http.MethodGet, "/sites", "", true)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `["radio-t"]`+"\n", body)
+
+	// dev user is site's admin now, still not a superuser
+	_, code = send(http.MethodGet, "/sites?site=radio-t", "", false)
+	assert.Equal(t, http.StatusForbidden, code)
+	_, code = send(http.MethodPut, "/sites/radio-t?site=radio-t", `{"admins":["dev2"]}`, false)
+	assert.Equal(t, http.StatusForbidden, code)
+	_, code = send(http.MethodPost, "/sites/radio-t/rotate?site=radio-t", "", false)
+	assert.Equal(t, http.StatusForbidden, code)
+
+	_, code = send(http.MethodDelete, "/sites/radio-t", "", true)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"a1"}, bs.Admins("radio-t"), "defaults after delete")
+	key, err = bs.Key("radio-t")
+	require.Nil(t, err)
+	assert.Equal(t, "123456", key)
+}
+
+func TestAdmin_RotateKey(t *testing.T) {
+	ts, srv, teardown := startupT(t)
+	defer teardown()
+
+	rotate := func(body string) (string, int) {
+		client := http.Client{}
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/v1/admin/sites/radio-t/rotate", strings.NewReader(body))
+		require.Nil(t, err)
+		req.SetBasicAuth("admin", "password")
+		resp, err := client.Do(req)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		require.Nil(t, err)
+		return string(b), resp.StatusCode
+	}
+
+	body, code := rotate("")
+	assert.Equal(t, http.StatusBadRequest, code, "static store")
+	assert.Contains(t, body, "admin store doesn't support key rotation")
+
+	fileName := "/tmp/test-remark-admin.db"
+	defer os.Remove(fileName)
+	bs, err := adminstore.NewBoltStore(fileName, bolt.Options{}, adminstore.SiteInfo{Key: "123456"})
+	require.Nil(t, err)
+	defer bs.Close()
+	srv.DataService.AdminStore = bs
+
+	c1 := store.Comment{Text: "test test #1", Locator: store.Locator{SiteID: "radio-t", URL: "https://radio-t.com/blah1"},
+		User: store.User{ID: "dev", IP: "127.0.0.1"}}
+	addComment(t, c1, ts)
+
+	body, code = rotate(`{"key":"new-key","grace":"1h"}`)
+	assert.Equal(t, http.StatusOK, code, body)
+	res := struct {
+		Site           string    `json:"site"`
+		KeyRotated     time.Time `json:"key_rotated"`
+		PrevKeyExpires time.Time `json:"prev_key_expires"`
+	}{}
+	require.Nil(t, json.Unmarshal([]byte(body), &res))
+	assert.Equal(t, "radio-t", res.Site)
+	assert.WithinDuration(t, time.Now(), res.KeyRotated, time.Second)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), res.PrevKeyExpires, time.Second)
+	key, err := bs.Key("radio-t")
+	require.Nil(t, err)
+	assert.Equal(t, "new-key", key)
+	prev, ok := bs.PrevKey("radio-t")
+	assert.True(t, ok)
+	assert.Equal(t, "123456", prev)
+
+	body, code = rotate(`{"key":"new-key"}`)
+	assert.Equal(t, http.StatusBadRequest, code, body)
+	body, code = rotate(`{"grace":"bad"}`)
+	assert.Equal(t, http.StatusBadRequest, code, body)
+
+	// comment made before rotation has stale ip hash, visible to admins only
+	time.Sleep(10 * time.Millisecond)
+	addComment(t, store.Comment{Text: "test test #2", Locator: c1.Locator, User: store.User{ID: "dev", IP: "127.0.0.1"}}, ts)
+	body, code = getWithAdminAuth(t, ts.URL+"/api/v1/find?site=radio-t&url=https://radio-t.com/blah1&sort=time")
+	assert.Equal(t, http.StatusOK, code)
+	comments := commentsWithInfo{}
+	require.Nil(t, json.Unmarshal([]byte(body), &comments))
+	require.Equal(t, 2, len(comments.Comments))
+	assert.True(t, comments.Comments[0].User.IPStale)
+	assert.False(t, comments.Comments[1].User.IPStale)
+	assert.NotEqual(t, comments.Comments[0].User.IP, comments.Comments[1].User.IP, "same ip, different keys")
+
+	body, code = get(t, ts.URL+"/api/v1/find?site=radio-t&url=https://radio-t.com/blah1&sort=time")
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotContains(t, body, "ip_stale")
+}
+
+func TestAdmin_APITokens(t *testing.T) {
+	ts, srv, teardown := startupT(t)
+	defer teardown()
+
+	send := func(method, path, body, auth string) (string, int) {
+		client := http.Client{}
+		req, err := http.NewRequest(method, ts.URL+"/api/v1/admin"+path, strings.NewReader(body))
+		require.Nil(t, err)
+		if auth == "" {
+			req.SetBasicAuth("admin", "password")
+		} else {
+			req.Header.Set("Authorization", "Token "+auth)
+		}
+		resp, err := client.Do(req)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		require.Nil(t, err)
+		return string(b), resp.StatusCode
+	}
+
+	body, code := send(http.MethodGet, "/sites/radio-t/tokens", "", "")
+	assert.Equal(t, http.StatusBadRequest, code, "static store")
+	assert.Contains(t, body, "admin store doesn't support api tokens")
+	_, code = send(http.MethodGet, "/pending?site=radio-t", "", "some.token")
+	assert.Equal(t, http.StatusUnauthorized, code, "static store")
+
+	fileName := "/tmp/test-remark-admin.db"
+	defer os.Remove(fileName)
+	bs, err := adminstore.NewBoltStore(fileName, bolt.Options{}, adminstore.SiteInfo{Key: "123456"})
+	require.Nil(t, err)
+	defer bs.Close()
+	srv.DataService.AdminStore = bs
+
+	c1 := store.Comment{Text: "test test #1", Locator: store.Locator{SiteID: "radio-t", URL: "https://radio-t.com/blah1"}}
+	id1 := addComment(t, c1, ts)
+
+	body, code = send(http.MethodPost, "/sites/radio-t/tokens", `{"name":"stats","scopes":["read"]}`, "")
+	assert.Equal(t, http.StatusCreated, code, body)
+	created := struct {
+		adminstore.APIToken
+		Token string `json:"token"`
+	}{}
+	require.Nil(t, json.Unmarshal([]byte(body), &created))
+	assert.Equal(t, "stats", created.Name)
+	assert.Equal(t, []string{"read"}, created.Scopes)
+	readTkn := created.Token
+
+	body, code = send(http.MethodPost, "/sites/radio-t/tokens", `{"name":"cleaner","scopes":["delete"]}`, "")
+	assert.Equal(t, http.StatusCreated, code, body)
+	require.Nil(t, json.Unmarshal([]byte(body), &created))
+	deleteTkn, deleteID := created.Token, created.ID
+
+	body, code = send(http.MethodPost, "/sites/radio-t/tokens", `{"name":"bad","scopes":["all"]}`, "")
+	assert.Equal(t, http.StatusBadRequest, code, body)
+
+	body, code = send(http.MethodGet, "/sites/radio-t/tokens", "", "")
+	assert.Equal(t, http.StatusOK, code)
+	tokens := []adminstore.APIToken{}
+	require.Nil(t, json.Unmarshal([]byte(body), &tokens))
+	assert.Equal(t, 2, len(tokens))
+	assert.NotContains(t, body, readTkn, "tokens not listed")
+	assert.NotContains(t, body, "hash")
+
+	// read-only token
+	body, code = send(http.MethodGet, "/pending?site=radio-t", "", readTkn)
+	assert.Equal(t, http.StatusOK, code, body)
+	_, code = send(http.MethodGet, "/pending?site=other", "", readTkn)
+	assert.Equal(t, http.StatusForbidden, code, "other site")
+	_, code = send(http.MethodDelete, fmt.Sprintf("/comment/%s?site=radio-t&url=https://radio-t.com/blah1", id1), "", readTkn)
+	assert.Equal(t, http.StatusForbidden, code, "no delete scope")
+	_, code = send(http.MethodPut, "/pin/"+id1+"?site=radio-t&url=https://radio-t.com/blah1&pin=1", "", readTkn)
+	assert.Equal(t, http.StatusForbidden, code, "no moderate scope")
+	body, code = send(http.MethodGet, "/search?site=radio-t&q=test", "", readTkn)
+	assert.Equal(t, http.StatusOK, code, body)
+	_, code = send(http.MethodGet, "/user/dev?site=radio-t", "", readTkn)
+	assert.Equal(t, http.StatusForbidden, code, "user's info with ip not allowed")
+	_, code = send(http.MethodGet, "/revisions/"+id1+"?site=radio-t&url=https://radio-t.com/blah1", "", readTkn)
+	assert.Equal(t, http.StatusForbidden, code, "revisions not allowed")
+	_, code = send(http.MethodGet, "/no-such-route?site=radio-t", "", readTkn)
+	assert.Equal(t, http.StatusForbidden, code, "unknown route")
+	_, code = send(http.MethodPut, "/verify/dev?site=radio-t&verified=1", "", readTkn)
+	assert.Equal(t, http.StatusForbidden, code, "admins only call")
+	_, code = send(http.MethodGet, "/sites/radio-t/tokens?site=radio-t", "", readTkn)
+	assert.Equal(t, http.StatusForbidden, code, "superuser only call")
+	_, code = send(http.MethodGet, "/pending?site=radio-t", "", readTkn+"x")
+	assert.Equal(t, http.StatusUnauthorized, code, "bad token")
+
+	// private routes not allowed with api token
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/api/v1/user?site=radio-t", nil)
+	require.Nil(t, err)
+	req.Header.Set("Authorization", "Token "+readTkn)
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp.Body.Close()
+
+	// delete-only token
+	_, code = send(http.MethodGet, "/pending?site=radio-t", "", deleteTkn)
+	assert.Equal(t, http.StatusForbidden, code, "no read scope")
+	body, code = send(http.MethodDelete, fmt.Sprintf("/comment/%s?site=radio-t&url=https://radio-t.com/blah1", id1), "", deleteTkn)
+	assert.Equal(t, http.StatusOK, code, body)
+	comment, err := srv.DataService.Get(c1.Locator, id1)
+	require.Nil(t, err)
+	assert.True(t, comment.Deleted)
+
+	tokens, err = bs.Tokens("radio-t")
+	require.Nil(t, err)
+	for _, tk := range tokens {
+		assert.False(t, tk.LastUsed.IsZero(), "last used set for %s", tk.Name)
+	}
+
+	// revoke
+	_, code = send(http.MethodDelete, "/sites/other/tokens/"+deleteID, "", "")
+	assert.Equal(t, http.StatusBadRequest, code, "token of other site")
+	body, code = send(http.MethodDelete, "/sites/radio-t/tokens/"+deleteID, "", "")
+	assert.Equal(t, http.StatusOK, code, body)
+	_, code = send(http.MethodDelete, fmt.Sprintf("/comment/%s?site=radio-t&url=https://radio-t.com/blah1", id1), "", deleteTkn)
+	assert.Equal(t, http.StatusUnauthorized, code, "revoked")
+}
+
+func TestAdmin_Registry(t *testing.T) {
+	ts, srv, teardown := startupT(t)
+	defer teardown()
+
+	send := func(method, path, body string) (string, int) {
+		client := http.Client{}
+		req, err := http.NewRequest(method, ts.URL+"/api/v1"+path, strings.NewReader(body))
+		require.Nil(t, err)
+		req.SetBasicAuth("admin", "password")
+		resp, err := client.Do(req)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		require.Nil(t, err)
+		return string(b), resp.StatusCode
+	}
+
+	body, code := send(http.MethodGet, "/admin/registry", "")
+	assert.Equal(t, http.StatusBadRequest, code, "no registry")
+	assert.Contains(t, body, "sites registry disabled")
+	_, code = send(http.MethodPut, "/admin/registry/radio-t", `{}`)
+	assert.Equal(t, http.StatusBadRequest, code, "no registry")
+
+	dir, err := ioutil.TempDir("", "remark-sites")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	require.Nil(t, srv.DataService.Close())
+	srv.DataService.Interface, err = engine.NewBoltDBDir(bolt.Options{}, dir, "radio-t")
+	require.Nil(t, err)
+	reg, err := registry.New(dir+"/sites.db", bolt.Options{}, "radio-t")
+	require.Nil(t, err)
+	defer reg.Close()
+	srv.DataService.Registry = reg
+
+	body, code = send(http.MethodPost, "/admin/registry", `{"site":"blog"}`)
+	assert.Equal(t, http.StatusCreated, code, body)
+	_, code = send(http.MethodPost, "/admin/registry", `{"site":"../blog"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	c1 := store.Comment{Text: "test test #1", Locator: store.Locator{SiteID: "blog", URL: "https://example.com/post1"}}
+	addComment(t, c1, ts)
+	body, code = get(t, ts.URL+"/api/v1/count?site=blog&url=https://example.com/post1")
+	assert.Equal(t, http.StatusOK, code, body)
+	assert.Contains(t, body, `"count":1`)
+
+	body, code = send(http.MethodGet, "/admin/registry", "")
+	assert.Equal(t, http.StatusOK, code)
+	sites := []registry.Site{}
+	require.Nil(t, json.Unmarshal([]byte(body), &sites))
+	require.Equal(t, 2, len(sites))
+	assert.Equal(t, "blog", sites[0].ID)
+	assert.Equal(t, "radio-t", sites[1].ID)
+
+	// disabled site rejects requests
+	body, code = send(http.MethodPut, "/admin/registry/blog", `{"disabled":true}`)
+	assert.Equal(t, http.StatusOK, code, body)
+	assert.Contains(t, body, `"disabled":true`)
+	body, code = get(t, ts.URL+"/api/v1/count?site=blog&url=https://example.com/post1")
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Contains(t, body, "site disabled")
+	_, code = send(http.MethodPut, "/admin/registry/blog", `{"disabled":false}`)
+	assert.Equal(t, http.StatusOK, code)
+
+	// rename
+	body, code = send(http.MethodPut, "/admin/registry/blog", `{"site":"new-blog"}`)
+	assert.Equal(t, http.StatusOK, code, body)
+	assert.Contains(t, body, `"site":"new-blog"`)
+	body, code = get(t, ts.URL+"/api/v1/count?site=new-blog&url=https://example.com/post1")
+	assert.Equal(t, http.StatusOK, code, body)
+	assert.Contains(t, body, `"count":1`)
+	_, code = send(http.MethodPut, "/admin/registry/new-blog", `{"site":"radio-t"}`)
+	assert.Equal(t, http.StatusBadRequest, code, "already exists")
+
+	// dev user is not a superuser
+	req, err := http.NewRequest(http.MethodDelete, ts.URL+"/api/v1/admin/registry/new-blog?site=new-blog", nil)
+	require.Nil(t, err)
+	req.Header.Add("X-JWT", devToken)
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	body, code = send(http.MethodDelete, "/admin/registry/new-blog", "")
+	assert.Equal(t, http.StatusOK, code, body)
+	_, err = os.Stat(dir + "/new-blog.db")
+	assert.True(t, os.IsNotExist(err))
+	_, code = get(t, ts.URL+"/api/v1/count?site=new-blog&url=https://example.com/post1")
+	assert.Equal(t, http.StatusBadRequest, code, "unknown site")
+	_, code = send(http.MethodDelete, "/admin/registry/new-blog", "")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
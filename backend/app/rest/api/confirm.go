@@ -0,0 +1,240 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	htmltemplate "html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"text/template"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/didip/tollbooth"
+	"github.com/didip/tollbooth/limiter"
+	"github.com/go-chi/render"
+	R "github.com/go-pkgz/rest"
+	"github.com/pkg/errors"
+
+	"github.com/umputun/remark/backend/app/rest"
+	"github.com/umputun/remark/backend/app/rest/emailauth"
+	"github.com/umputun/remark/backend/app/store"
+	adminstore "github.com/umputun/remark/backend/app/store/admin"
+)
+
+// EmailSender defines the minimal interface to send email with plain text and html versions
+type EmailSender interface {
+	Send(ctx context.Context, to, subject, text, html string) error
+}
+
+const (
+	confirmTTL         = 24 * time.Hour
+	confirmAddrLimit   = 3 // confirmations sent to one address per hour
+	confirmSendTimeout = 30 * time.Second
+	confirmKeyPurpose  = "confirm"
+	confirmReplies     = "replies"
+	confirmDigest      = "digest"
+)
+
+// confirmClaims of the token in confirmation link. Address of the user used for notifications only after the user
+// follows the link sent to it, so notifications can't be sent to somebody else's address
+type confirmClaims struct {
+	jwt.StandardClaims        // audience is the site, subject is the user
+	Email              string `json:"email"`
+	Action             string `json:"action"`           // what to enable after confirmation
+	URL                string `json:"url,omitempty"`    // post of digest subscription
+	Period             string `json:"period,omitempty"` // period of digest subscription
+}
+
+// what the notifications are about, for texts of email and page
+func (c confirmClaims) what() string {
+	if c.Action == confirmDigest {
+		return "new comments of " + c.URL
+	}
+	return c.Action
+}
+
+var confirmTextTmpl = template.Must(template.New("text").Parse(`Hello,
+
+follow the link to confirm your email for notifications about {{.What}} on {{.Site}}:
+
+{{.Link}}
+
+The link is valid for {{.TTL}}. Ignore this email if you didn't request it.
+`))
+
+var confirmHTMLTmpl = htmltemplate.Must(htmltemplate.New("html").Parse(`<!DOCTYPE html>
+<html>
+<body>
+<p>Hello,</p>
+<p>follow the link to confirm your email for notifications about {{.What}} on {{.Site}}:</p>
+<p><a href="{{.Link}}">Confirm email</a></p>
+<p>The link is valid for {{.TTL}}. Ignore this email if you didn't request it.</p>
+</body>
+</html>
+`))
+
+// actionPageTmpl is the page shown by links from emails. Action made by the form's POST only,
+// so links opened by mail scanners and prefetchers change nothing
+var actionPageTmpl = htmltemplate.Must(htmltemplate.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta name="robots" content="noindex"><title>{{.Title}}</title></head>
+<body>
+<p>{{.Text}}</p>
+<form method="post"><button type="submit">{{.Title}}</button></form>
+</body>
+</html>
+`))
+
+// sendConfirmation sends link confirming the address to the address itself, sends error if not sent
+func (s *Rest) sendConfirmation(w http.ResponseWriter, r *http.Request, claims confirmClaims) bool {
+	if s.EmailSender == nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, errors.New("no email sender"), "email notifications disabled")
+		return false
+	}
+	if s.confirmLimiter.LimitReached(claims.Email) {
+		rest.SendErrorJSON(w, r, http.StatusTooManyRequests, errors.New("too many requests"),
+			"confirmation limit reached for address")
+		return false
+	}
+
+	siteID := claims.Audience
+	key, err := s.DataService.AdminStore.Key(siteID)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't get site key")
+		return false
+	}
+	claims.ExpiresAt = time.Now().Add(confirmTTL).Unix()
+	tkn, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).
+		SignedString([]byte(adminstore.DeriveKey(key, confirmKeyPurpose)))
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "failed to make confirmation token")
+		return false
+	}
+
+	msg := struct {
+		What, Site, Link string
+		TTL              time.Duration
+	}{What: claims.what(), Site: siteID, TTL: confirmTTL,
+		Link: s.RemarkURL + "/api/v1/notify/confirm?tkn=" + url.QueryEscape(tkn)}
+	text, html := bytes.Buffer{}, bytes.Buffer{}
+	if err = confirmTextTmpl.Execute(&text, msg); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "failed to make confirmation email")
+		return false
+	}
+	if err = confirmHTMLTmpl.Execute(&html, msg); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "failed to make confirmation email")
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), confirmSendTimeout)
+	defer cancel()
+	if err = s.EmailSender.Send(ctx, claims.Email, "Confirm your email", text.String(), html.String()); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "failed to send confirmation email")
+		return false
+	}
+	log.Printf("[DEBUG] confirmation of %s sent to %s, site %s", claims.Action, claims.Email, siteID)
+	return true
+}
+
+// GET /notify/confirm?tkn=token - page confirming the email, POST /notify/confirm?tkn=token - confirms it
+// and enables notifications requested with the email
+func (s *Rest) confirmEmailCtrl(w http.ResponseWriter, r *http.Request) {
+	claims, err := s.parseConfirmToken(r.URL.Query().Get("tkn"))
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusForbidden, err, "failed to verify confirmation token")
+		return
+	}
+	if r.Method != http.MethodPost {
+		actionPage(w, r, "Confirm email", "Confirm "+claims.Email+" for notifications about "+claims.what()+".")
+		return
+	}
+
+	siteID, userID := claims.Audience, claims.Subject
+	switch claims.Action {
+	case confirmReplies:
+		rn, e := s.DataService.ReplyNotify(siteID, userID)
+		if e != nil {
+			rest.SendErrorJSON(w, r, http.StatusBadRequest, e, "can't get reply notifications")
+			return
+		}
+		rn.Email = claims.Email
+		err = s.DataService.SetReplyNotify(siteID, userID, rn)
+	case confirmDigest:
+		locator := store.Locator{SiteID: siteID, URL: claims.URL}
+		if e := s.checkSubscription(locator, userID); e != nil {
+			rest.SendErrorJSON(w, r, http.StatusBadRequest, e, "can't subscribe")
+			return
+		}
+		err = s.DataService.Subscribe(store.Subscription{Locator: locator, UserID: userID, Email: claims.Email,
+			Period: claims.Period, LastSent: time.Now()})
+	default:
+		err = errors.Errorf("unknown action %q", claims.Action)
+	}
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't confirm email")
+		return
+	}
+	log.Printf("[INFO] user %s confirmed %s for %s on %s", userID, claims.Email, claims.Action, siteID)
+	render.JSON(w, r, R.JSON{"user": userID, "email": claims.Email, "confirmed": true})
+}
+
+// parseConfirmToken checks token of confirmation link, signed with key derived from the site's secret
+func (s *Rest) parseConfirmToken(tkn string) (confirmClaims, error) {
+	claims := confirmClaims{}
+	_, err := jwt.ParseWithClaims(tkn, &claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.Errorf("unexpected signing method %v", t.Header["alg"])
+		}
+		key, err := s.DataService.AdminStore.Key(t.Claims.(*confirmClaims).Audience)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(adminstore.DeriveKey(key, confirmKeyPurpose)), nil
+	})
+	if err != nil {
+		return confirmClaims{}, errors.Wrap(err, "bad token")
+	}
+	if claims.Subject == "" || claims.Email == "" {
+		return confirmClaims{}, errors.New("no user or email in token")
+	}
+	return claims, nil
+}
+
+// confirmedEmail checks if the user already confirmed the address, by login with email,
+// for reply notifications or for digest subscription
+func (s *Rest) confirmedEmail(siteID, userID, email string) bool {
+	if userID == emailauth.UserID(email) {
+		return true
+	}
+	if rn, err := s.DataService.ReplyNotify(siteID, userID); err == nil && rn.Email == email {
+		return true
+	}
+	subs, err := s.DataService.Subscriptions(siteID, userID)
+	if err != nil {
+		return false
+	}
+	for _, sub := range subs {
+		if sub.Email == email {
+			return true
+		}
+	}
+	return false
+}
+
+// actionPage renders page with the form making the action by POST to the same url
+func actionPage(w http.ResponseWriter, r *http.Request, title, text string) {
+	buf := bytes.Buffer{}
+	if err := actionPageTmpl.Execute(&buf, struct{ Title, Text string }{title, text}); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "can't render page")
+		return
+	}
+	render.HTML(w, r, buf.String())
+}
+
+// hourlyLimiter allows up to limit requests per key, restored within an hour
+func hourlyLimiter(limit int) *limiter.Limiter {
+	return tollbooth.NewLimiter(float64(limit)/time.Hour.Seconds(),
+		&limiter.ExpirableOptions{DefaultExpirationTTL: time.Hour}).SetBurst(limit)
+}
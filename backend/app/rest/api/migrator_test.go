@@ -277,7 +277,7 @@ func TestMigrator_Export(t *testing.T) {
 func prepImportSrv(t *testing.T) (svc *Migrator, ds *service.DataStore, ts *httptest.Server) {
 	b, err := engine.NewBoltDB(bolt.Options{}, engine.BoltSite{FileName: testDb, SiteID: "radio-t"})
 	require.Nil(t, err)
-	adminStore := adminstore.NewStaticStore("123456", []string{"a1", "a2"}, "admin@remark-42.com")
+	adminStore := adminstore.NewStaticStore("123456", []string{"a1", "a2"}, nil, "admin@remark-42.com")
 	dataStore := &service.DataStore{Interface: b, AdminStore: adminStore}
 	svc = &Migrator{
 		DisqusImporter:    &migrator.Disqus{DataStore: dataStore},
@@ -13,7 +13,9 @@ import (
 	"sync"
 	"time"
 
+	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/didip/tollbooth"
+	"github.com/didip/tollbooth/limiter"
 	"github.com/didip/tollbooth_chi"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
@@ -23,6 +25,8 @@ import (
 	"github.com/rakyll/statik/fs"
 
 	"github.com/go-pkgz/auth"
+	"github.com/go-pkgz/auth/provider"
+	"github.com/go-pkgz/auth/token"
 	R "github.com/go-pkgz/rest"
 	"github.com/go-pkgz/rest/cache"
 	"github.com/go-pkgz/rest/logger"
@@ -31,6 +35,7 @@ import (
 	"github.com/umputun/remark/backend/app/rest"
 	"github.com/umputun/remark/backend/app/rest/proxy"
 	"github.com/umputun/remark/backend/app/store"
+	adminstore "github.com/umputun/remark/backend/app/store/admin"
 	"github.com/umputun/remark/backend/app/store/service"
 )
 
@@ -40,16 +45,19 @@ type Rest struct {
 
 	DataService      *service.DataStore
 	Authenticator    *auth.Service
+	AuthProviders    []provider.Service // providers not built into authenticator, i.e. email, mounted to /auth/{name}
 	Cache            cache.LoadingCache
 	ImageProxy       *proxy.Image
 	CommentFormatter *store.CommentFormatter
 	Migrator         *Migrator
 	NotifyService    *notify.Service
+	EmailSender      EmailSender // sends confirmations of users' emails for notifications, emails disabled if nil
 
 	WebRoot         string
 	RemarkURL       string
 	ReadOnlyAge     int
 	SharedSecret    string
+	PublicSearch    []string // sites with search allowed for all users
 	ScoreThresholds struct {
 		Low      int
 		Critical int
@@ -60,16 +68,32 @@ type Rest struct {
 	httpServer  *http.Server
 	lock        sync.Mutex
 
-	adminService admin
+	adminService   admin
+	confirmLimiter *limiter.Limiter
 }
 
 const hardBodyLimit = 1024 * 64 // limit size of body
 
 const lastCommentsScope = "last"
 
+const maxSubscriptions = 100 // posts one user can subscribe to on the site
+
+// prefixes of cache keys for views of admins, moderators and shadow-banned users, see cacheKey
+const (
+	adminKeyPrefix     = "admin!!"
+	moderatorKeyPrefix = "moderator!!"
+	shadowKeyPrefix    = "shadow!!" // followed by user id, as each shadow-banned user sees own comments only
+)
+
 type commentsWithInfo struct {
-	Comments []store.Comment `json:"comments"`
-	Info     store.PostInfo  `json:"info,omitempty"`
+	Comments   []store.Comment `json:"comments"`
+	Info       store.PostInfo  `json:"info,omitempty"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+}
+
+type treeWithCursor struct {
+	*rest.Tree
+	NextCursor string `json:"next_cursor,omitempty"`
 }
 
 // Run the lister and request's router, activate rest server
@@ -144,6 +168,43 @@ func (s *Rest) Shutdown() {
 	s.lock.Unlock()
 }
 
+// authHandler serves AuthProviders along with authenticator's handler, adds them to the list of providers and
+// handles logout if authenticator has no providers at all
+func (s *Rest) authHandler(h http.Handler) http.Handler {
+	if len(s.AuthProviders) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		elems := strings.Split(r.URL.Path, "/")
+		switch elems[len(elems)-1] {
+		case "list":
+			list := []string{}
+			for _, p := range s.Authenticator.Providers() {
+				list = append(list, p.Name())
+			}
+			for _, p := range s.AuthProviders {
+				list = append(list, p.Name())
+			}
+			render.JSON(w, r, list)
+			return
+		case "logout":
+			if len(s.Authenticator.Providers()) == 0 {
+				s.AuthProviders[0].Handler(w, r)
+				return
+			}
+		}
+		if len(elems) > 2 {
+			for _, p := range s.AuthProviders {
+				if p.Name() == elems[len(elems)-2] {
+					p.Handler(w, r)
+					return
+				}
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
 func (s *Rest) makeHTTPServer(port int, router http.Handler) *http.Server {
 	return &http.Server{
 		Addr:              fmt.Sprintf(":%d", port),
@@ -159,6 +220,7 @@ func (s *Rest) routes() chi.Router {
 	router.Use(middleware.RealIP, R.Recoverer)
 	router.Use(middleware.Throttle(1000), middleware.Timeout(60*time.Second))
 	router.Use(R.AppInfo("remark42", "umputun", s.Version), R.Ping)
+	s.confirmLimiter = hourlyLimiter(confirmAddrLimit)
 
 	s.adminService = admin{
 		dataService:   s.DataService,
@@ -166,17 +228,19 @@ func (s *Rest) routes() chi.Router {
 		cache:         s.Cache,
 		authenticator: s.Authenticator,
 		readOnlyAge:   s.ReadOnlyAge,
+		notifyService: s.NotifyService,
 	}
 
 	corsMiddleware := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-XSRF-Token", "X-JWT"},
-		ExposedHeaders:   []string{"Authorization"},
+		ExposedHeaders:   []string{"Authorization", jwtHeaderKey},
 		AllowCredentials: true,
 		MaxAge:           300,
 	})
 	router.Use(corsMiddleware.Handler)
+	router.Use(s.prevKeyTokens)
 
 	ipFn := func(ip string) string { return store.HashValue(ip, s.SharedSecret)[:12] } // logger uses it for anonymization
 
@@ -185,7 +249,7 @@ func (s *Rest) routes() chi.Router {
 	router.Group(func(r chi.Router) {
 		l := logger.New(logger.Flags(logger.All), logger.IPfn(ipFn))
 		r.Use(l.Handler, tollbooth_chi.LimitHandler(tollbooth.NewLimiter(5, nil)))
-		r.Mount("/auth", authHandler)
+		r.Mount("/auth", s.authHandler(authHandler))
 	})
 
 	router.Group(func(r chi.Router) {
@@ -217,6 +281,7 @@ func (s *Rest) routes() chi.Router {
 
 	// api routes
 	router.Route("/api/v1", func(rapi chi.Router) {
+		rapi.Use(s.siteEnabled)
 
 		rapi.Group(func(rava chi.Router) {
 			rava.Use(logger.New(logger.Flags(logger.None)).Handler, tollbooth_chi.LimitHandler(tollbooth.NewLimiter(100, nil)))
@@ -238,6 +303,13 @@ func (s *Rest) routes() chi.Router {
 			ropen.Get("/config", s.configCtrl)
 			ropen.Post("/preview", s.previewCommentCtrl)
 			ropen.Get("/info", s.infoCtrl)
+			ropen.Get("/search", s.searchCommentsCtrl)
+			ropen.Get("/notify/unsubscribe", s.unsubscribeReplyNotifyCtrl)
+			ropen.Post("/notify/unsubscribe", s.unsubscribeReplyNotifyCtrl)
+			ropen.Get("/notify/confirm", s.confirmEmailCtrl)
+			ropen.Post("/notify/confirm", s.confirmEmailCtrl)
+			ropen.Get("/subscriptions/unsubscribe", s.unsubscribeDigestCtrl)
+			ropen.Post("/subscriptions/unsubscribe", s.unsubscribeDigestCtrl)
 
 			ropen.Mount("/rss", s.rssRoutes())
 			ropen.Mount("/img", s.ImageProxy.Routes())
@@ -252,11 +324,22 @@ func (s *Rest) routes() chi.Router {
 			rauth.Put("/comment/{id}", s.updateCommentCtrl)
 			rauth.Get("/user", s.userInfoCtrl)
 			rauth.Put("/vote/{id}", s.voteCtrl)
+			rauth.Post("/report/{id}", s.reportCtrl)
+			rauth.Get("/notify", s.getReplyNotifyCtrl)
+			rauth.Put("/notify", s.setReplyNotifyCtrl)
+			rauth.Post("/subscribe", s.subscribeCtrl)
+			rauth.Delete("/subscribe", s.unsubscribeCtrl)
+			rauth.Get("/subscriptions", s.subscriptionsCtrl)
 			rauth.Get("/userdata", s.userAllDataCtrl)
 			rauth.Post("/deleteme", s.deleteMeCtrl)
+		})
 
-			// admin routes, admin users only
-			rauth.Mount("/admin", s.adminService.routes(authMiddleware.AdminOnly))
+		// admin routes, admin and moderator users or admin api tokens only
+		rapi.Group(func(radmin chi.Router) {
+			radmin.Use(tollbooth_chi.LimitHandler(tollbooth.NewLimiter(10, nil)))
+			radmin.Use(s.adminService.apiTokenAuth(authMiddleware.Auth))
+			radmin.Use(logger.New(logger.Flags(logger.All), logger.IPfn(ipFn)).Handler)
+			radmin.Mount("/admin", s.adminService.routes())
 		})
 	})
 
@@ -343,10 +426,152 @@ func filterComments(comments []store.Comment, fn func(c store.Comment) bool) (fi
 // URLKey gets url from request to use it as cache key
 // admins will have different keys in order to prevent leak of admin-only data to regular users
 func URLKey(r *http.Request) string {
-	adminPrefix := "admin!!"
-	key := strings.TrimPrefix(r.URL.String(), adminPrefix)          // prevents attach with fake url to get admin view
 	if user, err := rest.GetUserInfo(r); err == nil && user.Admin { // make separate cache key for admins
-		key = adminPrefix + key
+		return prefixedURLKey(r, adminKeyPrefix)
+	}
+	return prefixedURLKey(r, "")
+}
+
+// prefixedURLKey gets url from request to use it as cache key with prefix of user's view
+func prefixedURLKey(r *http.Request, prefix string) string {
+	key := r.URL.String()
+	for _, p := range []string{adminKeyPrefix, moderatorKeyPrefix} {
+		key = strings.TrimPrefix(key, p) // prevents attach with fake url to get admin view
+	}
+	return prefix + key
+}
+
+// cacheKey makes URLKey separate for moderators of the site, and personal for shadow-banned users,
+// as only they see their own comments
+func (s *Rest) cacheKey(r *http.Request) string {
+	siteID := r.URL.Query().Get("site")
+	user, err := rest.GetUserInfo(r)
+	if err != nil || user.Admin {
+		return URLKey(r)
+	}
+	switch {
+	case s.DataService.IsModerator(siteID, user.ID):
+		return prefixedURLKey(r, moderatorKeyPrefix)
+	case s.DataService.IsShadowBanned(siteID, user.ID):
+		return shadowKeyPrefix + user.ID + "!!" + URLKey(r)
+	}
+	return URLKey(r)
+}
+
+// siteEnabled middleware rejects requests to site disabled in sites registry, site from "site" query param
+func (s *Rest) siteEnabled(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if siteID := r.URL.Query().Get("site"); siteID != "" && s.DataService.IsSiteDisabled(siteID) {
+			rest.SendErrorJSON(w, r, http.StatusForbidden, errors.Errorf("site %s disabled", siteID), "site disabled")
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// names of header and cookie with user's token, the same as used by auth
+const (
+	jwtHeaderKey  = "X-JWT"
+	jwtCookieName = "JWT"
+)
+
+// prevKeyTokens middleware accepts user's token signed with the previous key of the site during grace period
+// after key rotation. Such token re-signed with the current key, replaced in the request and sent back to the user,
+// as a cookie or X-JWT header, the same way it came
+func (s *Rest) prevKeyTokens(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		rotator, ok := s.DataService.AdminStore.(adminstore.Rotator)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		tkn, fromCookie := r.Header.Get(jwtHeaderKey), false
+		if tkn == "" {
+			if c, err := r.Cookie(jwtCookieName); err == nil {
+				tkn, fromCookie = c.Value, true
+			}
+		}
+		if tkn == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		tokenService := s.Authenticator.TokenService()
+		if _, err := tokenService.Parse(tkn); err == nil { // signed with the current key
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		claims, err := parsePrevKeyToken(tkn, rotator)
+		if err != nil { // leave invalid token as is, rejected by auth
+			next.ServeHTTP(w, r)
+			return
+		}
+		newTkn, err := tokenService.Token(claims)
+		if err != nil {
+			log.Printf("[WARN] can't re-sign token for site %s, %v", claims.Audience, err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if fromCookie {
+			cookies := r.Cookies()
+			r.Header.Del("Cookie")
+			for _, c := range cookies {
+				if c.Name == jwtCookieName {
+					c.Value = newTkn
+				}
+				r.AddCookie(c)
+			}
+			if err = tokenService.Set(w, claims); err != nil {
+				log.Printf("[WARN] can't set re-signed token for site %s, %v", claims.Audience, err)
+			}
+		} else {
+			r.Header.Set(jwtHeaderKey, newTkn)
+			w.Header().Set(jwtHeaderKey, newTkn)
+		}
+		log.Printf("[DEBUG] token signed with previous key of site %s re-signed", claims.Audience)
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// parsePrevKeyToken verifies token with the previous key of the site (token's audience), valid during grace period only.
+// Expiration not checked, expired tokens refreshed by auth
+func parsePrevKeyToken(tkn string, rotator adminstore.Rotator) (token.Claims, error) {
+	parser := jwt.Parser{SkipClaimsValidation: true}
+	preClaims := token.Claims{}
+	if _, _, err := parser.ParseUnverified(tkn, &preClaims); err != nil {
+		return token.Claims{}, errors.Wrap(err, "can't pre-parse token")
+	}
+	prevKey, ok := rotator.PrevKey(preClaims.Audience)
+	if !ok {
+		return token.Claims{}, errors.Errorf("no valid previous key for site %s", preClaims.Audience)
+	}
+
+	claims := token.Claims{}
+	t, err := parser.ParseWithClaims(tkn, &claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.Errorf("unexpected signing method: %v", t.Header["alg"])
+		}
+		return []byte(prevKey), nil
+	})
+	if err != nil {
+		return token.Claims{}, errors.Wrap(err, "can't parse token with previous key")
+	}
+	if !t.Valid {
+		return token.Claims{}, errors.New("invalid token")
+	}
+	return claims, nil
+}
+
+func contains(s string, list []string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
 	}
-	return key
+	return false
 }
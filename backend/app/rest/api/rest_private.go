@@ -3,10 +3,11 @@ package api
 import (
 	"compress/gzip"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/mail"
+	"net/url"
 	"strings"
 	"time"
 
@@ -14,11 +15,13 @@ import (
 	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
 	multierror "github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
 
 	"github.com/go-pkgz/auth/token"
 	R "github.com/go-pkgz/rest"
 	"github.com/go-pkgz/rest/cache"
 
+	"github.com/umputun/remark/backend/app/notify"
 	"github.com/umputun/remark/backend/app/rest"
 	"github.com/umputun/remark/backend/app/store"
 	"github.com/umputun/remark/backend/app/store/service"
@@ -58,6 +61,14 @@ func (s *Rest) createCommentCtrl(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if s.DataService.TooFrequent(comment) {
+		rest.SendErrorJSON(w, r, http.StatusTooManyRequests, errors.New("rejected"), "too frequent anonymous comments")
+		return
+	}
+
+	comment.Pending = s.DataService.NeedsApproval(comment) // pre-moderated comment published after approval
+	comment.Shadow = s.DataService.IsShadowBanned(comment.Locator.SiteID, comment.User.ID)
+
 	id, err := s.DataService.Create(comment)
 	if err != nil {
 		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "can't save comment")
@@ -73,10 +84,11 @@ func (s *Rest) createCommentCtrl(w http.ResponseWriter, r *http.Request) {
 	s.Cache.Flush(cache.Flusher(comment.Locator.SiteID).
 		Scopes(comment.Locator.URL, lastCommentsScope, comment.User.ID, comment.Locator.SiteID))
 
-	if s.NotifyService != nil {
+	if s.NotifyService != nil && !finalComment.Shadow {
 		s.NotifyService.Submit(finalComment)
 	}
 
+	finalComment.Shadow = false // author doesn't know about shadow-ban
 	render.Status(r, http.StatusCreated)
 	render.JSON(w, r, &finalComment)
 }
@@ -127,6 +139,16 @@ func (s *Rest) updateCommentCtrl(w http.ResponseWriter, r *http.Request) {
 	}
 
 	s.Cache.Flush(cache.Flusher(locator.SiteID).Scopes(locator.URL, lastCommentsScope, user.ID))
+	if !res.Shadow {
+		event := notify.EventUpdate
+		if edit.Delete {
+			event = notify.EventDelete
+		}
+		s.NotifyService.SubmitEvent(event, res)
+	}
+	res.Revisions = nil // available to admins via revisions api only
+	res.Reports = nil
+	res.Shadow = false
 	render.JSON(w, r, res)
 }
 
@@ -135,6 +157,7 @@ func (s *Rest) userInfoCtrl(w http.ResponseWriter, r *http.Request) {
 	user := rest.MustGetUserInfo(r)
 	if siteID := r.URL.Query().Get("site"); siteID != "" {
 		user.Verified = s.DataService.IsVerified(siteID, user.ID)
+		user.Moderator = s.DataService.IsModerator(siteID, user.ID) // from the store, changes applied without new token
 	}
 
 	render.JSON(w, r, user)
@@ -166,9 +189,225 @@ func (s *Rest) voteCtrl(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	s.Cache.Flush(cache.Flusher(locator.SiteID).Scopes(locator.URL, comment.User.ID))
+	if !comment.Shadow {
+		s.NotifyService.SubmitEvent(notify.EventVote, comment)
+	}
 	render.JSON(w, r, R.JSON{"id": comment.ID, "score": comment.Score})
 }
 
+// POST /report/{id}?site=siteID&url=post-url - report comment to admins, body is {"reason": "why"}
+func (s *Rest) reportCtrl(w http.ResponseWriter, r *http.Request) {
+	report := struct {
+		Reason string `json:"reason"`
+	}{}
+	if err := render.DecodeJSON(http.MaxBytesReader(w, r.Body, hardBodyLimit), &report); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't bind report")
+		return
+	}
+	if strings.TrimSpace(report.Reason) == "" {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, errors.New("empty reason"), "can't report comment")
+		return
+	}
+
+	user := rest.MustGetUserInfo(r)
+	locator := store.Locator{SiteID: r.URL.Query().Get("site"), URL: r.URL.Query().Get("url")}
+	id := chi.URLParam(r, "id")
+	log.Printf("[DEBUG] report comment %s", id)
+
+	if s.adminService.checkBlocked(locator.SiteID, user) {
+		rest.SendErrorJSON(w, r, http.StatusForbidden, errors.New("rejected"), "user blocked")
+		return
+	}
+
+	comment, err := s.DataService.ReportComment(locator, id, user.ID, strings.TrimSpace(report.Reason))
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't report comment")
+		return
+	}
+	if comment.Pending { // hidden for review
+		s.Cache.Flush(cache.Flusher(locator.SiteID).Scopes(locator.URL, lastCommentsScope, comment.User.ID, locator.SiteID))
+	} else {
+		s.Cache.Flush(cache.Flusher(locator.SiteID).Scopes(locator.URL))
+	}
+	render.JSON(w, r, R.JSON{"id": comment.ID, "reported": true})
+}
+
+// GET /notify?site=siteID - returns current user's reply notifications opt-in, empty if opted-out
+func (s *Rest) getReplyNotifyCtrl(w http.ResponseWriter, r *http.Request) {
+	user := rest.MustGetUserInfo(r)
+	rn, err := s.DataService.ReplyNotify(r.URL.Query().Get("site"), user.ID)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't get reply notifications")
+		return
+	}
+	render.JSON(w, r, rn)
+}
+
+// PUT /notify?site=siteID - sets reply notifications of current user, body is {"email": "addr", "webhook": "url"}.
+// Both empty to opt-out. New email used after confirmation only, confirmation link sent to it and returned
+// in "confirmation" field of response
+func (s *Rest) setReplyNotifyCtrl(w http.ResponseWriter, r *http.Request) {
+	rn := store.ReplyNotify{}
+	if err := render.DecodeJSON(http.MaxBytesReader(w, r.Body, hardBodyLimit), &rn); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't bind reply notifications")
+		return
+	}
+	rn.Email, rn.Webhook = strings.TrimSpace(rn.Email), strings.TrimSpace(rn.Webhook)
+
+	if rn.Email != "" {
+		addr, err := mail.ParseAddress(rn.Email)
+		if err != nil {
+			rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "invalid email")
+			return
+		}
+		rn.Email = addr.Address
+	}
+	if rn.Webhook != "" {
+		u, err := url.Parse(rn.Webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			rest.SendErrorJSON(w, r, http.StatusBadRequest, errors.New("not http(s) url"), "invalid webhook")
+			return
+		}
+	}
+
+	user := rest.MustGetUserInfo(r)
+	siteID := r.URL.Query().Get("site")
+	resp := struct {
+		store.ReplyNotify
+		Confirmation string `json:"confirmation,omitempty"` // address confirmation sent to
+	}{}
+	if rn.Email != "" && !s.confirmedEmail(siteID, user.ID, rn.Email) {
+		claims := confirmClaims{Email: rn.Email, Action: confirmReplies,
+			StandardClaims: jwt.StandardClaims{Audience: siteID, Subject: user.ID}}
+		if !s.sendConfirmation(w, r, claims) {
+			return
+		}
+		resp.Confirmation = rn.Email
+		current, err := s.DataService.ReplyNotify(siteID, user.ID)
+		if err != nil {
+			rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't get reply notifications")
+			return
+		}
+		rn.Email = current.Email // kept till confirmation
+	}
+
+	if err := s.DataService.SetReplyNotify(siteID, user.ID, rn); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't set reply notifications")
+		return
+	}
+	log.Printf("[DEBUG] set reply notifications for %s, %+v", user.ID, rn)
+	resp.ReplyNotify = rn
+	render.JSON(w, r, resp)
+}
+
+// POST /subscribe?site=siteID&url=post-url - subscribes current user to digest of new comments of the post,
+// body is {"email": "addr", "period": "daily|weekly"}, daily by default. Subscription with not confirmed email
+// made after confirmation only, confirmation link sent to it and returned in "confirmation" field of response
+func (s *Rest) subscribeCtrl(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Email  string `json:"email"`
+		Period string `json:"period"`
+	}{}
+	if err := render.DecodeJSON(http.MaxBytesReader(w, r.Body, hardBodyLimit), &req); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't bind subscription")
+		return
+	}
+
+	locator := store.Locator{SiteID: r.URL.Query().Get("site"), URL: r.URL.Query().Get("url")}
+	if locator.URL == "" {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, errors.New("empty url"), "invalid subscription")
+		return
+	}
+	addr, err := mail.ParseAddress(strings.TrimSpace(req.Email))
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "invalid email")
+		return
+	}
+	switch req.Period {
+	case "":
+		req.Period = store.DigestDaily
+	case store.DigestDaily, store.DigestWeekly:
+	default:
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, errors.New("not daily or weekly"), "invalid period")
+		return
+	}
+
+	user := rest.MustGetUserInfo(r)
+	if err = s.checkSubscription(locator, user.ID); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't subscribe")
+		return
+	}
+	if !s.confirmedEmail(locator.SiteID, user.ID, addr.Address) {
+		claims := confirmClaims{Email: addr.Address, Action: confirmDigest, URL: locator.URL, Period: req.Period,
+			StandardClaims: jwt.StandardClaims{Audience: locator.SiteID, Subject: user.ID}}
+		if !s.sendConfirmation(w, r, claims) {
+			return
+		}
+		render.JSON(w, r, R.JSON{"url": locator.URL, "confirmation": addr.Address})
+		return
+	}
+
+	sub := store.Subscription{Locator: locator, UserID: user.ID, Email: addr.Address, Period: req.Period, LastSent: time.Now()}
+	if err = s.DataService.Subscribe(sub); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't subscribe")
+		return
+	}
+	log.Printf("[DEBUG] user %s subscribed to %s, %s", user.ID, locator.URL, sub.Period)
+	render.JSON(w, r, sub)
+}
+
+// checkSubscription rejects subscription to the post without comments and new subscriptions
+// of the user with maxSubscriptions already
+func (s *Rest) checkSubscription(locator store.Locator, userID string) error {
+	count, err := s.DataService.Count(locator)
+	if err != nil {
+		return errors.Wrapf(err, "can't get comments of %s", locator.URL)
+	}
+	if count == 0 {
+		return errors.Errorf("no comments for %s", locator.URL)
+	}
+	subs, err := s.DataService.Subscriptions(locator.SiteID, userID)
+	if err != nil {
+		return errors.Wrapf(err, "can't get subscriptions of %s", userID)
+	}
+	for _, sub := range subs {
+		if sub.Locator.URL == locator.URL {
+			return nil // update of existing subscription
+		}
+	}
+	if len(subs) >= maxSubscriptions {
+		return errors.Errorf("user %s has %d subscriptions already", userID, len(subs))
+	}
+	return nil
+}
+
+// DELETE /subscribe?site=siteID&url=post-url - unsubscribes current user from the post
+func (s *Rest) unsubscribeCtrl(w http.ResponseWriter, r *http.Request) {
+	locator := store.Locator{SiteID: r.URL.Query().Get("site"), URL: r.URL.Query().Get("url")}
+	if locator.URL == "" {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, errors.New("empty url"), "can't unsubscribe")
+		return
+	}
+	user := rest.MustGetUserInfo(r)
+	if err := s.DataService.Unsubscribe(locator, user.ID); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't unsubscribe")
+		return
+	}
+	log.Printf("[DEBUG] user %s unsubscribed from %s", user.ID, locator.URL)
+	render.JSON(w, r, R.JSON{"url": locator.URL, "unsubscribed": true})
+}
+
+// GET /subscriptions?site=siteID - lists posts subscriptions of current user
+func (s *Rest) subscriptionsCtrl(w http.ResponseWriter, r *http.Request) {
+	user := rest.MustGetUserInfo(r)
+	subs, err := s.DataService.Subscriptions(r.URL.Query().Get("site"), user.ID)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't get subscriptions")
+		return
+	}
+	render.JSON(w, r, subs)
+}
+
 // GET /userdata?site=siteID - exports all data about the user as a json with user info and list of all comments
 func (s *Rest) userAllDataCtrl(w http.ResponseWriter, r *http.Request) {
 	siteID := r.URL.Query().Get("site")
@@ -6,15 +6,21 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-pkgz/auth/token"
 	R "github.com/go-pkgz/rest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/umputun/remark/backend/app/notify"
 	"github.com/umputun/remark/backend/app/store"
+	"github.com/umputun/remark/backend/app/store/service"
 )
 
 func TestRest_Create(t *testing.T) {
@@ -180,6 +186,7 @@ func TestRest_Update(t *testing.T) {
 	assert.Equal(t, "updated text", c2.Orig)
 	assert.Equal(t, "my edit", c2.Edit.Summary)
 	assert.True(t, time.Since(c2.Edit.Timestamp) < 1*time.Second)
+	assert.Nil(t, c2.Revisions, "revisions not exposed")
 
 	// read updated comment
 	res, code := getWithAdminAuth(t, fmt.Sprintf("%s/api/v1/id/%s?site=radio-t&url=https://radio-t.com/blah1", ts.URL, id))
@@ -258,6 +265,315 @@ func TestRest_UpdateNotOwner(t *testing.T) {
 	assert.Equal(t, 400, b.StatusCode, string(body), "update is not json")
 }
 
+func TestRest_Report(t *testing.T) {
+	ts, srv, teardown := startupT(t)
+	defer teardown()
+	srv.DataService.ReportLimit = 2
+
+	id1 := addComment(t, store.Comment{Text: "test test #1",
+		Locator: store.Locator{SiteID: "radio-t", URL: "https://radio-t.com/blah"}}, ts)
+
+	report := func(body string) int {
+		client := http.Client{}
+		req, err := http.NewRequest(http.MethodPost,
+			fmt.Sprintf("%s/api/v1/report/%s?site=radio-t&url=https://radio-t.com/blah", ts.URL, id1), strings.NewReader(body))
+		assert.Nil(t, err)
+		req.SetBasicAuth("admin", "password")
+		resp, err := client.Do(req)
+		assert.Nil(t, err)
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, 400, report(`{"reason": " "}`), "reason required")
+	assert.Equal(t, 200, report(`{"reason": "spam"}`))
+	assert.Equal(t, 400, report(`{"reason": "spam"}`), "second report rejected")
+
+	body, code := get(t, fmt.Sprintf("%s/api/v1/id/%s?site=radio-t&url=https://radio-t.com/blah", ts.URL, id1))
+	require.Equal(t, 200, code)
+	cr := store.Comment{}
+	require.Nil(t, json.Unmarshal([]byte(body), &cr))
+	assert.Nil(t, cr.Reports, "reports hidden from public")
+
+	body, code = getWithAdminAuth(t, fmt.Sprintf("%s/api/v1/id/%s?site=radio-t&url=https://radio-t.com/blah", ts.URL, id1))
+	require.Equal(t, 200, code)
+	cr = store.Comment{}
+	require.Nil(t, json.Unmarshal([]byte(body), &cr))
+	require.Equal(t, 1, len(cr.Reports))
+	assert.Equal(t, "admin", cr.Reports[0].UserID)
+	assert.Equal(t, "spam", cr.Reports[0].Reason)
+
+	// second report hides comment
+	_, err := srv.DataService.ReportComment(store.Locator{SiteID: "radio-t", URL: "https://radio-t.com/blah"}, id1, "user2", "abuse")
+	require.Nil(t, err)
+	_, code = get(t, fmt.Sprintf("%s/api/v1/id/%s?site=radio-t&url=https://radio-t.com/blah", ts.URL, id1))
+	assert.Equal(t, 404, code)
+}
+
+func TestRest_ReplyNotify(t *testing.T) {
+	ts, srv, teardown := startupT(t)
+	defer teardown()
+
+	set := func(body string) (string, int) {
+		client := http.Client{}
+		req, err := http.NewRequest(http.MethodPut, ts.URL+"/api/v1/notify?site=radio-t", strings.NewReader(body))
+		require.Nil(t, err)
+		req.SetBasicAuth("admin", "password")
+		resp, err := client.Do(req)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		require.Nil(t, err)
+		return string(b), resp.StatusCode
+	}
+
+	body, code := getWithAdminAuth(t, ts.URL+"/api/v1/notify?site=radio-t")
+	require.Equal(t, 200, code)
+	assert.Equal(t, "{}\n", body, "not opted-in")
+
+	_, code = set(`{"email": "bad email"}`)
+	assert.Equal(t, 400, code)
+	_, code = set(`{"webhook": "ftp://example.com/hook"}`)
+	assert.Equal(t, 400, code)
+
+	_, code = set(`{"email": "admin@example.com"}`)
+	assert.Equal(t, 400, code, "no email sender")
+
+	sender := &mockEmailSender{}
+	srv.EmailSender, srv.RemarkURL = sender, ts.URL
+	body, code = set(`{"email": "Admin <admin@example.com>", "webhook": " https://example.com/hook "}`)
+	require.Equal(t, 200, code)
+	assert.Equal(t, `{"webhook":"https://example.com/hook","confirmation":"admin@example.com"}`+"\n", body)
+	rn, err := srv.DataService.ReplyNotify("radio-t", "admin")
+	require.Nil(t, err)
+	assert.Equal(t, store.ReplyNotify{Webhook: "https://example.com/hook"}, rn, "email not confirmed")
+
+	// confirm email by link
+	require.Equal(t, 1, len(sender.sent))
+	assert.Equal(t, "admin@example.com", sender.sent[0].to)
+	link := sender.link(t, ts.URL+"/api/v1/notify/confirm?tkn=")
+	body, code = get(t, link)
+	require.Equal(t, 200, code)
+	assert.Contains(t, body, `<form method="post">`, "page only, no changes")
+	rn, err = srv.DataService.ReplyNotify("radio-t", "admin")
+	require.Nil(t, err)
+	assert.Equal(t, "", rn.Email)
+	_, code = postNoAuth(t, ts.URL+"/api/v1/notify/confirm?tkn=bad")
+	assert.Equal(t, 403, code)
+	body, code = postNoAuth(t, link)
+	require.Equal(t, 200, code)
+	assert.Equal(t, `{"confirmed":true,"email":"admin@example.com","user":"admin"}`+"\n", body)
+	rn, err = srv.DataService.ReplyNotify("radio-t", "admin")
+	require.Nil(t, err)
+	assert.Equal(t, store.ReplyNotify{Email: "admin@example.com", Webhook: "https://example.com/hook"}, rn)
+
+	body, code = getWithAdminAuth(t, ts.URL+"/api/v1/notify?site=radio-t")
+	require.Equal(t, 200, code)
+	assert.Equal(t, `{"email":"admin@example.com","webhook":"https://example.com/hook"}`+"\n", body)
+	body, code = set(`{"email": "admin@example.com"}`)
+	require.Equal(t, 200, code)
+	assert.Equal(t, `{"email":"admin@example.com"}`+"\n", body, "confirmed email set without confirmation")
+	assert.Equal(t, 1, len(sender.sent))
+
+	// confirmations limited per address
+	srv.confirmLimiter = hourlyLimiter(1)
+	_, code = set(`{"email": "other@example.com"}`)
+	require.Equal(t, 200, code)
+	_, code = set(`{"email": "other@example.com"}`)
+	assert.Equal(t, 429, code)
+
+	// unsubscribe by signed link
+	_, code = get(t, ts.URL+"/api/v1/notify/unsubscribe?site=radio-t&user=admin&tkn=bad")
+	assert.Equal(t, 403, code)
+	_, code = get(t, ts.URL+"/api/v1/notify/unsubscribe?site=radio-t&user=admin&tkn="+
+		notify.UnsubscribeToken("123456", notify.UnsubscribeDigest, "radio-t", "admin"))
+	assert.Equal(t, 403, code, "token of digest unsubscribe link")
+	tkn := notify.UnsubscribeToken("123456", notify.UnsubscribeReplies, "radio-t", "admin")
+	_, code = postNoAuth(t, ts.URL+"/api/v1/notify/unsubscribe?site=radio-t&user=admin2&tkn="+tkn)
+	assert.Equal(t, 403, code, "token of other user")
+	body, code = get(t, ts.URL+"/api/v1/notify/unsubscribe?site=radio-t&user=admin&tkn="+tkn)
+	require.Equal(t, 200, code)
+	assert.Contains(t, body, `<form method="post">`, "page only, no changes")
+	rn, err = srv.DataService.ReplyNotify("radio-t", "admin")
+	require.Nil(t, err)
+	assert.Equal(t, "admin@example.com", rn.Email)
+	body, code = postNoAuth(t, ts.URL+"/api/v1/notify/unsubscribe?site=radio-t&user=admin&tkn="+tkn)
+	require.Equal(t, 200, code)
+	assert.Equal(t, `{"unsubscribed":true,"user":"admin"}`+"\n", body)
+	rn, err = srv.DataService.ReplyNotify("radio-t", "admin")
+	require.Nil(t, err)
+	assert.Equal(t, store.ReplyNotify{}, rn)
+
+	_, code = get(t, ts.URL+"/api/v1/notify?site=radio-t")
+	assert.Equal(t, 401, code, "auth required")
+}
+
+func TestRest_Subscriptions(t *testing.T) {
+	ts, srv, teardown := startupT(t)
+	defer teardown()
+
+	send := func(method, url, body string) (string, int) {
+		client := http.Client{}
+		req, err := http.NewRequest(method, ts.URL+url, strings.NewReader(body))
+		require.Nil(t, err)
+		req.SetBasicAuth("admin", "password")
+		resp, err := client.Do(req)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		require.Nil(t, err)
+		return string(b), resp.StatusCode
+	}
+
+	body, code := getWithAdminAuth(t, ts.URL+"/api/v1/subscriptions?site=radio-t")
+	require.Equal(t, 200, code)
+	assert.Equal(t, "[]\n", body)
+
+	_, code = send("POST", "/api/v1/subscribe?site=radio-t", `{"email": "admin@example.com"}`)
+	assert.Equal(t, 400, code, "no url")
+	_, code = send("POST", "/api/v1/subscribe?site=radio-t&url=https://radio-t.com/blah1", `{"email": "bad email"}`)
+	assert.Equal(t, 400, code)
+	_, code = send("POST", "/api/v1/subscribe?site=radio-t&url=https://radio-t.com/blah1",
+		`{"email": "admin@example.com", "period": "monthly"}`)
+	assert.Equal(t, 400, code)
+
+	_, code = send("POST", "/api/v1/subscribe?site=radio-t&url=https://radio-t.com/blah1", `{"email": "admin@example.com"}`)
+	assert.Equal(t, 400, code, "no comments for the post")
+	for _, u := range []string{"https://radio-t.com/blah1", "https://radio-t.com/blah2", "https://radio-t.com/blah3"} {
+		addComment(t, store.Comment{Text: "test", Locator: store.Locator{SiteID: "radio-t", URL: u}}, ts)
+	}
+	_, code = send("POST", "/api/v1/subscribe?site=radio-t&url=https://radio-t.com/blah1", `{"email": "admin@example.com"}`)
+	assert.Equal(t, 400, code, "no email sender")
+
+	// subscription with new email made after confirmation
+	sender := &mockEmailSender{}
+	srv.EmailSender, srv.RemarkURL = sender, ts.URL
+	body, code = send("POST", "/api/v1/subscribe?site=radio-t&url=https://radio-t.com/blah1", `{"email": "admin@example.com"}`)
+	require.Equal(t, 200, code)
+	assert.Equal(t, `{"confirmation":"admin@example.com","url":"https://radio-t.com/blah1"}`+"\n", body)
+	subs, err := srv.DataService.Subscriptions("radio-t", "admin")
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(subs), "email not confirmed")
+	require.Equal(t, 1, len(sender.sent))
+	assert.Contains(t, sender.sent[0].text, "new comments of https://radio-t.com/blah1")
+	body, code = postNoAuth(t, sender.link(t, ts.URL+"/api/v1/notify/confirm?tkn="))
+	require.Equal(t, 200, code)
+	assert.Equal(t, `{"confirmed":true,"email":"admin@example.com","user":"admin"}`+"\n", body)
+
+	// confirmed email reused
+	_, code = send("POST", "/api/v1/subscribe?site=radio-t&url=https://radio-t.com/blah2",
+		`{"email": "Admin <admin@example.com>", "period": "weekly"}`)
+	require.Equal(t, 200, code)
+	assert.Equal(t, 1, len(sender.sent))
+
+	body, code = getWithAdminAuth(t, ts.URL+"/api/v1/subscriptions?site=radio-t")
+	require.Equal(t, 200, code)
+	subs = []store.Subscription{}
+	require.Nil(t, json.Unmarshal([]byte(body), &subs))
+	require.Equal(t, 2, len(subs))
+	assert.Equal(t, store.Locator{SiteID: "radio-t", URL: "https://radio-t.com/blah1"}, subs[0].Locator)
+	assert.Equal(t, "admin", subs[0].UserID)
+	assert.Equal(t, "admin@example.com", subs[0].Email)
+	assert.Equal(t, store.DigestDaily, subs[0].Period)
+	assert.True(t, time.Since(subs[0].LastSent) < time.Minute, "new comments collected from now")
+	assert.Equal(t, "https://radio-t.com/blah2", subs[1].Locator.URL)
+	assert.Equal(t, "admin@example.com", subs[1].Email)
+	assert.Equal(t, store.DigestWeekly, subs[1].Period)
+
+	body, code = send("DELETE", "/api/v1/subscribe?site=radio-t&url=https://radio-t.com/blah1", "")
+	require.Equal(t, 200, code)
+	assert.Equal(t, `{"unsubscribed":true,"url":"https://radio-t.com/blah1"}`+"\n", body)
+	subs, err = srv.DataService.Subscriptions("radio-t", "admin")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(subs))
+	assert.Equal(t, "https://radio-t.com/blah2", subs[0].Locator.URL)
+
+	// new subscriptions limited per user, existing can be changed
+	for i := 0; i < maxSubscriptions; i++ {
+		require.Nil(t, srv.DataService.Subscribe(store.Subscription{UserID: "admin", Email: "admin@example.com",
+			Locator: store.Locator{SiteID: "radio-t", URL: fmt.Sprintf("https://radio-t.com/post%d", i)}}))
+	}
+	_, code = send("POST", "/api/v1/subscribe?site=radio-t&url=https://radio-t.com/blah3", `{"email": "admin@example.com"}`)
+	assert.Equal(t, 400, code, "too many subscriptions")
+	_, code = send("POST", "/api/v1/subscribe?site=radio-t&url=https://radio-t.com/blah2", `{"email": "admin@example.com"}`)
+	assert.Equal(t, 200, code)
+
+	// unsubscribe from all by signed link
+	_, code = get(t, ts.URL+"/api/v1/subscriptions/unsubscribe?site=radio-t&user=admin&tkn=bad")
+	assert.Equal(t, 403, code)
+	_, code = get(t, ts.URL+"/api/v1/subscriptions/unsubscribe?site=radio-t&user=admin&tkn="+
+		notify.UnsubscribeToken("123456", notify.UnsubscribeReplies, "radio-t", "admin"))
+	assert.Equal(t, 403, code, "token of reply unsubscribe link")
+	tkn := notify.UnsubscribeToken("123456", notify.UnsubscribeDigest, "radio-t", "admin")
+	body, code = get(t, ts.URL+"/api/v1/subscriptions/unsubscribe?site=radio-t&user=admin&tkn="+tkn)
+	require.Equal(t, 200, code)
+	assert.Contains(t, body, `<form method="post">`, "page only, no changes")
+	body, code = postNoAuth(t, ts.URL+"/api/v1/subscriptions/unsubscribe?site=radio-t&user=admin&tkn="+tkn)
+	require.Equal(t, 200, code)
+	assert.Equal(t, `{"unsubscribed":true,"user":"admin"}`+"\n", body)
+	subs, err = srv.DataService.Subscriptions("radio-t", "admin")
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(subs))
+
+	_, code = get(t, ts.URL+"/api/v1/subscriptions?site=radio-t")
+	assert.Equal(t, 401, code, "auth required")
+}
+
+func TestRest_WebhookEvents(t *testing.T) {
+	ts, srv, teardown := startupT(t)
+	defer teardown()
+
+	var lock sync.Mutex
+	var events []string
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		events = append(events, r.Header.Get("X-Remark42-Event"))
+		lock.Unlock()
+	}))
+	defer hook.Close()
+	wh, err := notify.NewWebhook(notify.WebhookParams{URLs: []string{hook.URL}}, srv.DataService.AdminStore)
+	require.Nil(t, err)
+	srv.NotifyService = notify.NewService(srv.DataService, notify.ServiceParams{}, wh)
+	srv.adminService.notifyService = srv.NotifyService
+	defer srv.NotifyService.Close()
+
+	id := addComment(t, store.Comment{Text: "test test #1",
+		Locator: store.Locator{SiteID: "radio-t", URL: "https://radio-t.com/blah"}}, ts)
+
+	client := http.Client{}
+	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/api/v1/comment/%s?site=radio-t&url=https://radio-t.com/blah",
+		ts.URL, id), strings.NewReader(`{"text":"updated text"}`))
+	require.Nil(t, err)
+	req.Header.Add("X-JWT", devToken)
+	resp, err := client.Do(req)
+	require.Nil(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+
+	for _, u := range []string{
+		fmt.Sprintf("%s/api/v1/vote/%s?site=radio-t&url=https://radio-t.com/blah&vote=1", ts.URL, id),
+		fmt.Sprintf("%s/api/v1/admin/user/dev?site=radio-t&block=1&ttl=1h", ts.URL),
+	} {
+		req, err = http.NewRequest(http.MethodPut, u, nil)
+		require.Nil(t, err)
+		req.SetBasicAuth("admin", "password")
+		resp, err = client.Do(req)
+		require.Nil(t, err)
+		require.Equal(t, 200, resp.StatusCode, u)
+	}
+
+	req, err = http.NewRequest(http.MethodDelete,
+		fmt.Sprintf("%s/api/v1/admin/comment/%s?site=radio-t&url=https://radio-t.com/blah", ts.URL, id), nil)
+	require.Nil(t, err)
+	req.SetBasicAuth("admin", "password")
+	resp, err = client.Do(req)
+	require.Nil(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+
+	time.Sleep(200 * time.Millisecond)
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, []string{"comment.create", "comment.update", "comment.vote", "user.block", "comment.delete"}, events)
+}
+
 func TestRest_Vote(t *testing.T) {
 	ts, _, teardown := startupT(t)
 	defer teardown()
@@ -301,6 +617,53 @@ func TestRest_Vote(t *testing.T) {
 	assert.Equal(t, map[string]bool{}, cr.Votes)
 }
 
+func TestRest_Anonymous(t *testing.T) {
+	ts, srv, teardown := startupT(t)
+	defer teardown()
+	srv.DataService.Anonymous = service.Anonymous{StrictSites: []string{"radio-t"}, MaxCommentSize: 20, Interval: time.Hour}
+
+	id1 := addComment(t, store.Comment{Text: "test test #1",
+		Locator: store.Locator{SiteID: "radio-t", URL: "https://radio-t.com/blah"}}, ts)
+
+	claims := token.Claims{User: &token.User{ID: store.AnonymousPrefix + "123", Name: "anon"},
+		StandardClaims: jwt.StandardClaims{Audience: "radio-t", ExpiresAt: time.Now().Add(time.Hour).Unix()}}
+	anonToken, err := srv.Authenticator.TokenService().Token(claims)
+	require.Nil(t, err)
+	client := http.Client{Timeout: 5 * time.Second}
+	send := func(method, url, body string) (int, string) {
+		req, e := http.NewRequest(method, ts.URL+url, strings.NewReader(body))
+		require.Nil(t, e)
+		req.Header.Add("X-JWT", anonToken)
+		resp, e := client.Do(req)
+		require.Nil(t, e)
+		defer resp.Body.Close()
+		b, e := ioutil.ReadAll(resp.Body)
+		require.Nil(t, e)
+		return resp.StatusCode, string(b)
+	}
+
+	code, body := send("PUT", "/api/v1/vote/"+id1+"?site=radio-t&url=https://radio-t.com/blah&vote=1", "")
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, body, "anonymous user anonymous_123 can not vote on site radio-t")
+
+	code, body = send("POST", "/api/v1/comment", `{"text": "some long anonymous comment",
+		"locator":{"url": "https://radio-t.com/blah", "site": "radio-t"}}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, body, "anonymous comment text exceeded max allowed size 20 (27)")
+
+	code, _ = send("POST", "/api/v1/comment", `{"text": "short comment", "locator":{"url": "https://radio-t.com/blah", "site": "radio-t"}}`)
+	assert.Equal(t, http.StatusCreated, code)
+	code, body = send("POST", "/api/v1/comment", `{"text": "next comment", "locator":{"url": "https://radio-t.com/blah", "site": "radio-t"}}`)
+	assert.Equal(t, http.StatusTooManyRequests, code)
+	assert.Contains(t, body, "too frequent anonymous comments")
+
+	srv.DataService.Anonymous = service.Anonymous{VoteSites: []string{"radio-t"}}
+	code, _ = send("POST", "/api/v1/comment", `{"text": "next comment", "locator":{"url": "https://radio-t.com/blah", "site": "radio-t"}}`)
+	assert.Equal(t, http.StatusCreated, code, "no strict limits")
+	code, _ = send("PUT", "/api/v1/vote/"+id1+"?site=radio-t&url=https://radio-t.com/blah&vote=1", "")
+	assert.Equal(t, http.StatusOK, code, "voting allowed")
+}
+
 func TestRest_UserAllData(t *testing.T) {
 	ts, srv, teardown := startupT(t)
 	defer teardown()
@@ -1,50 +1,80 @@
 package api
 
 import (
+	"crypto/hmac"
 	"crypto/sha1"
 	"encoding/base64"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
+	"github.com/pkg/errors"
 
 	R "github.com/go-pkgz/rest"
 	"github.com/go-pkgz/rest/cache"
 
+	"github.com/umputun/remark/backend/app/notify"
 	"github.com/umputun/remark/backend/app/rest"
 	"github.com/umputun/remark/backend/app/store"
+	adminstore "github.com/umputun/remark/backend/app/store/admin"
+	"github.com/umputun/remark/backend/app/store/engine"
 )
 
-// GET /find?site=siteID&url=post-url&format=[tree|plain]&sort=[+/-time|+/-score]
-// find comments for given post. Returns in tree or plain formats, sorted
+// GET /find?site=siteID&url=post-url&format=[tree|plain]&sort=[+/-time|+/-score]&limit=N&cursor=C
+// find comments for given post. Returns in tree or plain formats, sorted.
+// With limit or cursor returns a page of up to limit threads and next_cursor to request the next page
 func (s *Rest) findCommentsCtrl(w http.ResponseWriter, r *http.Request) {
 	locator := store.Locator{SiteID: r.URL.Query().Get("site"), URL: r.URL.Query().Get("url")}
 	sort := r.URL.Query().Get("sort")
 	if strings.HasPrefix(sort, " ") { // restore + replaced by " "
 		sort = "+" + sort[1:]
 	}
-	log.Printf("[DEBUG] get comments for %+v, sort %s, format %s", locator, sort, r.URL.Query().Get("format"))
+	cursor, limit := r.URL.Query().Get("cursor"), 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+			rest.SendErrorJSON(w, r, http.StatusBadRequest, errors.Errorf("invalid limit %q", v), "bad limit")
+			return
+		}
+	}
+	paged := limit > 0 || cursor != ""
+	log.Printf("[DEBUG] get comments for %+v, sort %s, format %s, limit %d, cursor %q",
+		locator, sort, r.URL.Query().Get("format"), limit, cursor)
 
-	key := cache.NewKey(locator.SiteID).ID(URLKey(r)).Scopes(locator.SiteID, locator.URL)
+	key := cache.NewKey(locator.SiteID).ID(s.cacheKey(r)).Scopes(locator.SiteID, locator.URL)
 	data, err := s.Cache.Get(key, func() ([]byte, error) {
-		comments, e := s.DataService.Find(locator, sort)
+		view := func(comments []store.Comment) []store.Comment { return s.adminService.alterComments(comments, r) }
+		page := engine.Page{}
+		var e error
+		if paged { // comments hidden from the user filtered before paging
+			page, e = s.DataService.FindPage(locator, sort, cursor, limit, view)
+		} else {
+			page.Comments, e = s.DataService.Find(locator, sort)
+			page.Comments = view(page.Comments)
+		}
 		if e != nil {
 			return nil, e
 		}
-		maskedComments := s.adminService.alterComments(comments, r)
+		maskedComments := page.Comments
 		var b []byte
 		switch r.URL.Query().Get("format") {
 		case "tree":
 			tree := rest.MakeTree(maskedComments, sort, s.ReadOnlyAge)
+			if paged { // tree made from the page only, info should be for the whole post
+				if info, ee := s.DataService.Info(locator, s.ReadOnlyAge); ee == nil {
+					tree.Info = info
+				}
+			}
 			if s.DataService.IsReadOnly(locator) {
 				tree.Info.ReadOnly = true
 			}
-			b, e = encodeJSONWithHTML(tree)
+			b, e = encodeJSONWithHTML(treeWithCursor{Tree: tree, NextCursor: page.NextCursor})
 		default:
-			withInfo := commentsWithInfo{Comments: maskedComments}
+			withInfo := commentsWithInfo{Comments: maskedComments, NextCursor: page.NextCursor}
 			if info, ee := s.DataService.Info(locator, s.ReadOnlyAge); ee == nil {
 				withInfo.Info = info
 			}
@@ -92,7 +122,7 @@ func (s *Rest) previewCommentCtrl(w http.ResponseWriter, r *http.Request) {
 func (s *Rest) infoCtrl(w http.ResponseWriter, r *http.Request) {
 	locator := store.Locator{SiteID: r.URL.Query().Get("site"), URL: r.URL.Query().Get("url")}
 
-	key := cache.NewKey(locator.SiteID).ID(URLKey(r)).Scopes(locator.SiteID, locator.URL)
+	key := cache.NewKey(locator.SiteID).ID(s.cacheKey(r)).Scopes(locator.SiteID, locator.URL)
 	data, err := s.Cache.Get(key, func() ([]byte, error) {
 		info, e := s.DataService.Info(locator, s.ReadOnlyAge)
 		if e != nil {
@@ -121,7 +151,7 @@ func (s *Rest) lastCommentsCtrl(w http.ResponseWriter, r *http.Request) {
 		limit = 0
 	}
 
-	key := cache.NewKey(siteID).ID(URLKey(r)).Scopes(lastCommentsScope)
+	key := cache.NewKey(siteID).ID(s.cacheKey(r)).Scopes(lastCommentsScope)
 	data, err := s.Cache.Get(key, func() ([]byte, error) {
 		comments, e := s.DataService.Last(siteID, limit)
 		if e != nil {
@@ -143,6 +173,74 @@ func (s *Rest) lastCommentsCtrl(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// GET /search?site=siteID&q=query&user=userID&url=post-url&from=time&to=time&limit=N&skip=N - search comments
+// allowed for sites with public search only. Time in RFC3339 format, all filters are optional
+func (s *Rest) searchCommentsCtrl(w http.ResponseWriter, r *http.Request) {
+	req, err := searchRequest(r)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "bad search request")
+		return
+	}
+	if !contains(req.SiteID, s.PublicSearch) {
+		rest.SendErrorJSON(w, r, http.StatusForbidden, errors.Errorf("search disabled for %s", req.SiteID), "search disabled")
+		return
+	}
+	log.Printf("[DEBUG] search comments for %+v", req)
+
+	key := cache.NewKey(req.SiteID).ID(s.cacheKey(r)).Scopes(req.SiteID, lastCommentsScope)
+	data, err := s.Cache.Get(key, func() ([]byte, error) {
+		comments, e := s.DataService.Search(req)
+		if e != nil {
+			return nil, e
+		}
+		comments = s.adminService.alterComments(comments, r)
+		// blocked users marked as deleted by alterComments
+		filtered := filterComments(comments, func(c store.Comment) bool { return !c.Deleted })
+		if filtered == nil {
+			filtered = []store.Comment{}
+		}
+		return encodeJSONWithHTML(filtered)
+	})
+
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't search comments")
+		return
+	}
+
+	if err = R.RenderJSONFromBytes(w, r, data); err != nil {
+		log.Printf("[WARN] can't render search results for site %s", req.SiteID)
+	}
+}
+
+// searchRequest makes search request from query params, used by public and admin search
+func searchRequest(r *http.Request) (engine.SearchRequest, error) {
+	query := r.URL.Query()
+	req := engine.SearchRequest{SiteID: query.Get("site"), Query: query.Get("q"), UserID: query.Get("user"), URL: query.Get("url")}
+
+	var err error
+	if v := query.Get("from"); v != "" {
+		if req.From, err = time.Parse(time.RFC3339, v); err != nil {
+			return req, errors.Wrapf(err, "invalid from %q", v)
+		}
+	}
+	if v := query.Get("to"); v != "" {
+		if req.To, err = time.Parse(time.RFC3339, v); err != nil {
+			return req, errors.Wrapf(err, "invalid to %q", v)
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		if req.Limit, err = strconv.Atoi(v); err != nil {
+			return req, errors.Wrapf(err, "invalid limit %q", v)
+		}
+	}
+	if v := query.Get("skip"); v != "" {
+		if req.Skip, err = strconv.Atoi(v); err != nil {
+			return req, errors.Wrapf(err, "invalid skip %q", v)
+		}
+	}
+	return req, nil
+}
+
 // GET /id/{id}?site=siteID&url=post-url - gets a comment by id
 func (s *Rest) commentByIDCtrl(w http.ResponseWriter, r *http.Request) {
 
@@ -157,7 +255,12 @@ func (s *Rest) commentByIDCtrl(w http.ResponseWriter, r *http.Request) {
 		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't get comment by id")
 		return
 	}
-	comment = s.adminService.alterComments([]store.Comment{comment}, r)[0]
+	altered := s.adminService.alterComments([]store.Comment{comment}, r)
+	if len(altered) == 0 { // pending comment hidden from non-admins
+		rest.SendErrorJSON(w, r, http.StatusNotFound, errors.New("not found"), "can't get comment by id")
+		return
+	}
+	comment = altered[0]
 	render.Status(r, http.StatusOK)
 
 	if err = R.RenderJSONWithHTML(w, r, comment); err != nil {
@@ -183,7 +286,7 @@ func (s *Rest) findUserCommentsCtrl(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("[DEBUG] get comments for userID %s, %s", userID, siteID)
 
-	key := cache.NewKey(siteID).ID(URLKey(r)).Scopes(userID, siteID)
+	key := cache.NewKey(siteID).ID(s.cacheKey(r)).Scopes(userID, siteID)
 	data, err := s.Cache.Get(key, func() ([]byte, error) {
 		comments, e := s.DataService.User(siteID, userID, limit, 0)
 		if e != nil {
@@ -218,6 +321,7 @@ func (s *Rest) configCtrl(w http.ResponseWriter, r *http.Request) {
 		EditDuration   int      `json:"edit_duration"`
 		MaxCommentSize int      `json:"max_comment_size"`
 		Admins         []string `json:"admins"`
+		Moderators     []string `json:"moderators"`
 		AdminEmail     string   `json:"admin_email"`
 		Auth           []string `json:"auth_providers"`
 		LowScore       int      `json:"low_score"`
@@ -230,6 +334,7 @@ func (s *Rest) configCtrl(w http.ResponseWriter, r *http.Request) {
 		EditDuration:   int(s.DataService.EditDuration.Seconds()),
 		MaxCommentSize: s.DataService.MaxCommentSize,
 		Admins:         s.DataService.AdminStore.Admins(siteID),
+		Moderators:     s.DataService.AdminStore.Moderators(siteID),
 		AdminEmail:     s.DataService.AdminStore.Email(siteID),
 		LowScore:       s.ScoreThresholds.Low,
 		CriticalScore:  s.ScoreThresholds.Critical,
@@ -244,6 +349,9 @@ func (s *Rest) configCtrl(w http.ResponseWriter, r *http.Request) {
 	if cnf.Admins == nil { // prevent json serialization to nil
 		cnf.Admins = []string{}
 	}
+	if cnf.Moderators == nil {
+		cnf.Moderators = []string{}
+	}
 	render.Status(r, http.StatusOK)
 	render.JSON(w, r, cnf)
 }
@@ -269,7 +377,7 @@ func (s *Rest) countMultiCtrl(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// key could be long for multiple posts, make it sha1
-	k := URLKey(r) + strings.Join(posts, ",")
+	k := s.cacheKey(r) + strings.Join(posts, ",")
 	hasher := sha1.New()
 	if _, err := hasher.Write([]byte(k)); err != nil {
 		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "can't make sha1 for list of urls")
@@ -308,7 +416,7 @@ func (s *Rest) listCtrl(w http.ResponseWriter, r *http.Request) {
 		skip = v
 	}
 
-	key := cache.NewKey(siteID).ID(URLKey(r)).Scopes(siteID)
+	key := cache.NewKey(siteID).ID(s.cacheKey(r)).Scopes(siteID)
 	data, err := s.Cache.Get(key, func() ([]byte, error) {
 		posts, e := s.DataService.List(siteID, limit, skip)
 		if e != nil {
@@ -326,3 +434,74 @@ func (s *Rest) listCtrl(w http.ResponseWriter, r *http.Request) {
 		log.Printf("[WARN] can't render posts lits for site %s", siteID)
 	}
 }
+
+// GET /notify/unsubscribe?site=siteID&user=userID&tkn=token - page of opt-out from reply notifications by signed link,
+// POST with the same params opts-out
+func (s *Rest) unsubscribeReplyNotifyCtrl(w http.ResponseWriter, r *http.Request) {
+	siteID, userID, tkn := r.URL.Query().Get("site"), r.URL.Query().Get("user"), r.URL.Query().Get("tkn")
+	valid, err := s.validUnsubscribeToken(notify.UnsubscribeReplies, siteID, userID, tkn)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't get site key")
+		return
+	}
+	if !valid {
+		rest.SendErrorJSON(w, r, http.StatusForbidden, errors.New("bad token"), "can't unsubscribe")
+		return
+	}
+	if r.Method != http.MethodPost {
+		actionPage(w, r, "Unsubscribe", "Stop notifications about replies to your comments on "+siteID+".")
+		return
+	}
+	if err = s.DataService.SetReplyNotify(siteID, userID, store.ReplyNotify{}); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't unsubscribe")
+		return
+	}
+	log.Printf("[INFO] user %s unsubscribed from reply notifications on %s", userID, siteID)
+	render.JSON(w, r, R.JSON{"user": userID, "unsubscribed": true})
+}
+
+// GET /subscriptions/unsubscribe?site=siteID&user=userID&tkn=token - page of unsubscribe from all digests of the site,
+// used by link in digest email, POST with the same params unsubscribes. Token signed with site's secret
+func (s *Rest) unsubscribeDigestCtrl(w http.ResponseWriter, r *http.Request) {
+	siteID, userID, tkn := r.URL.Query().Get("site"), r.URL.Query().Get("user"), r.URL.Query().Get("tkn")
+	valid, err := s.validUnsubscribeToken(notify.UnsubscribeDigest, siteID, userID, tkn)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't get site key")
+		return
+	}
+	if !valid {
+		rest.SendErrorJSON(w, r, http.StatusForbidden, errors.New("bad token"), "can't unsubscribe")
+		return
+	}
+	if r.Method != http.MethodPost {
+		actionPage(w, r, "Unsubscribe", "Stop digests of new comments on "+siteID+".")
+		return
+	}
+	if err = s.DataService.Unsubscribe(store.Locator{SiteID: siteID}, userID); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't unsubscribe")
+		return
+	}
+	log.Printf("[INFO] user %s unsubscribed from all digests on %s", userID, siteID)
+	render.JSON(w, r, R.JSON{"user": userID, "unsubscribed": true})
+}
+
+// validUnsubscribeToken checks token of unsubscribe link of the given purpose, signed with the current key of the site or,
+// during grace period after key rotation, with the previous one
+func (s *Rest) validUnsubscribeToken(purpose, siteID, userID, tkn string) (bool, error) {
+	key, err := s.DataService.AdminStore.Key(siteID)
+	if err != nil {
+		return false, err
+	}
+	if userID == "" {
+		return false, nil
+	}
+	if hmac.Equal([]byte(tkn), []byte(notify.UnsubscribeToken(key, purpose, siteID, userID))) {
+		return true, nil
+	}
+	if rotator, ok := s.DataService.AdminStore.(adminstore.Rotator); ok {
+		if prevKey, ok := rotator.PrevKey(siteID); ok {
+			return hmac.Equal([]byte(tkn), []byte(notify.UnsubscribeToken(prevKey, purpose, siteID, userID))), nil
+		}
+	}
+	return false, nil
+}
@@ -5,16 +5,21 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"strings"
 	"testing"
 	"time"
 
+	bolt "github.com/coreos/bbolt"
 	R "github.com/go-pkgz/rest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/umputun/remark/backend/app/notify"
 	"github.com/umputun/remark/backend/app/rest"
 	"github.com/umputun/remark/backend/app/store"
+	adminstore "github.com/umputun/remark/backend/app/store/admin"
+	"github.com/umputun/remark/backend/app/store/service"
 )
 
 func TestRest_Ping(t *testing.T) {
@@ -118,6 +123,97 @@ func TestRest_Find(t *testing.T) {
 	assert.False(t, tree.Info.ReadOnly, "post is fresh")
 }
 
+func TestRest_FindPage(t *testing.T) {
+	ts, srv, teardown := startupT(t)
+	defer teardown()
+
+	ids := []string{}
+	for i := 0; i < 3; i++ {
+		c := store.Comment{Text: fmt.Sprintf("top #%d", i), Locator: store.Locator{SiteID: "radio-t", URL: "https://radio-t.com/blah1"}}
+		ids = append(ids, addComment(t, c, ts))
+	}
+	reply := store.Comment{Text: "reply", ParentID: ids[0], Locator: store.Locator{SiteID: "radio-t", URL: "https://radio-t.com/blah1"}}
+	replyID := addComment(t, reply, ts)
+
+	// first page in plain mode
+	res, code := get(t, ts.URL+"/api/v1/find?site=radio-t&url=https://radio-t.com/blah1&sort=+time&limit=2")
+	assert.Equal(t, 200, code)
+	comments := commentsWithInfo{}
+	require.Nil(t, json.Unmarshal([]byte(res), &comments))
+	require.Equal(t, 3, len(comments.Comments), "two threads, one with reply")
+	assert.Equal(t, ids[0], comments.Comments[0].ID)
+	assert.Equal(t, replyID, comments.Comments[1].ID)
+	assert.Equal(t, ids[1], comments.Comments[2].ID)
+	assert.Equal(t, 4, comments.Info.Count, "info for the whole post")
+	require.NotEmpty(t, comments.NextCursor)
+
+	// next page in tree mode
+	tree := treeWithCursor{}
+	res, code = get(t, ts.URL+"/api/v1/find?site=radio-t&url=https://radio-t.com/blah1&sort=+time&limit=2&format=tree&cursor="+
+		comments.NextCursor)
+	assert.Equal(t, 200, code)
+	require.Nil(t, json.Unmarshal([]byte(res), &tree))
+	require.Equal(t, 1, len(tree.Nodes))
+	assert.Equal(t, ids[2], tree.Nodes[0].Comment.ID)
+	assert.Equal(t, 4, tree.Info.Count, "info for the whole post")
+	assert.Empty(t, tree.NextCursor, "last page")
+
+	// pending thread hidden before paging, doesn't take a slot of the page
+	srv.DataService.PreModeration = service.PreModeration{Mode: service.PreModAll}
+	addComment(t, store.Comment{Text: "pending", Locator: store.Locator{SiteID: "radio-t", URL: "https://radio-t.com/blah1"}}, ts)
+	srv.DataService.PreModeration = service.PreModeration{}
+	lastID := addComment(t, store.Comment{Text: "last", Locator: store.Locator{SiteID: "radio-t", URL: "https://radio-t.com/blah1"}}, ts)
+	res, code = get(t, ts.URL+"/api/v1/find?site=radio-t&url=https://radio-t.com/blah1&sort=+time&limit=2&cursor="+
+		comments.NextCursor)
+	assert.Equal(t, 200, code)
+	comments = commentsWithInfo{}
+	require.Nil(t, json.Unmarshal([]byte(res), &comments))
+	assert.Equal(t, []string{ids[2], lastID}, []string{comments.Comments[0].ID, comments.Comments[1].ID})
+	assert.Equal(t, 2, len(comments.Comments))
+	assert.Empty(t, comments.NextCursor, "last page")
+
+	_, code = get(t, ts.URL+"/api/v1/find?site=radio-t&url=https://radio-t.com/blah1&limit=2&cursor=bad")
+	assert.Equal(t, 400, code, "invalid cursor")
+	_, code = get(t, ts.URL+"/api/v1/find?site=radio-t&url=https://radio-t.com/blah1&limit=-1")
+	assert.Equal(t, 400, code, "invalid limit")
+}
+
+func TestRest_Search(t *testing.T) {
+	ts, srv, teardown := startupT(t)
+	defer teardown()
+
+	for _, text := range []string{"first search text", "second search text", "something else"} {
+		addComment(t, store.Comment{Text: text, Locator: store.Locator{SiteID: "radio-t", URL: "https://radio-t.com/blah1"}}, ts)
+	}
+
+	_, code := get(t, ts.URL+"/api/v1/search?site=radio-t&q=search")
+	assert.Equal(t, http.StatusForbidden, code, "public search disabled")
+
+	srv.PublicSearch = []string{"radio-t"}
+	res, code := get(t, ts.URL+"/api/v1/search?site=radio-t&q=search+text")
+	assert.Equal(t, http.StatusOK, code)
+	comments := []store.Comment{}
+	require.Nil(t, json.Unmarshal([]byte(res), &comments))
+	require.Equal(t, 2, len(comments))
+	assert.Equal(t, "second search text", comments[0].Orig, "sorted by time desc")
+	assert.Equal(t, "", comments[0].User.IP, "user info hidden")
+
+	res, code = get(t, ts.URL+"/api/v1/search?site=radio-t&q=search&limit=1&skip=1&url=https://radio-t.com/blah1")
+	assert.Equal(t, http.StatusOK, code)
+	require.Nil(t, json.Unmarshal([]byte(res), &comments))
+	require.Equal(t, 1, len(comments))
+	assert.Equal(t, "first search text", comments[0].Orig)
+
+	res, code = get(t, ts.URL+"/api/v1/search?site=radio-t&q=search&from="+time.Now().Add(time.Hour).Format(time.RFC3339))
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "[]\n", res, "nothing in future")
+
+	_, code = get(t, ts.URL+"/api/v1/search?site=radio-t&q=search&from=bad")
+	assert.Equal(t, http.StatusBadRequest, code, "bad time")
+	_, code = get(t, ts.URL+"/api/v1/search?site=radio-t")
+	assert.Equal(t, http.StatusBadRequest, code, "no query")
+}
+
 func TestRest_FindAge(t *testing.T) {
 	ts, srv, teardown := startupT(t)
 	defer teardown()
@@ -272,7 +368,7 @@ func TestRest_FindUserComments(t *testing.T) {
 }
 
 func TestRest_UserInfo(t *testing.T) {
-	ts, _, teardown := startupT(t)
+	ts, srv, teardown := startupT(t)
 	defer teardown()
 
 	body, code := getWithDevAuth(t, ts.URL+"/api/v1/user?site=radio-t")
@@ -281,6 +377,19 @@ func TestRest_UserInfo(t *testing.T) {
 	err := json.Unmarshal([]byte(body), &user)
 	assert.Nil(t, err)
 	assert.Equal(t, store.User{Name: "developer one", ID: "dev", Picture: "http://example.com/pic.png", IP: "127.0.0.1"}, user)
+
+	srv.DataService.AdminStore = siteModerators{StaticStore: adminstore.NewStaticStore("123456", []string{"a1", "a2"}, nil, ""),
+		moderators: map[string][]string{"radio-t": {"dev"}}}
+	body, code = getWithDevAuth(t, ts.URL+"/api/v1/user?site=radio-t")
+	assert.Equal(t, 200, code)
+	user = store.User{}
+	require.Nil(t, json.Unmarshal([]byte(body), &user))
+	assert.True(t, user.Moderator, "moderator of the site, with the same token")
+	body, code = getWithDevAuth(t, ts.URL+"/api/v1/user?site=other")
+	assert.Equal(t, 200, code)
+	user = store.User{}
+	require.Nil(t, json.Unmarshal([]byte(body), &user))
+	assert.False(t, user.Moderator, "not moderator of other site")
 }
 
 func TestRest_Count(t *testing.T) {
@@ -378,6 +487,7 @@ func TestRest_Config(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, 300., j["edit_duration"])
 	assert.EqualValues(t, []interface{}([]interface{}{"a1", "a2"}), j["admins"])
+	assert.EqualValues(t, []interface{}{"m1"}, j["moderators"])
 	assert.Equal(t, "admin@remark-42.com", j["admin_email"])
 	assert.Equal(t, 4000., j["max_comment_size"])
 	assert.Equal(t, -5., j["low_score"])
@@ -433,3 +543,42 @@ func TestRest_Robots(t *testing.T) {
 		"Allow: /api/v1/last\nAllow: /api/v1/id\nAllow: /api/v1/count\nAllow: /api/v1/counts\n"+
 		"Allow: /api/v1/list\nAllow: /api/v1/config\nAllow: /api/v1/img\nAllow: /api/v1/avatar\n", string(body))
 }
+
+func TestRest_validUnsubscribeToken(t *testing.T) {
+	fileName := "/tmp/test-remark-admin.db"
+	defer os.Remove(fileName)
+	os.Remove(fileName)
+	bs, err := adminstore.NewBoltStore(fileName, bolt.Options{}, adminstore.SiteInfo{Key: "old-key"})
+	require.Nil(t, err)
+	defer bs.Close()
+	srv := &Rest{DataService: &service.DataStore{AdminStore: bs}}
+
+	oldTkn := notify.UnsubscribeToken("old-key", notify.UnsubscribeReplies, "radio-t", "dev")
+	valid, err := srv.validUnsubscribeToken(notify.UnsubscribeReplies, "radio-t", "dev", oldTkn)
+	require.Nil(t, err)
+	assert.True(t, valid)
+	valid, err = srv.validUnsubscribeToken(notify.UnsubscribeReplies, "radio-t", "", oldTkn)
+	require.Nil(t, err)
+	assert.False(t, valid, "empty user")
+	valid, err = srv.validUnsubscribeToken(notify.UnsubscribeDigest, "radio-t", "dev", oldTkn)
+	require.Nil(t, err)
+	assert.False(t, valid, "other purpose")
+
+	_, err = bs.RotateKey("radio-t", "new-key", time.Hour)
+	require.Nil(t, err)
+	valid, err = srv.validUnsubscribeToken(notify.UnsubscribeReplies, "radio-t", "dev", oldTkn)
+	require.Nil(t, err)
+	assert.True(t, valid, "previous key during grace period")
+	valid, err = srv.validUnsubscribeToken(notify.UnsubscribeReplies, "radio-t", "dev", notify.UnsubscribeToken("new-key", notify.UnsubscribeReplies, "radio-t", "dev"))
+	require.Nil(t, err)
+	assert.True(t, valid)
+	valid, err = srv.validUnsubscribeToken(notify.UnsubscribeReplies, "radio-t", "dev2", oldTkn)
+	require.Nil(t, err)
+	assert.False(t, valid, "other user")
+
+	_, err = bs.RotateKey("radio-t", "newer-key", 0)
+	require.Nil(t, err)
+	valid, err = srv.validUnsubscribeToken(notify.UnsubscribeReplies, "radio-t", "dev", notify.UnsubscribeToken("new-key", notify.UnsubscribeReplies, "radio-t", "dev"))
+	require.Nil(t, err)
+	assert.False(t, valid, "grace period expired")
+}
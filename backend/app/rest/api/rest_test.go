@@ -2,6 +2,7 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"io/ioutil"
@@ -15,6 +16,7 @@ import (
 	bolt "github.com/coreos/bbolt"
 	"github.com/go-pkgz/auth"
 	"github.com/go-pkgz/auth/avatar"
+	"github.com/go-pkgz/auth/provider"
 	"github.com/go-pkgz/auth/token"
 	R "github.com/go-pkgz/rest"
 	"github.com/go-pkgz/rest/cache"
@@ -74,6 +76,39 @@ func TestRest_Shutdown(t *testing.T) {
 	assert.True(t, time.Since(st).Seconds() < 1, "should take about 100ms")
 }
 
+func TestRest_AuthProviders(t *testing.T) {
+	_, srv, teardown := startupT(t)
+	defer teardown()
+
+	srv.AuthProviders = []provider.Service{provider.NewService(mockProvider{name: "email"})}
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	body, code := get(t, ts.URL+"/auth/list")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `["email"]`+"\n", body, "extra providers listed")
+
+	body, code = get(t, ts.URL+"/auth/email/login?site=radio-t")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "email login", body)
+	body, code = get(t, ts.URL+"/auth/email/callback")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "email callback", body)
+	body, code = get(t, ts.URL+"/auth/logout")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "email logout", body, "logout with extra provider, no authenticator's providers")
+
+	srv.Authenticator.AddProvider("dev", "", "")
+	body, code = get(t, ts.URL+"/auth/list")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `["dev","email"]`+"\n", body)
+	body, code = get(t, ts.URL+"/auth/logout")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "", body, "authenticator's logout")
+	_, code = get(t, ts.URL+"/auth/blah/login")
+	assert.Equal(t, 400, code, "unknown provider")
+}
+
 func TestRest_filterComments(t *testing.T) {
 	user := store.User{ID: "user1", Name: "user name 1"}
 	c1 := store.Comment{User: user, Text: "test test #1", Locator: store.Locator{SiteID: "radio-t",
@@ -89,6 +124,91 @@ func TestRest_filterComments(t *testing.T) {
 	assert.Equal(t, 2, len(r), "one comment filtered")
 }
 
+func TestRest_PrevKeyTokens(t *testing.T) {
+	fileName := "/tmp/test-remark-admin.db"
+	defer os.Remove(fileName)
+	os.Remove(fileName)
+	bs, err := adminstore.NewBoltStore(fileName, bolt.Options{}, adminstore.SiteInfo{Key: "old-key"})
+	require.Nil(t, err)
+	defer bs.Close()
+
+	srv := &Rest{
+		DataService: &service.DataStore{AdminStore: bs},
+		Authenticator: auth.NewService(auth.Opts{
+			SecretReader:   token.SecretFunc(bs.Key),
+			TokenDuration:  time.Minute,
+			CookieDuration: time.Hour,
+		}),
+	}
+	tokenService := srv.Authenticator.TokenService()
+	claims := token.Claims{User: &token.User{ID: "dev", Name: "developer one"}}
+	claims.Audience, claims.Id, claims.ExpiresAt = "radio-t", "xsrf-id", time.Now().Add(-time.Minute).Unix()
+	oldTkn, err := tokenService.Token(claims)
+	require.Nil(t, err)
+
+	var reqTkn, reqCookie string // token seen by handler
+	handler := srv.prevKeyTokens(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqTkn = r.Header.Get("X-JWT")
+		if c, e := r.Cookie("JWT"); e == nil {
+			reqCookie = c.Value
+		}
+	}))
+	withHeader := func(tkn string) *httptest.ResponseRecorder {
+		reqTkn, reqCookie = "", ""
+		req := httptest.NewRequest("GET", "/api/v1/find?site=radio-t", nil)
+		req.Header.Set("X-JWT", tkn)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := withHeader(oldTkn)
+	assert.Equal(t, oldTkn, reqTkn, "valid with current key")
+	assert.Equal(t, "", rr.Header().Get("X-JWT"))
+
+	_, err = bs.RotateKey("radio-t", "new-key", time.Hour)
+	require.Nil(t, err)
+	_, err = tokenService.Parse(oldTkn)
+	require.NotNil(t, err, "signed with previous key")
+
+	rr = withHeader(oldTkn)
+	assert.NotEqual(t, oldTkn, reqTkn, "re-signed")
+	assert.Equal(t, reqTkn, rr.Header().Get("X-JWT"))
+	newClaims, err := tokenService.Parse(reqTkn)
+	require.Nil(t, err)
+	assert.Equal(t, "dev", newClaims.User.ID)
+	assert.Equal(t, "xsrf-id", newClaims.Id, "xsrf id kept")
+	assert.Equal(t, claims.ExpiresAt, newClaims.ExpiresAt, "expiration kept")
+
+	// cookie token, re-signed token set back to cookie
+	req := httptest.NewRequest("GET", "/api/v1/find?site=radio-t", nil)
+	req.AddCookie(&http.Cookie{Name: "JWT", Value: oldTkn})
+	req.AddCookie(&http.Cookie{Name: "XSRF-TOKEN", Value: "xsrf-id"})
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	_, err = tokenService.Parse(reqCookie)
+	assert.Nil(t, err, "request cookie replaced")
+	cookies := rr.Result().Cookies()
+	require.Equal(t, 2, len(cookies))
+	assert.Equal(t, "JWT", cookies[0].Name)
+	_, err = tokenService.Parse(cookies[0].Value)
+	assert.Nil(t, err)
+	assert.Equal(t, "xsrf-id", cookies[1].Value)
+
+	// token with bad signature left as is
+	badTkn := oldTkn[:len(oldTkn)-2] + "xx"
+	rr = withHeader(badTkn)
+	assert.Equal(t, badTkn, reqTkn)
+	assert.Equal(t, "", rr.Header().Get("X-JWT"))
+
+	// grace period expired
+	_, err = bs.RotateKey("radio-t", "newer-key", 0)
+	require.Nil(t, err)
+	rr = withHeader(oldTkn)
+	assert.Equal(t, oldTkn, reqTkn, "previous key expired")
+	assert.Equal(t, "", rr.Header().Get("X-JWT"))
+}
+
 func TestRest_RunStaticSSLMode(t *testing.T) {
 	srv := Rest{
 		Authenticator: auth.NewService(auth.Opts{
@@ -179,7 +299,7 @@ func startupT(t *testing.T) (ts *httptest.Server, srv *Rest, teardown func()) {
 	b, err := engine.NewBoltDB(bolt.Options{}, engine.BoltSite{FileName: testDb, SiteID: "radio-t"})
 	require.Nil(t, err)
 
-	adminStore := adminstore.NewStaticStore("123456", []string{"a1", "a2"}, "admin@remark-42.com")
+	adminStore := adminstore.NewStaticStore("123456", []string{"a1", "a2"}, []string{"m1"}, "admin@remark-42.com")
 
 	dataStore := &service.DataStore{
 		Interface:      b,
@@ -187,6 +307,7 @@ func startupT(t *testing.T) (ts *httptest.Server, srv *Rest, teardown func()) {
 		MaxCommentSize: 4000,
 		AdminStore:     adminStore,
 		MaxVotes:       service.UnlimitedVotes,
+		RetainDeleted:  time.Hour,
 	}
 
 	srv = &Rest{
@@ -264,6 +385,17 @@ func getWithAdminAuth(t *testing.T, url string) (string, int) {
 	assert.Nil(t, err)
 	return string(body), r.StatusCode
 }
+
+// postNoAuth sends empty POST without auth, like form submitted from a page opened by link from email
+func postNoAuth(t *testing.T, url string) (string, int) {
+	r, err := http.Post(url, "application/x-www-form-urlencoded", nil)
+	require.Nil(t, err)
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	require.Nil(t, err)
+	return string(body), r.StatusCode
+}
+
 func post(t *testing.T, url string, body string) (*http.Response, error) {
 	client := &http.Client{Timeout: 5 * time.Second}
 	req, err := http.NewRequest("POST", url, strings.NewReader(body))
@@ -299,3 +431,40 @@ func cleanup(ts *httptest.Server, srv *Rest) {
 	os.Remove(testDb)
 	os.Remove(testHTML)
 }
+
+type mockProvider struct {
+	name string
+}
+
+func (m mockProvider) Name() string { return m.name }
+
+func (m mockProvider) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	_, _ = w.Write([]byte(m.name + " login"))
+}
+
+func (m mockProvider) AuthHandler(w http.ResponseWriter, r *http.Request) {
+	_, _ = w.Write([]byte(m.name + " callback"))
+}
+
+func (m mockProvider) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	_, _ = w.Write([]byte(m.name + " logout"))
+}
+
+// mockEmailSender keeps sent emails
+type mockEmailSender struct {
+	sent []struct{ to, subject, text string }
+}
+
+func (m *mockEmailSender) Send(_ context.Context, to, subject, text, _ string) error {
+	m.sent = append(m.sent, struct{ to, subject, text string }{to, subject, text})
+	return nil
+}
+
+// link returns link with the prefix from the last sent email
+func (m *mockEmailSender) link(t *testing.T, prefix string) string {
+	require.NotEmpty(t, m.sent)
+	text := m.sent[len(m.sent)-1].text
+	i := strings.Index(text, prefix)
+	require.True(t, i >= 0, text)
+	return strings.Fields(text[i:])[0]
+}
@@ -0,0 +1,269 @@
+// Package emailauth implements passwordless (magic link) auth provider. Login request sends the link with signed
+// short-lived confirmation token to user's email, following the link logs user in with the name chosen on login.
+// User ID made from hashed email, so it stays the same for all logins with the same address.
+package emailauth
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	htmltemplate "html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/didip/tollbooth"
+	"github.com/didip/tollbooth/limiter"
+	"github.com/go-chi/render"
+	"github.com/go-pkgz/auth/token"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/umputun/remark/backend/app/rest"
+)
+
+// Provider implements auth provider.Provider for login by email confirmation
+type Provider struct {
+	Params
+	addrLimiter *limiter.Limiter
+	ipLimiter   *limiter.Limiter
+}
+
+// Params to make Provider
+type Params struct {
+	URL          string        // root url of remark42, confirmation link points to it
+	Issuer       string        // iss claim of user's token
+	TokenService TokenService  // signs and parses tokens, shared with other providers
+	Sender       Sender        // sends confirmation emails
+	TokenTTL     time.Duration // confirmation token TTL, default 15m
+	AddrLimit    int           // max confirmations sent to one address per hour, default 3
+	IPLimit      int           // max confirmations requested from one ip per hour, default 10
+}
+
+// TokenService defines the minimal interface to make, parse and set tokens
+type TokenService interface {
+	Token(claims token.Claims) (string, error)
+	Parse(tokenString string) (claims token.Claims, err error)
+	Set(w http.ResponseWriter, claims token.Claims) error
+	Reset(w http.ResponseWriter)
+}
+
+// Sender defines the minimal interface to send email with plain text and html versions
+type Sender interface {
+	Send(ctx context.Context, to, subject, text, html string) error
+}
+
+const (
+	providerName     = "email"
+	confirmState     = "email-confirmation" // handshake state of confirmation tokens, not valid for auth
+	defaultTokenTTL  = 15 * time.Minute
+	defaultAddrLimit = 3
+	defaultIPLimit   = 10
+	sendTimeout      = 30 * time.Second
+)
+
+// confirmMessage is the data passed to confirmation email templates
+type confirmMessage struct {
+	Name string
+	Site string
+	Link string
+	TTL  time.Duration
+}
+
+var confirmTextTmpl = template.Must(template.New("text").Parse(`Hello {{.Name}},
+
+follow the link to confirm your email and log in to comments{{if .Site}} on {{.Site}}{{end}}:
+
+{{.Link}}
+
+The link is valid for {{.TTL}}. Ignore this email if you didn't request it.
+`))
+
+var confirmHTMLTmpl = htmltemplate.Must(htmltemplate.New("html").Parse(`<!DOCTYPE html>
+<html>
+<body>
+<p>Hello <b>{{.Name}}</b>,</p>
+<p>follow the link to confirm your email and log in to comments{{if .Site}} on {{.Site}}{{end}}:</p>
+<p><a href="{{.Link}}">Confirm and log in</a></p>
+<p>The link is valid for {{.TTL}}. Ignore this email if you didn't request it.</p>
+</body>
+</html>
+`))
+
+// New makes email auth provider with rate limiters for addresses and ips
+func New(params Params) *Provider {
+	res := Provider{Params: params}
+	res.URL = strings.TrimSuffix(res.URL, "/")
+	if res.TokenTTL == 0 {
+		res.TokenTTL = defaultTokenTTL
+	}
+	if res.AddrLimit == 0 {
+		res.AddrLimit = defaultAddrLimit
+	}
+	if res.IPLimit == 0 {
+		res.IPLimit = defaultIPLimit
+	}
+	res.addrLimiter = hourlyLimiter(res.AddrLimit)
+	res.ipLimiter = hourlyLimiter(res.IPLimit)
+	log.Printf("[DEBUG] create email auth provider, token ttl=%s, limits: %d per address, %d per ip",
+		res.TokenTTL, res.AddrLimit, res.IPLimit)
+	return &res
+}
+
+// Name of the provider
+func (p *Provider) Name() string { return providerName }
+
+// LoginHandler sends confirmation link to the address. From url checked to be remark42's own
+// GET /login?address=user@example.com&user=name&site=site-id&from=url&session=[0|1]
+func (p *Provider) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	address, err := normalizeAddress(r.URL.Query().Get("address"))
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "invalid email address")
+		return
+	}
+	name, err := rest.NormalizeUserName(r.URL.Query().Get("user"))
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "invalid user name")
+		return
+	}
+
+	from := r.URL.Query().Get("from")
+	if from != "" && !rest.AllowedRedirect(from, p.URL) {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, errors.Errorf("redirect to %q not allowed", from),
+			"invalid from url")
+		return
+	}
+
+	if p.ipLimiter.LimitReached(remoteIP(r)) {
+		rest.SendErrorJSON(w, r, http.StatusTooManyRequests, errors.New("too many requests"),
+			"confirmation limit reached for ip")
+		return
+	}
+	if p.addrLimiter.LimitReached(address) {
+		rest.SendErrorJSON(w, r, http.StatusTooManyRequests, errors.New("too many requests"),
+			"confirmation limit reached for address")
+		return
+	}
+
+	siteID := r.URL.Query().Get("site")
+	claims := token.Claims{
+		Handshake: &token.Handshake{State: confirmState, From: from, ID: name},
+		StandardClaims: jwt.StandardClaims{
+			Subject:   address,
+			Audience:  siteID,
+			Issuer:    p.Issuer,
+			ExpiresAt: time.Now().Add(p.TokenTTL).Unix(),
+		},
+		SessionOnly: r.URL.Query().Get("session") != "" && r.URL.Query().Get("session") != "0",
+	}
+	tkn, err := p.TokenService.Token(claims)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "failed to make confirmation token")
+		return
+	}
+
+	msg := confirmMessage{Name: name, Site: siteID, TTL: p.TokenTTL,
+		Link: p.URL + "/auth/" + providerName + "/callback?token=" + url.QueryEscape(tkn)}
+	text, html := bytes.Buffer{}, bytes.Buffer{}
+	if err = confirmTextTmpl.Execute(&text, msg); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "failed to make confirmation email")
+		return
+	}
+	if err = confirmHTMLTmpl.Execute(&html, msg); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "failed to make confirmation email")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), sendTimeout)
+	defer cancel()
+	if err = p.Sender.Send(ctx, address, "Confirm your email", text.String(), html.String()); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "failed to send confirmation email")
+		return
+	}
+	log.Printf("[DEBUG] confirmation sent to %s for %s, site %s", address, name, siteID)
+	render.JSON(w, r, map[string]interface{}{"address": address, "user": name})
+}
+
+// AuthHandler verifies confirmation token from the link, sets user's token and redirects back to from url.
+// Redirects to remark42 itself only, see rest.AllowedRedirect
+// GET /callback?token=confirmation-token
+func (p *Provider) AuthHandler(w http.ResponseWriter, r *http.Request) {
+	confClaims, err := p.TokenService.Parse(r.URL.Query().Get("token"))
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusForbidden, err, "failed to verify confirmation token")
+		return
+	}
+	if confClaims.Handshake == nil || confClaims.Handshake.State != confirmState || confClaims.Subject == "" {
+		rest.SendErrorJSON(w, r, http.StatusForbidden, errors.New("not a confirmation token"),
+			"failed to verify confirmation token")
+		return
+	}
+	if !confClaims.VerifyExpiresAt(time.Now().Unix(), true) {
+		rest.SendErrorJSON(w, r, http.StatusForbidden, errors.New("token expired"), "failed to verify confirmation token")
+		return
+	}
+
+	claims := token.Claims{
+		User: &token.User{
+			ID:   UserID(confClaims.Subject),
+			Name: confClaims.Handshake.ID,
+		},
+		StandardClaims: jwt.StandardClaims{
+			Issuer:   p.Issuer,
+			Id:       uuid.New().String(),
+			Audience: confClaims.Audience,
+		},
+		SessionOnly: confClaims.SessionOnly,
+	}
+	if err = p.TokenService.Set(w, claims); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "failed to set token")
+		return
+	}
+	log.Printf("[DEBUG] user %s confirmed email, site %s", claims.User.ID, claims.Audience)
+
+	if confClaims.Handshake.From != "" && rest.AllowedRedirect(confClaims.Handshake.From, p.URL) {
+		http.Redirect(w, r, confClaims.Handshake.From, http.StatusTemporaryRedirect)
+		return
+	}
+	render.JSON(w, r, claims.User)
+}
+
+// LogoutHandler removes user's token
+// GET /logout
+func (p *Provider) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	p.TokenService.Reset(w)
+}
+
+// UserID returns ID of the user logged in with the address, the address is confirmed for such user
+func UserID(address string) string {
+	return providerName + "_" + token.HashID(sha1.New(), strings.ToLower(address))
+}
+
+// normalizeAddress checks if address is a plain email and makes it lower case, to get the same user ID for all logins
+func normalizeAddress(address string) (string, error) {
+	address = strings.ToLower(strings.TrimSpace(address))
+	addr, err := mail.ParseAddress(address)
+	if err != nil || addr.Address != address {
+		return "", errors.Errorf("bad address %q", address)
+	}
+	return address, nil
+}
+
+// hourlyLimiter allows up to limit requests per key, restored within an hour
+func hourlyLimiter(limit int) *limiter.Limiter {
+	return tollbooth.NewLimiter(float64(limit)/time.Hour.Seconds(),
+		&limiter.ExpirableOptions{DefaultExpirationTTL: time.Hour}).SetBurst(limit)
+}
+
+func remoteIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,265 @@
+package emailauth
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-pkgz/auth/token"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProvider_Login(t *testing.T) {
+	p, sender, tokenService := prepProvider(t)
+
+	resp := login(p, "/login?address=%20User@Example.com&user=%20dev%20user&site=remark&from=http://remark.example.com/web/iframe.html",
+		"127.0.0.1:1234")
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	assert.Equal(t, `{"address":"user@example.com","user":"dev user"}`+"\n", resp.Body.String())
+
+	msgs := sender.get()
+	require.Equal(t, 1, len(msgs))
+	assert.Equal(t, "user@example.com", msgs[0].to)
+	assert.Equal(t, "Confirm your email", msgs[0].subject)
+	assert.Contains(t, msgs[0].text, "Hello dev user,")
+	assert.Contains(t, msgs[0].text, "log in to comments on remark:")
+	assert.Contains(t, msgs[0].text, "The link is valid for 15m0s.")
+	assert.Contains(t, msgs[0].html, `<a href="http://remark.example.com/auth/email/callback?token=`)
+
+	claims, err := tokenService.Parse(confirmationToken(t, msgs[0].text))
+	require.NoError(t, err)
+	assert.Nil(t, claims.User, "confirmation token can't be used for auth")
+	assert.Equal(t, "user@example.com", claims.Subject)
+	assert.Equal(t, "remark", claims.Audience)
+	assert.Equal(t, &token.Handshake{State: confirmState, From: "http://remark.example.com/web/iframe.html", ID: "dev user"}, claims.Handshake)
+	assert.InDelta(t, time.Now().Add(15*time.Minute).Unix(), claims.ExpiresAt, 5)
+}
+
+func TestProvider_LoginRejected(t *testing.T) {
+	p, sender, _ := prepProvider(t)
+	p.Sender = &mockSender{err: errors.New("smtp failed")}
+
+	tbl := []struct {
+		query string
+		code  int
+		err   string
+	}{
+		{"address=bad&user=dev", http.StatusBadRequest, `bad address \"bad\"`},
+		{"address=Dev+%3Cuser@example.com%3E&user=dev", http.StatusBadRequest, "bad address"},
+		{"address=user@example.com", http.StatusBadRequest, "empty user name"},
+		{"address=user@example.com&user=" + strings.Repeat("x", 65), http.StatusBadRequest, "user name longer than 64"},
+		{"address=user@example.com&user=dev%0Auser", http.StatusBadRequest, "control characters in user name"},
+		{"address=user@example.com&user=dev&from=http://evil.example.com/post", http.StatusBadRequest, "invalid from url"},
+		{"address=user@example.com&user=dev&from=//evil.example.com/post", http.StatusBadRequest, "invalid from url"},
+		{"address=user@example.com&user=dev", http.StatusInternalServerError, "smtp failed"},
+	}
+	for i, tt := range tbl {
+		resp := login(p, "/login?"+tt.query, "127.0.0.1:1234")
+		assert.Equal(t, tt.code, resp.Code, "case #%d", i)
+		assert.Contains(t, resp.Body.String(), tt.err, "case #%d", i)
+	}
+	assert.Equal(t, 0, len(sender.get()))
+}
+
+func TestProvider_LoginLimits(t *testing.T) {
+	p, sender, _ := prepProvider(t)
+
+	for i := 0; i < 3; i++ {
+		resp := login(p, "/login?address=user1@example.com&user=dev", "127.0.0.1:1234")
+		require.Equal(t, http.StatusOK, resp.Code, "attempt #%d", i)
+	}
+	resp := login(p, "/login?address=user1@example.com&user=dev", "127.0.0.2:1234")
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code, "address limit, from any ip")
+	assert.Contains(t, resp.Body.String(), "confirmation limit reached for address")
+
+	for i := 0; i < 2; i++ {
+		resp = login(p, "/login?address=user2@example.com&user=dev", "127.0.0.1:1234")
+		require.Equal(t, http.StatusOK, resp.Code, "attempt #%d", i)
+	}
+	resp = login(p, "/login?address=user3@example.com&user=dev", "127.0.0.1:5678")
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code, "ip limit, for any address")
+	assert.Contains(t, resp.Body.String(), "confirmation limit reached for ip")
+
+	resp = login(p, "/login?address=user3@example.com&user=dev", "127.0.0.3:1234")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, 6, len(sender.get()))
+}
+
+func TestProvider_Callback(t *testing.T) {
+	p, sender, tokenService := prepProvider(t)
+
+	resp := login(p, "/login?address=user@example.com&user=dev&site=remark&from=http://remark.example.com/web/iframe.html", "127.0.0.1:1234")
+	require.Equal(t, http.StatusOK, resp.Code)
+	resp = login(p, "/login?address=USER@example.com&user=new+name&site=remark&session=1", "127.0.0.1:1234")
+	require.Equal(t, http.StatusOK, resp.Code)
+	msgs := sender.get()
+	require.Equal(t, 2, len(msgs))
+
+	// redirect back to from url
+	rr := httptest.NewRecorder()
+	p.AuthHandler(rr, httptest.NewRequest("GET", "/callback?token="+confirmationToken(t, msgs[0].text), nil))
+	assert.Equal(t, http.StatusTemporaryRedirect, rr.Code)
+	assert.Equal(t, "http://remark.example.com/web/iframe.html", rr.Header().Get("Location"))
+	claims := userClaims(t, tokenService, rr)
+	assert.Equal(t, "email_"+token.HashID(sha1.New(), "user@example.com"), claims.User.ID)
+	assert.Equal(t, claims.User.ID, UserID("User@Example.com"))
+	assert.Equal(t, "dev", claims.User.Name)
+	assert.Equal(t, "remark", claims.Audience)
+	assert.Equal(t, "remark42", claims.Issuer)
+	assert.NotEmpty(t, claims.Id, "xsrf id")
+	assert.False(t, claims.SessionOnly)
+	user1 := claims.User.ID
+
+	// no from url, user info returned
+	rr = httptest.NewRecorder()
+	p.AuthHandler(rr, httptest.NewRequest("GET", "/callback?token="+confirmationToken(t, msgs[1].text), nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	claims = userClaims(t, tokenService, rr)
+	assert.Equal(t, user1, claims.User.ID, "same id for the same address")
+	assert.Equal(t, "new name", claims.User.Name, "name chosen on login")
+	assert.True(t, claims.SessionOnly)
+	u := token.User{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &u))
+	assert.Equal(t, *claims.User, u)
+}
+
+func TestProvider_CallbackForeignFrom(t *testing.T) {
+	p, _, tokenService := prepProvider(t)
+
+	// signed before from urls checked on login
+	tkn, err := tokenService.Token(token.Claims{Handshake: &token.Handshake{State: confirmState, ID: "dev",
+		From: "http://evil.example.com/post"},
+		StandardClaims: jwt.StandardClaims{Subject: "user@example.com", ExpiresAt: time.Now().Add(time.Minute).Unix()}})
+	require.NoError(t, err)
+	rr := httptest.NewRecorder()
+	p.AuthHandler(rr, httptest.NewRequest("GET", "/callback?token="+tkn, nil))
+	assert.Equal(t, http.StatusOK, rr.Code, "no redirect to other site")
+	assert.Empty(t, rr.Header().Get("Location"))
+	assert.Equal(t, "dev", userClaims(t, tokenService, rr).User.Name)
+}
+
+func TestProvider_CallbackRejected(t *testing.T) {
+	p, _, tokenService := prepProvider(t)
+
+	expired, err := tokenService.Token(token.Claims{Handshake: &token.Handshake{State: confirmState, ID: "dev"},
+		StandardClaims: jwt.StandardClaims{Subject: "user@example.com", ExpiresAt: time.Now().Add(-time.Minute).Unix()}})
+	require.NoError(t, err)
+	userToken, err := tokenService.Token(token.Claims{User: &token.User{ID: "dev", Name: "dev"},
+		StandardClaims: jwt.StandardClaims{Subject: "user@example.com", ExpiresAt: time.Now().Add(time.Minute).Unix()}})
+	require.NoError(t, err)
+	otherKey := token.NewService(token.Opts{SecretReader: token.SecretFunc(func(string) (string, error) { return "other", nil })})
+	forged, err := otherKey.Token(token.Claims{Handshake: &token.Handshake{State: confirmState, ID: "dev"},
+		StandardClaims: jwt.StandardClaims{Subject: "user@example.com", ExpiresAt: time.Now().Add(time.Minute).Unix()}})
+	require.NoError(t, err)
+
+	tbl := []struct {
+		tkn string
+		err string
+	}{
+		{"", "can't pre-parse token"},
+		{"bad", "can't pre-parse token"},
+		{forged, "signature is invalid"},
+		{userToken, "not a confirmation token"},
+		{expired, "token expired"},
+	}
+	for i, tt := range tbl {
+		rr := httptest.NewRecorder()
+		p.AuthHandler(rr, httptest.NewRequest("GET", "/callback?token="+tt.tkn, nil))
+		assert.Equal(t, http.StatusForbidden, rr.Code, "case #%d", i)
+		assert.Contains(t, rr.Body.String(), tt.err, "case #%d", i)
+		assert.Empty(t, rr.Result().Cookies(), "case #%d", i)
+	}
+}
+
+func TestProvider_Logout(t *testing.T) {
+	p, _, _ := prepProvider(t)
+	assert.Equal(t, "email", p.Name())
+	rr := httptest.NewRecorder()
+	p.LogoutHandler(rr, httptest.NewRequest("GET", "/logout", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, 2, len(rr.Result().Cookies()))
+	assert.Equal(t, "JWT", rr.Result().Cookies()[0].Name)
+	assert.Equal(t, -1, rr.Result().Cookies()[0].MaxAge)
+}
+
+func prepProvider(t *testing.T) (*Provider, *mockSender, *token.Service) {
+	tokenService := token.NewService(token.Opts{
+		SecretReader:   token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+		TokenDuration:  time.Minute,
+		CookieDuration: time.Hour,
+		Issuer:         "remark42",
+	})
+	sender := &mockSender{}
+	p := New(Params{URL: "http://remark.example.com/", Issuer: "remark42", TokenService: tokenService, Sender: sender,
+		AddrLimit: 3, IPLimit: 5})
+	require.NotNil(t, p)
+	return p, sender, tokenService
+}
+
+func login(p *Provider, query, remoteAddr string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", query, nil)
+	req.RemoteAddr = remoteAddr
+	p.LoginHandler(rr, req)
+	return rr
+}
+
+// confirmationToken extracts token from the link in confirmation email
+func confirmationToken(t *testing.T, text string) string {
+	link := regexp.MustCompile(`http://remark.example.com/auth/email/callback\?token=\S+`).FindString(text)
+	require.NotEmpty(t, link, text)
+	u, err := url.Parse(link)
+	require.NoError(t, err)
+	return u.Query().Get("token")
+}
+
+// userClaims parses user's token set in JWT cookie
+func userClaims(t *testing.T, tokenService *token.Service, rr *httptest.ResponseRecorder) token.Claims {
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == "JWT" {
+			claims, err := tokenService.Parse(c.Value)
+			require.NoError(t, err)
+			require.NotNil(t, claims.User)
+			return claims
+		}
+	}
+	t.Fatal("no JWT cookie")
+	return token.Claims{}
+}
+
+type mockSenderMessage struct {
+	to, subject, text, html string
+}
+
+type mockSender struct {
+	lock sync.Mutex
+	msgs []mockSenderMessage
+	err  error
+}
+
+func (m *mockSender) Send(_ context.Context, to, subject, text, html string) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.msgs = append(m.msgs, mockSenderMessage{to: to, subject: subject, text: text, html: html})
+	return nil
+}
+
+func (m *mockSender) get() []mockSenderMessage {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]mockSenderMessage{}, m.msgs...)
+}
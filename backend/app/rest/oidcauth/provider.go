@@ -0,0 +1,396 @@
+// Package oidcauth implements generic OpenID Connect auth provider for identity providers like Keycloak or Dex.
+// Endpoints and signing keys discovered from the issuer, user info taken from the validated ID token.
+// User ID made from hashed issuer and subject, so the same user always gets the same ID.
+package oidcauth
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/render"
+	"github.com/go-pkgz/auth/token"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+
+	"github.com/umputun/remark/backend/app/rest"
+)
+
+// Provider implements auth provider.Provider for OpenID Connect login
+type Provider struct {
+	Params
+
+	lock      sync.Mutex
+	discovery *discovery                // provider's metadata, loaded on the first use
+	keys      map[string]*rsa.PublicKey // signing keys by kid, reloaded on unknown kid
+}
+
+// Params to make Provider
+type Params struct {
+	ProviderName string       // name used in auth urls and user IDs, default "oidc"
+	URL          string       // root url of remark42, callback points to it
+	Issuer       string       // iss claim of user's token
+	IssuerURL    string       // url of identity provider, discovery loaded from it
+	CID          string       // client ID
+	CSecret      string       // client secret
+	Scopes       []string     // requested scopes, "openid" always added
+	TokenService TokenService // sets and gets tokens, shared with other providers
+	AvatarSaver  AvatarSaver  // saves user's picture to avatar proxy, optional
+	HTTPClient   *http.Client // client for discovery, keys and code exchange
+}
+
+// TokenService defines the minimal interface to set, get and reset tokens
+type TokenService interface {
+	Set(w http.ResponseWriter, claims token.Claims) error
+	Get(r *http.Request) (claims token.Claims, token string, err error)
+	Reset(w http.ResponseWriter)
+}
+
+// AvatarSaver defines the minimal interface to save user's avatar
+type AvatarSaver interface {
+	Put(u token.User) (avatarURL string, err error)
+}
+
+// discovery is the part of provider's metadata used for login
+type discovery struct {
+	Issuer   string `json:"issuer"`
+	AuthURL  string `json:"authorization_endpoint"`
+	TokenURL string `json:"token_endpoint"`
+	JwksURL  string `json:"jwks_uri"`
+}
+
+const (
+	defaultName    = "oidc"
+	discoveryPath  = "/.well-known/openid-configuration"
+	handshakeTTL   = 30 * time.Minute
+	requestTimeout = 30 * time.Second
+)
+
+// New makes OpenID Connect auth provider, discovery and keys loaded on the first login
+func New(params Params) *Provider {
+	res := Provider{Params: params}
+	if res.ProviderName == "" {
+		res.ProviderName = defaultName
+	}
+	res.URL = strings.TrimSuffix(res.URL, "/")
+	res.IssuerURL = strings.TrimSuffix(res.IssuerURL, "/")
+	if res.HTTPClient == nil {
+		res.HTTPClient = &http.Client{Timeout: requestTimeout}
+	}
+	hasOpenID := false
+	for _, s := range res.Scopes {
+		if s == "openid" {
+			hasOpenID = true
+		}
+	}
+	if !hasOpenID {
+		res.Scopes = append([]string{"openid"}, res.Scopes...)
+	}
+	log.Printf("[DEBUG] create oidc auth provider %s, issuer=%s, scopes=%v", res.ProviderName, res.IssuerURL, res.Scopes)
+	return &res
+}
+
+// Name of the provider
+func (p *Provider) Name() string { return p.ProviderName }
+
+// LoginHandler sets handshake token and redirects to provider's authorization endpoint.
+// From url has to be remark42's own
+// GET /login?from=url&site=site-id&session=[0|1]
+func (p *Provider) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	from := r.URL.Query().Get("from")
+	if from != "" && !rest.AllowedRedirect(from, p.URL) {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, errors.Errorf("redirect to %q not allowed", from),
+			"invalid from url")
+		return
+	}
+
+	conf, _, err := p.config(r.Context())
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusServiceUnavailable, err, "failed to discover oidc provider")
+		return
+	}
+
+	state, nonce := uuid.New().String(), uuid.New().String()
+	claims := token.Claims{
+		Handshake: &token.Handshake{State: state, From: from, ID: nonce},
+		StandardClaims: jwt.StandardClaims{
+			Id:        uuid.New().String(),
+			Audience:  r.URL.Query().Get("site"),
+			ExpiresAt: time.Now().Add(handshakeTTL).Unix(),
+			NotBefore: time.Now().Add(-1 * time.Minute).Unix(),
+		},
+		SessionOnly: r.URL.Query().Get("session") != "" && r.URL.Query().Get("session") != "0",
+	}
+	if err = p.TokenService.Set(w, claims); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "failed to set token")
+		return
+	}
+	http.Redirect(w, r, conf.AuthCodeURL(state, oauth2.SetAuthURLParam("nonce", nonce)), http.StatusFound)
+}
+
+// AuthHandler exchanges code for ID token, validates it, sets user's token and redirects back to from url
+// GET /callback?state=state&code=code
+func (p *Provider) AuthHandler(w http.ResponseWriter, r *http.Request) {
+	hsClaims, _, err := p.TokenService.Get(r)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "failed to get token")
+		return
+	}
+	if hsClaims.Handshake == nil || hsClaims.Handshake.State == "" || hsClaims.Handshake.State != r.URL.Query().Get("state") {
+		rest.SendErrorJSON(w, r, http.StatusForbidden, errors.New("unexpected state"), "invalid handshake token")
+		return
+	}
+	if e := r.URL.Query().Get("error"); e != "" {
+		rest.SendErrorJSON(w, r, http.StatusForbidden, errors.Errorf("%s %s", e, r.URL.Query().Get("error_description")),
+			"oidc provider rejected login")
+		return
+	}
+
+	conf, disc, err := p.config(r.Context())
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusServiceUnavailable, err, "failed to discover oidc provider")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithValue(r.Context(), oauth2.HTTPClient, p.HTTPClient), requestTimeout)
+	defer cancel()
+	tok, err := conf.Exchange(ctx, r.URL.Query().Get("code"))
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "exchange failed")
+		return
+	}
+	rawIDToken, ok := tok.Extra("id_token").(string)
+	if !ok || rawIDToken == "" {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, errors.New("no id_token in response"), "exchange failed")
+		return
+	}
+	idClaims, err := p.verify(r.Context(), disc, rawIDToken, hsClaims.Handshake.ID)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusForbidden, err, "failed to verify id token")
+		return
+	}
+
+	u := p.mapUser(disc.Issuer, idClaims)
+	if p.AvatarSaver != nil {
+		if u.Picture, err = p.AvatarSaver.Put(u); err != nil {
+			rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "failed to save avatar to proxy")
+			return
+		}
+	}
+
+	claims := token.Claims{
+		User: &u,
+		StandardClaims: jwt.StandardClaims{
+			Issuer:   p.Issuer,
+			Id:       uuid.New().String(),
+			Audience: hsClaims.Audience,
+		},
+		SessionOnly: hsClaims.SessionOnly,
+	}
+	if err = p.TokenService.Set(w, claims); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "failed to set token")
+		return
+	}
+	log.Printf("[DEBUG] user %s logged in with %s, site %s", u.ID, p.Name(), claims.Audience)
+
+	if hsClaims.Handshake.From != "" && rest.AllowedRedirect(hsClaims.Handshake.From, p.URL) {
+		http.Redirect(w, r, hsClaims.Handshake.From, http.StatusTemporaryRedirect)
+		return
+	}
+	render.JSON(w, r, &u)
+}
+
+// LogoutHandler removes user's token
+// GET /logout
+func (p *Provider) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	p.TokenService.Reset(w)
+}
+
+// verify checks signature and standard claims of ID token, nonce has to match the one sent on login
+func (p *Provider) verify(ctx context.Context, disc discovery, rawIDToken, nonce string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(rawIDToken, claims, func(tkn *jwt.Token) (interface{}, error) {
+		if _, ok := tkn.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, errors.Errorf("unexpected signing method %v", tkn.Header["alg"])
+		}
+		kid, _ := tkn.Header["kid"].(string)
+		return p.key(ctx, disc, kid)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "can't parse id token")
+	}
+
+	if !claims.VerifyIssuer(disc.Issuer, true) {
+		return nil, errors.Errorf("unexpected issuer %v", claims["iss"])
+	}
+	if !hasAudience(claims["aud"], p.CID) {
+		return nil, errors.Errorf("unexpected audience %v", claims["aud"])
+	}
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, errors.New("id token expired")
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, errors.New("unexpected nonce")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.New("no subject in id token")
+	}
+	return claims, nil
+}
+
+// mapUser makes user from ID token claims, name falls back to preferred_username and email
+func (p *Provider) mapUser(issuer string, claims jwt.MapClaims) token.User {
+	value := func(key string) string {
+		v, _ := claims[key].(string)
+		return strings.TrimSpace(v)
+	}
+	u := token.User{
+		// encode subject with issuer to avoid collision if same subject returned by other provider
+		ID:      p.Name() + "_" + token.HashID(sha1.New(), issuer+"!!"+value("sub")),
+		Name:    value("name"),
+		Picture: value("picture"),
+	}
+	if u.Name == "" {
+		u.Name = value("preferred_username")
+	}
+	if u.Name == "" {
+		u.Name = strings.Split(value("email"), "@")[0]
+	}
+	if u.Name == "" {
+		u.Name = "noname_" + u.ID[len(p.Name())+1:len(p.Name())+5]
+	}
+	return u
+}
+
+// config returns oauth2 config with discovered endpoints
+func (p *Provider) config(ctx context.Context) (oauth2.Config, discovery, error) {
+	disc, err := p.discover(ctx)
+	if err != nil {
+		return oauth2.Config{}, discovery{}, err
+	}
+	return oauth2.Config{
+		ClientID:     p.CID,
+		ClientSecret: p.CSecret,
+		RedirectURL:  p.URL + "/auth/" + p.Name() + "/callback",
+		Scopes:       p.Scopes,
+		Endpoint:     oauth2.Endpoint{AuthURL: disc.AuthURL, TokenURL: disc.TokenURL},
+	}, disc, nil
+}
+
+// discover loads provider's metadata, kept once loaded successfully
+func (p *Provider) discover(ctx context.Context) (discovery, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.discovery != nil {
+		return *p.discovery, nil
+	}
+
+	disc := discovery{}
+	if err := p.getJSON(ctx, p.IssuerURL+discoveryPath, &disc); err != nil {
+		return discovery{}, errors.Wrap(err, "can't load discovery")
+	}
+	if strings.TrimSuffix(disc.Issuer, "/") != p.IssuerURL {
+		return discovery{}, errors.Errorf("discovery issuer %q doesn't match %q", disc.Issuer, p.IssuerURL)
+	}
+	if disc.AuthURL == "" || disc.TokenURL == "" || disc.JwksURL == "" {
+		return discovery{}, errors.New("discovery missing endpoints")
+	}
+	p.discovery = &disc
+	log.Printf("[DEBUG] discovered oidc provider %s, auth=%s, token=%s", disc.Issuer, disc.AuthURL, disc.TokenURL)
+	return disc, nil
+}
+
+// key returns signing key by kid, keys reloaded if kid unknown to handle rotation
+func (p *Provider) key(ctx context.Context, disc discovery, kid string) (*rsa.PublicKey, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+
+	jwks := struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}{}
+	if err := p.getJSON(ctx, disc.JwksURL, &jwks); err != nil {
+		return nil, errors.Wrap(err, "can't load keys")
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad modulus of key %s", k.Kid)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad exponent of key %s", k.Kid)
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	p.keys = keys
+
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	// single key can be used without kid
+	if kid == "" && len(p.keys) == 1 {
+		for _, k := range p.keys {
+			return k, nil
+		}
+	}
+	return nil, errors.Errorf("unknown key %q", kid)
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, res interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return errors.Wrapf(err, "can't make request to %s", url)
+	}
+	resp, err := p.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "request to %s failed", url)
+	}
+	defer func() {
+		if e := resp.Body.Close(); e != nil {
+			log.Printf("[WARN] failed to close response body, %s", e)
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("request to %s failed with status %d", url, resp.StatusCode)
+	}
+	return errors.Wrapf(json.NewDecoder(resp.Body).Decode(res), "can't decode response from %s", url)
+}
+
+// hasAudience checks aud claim, single string or list
+func hasAudience(aud interface{}, cid string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == cid
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok && s == cid {
+				return true
+			}
+		}
+	}
+	return false
+}
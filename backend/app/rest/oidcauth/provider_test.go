@@ -0,0 +1,305 @@
+package oidcauth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-pkgz/auth/token"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProvider_Login(t *testing.T) {
+	idp := newMockIDP(t)
+	defer idp.Close()
+	p, tokenService := prepProvider(idp)
+	assert.Equal(t, "oidc", p.Name())
+	assert.Equal(t, []string{"openid", "profile", "email"}, p.Scopes)
+
+	rr := httptest.NewRecorder()
+	p.LoginHandler(rr, httptest.NewRequest("GET", "/login?site=remark&from=http://remark.example.com/web/iframe.html", nil))
+	require.Equal(t, http.StatusFound, rr.Code, rr.Body.String())
+	loc, err := url.Parse(rr.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, idp.URL+"/auth", loc.Scheme+"://"+loc.Host+loc.Path)
+	assert.Equal(t, "cid", loc.Query().Get("client_id"))
+	assert.Equal(t, "http://remark.example.com/auth/oidc/callback", loc.Query().Get("redirect_uri"))
+	assert.Equal(t, "openid profile email", loc.Query().Get("scope"))
+	assert.Equal(t, "code", loc.Query().Get("response_type"))
+
+	hsCookie := cookie(t, rr, "JWT")
+	claims, err := tokenService.Parse(hsCookie.Value)
+	require.NoError(t, err)
+	require.NotNil(t, claims.Handshake)
+	assert.Equal(t, loc.Query().Get("state"), claims.Handshake.State)
+	assert.Equal(t, loc.Query().Get("nonce"), claims.Handshake.ID)
+	assert.Equal(t, "http://remark.example.com/web/iframe.html", claims.Handshake.From)
+	assert.Equal(t, "remark", claims.Audience)
+	assert.Nil(t, claims.User)
+
+	rr = httptest.NewRecorder()
+	p.LoginHandler(rr, httptest.NewRequest("GET", "/login?site=remark&from=http://evil.example.com/post", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code, "redirect to other site")
+	assert.Contains(t, rr.Body.String(), "invalid from url")
+	assert.Empty(t, rr.Result().Cookies())
+}
+
+func TestProvider_Callback(t *testing.T) {
+	idp := newMockIDP(t)
+	defer idp.Close()
+	p, tokenService := prepProvider(idp)
+
+	hsCookie, state, nonce := startLogin(t, p, "/login?site=remark&from=http://remark.example.com/web/iframe.html")
+	idp.setClaims(jwt.MapClaims{"iss": idp.URL, "aud": []string{"other", "cid"}, "sub": "user1", "nonce": nonce,
+		"exp": time.Now().Add(time.Minute).Unix(), "name": "Dev User", "picture": "http://example.com/pic.png"})
+	rr := callback(p, "/callback?code=good-code&state="+state, hsCookie)
+	require.Equal(t, http.StatusTemporaryRedirect, rr.Code, rr.Body.String())
+	assert.Equal(t, "http://remark.example.com/web/iframe.html", rr.Header().Get("Location"))
+
+	claims, err := tokenService.Parse(cookie(t, rr, "JWT").Value)
+	require.NoError(t, err)
+	require.NotNil(t, claims.User)
+	assert.Equal(t, "oidc_"+token.HashID(sha1.New(), idp.URL+"!!user1"), claims.User.ID)
+	assert.Equal(t, "Dev User", claims.User.Name)
+	assert.Equal(t, "http://remark.example.com/avatar/pic.png", claims.User.Picture, "picture saved to proxy")
+	assert.Equal(t, "remark", claims.Audience)
+	assert.Equal(t, "remark42", claims.Issuer)
+	assert.NotEmpty(t, claims.Id)
+
+	// no name, no from url
+	hsCookie, state, nonce = startLogin(t, p, "/login?site=remark&session=1")
+	idp.setClaims(jwt.MapClaims{"iss": idp.URL, "aud": "cid", "sub": "user1", "nonce": nonce,
+		"exp": time.Now().Add(time.Minute).Unix(), "preferred_username": "dev"})
+	rr = callback(p, "/callback?code=good-code&state="+state, hsCookie)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	u := token.User{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &u))
+	assert.Equal(t, "oidc_"+token.HashID(sha1.New(), idp.URL+"!!user1"), u.ID, "same id for the same subject")
+	assert.Equal(t, "dev", u.Name)
+	claims, err = tokenService.Parse(cookie(t, rr, "JWT").Value)
+	require.NoError(t, err)
+	assert.True(t, claims.SessionOnly)
+	assert.Equal(t, 1, idp.jwksLoads(), "keys cached")
+}
+
+func TestProvider_CallbackRejected(t *testing.T) {
+	idp := newMockIDP(t)
+	defer idp.Close()
+	p, _ := prepProvider(idp)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	valid := func(nonce string) jwt.MapClaims {
+		return jwt.MapClaims{"iss": idp.URL, "aud": "cid", "sub": "user1", "nonce": nonce, "name": "dev",
+			"exp": time.Now().Add(time.Minute).Unix()}
+	}
+	tbl := []struct {
+		upd  func(c jwt.MapClaims)
+		key  *rsa.PrivateKey
+		code string
+		err  string
+	}{
+		{upd: func(c jwt.MapClaims) { c["iss"] = "http://other.example.com" }, err: "unexpected issuer"},
+		{upd: func(c jwt.MapClaims) { c["aud"] = "other" }, err: "unexpected audience"},
+		{upd: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() }, err: "expired"},
+		{upd: func(c jwt.MapClaims) { delete(c, "exp") }, err: "id token expired"},
+		{upd: func(c jwt.MapClaims) { c["nonce"] = "other" }, err: "unexpected nonce"},
+		{upd: func(c jwt.MapClaims) { delete(c, "sub") }, err: "no subject in id token"},
+		{key: otherKey, err: "verification error"},
+		{code: "bad-code", err: "exchange failed"},
+	}
+	for i, tt := range tbl {
+		hsCookie, state, nonce := startLogin(t, p, "/login?site=remark")
+		c := valid(nonce)
+		if tt.upd != nil {
+			tt.upd(c)
+		}
+		idp.setClaims(c)
+		idp.setKey(tt.key)
+		code := "good-code"
+		if tt.code != "" {
+			code = tt.code
+		}
+		rr := callback(p, "/callback?code="+code+"&state="+state, hsCookie)
+		assert.NotEqual(t, http.StatusOK, rr.Code, "case #%d", i)
+		assert.Contains(t, rr.Body.String(), tt.err, "case #%d", i)
+		assert.Empty(t, rr.Result().Cookies(), "case #%d", i)
+	}
+
+	hsCookie, _, _ := startLogin(t, p, "/login?site=remark")
+	rr := callback(p, "/callback?code=good-code&state=bad", hsCookie)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), "unexpected state")
+
+	hsCookie, state, _ := startLogin(t, p, "/login?site=remark")
+	rr = callback(p, "/callback?error=access_denied&state="+state, hsCookie)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), "access_denied")
+}
+
+func TestProvider_DiscoveryFailed(t *testing.T) {
+	idp := newMockIDP(t)
+	defer idp.Close()
+	p, _ := prepProvider(idp)
+	p.IssuerURL = idp.URL + "/other"
+
+	rr := httptest.NewRecorder()
+	p.LoginHandler(rr, httptest.NewRequest("GET", "/login?site=remark", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Contains(t, rr.Body.String(), "can't load discovery")
+
+	p.IssuerURL = idp.URL
+	rr = httptest.NewRecorder()
+	p.LoginHandler(rr, httptest.NewRequest("GET", "/login?site=remark", nil))
+	assert.Equal(t, http.StatusFound, rr.Code, "discovered on retry")
+}
+
+func TestProvider_Logout(t *testing.T) {
+	p := New(Params{TokenService: token.NewService(token.Opts{})})
+	rr := httptest.NewRecorder()
+	p.LogoutHandler(rr, httptest.NewRequest("GET", "/logout", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, 2, len(rr.Result().Cookies()))
+	assert.Equal(t, -1, rr.Result().Cookies()[0].MaxAge)
+}
+
+func prepProvider(idp *mockIDP) (*Provider, *token.Service) {
+	tokenService := token.NewService(token.Opts{
+		SecretReader:   token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+		TokenDuration:  time.Minute,
+		CookieDuration: time.Hour,
+	})
+	p := New(Params{URL: "http://remark.example.com/", Issuer: "remark42", IssuerURL: idp.URL + "/", CID: "cid",
+		CSecret: "csecret", Scopes: []string{"profile", "email"}, TokenService: tokenService, AvatarSaver: mockAvatarSaver{}})
+	return p, tokenService
+}
+
+// startLogin calls login handler and returns handshake cookie with state and nonce sent to provider
+func startLogin(t *testing.T, p *Provider, query string) (hsCookie *http.Cookie, state, nonce string) {
+	rr := httptest.NewRecorder()
+	p.LoginHandler(rr, httptest.NewRequest("GET", query, nil))
+	require.Equal(t, http.StatusFound, rr.Code, rr.Body.String())
+	loc, err := url.Parse(rr.Header().Get("Location"))
+	require.NoError(t, err)
+	return cookie(t, rr, "JWT"), loc.Query().Get("state"), loc.Query().Get("nonce")
+}
+
+func callback(p *Provider, query string, hsCookie *http.Cookie) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", query, nil)
+	req.AddCookie(hsCookie)
+	p.AuthHandler(rr, req)
+	return rr
+}
+
+func cookie(t *testing.T, rr *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	t.Fatalf("no %s cookie", name)
+	return nil
+}
+
+type mockAvatarSaver struct{}
+
+func (mockAvatarSaver) Put(u token.User) (string, error) {
+	if u.Picture == "" {
+		return "", nil
+	}
+	return "http://remark.example.com/avatar/pic.png", nil
+}
+
+// mockIDP is identity provider with discovery, keys and token endpoints, issues id tokens with claims set by test
+type mockIDP struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	lock      sync.Mutex
+	claims    jwt.MapClaims
+	signKey   *rsa.PrivateKey
+	jwksCount int
+}
+
+func newMockIDP(t *testing.T) *mockIDP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	res := &mockIDP{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{"issuer": res.URL, "authorization_endpoint": res.URL + "/auth",
+			"token_endpoint": res.URL + "/token", "jwks_uri": res.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		res.lock.Lock()
+		res.jwksCount++
+		res.lock.Unlock()
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kid": "enc-key", "kty": "RSA", "use": "enc", "n": "AQAB", "e": "AQAB"},
+			{"kid": "key1", "kty": "RSA", "use": "sig", "alg": "RS256",
+				"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("code") != "good-code" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		if user, secret, ok := r.BasicAuth(); !ok || user != "cid" || secret != "csecret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		res.lock.Lock()
+		signKey := res.key
+		if res.signKey != nil {
+			signKey = res.signKey
+		}
+		tkn := jwt.NewWithClaims(jwt.SigningMethodRS256, res.claims)
+		res.lock.Unlock()
+		tkn.Header["kid"] = "key1"
+		idToken, err := tkn.SignedString(signKey)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "access", "token_type": "Bearer",
+			"expires_in": 3600, "id_token": idToken})
+	})
+	res.Server = httptest.NewServer(mux)
+	return res
+}
+
+func (m *mockIDP) setClaims(claims jwt.MapClaims) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.claims = claims
+}
+
+// setKey sets the key to sign id tokens, nil for the published one
+func (m *mockIDP) setKey(key *rsa.PrivateKey) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.signKey = key
+}
+
+func (m *mockIDP) jwksLoads() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.jwksCount
+}
@@ -0,0 +1,24 @@
+package rest
+
+import (
+	"net/url"
+	"strings"
+)
+
+// AllowedRedirect checks if redirect url is a local path or has the same origin as rootURL, i.e. remark42 itself.
+// Prevents open redirects to urls passed by login links
+func AllowedRedirect(redirect, rootURL string) bool {
+	if strings.HasPrefix(redirect, "/") {
+		// protocol-relative //host and /\host are treated by browsers as other hosts
+		return !strings.HasPrefix(redirect, "//") && !strings.HasPrefix(redirect, `/\`)
+	}
+	u, err := url.Parse(redirect)
+	if err != nil || u.User != nil {
+		return false
+	}
+	root, err := url.Parse(rootURL)
+	if err != nil || root.Host == "" {
+		return false
+	}
+	return strings.EqualFold(u.Scheme, root.Scheme) && strings.EqualFold(u.Host, root.Host)
+}
@@ -0,0 +1,32 @@
+package rest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllowedRedirect(t *testing.T) {
+	tbl := []struct {
+		redirect string
+		allowed  bool
+	}{
+		{"https://remark.example.com/web/iframe.html?selfClose", true},
+		{"https://REMARK.example.com", true},
+		{"/web/iframe.html", true},
+		{"http://remark.example.com/web", false},
+		{"https://remark.example.com:8443/web", false},
+		{"https://evil.example.com/web", false},
+		{"https://remark.example.com.evil.com/web", false},
+		{"https://user@remark.example.com/web", false},
+		{"//evil.example.com/web", false},
+		{`/\evil.example.com/web`, false},
+		{"javascript:alert(1)", false},
+		{"web/iframe.html", false},
+		{"", false},
+	}
+	for i, tt := range tbl {
+		assert.Equal(t, tt.allowed, AllowedRedirect(tt.redirect, "https://remark.example.com"), "case #%d %s", i, tt.redirect)
+	}
+	assert.False(t, AllowedRedirect("https://remark.example.com/web", ""), "no root url")
+}
@@ -2,6 +2,9 @@ package rest
 
 import (
 	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/go-pkgz/auth/token"
 	"github.com/pkg/errors"
@@ -55,3 +58,21 @@ func SetUserInfo(r *http.Request, user store.User) *http.Request {
 
 	return token.SetUserInfo(r, u)
 }
+
+const maxUserNameLength = 64
+
+// NormalizeUserName trims name chosen by user and rejects empty, too long or with control characters one.
+// Used by providers allowing users to set their names
+func NormalizeUserName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errors.New("empty user name")
+	}
+	if utf8.RuneCountInString(name) > maxUserNameLength {
+		return "", errors.Errorf("user name longer than %d characters", maxUserNameLength)
+	}
+	if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return "", errors.New("control characters in user name")
+	}
+	return name, nil
+}
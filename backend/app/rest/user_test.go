@@ -2,6 +2,7 @@ package rest
 
 import (
 	"net/http"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -37,3 +38,25 @@ func TestUSer_MustGetUserInfo(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, store.User{Name: "test", ID: "id"}, u)
 }
+
+func TestUser_NormalizeUserName(t *testing.T) {
+	tbl := []struct {
+		name, res, err string
+	}{
+		{" dev user\t", "dev user", ""},
+		{"юзер", "юзер", ""},
+		{strings.Repeat("ю", 64), strings.Repeat("ю", 64), ""},
+		{"  ", "", "empty user name"},
+		{strings.Repeat("x", 65), "", "user name longer than 64 characters"},
+		{"dev\nuser", "", "control characters in user name"},
+	}
+	for i, tt := range tbl {
+		res, err := NormalizeUserName(tt.name)
+		if tt.err != "" {
+			assert.EqualError(t, err, tt.err, "case #%d", i)
+			continue
+		}
+		assert.NoError(t, err, "case #%d", i)
+		assert.Equal(t, tt.res, res, "case #%d", i)
+	}
+}
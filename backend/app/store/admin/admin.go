@@ -2,22 +2,100 @@
 package admin
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"log"
+	"time"
 )
 
 // Store defines interface returning admins info for given site
 type Store interface {
 	Key(siteID string) (key string, err error)
 	Admins(siteID string) (ids []string)
+	Moderators(siteID string) (ids []string)
 	Email(siteID string) (email string)
 }
 
+// Updater defines interface to change admins info of sites at runtime, implemented by stores allowing changes
+type Updater interface {
+	Site(siteID string) (info SiteInfo, err error)
+	Sites() (ids []string, err error)
+	SetSite(info SiteInfo) error
+	DeleteSite(siteID string) error
+}
+
+// Rotator defines interface to rotate secret keys of sites, implemented by stores keeping per-site keys.
+// Previous key of the site stays valid during grace period after rotation
+type Rotator interface {
+	RotateKey(siteID, key string, grace time.Duration) (info SiteInfo, err error)
+	PrevKey(siteID string) (key string, ok bool)
+	KeyRotated(siteID string) (ts time.Time)
+}
+
+// Tokens defines interface of stores keeping api tokens for admin automation. Tokens stored hashed,
+// the token itself returned on creation only
+type Tokens interface {
+	CreateToken(siteID, name string, scopes []string) (tkn string, info APIToken, err error)
+	Tokens(siteID string) (tokens []APIToken, err error)
+	DeleteToken(siteID, id string) error
+	CheckToken(tkn string) (info APIToken, err error)
+}
+
+// APIToken has info about named api token, limited to the site and scopes
+type APIToken struct {
+	ID       string    `json:"id"`
+	SiteID   string    `json:"site"`
+	Name     string    `json:"name"`
+	Scopes   []string  `json:"scopes"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used"` // zero if never used
+}
+
+// enum of api token scopes
+const (
+	ScopeRead     = "read"     // read-only calls
+	ScopeModerate = "moderate" // changes, like approve, block or pin
+	ScopeDelete   = "delete"   // deletes, like delete comment or reject pending
+)
+
+// HasScope checks if token allows scope
+func (t APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// DeriveKey makes key for the given purpose from the site's secret key. Derived key shared with third parties,
+// like webhook receivers, doesn't allow to recover the secret key signing users' tokens
+func DeriveKey(key, purpose string) string {
+	h := hmac.New(sha256.New, []byte(key))
+	_, _ = h.Write([]byte(purpose))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// SiteInfo has admins info for the site
+type SiteInfo struct {
+	SiteID         string    `json:"site"`
+	Key            string    `json:"key,omitempty"` // empty for the store's default key
+	Admins         []string  `json:"admins"`
+	Moderators     []string  `json:"moderators"`
+	Email          string    `json:"email"`
+	PrevKey        string    `json:"prev_key,omitempty"` // key before the last rotation, valid till PrevKeyExpires
+	PrevKeyExpires time.Time `json:"prev_key_expires"`
+	KeyRotated     time.Time `json:"key_rotated"` // time of the last key rotation, zero if never rotated
+}
+
 // StaticStore implements keys.Store with a single, predefined key
 type StaticStore struct {
-	admins []string
-	email  string
-	key    string
+	admins     []string
+	moderators []string
+	email      string
+	key        string
 }
 
 // Key returns static key for all sites, allows empty site
@@ -29,14 +107,14 @@ func (s *StaticStore) Key(siteID string) (key string, err error) {
 }
 
 // NewStaticStore makes StaticStore instance with given key
-func NewStaticStore(key string, admins []string, email string) *StaticStore {
-	log.Printf("[DEBUG] admin users %+v, email %s", admins, email)
-	return &StaticStore{key: key, admins: admins, email: email}
+func NewStaticStore(key string, admins, moderators []string, email string) *StaticStore {
+	log.Printf("[DEBUG] admin users %+v, moderators %+v, email %s", admins, moderators, email)
+	return &StaticStore{key: key, admins: admins, moderators: moderators, email: email}
 }
 
 // NewStaticKeyStore is a shortcut for making StaticStore for key consumers only
 func NewStaticKeyStore(key string) *StaticStore {
-	return &StaticStore{key: key, admins: []string{}, email: ""}
+	return &StaticStore{key: key, admins: []string{}, moderators: []string{}, email: ""}
 }
 
 // Admins returns static list of admin's ids, the same for all sites
@@ -44,6 +122,11 @@ func (s *StaticStore) Admins(string) (ids []string) {
 	return s.admins
 }
 
+// Moderators returns static list of moderator's ids, the same for all sites
+func (s *StaticStore) Moderators(string) (ids []string) {
+	return s.moderators
+}
+
 // Email gets static email address
 func (s *StaticStore) Email(string) (email string) {
 	return s.email
@@ -1,8 +1,14 @@
 package admin
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
+	bolt "github.com/coreos/bbolt"
 	"github.com/globalsign/mgo"
 	"github.com/go-pkgz/mongo"
 	"github.com/stretchr/testify/assert"
@@ -10,7 +16,7 @@ import (
 )
 
 func TestStaticStore_Get(t *testing.T) {
-	var ks Store = NewStaticStore("key123", []string{"123", "xyz"}, "aa@example.com")
+	var ks Store = NewStaticStore("key123", []string{"123", "xyz"}, []string{"mod1"}, "aa@example.com")
 
 	k, err := ks.Key("any")
 	assert.NoError(t, err, "valid store")
@@ -18,23 +24,32 @@ func TestStaticStore_Get(t *testing.T) {
 
 	a := ks.Admins("any")
 	assert.Equal(t, []string{"123", "xyz"}, a)
+	assert.Equal(t, []string{"mod1"}, ks.Moderators("any"))
 
 	email := ks.Email("blah")
 	assert.Equal(t, "aa@example.com", email)
 
-	ks = NewStaticStore("", []string{"123", "xyz"}, "aa@example.com")
+	ks = NewStaticStore("", []string{"123", "xyz"}, nil, "aa@example.com")
 	_, err = ks.Key("any")
 	assert.NotNil(t, err, "invalid (empty key) store")
 }
 
+func TestDeriveKey(t *testing.T) {
+	k := DeriveKey("secret", "webhook")
+	assert.Equal(t, 64, len(k))
+	assert.Equal(t, k, DeriveKey("secret", "webhook"))
+	assert.NotEqual(t, k, DeriveKey("secret", "confirm"))
+	assert.NotEqual(t, k, DeriveKey("secret2", "webhook"))
+}
+
 func TestMongoStore_Get(t *testing.T) {
 	conn, err := mongo.MakeTestConnection(t)
 	require.NoError(t, err)
 	var ms Store = NewMongoStore(conn)
 
 	recs := []mongoRec{
-		{"site1", "secret1", []string{"i11", "i12"}, "e1"},
-		{"site2", "secret2", []string{"i21", "i22"}, "e2"},
+		{"site1", "secret1", []string{"i11", "i12"}, "e1", []string{"m11"}},
+		{"site2", "secret2", []string{"i21", "i22"}, "e2", nil},
 	}
 	err = conn.WithCollection(func(coll *mgo.Collection) error {
 		if e1 := coll.Insert(recs[0]); e1 != nil {
@@ -46,6 +61,7 @@ func TestMongoStore_Get(t *testing.T) {
 
 	admins := ms.Admins("site1")
 	assert.Equal(t, []string{"i11", "i12"}, admins)
+	assert.Equal(t, []string{"m11"}, ms.Moderators("site1"))
 	email := ms.Email("site1")
 	assert.Equal(t, "e1", email)
 	key, err := ms.Key("site1")
@@ -54,6 +70,7 @@ func TestMongoStore_Get(t *testing.T) {
 
 	admins = ms.Admins("site2")
 	assert.Equal(t, []string{"i21", "i22"}, admins)
+	assert.Equal(t, []string{}, ms.Moderators("site2"))
 	email = ms.Email("site2")
 	assert.Equal(t, "e2", email)
 	key, err = ms.Key("site2")
@@ -62,8 +79,199 @@ func TestMongoStore_Get(t *testing.T) {
 
 	admins = ms.Admins("no-site-in-db")
 	assert.Equal(t, []string{}, admins)
+	assert.Equal(t, []string{}, ms.Moderators("no-site-in-db"))
 	email = ms.Email("no-site-in-db")
 	assert.Equal(t, "", email)
 	_, err = ms.Key("no-site-in-db")
 	assert.Error(t, err, "can't get secret for site no-site-in-db")
 }
+
+func TestBoltStore(t *testing.T) {
+	fileName := "/tmp/test-remark-admin.db"
+	defer os.Remove(fileName)
+	os.Remove(fileName)
+
+	bs, err := NewBoltStore(fileName, bolt.Options{},
+		SiteInfo{Key: "default-key", Admins: []string{"a1"}, Moderators: []string{"m1"}, Email: "admin@example.com"})
+	require.NoError(t, err)
+	var ks Store = bs
+
+	// defaults for site not set
+	key, err := ks.Key("site1")
+	require.NoError(t, err)
+	assert.Equal(t, "default-key", key)
+	assert.Equal(t, []string{"a1"}, ks.Admins("site1"))
+	assert.Equal(t, []string{"m1"}, ks.Moderators("site1"))
+	assert.Equal(t, "admin@example.com", ks.Email("site1"))
+	info, err := bs.Site("site1")
+	require.NoError(t, err)
+	assert.Equal(t, SiteInfo{SiteID: "site1", Admins: []string{"a1"}, Moderators: []string{"m1"}, Email: "admin@example.com"},
+		info, "no default key exposed")
+
+	require.NoError(t, bs.SetSite(SiteInfo{SiteID: "site1", Admins: []string{"a11", "a12"}, Email: "e1"}))
+	require.NoError(t, bs.SetSite(SiteInfo{SiteID: "site2", Key: "key2", Admins: []string{"a21"}, Moderators: []string{"m21"}}))
+	assert.EqualError(t, bs.SetSite(SiteInfo{Admins: []string{"a1"}}), "empty site id")
+
+	key, err = ks.Key("site1")
+	require.NoError(t, err)
+	assert.Equal(t, "default-key", key, "no own key")
+	assert.Equal(t, []string{"a11", "a12"}, ks.Admins("site1"))
+	assert.Equal(t, []string{}, ks.Moderators("site1"), "defaults not used for stored site")
+	assert.Equal(t, "e1", ks.Email("site1"))
+
+	key, err = ks.Key("site2")
+	require.NoError(t, err)
+	assert.Equal(t, "key2", key)
+	assert.Equal(t, []string{"a21"}, ks.Admins("site2"))
+	assert.Equal(t, []string{"m21"}, ks.Moderators("site2"))
+	assert.Equal(t, "", ks.Email("site2"))
+
+	sites, err := bs.Sites()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"site1", "site2"}, sites)
+
+	require.NoError(t, bs.DeleteSite("site1"))
+	require.NoError(t, bs.DeleteSite("no-such-site"))
+	assert.Equal(t, []string{"a1"}, ks.Admins("site1"), "defaults after delete")
+	sites, err = bs.Sites()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"site2"}, sites)
+
+	// reopen, data kept
+	require.NoError(t, bs.Close())
+	bs, err = NewBoltStore(fileName, bolt.Options{}, SiteInfo{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a21"}, bs.Admins("site2"))
+	_, err = bs.Key("site1")
+	assert.EqualError(t, err, "empty key for site site1")
+	assert.Equal(t, []string{}, bs.Admins("site1"))
+	require.NoError(t, bs.Close())
+}
+
+func TestBoltStore_RotateKey(t *testing.T) {
+	fileName := "/tmp/test-remark-admin.db"
+	defer os.Remove(fileName)
+	os.Remove(fileName)
+
+	bs, err := NewBoltStore(fileName, bolt.Options{}, SiteInfo{Key: "default-key", Admins: []string{"a1"}})
+	require.NoError(t, err)
+	defer bs.Close()
+	var rs Rotator = bs
+
+	_, ok := rs.PrevKey("site1")
+	assert.False(t, ok, "not rotated")
+	assert.True(t, rs.KeyRotated("site1").IsZero())
+
+	info, err := rs.RotateKey("site1", "key1", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, "key1", info.Key)
+	assert.Equal(t, "default-key", info.PrevKey)
+	assert.Equal(t, []string{"a1"}, info.Admins, "defaults kept")
+	assert.WithinDuration(t, time.Now(), rs.KeyRotated("site1"), time.Second)
+	key, err := bs.Key("site1")
+	require.NoError(t, err)
+	assert.Equal(t, "key1", key)
+	prev, ok := rs.PrevKey("site1")
+	assert.True(t, ok)
+	assert.Equal(t, "default-key", prev)
+
+	key, err = bs.Key("site2")
+	require.NoError(t, err)
+	assert.Equal(t, "default-key", key, "other sites not affected")
+
+	_, err = rs.RotateKey("site1", "key1", time.Hour)
+	assert.EqualError(t, err, "new key of site site1 is the same as current")
+	_, err = rs.RotateKey("", "key1", time.Hour)
+	assert.EqualError(t, err, "empty site id")
+
+	// random key, no grace period
+	info, err = rs.RotateKey("site1", "", 0)
+	require.NoError(t, err)
+	assert.Len(t, info.Key, 64)
+	assert.Equal(t, "key1", info.PrevKey)
+	_, ok = rs.PrevKey("site1")
+	assert.False(t, ok, "grace period expired")
+}
+
+func TestBoltStore_Tokens(t *testing.T) {
+	fileName := "/tmp/test-remark-admin.db"
+	defer os.Remove(fileName)
+	os.Remove(fileName)
+
+	bs, err := NewBoltStore(fileName, bolt.Options{}, SiteInfo{Key: "default-key"})
+	require.NoError(t, err)
+	var ts Tokens = bs
+
+	tkn1, info, err := ts.CreateToken("site1", " stats ", []string{ScopeRead})
+	require.NoError(t, err)
+	assert.Equal(t, "stats", info.Name)
+	assert.Equal(t, "site1", info.SiteID)
+	assert.True(t, strings.HasPrefix(tkn1, info.ID+"."), tkn1)
+	assert.True(t, info.HasScope(ScopeRead))
+	assert.False(t, info.HasScope(ScopeDelete))
+	tkn2, _, err := ts.CreateToken("site1", "cleaner", []string{ScopeRead, ScopeDelete})
+	require.NoError(t, err)
+	tkn3, _, err := ts.CreateToken("site2", "other", []string{ScopeModerate})
+	require.NoError(t, err)
+
+	_, _, err = ts.CreateToken("site1", "bad", []string{"all"})
+	assert.EqualError(t, err, `unknown token scope "all"`)
+	_, _, err = ts.CreateToken("site1", "bad", nil)
+	assert.EqualError(t, err, "no token scopes")
+	_, _, err = ts.CreateToken("site1", " ", []string{ScopeRead})
+	assert.EqualError(t, err, "empty token name")
+	_, _, err = ts.CreateToken("", "bad", []string{ScopeRead})
+	assert.EqualError(t, err, "empty site id")
+
+	tokens, err := ts.Tokens("site1")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(tokens))
+	assert.True(t, tokens[0].LastUsed.IsZero())
+
+	checked, err := ts.CheckToken(tkn1)
+	require.NoError(t, err)
+	assert.Equal(t, info.ID, checked.ID)
+	assert.WithinDuration(t, time.Now(), checked.LastUsed, time.Second)
+	tokens, err = ts.Tokens("site1")
+	require.NoError(t, err)
+	for _, tk := range tokens {
+		assert.Equal(t, tk.ID == info.ID, !tk.LastUsed.IsZero(), "last used set for checked token only")
+	}
+	time.Sleep(10 * time.Millisecond)
+	again, err := ts.CheckToken(tkn1)
+	require.NoError(t, err)
+	assert.Equal(t, checked.LastUsed.UnixNano(), again.LastUsed.UnixNano(), "not updated within a minute")
+
+	_, err = ts.CheckToken(tkn1 + "x")
+	assert.EqualError(t, err, "bad token")
+	_, err = ts.CheckToken(info.ID)
+	assert.EqualError(t, err, "bad token format")
+	_, err = ts.CheckToken("no-such-id.secret")
+	assert.EqualError(t, err, "no token no-such-id")
+
+	// stored hashed
+	raw, err := ioutil.ReadFile(fileName)
+	require.NoError(t, err)
+	assert.False(t, strings.Contains(string(raw), strings.Split(tkn2, ".")[1]), "secret not stored")
+
+	assert.EqualError(t, ts.DeleteToken("site2", info.ID), fmt.Sprintf("no token %s for site site2", info.ID))
+	require.NoError(t, ts.DeleteToken("site1", info.ID))
+	_, err = ts.CheckToken(tkn1)
+	assert.Error(t, err, "revoked")
+	_, err = ts.CheckToken(tkn2)
+	assert.NoError(t, err)
+	tokens, err = ts.Tokens("site1")
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(tokens))
+
+	// tokens of deleted site revoked
+	require.NoError(t, bs.DeleteSite("site2"))
+	_, err = ts.CheckToken(tkn3)
+	assert.Error(t, err)
+	tokens, err = ts.Tokens("site2")
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(tokens))
+	_, err = ts.CheckToken(tkn2)
+	assert.NoError(t, err, "other site's token kept")
+	require.NoError(t, bs.Close())
+}
@@ -0,0 +1,359 @@
+package admin
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/pkg/errors"
+)
+
+// BoltStore implements Store, Updater, Rotator and Tokens with boltdb. Sites kept in "sites" bucket, key is site ID,
+// value - json of SiteInfo. Api tokens kept in "tokens" bucket, key is token ID, value - json of APIToken with hash. Sites without record get admins and email from defaults, all sites without own key
+// use the default one
+type BoltStore struct {
+	db       *bolt.DB
+	defaults SiteInfo
+}
+
+const (
+	sitesBucketName  = "sites"
+	tokensBucketName = "tokens"
+
+	tokenLastUsedPrecision = time.Minute // last use time of token updated not more often than this
+)
+
+// tokenRec is api token info stored with hash of the token
+type tokenRec struct {
+	APIToken
+	Hash string `json:"hash"`
+}
+
+// NewBoltStore makes admin store in the given file, defaults used for sites not set yet
+func NewBoltStore(fileName string, options bolt.Options, defaults SiteInfo) (*BoltStore, error) {
+	db, err := bolt.Open(fileName, 0600, &options)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to make boltdb for %s", fileName)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range []string{sitesBucketName, tokensBucketName} {
+			if _, e := tx.CreateBucketIfNotExists([]byte(bucket)); e != nil {
+				return errors.Wrapf(e, "failed to create top level bucket %s", bucket)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	log.Printf("[INFO] admin store in %s, default admins %+v, moderators %+v, email %s", fileName,
+		defaults.Admins, defaults.Moderators, defaults.Email)
+	return &BoltStore{db: db, defaults: defaults}, nil
+}
+
+// Key returns secret key of the site, the default one if not set for the site
+func (b *BoltStore) Key(siteID string) (key string, err error) {
+	info, err := b.Site(siteID)
+	if err != nil {
+		return "", err
+	}
+	if info.Key == "" {
+		info.Key = b.defaults.Key
+	}
+	if info.Key == "" {
+		return "", errors.Errorf("empty key for site %s", siteID)
+	}
+	return info.Key, nil
+}
+
+// Admins returns admin's ids of the site
+func (b *BoltStore) Admins(siteID string) (ids []string) {
+	info, err := b.Site(siteID)
+	if err != nil || info.Admins == nil {
+		return []string{}
+	}
+	return info.Admins
+}
+
+// Moderators returns moderator's ids of the site
+func (b *BoltStore) Moderators(siteID string) (ids []string) {
+	info, err := b.Site(siteID)
+	if err != nil || info.Moderators == nil {
+		return []string{}
+	}
+	return info.Moderators
+}
+
+// Email returns admin's email of the site
+func (b *BoltStore) Email(siteID string) (email string) {
+	info, err := b.Site(siteID)
+	if err != nil {
+		return ""
+	}
+	return info.Email
+}
+
+// Site returns stored info of the site, or defaults without key if site not set yet
+func (b *BoltStore) Site(siteID string) (info SiteInfo, err error) {
+	found := false
+	err = b.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket([]byte(sitesBucketName)).Get([]byte(siteID))
+		if value == nil {
+			return nil
+		}
+		found = true
+		return errors.Wrapf(json.Unmarshal(value, &info), "failed to unmarshal site %s", siteID)
+	})
+	if err != nil {
+		return SiteInfo{}, err
+	}
+	if !found {
+		info = SiteInfo{Admins: b.defaults.Admins, Moderators: b.defaults.Moderators, Email: b.defaults.Email}
+	}
+	info.SiteID = siteID
+	return info, nil
+}
+
+// Sites returns ids of all stored sites
+func (b *BoltStore) Sites() (ids []string, err error) {
+	ids = []string{}
+	err = b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(sitesBucketName)).ForEach(func(k, _ []byte) error {
+			ids = append(ids, string(k))
+			return nil
+		})
+	})
+	return ids, err
+}
+
+// SetSite saves info of the site, replaces the stored one
+func (b *BoltStore) SetSite(info SiteInfo) error {
+	if info.SiteID == "" {
+		return errors.New("empty site id")
+	}
+	value, err := json.Marshal(info)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal site %s", info.SiteID)
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return errors.Wrapf(tx.Bucket([]byte(sitesBucketName)).Put([]byte(info.SiteID), value),
+			"failed to put site %s", info.SiteID)
+	})
+}
+
+// DeleteSite removes stored info of the site and revokes all its api tokens, defaults used for it after.
+// No error if not found
+func (b *BoltStore) DeleteSite(siteID string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte(sitesBucketName)).Delete([]byte(siteID)); err != nil {
+			return errors.Wrapf(err, "failed to delete site %s", siteID)
+		}
+		bucket := tx.Bucket([]byte(tokensBucketName))
+		ids := [][]byte{}
+		err := bucket.ForEach(func(k, v []byte) error {
+			rec := tokenRec{}
+			if e := json.Unmarshal(v, &rec); e != nil {
+				return errors.Wrapf(e, "failed to unmarshal token %s", string(k))
+			}
+			if rec.SiteID == siteID {
+				ids = append(ids, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err = bucket.Delete(id); err != nil {
+				return errors.Wrapf(err, "failed to delete token %s", string(id))
+			}
+		}
+		return nil
+	})
+}
+
+// RotateKey sets new key of the site, random one generated if key is empty. Current key, site's own or the default,
+// kept as previous and stays valid for grace duration
+func (b *BoltStore) RotateKey(siteID, key string, grace time.Duration) (info SiteInfo, err error) {
+	if siteID == "" {
+		return SiteInfo{}, errors.New("empty site id")
+	}
+	curKey, err := b.Key(siteID)
+	if err != nil {
+		return SiteInfo{}, err
+	}
+	if key == "" {
+		if key, err = randomKey(32); err != nil {
+			return SiteInfo{}, err
+		}
+	}
+	if key == curKey {
+		return SiteInfo{}, errors.Errorf("new key of site %s is the same as current", siteID)
+	}
+	if info, err = b.Site(siteID); err != nil {
+		return SiteInfo{}, err
+	}
+	now := time.Now()
+	info.Key, info.PrevKey, info.PrevKeyExpires, info.KeyRotated = key, curKey, now.Add(grace), now
+	if err = b.SetSite(info); err != nil {
+		return SiteInfo{}, err
+	}
+	log.Printf("[INFO] key of site %s rotated, previous key valid till %s", siteID, info.PrevKeyExpires.Format(time.RFC3339))
+	return info, nil
+}
+
+// PrevKey returns key of the site before the last rotation, ok is false if not rotated or grace period expired
+func (b *BoltStore) PrevKey(siteID string) (key string, ok bool) {
+	info, err := b.Site(siteID)
+	if err != nil || info.PrevKey == "" || time.Now().After(info.PrevKeyExpires) {
+		return "", false
+	}
+	return info.PrevKey, true
+}
+
+// KeyRotated returns time of the last key rotation of the site, zero if never rotated
+func (b *BoltStore) KeyRotated(siteID string) (ts time.Time) {
+	info, err := b.Site(siteID)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.KeyRotated
+}
+
+// CreateToken makes new api token of the site with given name and scopes. Token is "{id}.{secret}",
+// only sha256 hash of it stored
+func (b *BoltStore) CreateToken(siteID, name string, scopes []string) (tkn string, info APIToken, err error) {
+	if siteID == "" {
+		return "", APIToken{}, errors.New("empty site id")
+	}
+	if name = strings.TrimSpace(name); name == "" {
+		return "", APIToken{}, errors.New("empty token name")
+	}
+	if len(scopes) == 0 {
+		return "", APIToken{}, errors.New("no token scopes")
+	}
+	for _, scope := range scopes {
+		if scope != ScopeRead && scope != ScopeModerate && scope != ScopeDelete {
+			return "", APIToken{}, errors.Errorf("unknown token scope %q", scope)
+		}
+	}
+
+	id, err := randomKey(8)
+	if err != nil {
+		return "", APIToken{}, err
+	}
+	secret, err := randomKey(32)
+	if err != nil {
+		return "", APIToken{}, err
+	}
+	tkn = id + "." + secret
+	info = APIToken{ID: id, SiteID: siteID, Name: name, Scopes: scopes, Created: time.Now()}
+	if err = b.putToken(tokenRec{APIToken: info, Hash: hashToken(tkn)}); err != nil {
+		return "", APIToken{}, err
+	}
+	log.Printf("[INFO] api token %s %q created for site %s, scopes %+v", id, name, siteID, scopes)
+	return tkn, info, nil
+}
+
+// Tokens returns api tokens of the site
+func (b *BoltStore) Tokens(siteID string) (tokens []APIToken, err error) {
+	tokens = []APIToken{}
+	err = b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(tokensBucketName)).ForEach(func(k, v []byte) error {
+			rec := tokenRec{}
+			if e := json.Unmarshal(v, &rec); e != nil {
+				return errors.Wrapf(e, "failed to unmarshal token %s", string(k))
+			}
+			if rec.SiteID == siteID {
+				tokens = append(tokens, rec.APIToken)
+			}
+			return nil
+		})
+	})
+	return tokens, err
+}
+
+// DeleteToken revokes api token of the site
+func (b *BoltStore) DeleteToken(siteID, id string) error {
+	rec, err := b.getToken(id)
+	if err != nil {
+		return err
+	}
+	if rec.SiteID != siteID {
+		return errors.Errorf("no token %s for site %s", id, siteID)
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return errors.Wrapf(tx.Bucket([]byte(tokensBucketName)).Delete([]byte(id)), "failed to delete token %s", id)
+	})
+}
+
+// CheckToken verifies api token and returns its info, sets last used time, once a minute at most
+func (b *BoltStore) CheckToken(tkn string) (info APIToken, err error) {
+	elems := strings.SplitN(tkn, ".", 2)
+	if len(elems) != 2 {
+		return APIToken{}, errors.New("bad token format")
+	}
+	rec, err := b.getToken(elems[0])
+	if err != nil {
+		return APIToken{}, err
+	}
+	if subtle.ConstantTimeCompare([]byte(rec.Hash), []byte(hashToken(tkn))) != 1 {
+		return APIToken{}, errors.New("bad token")
+	}
+	if time.Since(rec.LastUsed) < tokenLastUsedPrecision {
+		return rec.APIToken, nil // recently updated, avoids write on each call
+	}
+	rec.LastUsed = time.Now()
+	if err = b.putToken(rec); err != nil {
+		return APIToken{}, err
+	}
+	return rec.APIToken, nil
+}
+
+func (b *BoltStore) getToken(id string) (rec tokenRec, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket([]byte(tokensBucketName)).Get([]byte(id))
+		if value == nil {
+			return errors.Errorf("no token %s", id)
+		}
+		return errors.Wrapf(json.Unmarshal(value, &rec), "failed to unmarshal token %s", id)
+	})
+	return rec, err
+}
+
+func (b *BoltStore) putToken(rec tokenRec) error {
+	value, err := json.Marshal(rec)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal token %s", rec.ID)
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return errors.Wrapf(tx.Bucket([]byte(tokensBucketName)).Put([]byte(rec.ID), value), "failed to put token %s", rec.ID)
+	})
+}
+
+// Close boltdb
+func (b *BoltStore) Close() error {
+	return errors.Wrap(b.db.Close(), "failed to close admin store")
+}
+
+// randomKey makes random key of size bytes, hex encoded
+func randomKey(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "can't make random key")
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashToken makes sha256 hash of api token, hex encoded
+func hashToken(tkn string) string {
+	h := sha256.Sum256([]byte(tkn))
+	return hex.EncodeToString(h[:])
+}
@@ -16,10 +16,11 @@ type MongoStore struct {
 }
 
 type mongoRec struct {
-	SiteID    string   `bson:"site"`
-	SecretKey string   `bson:"secret"`
-	IDs       []string `bson:"admin_ids"`
-	Email     string   `bson:"admin_email"`
+	SiteID       string   `bson:"site"`
+	SecretKey    string   `bson:"secret"`
+	IDs          []string `bson:"admin_ids"`
+	Email        string   `bson:"admin_email"`
+	ModeratorIDs []string `bson:"moderator_ids"`
 }
 
 // NewMongoStore makes admin Store for mongo's connection
@@ -49,6 +50,18 @@ func (m *MongoStore) Admins(siteID string) (ids []string) {
 	return resp.IDs
 }
 
+// Moderators executes find by siteID and returns moderators ids
+func (m *MongoStore) Moderators(siteID string) (ids []string) {
+	resp := mongoRec{}
+	err := m.connection.WithCollection(func(coll *mgo.Collection) error {
+		return coll.Find(bson.M{"site": siteID}).One(&resp)
+	})
+	if err != nil || resp.ModeratorIDs == nil {
+		return []string{}
+	}
+	return resp.ModeratorIDs
+}
+
 // Email executes find by siteID and returns admin's email
 func (m *MongoStore) Email(siteID string) (email string) {
 	resp := mongoRec{}
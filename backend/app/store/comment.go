@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/microcosm-cc/bluemonday"
+	"github.com/pkg/errors"
 )
 
 // Comment represents a single comment with optional reference to its parent
@@ -22,6 +23,11 @@ type Comment struct {
 	Edit      *Edit           `json:"edit,omitempty" bson:"edit,omitempty"` // pointer to have empty default in json response
 	Pin       bool            `json:"pin,omitempty" bson:"pin,omitempty"`
 	Deleted   bool            `json:"delete,omitempty" bson:"delete"`
+	Pending   bool            `json:"pending,omitempty" bson:"pending,omitempty"`     // waits for approval, hidden from public
+	Revisions []Revision      `json:"revisions,omitempty" bson:"revisions,omitempty"` // previous versions, admin only
+	Trash     *Trash          `json:"trash,omitempty" bson:"trash,omitempty"`         // payload of soft-deleted comment, admin only
+	Reports   []Report        `json:"reports,omitempty" bson:"reports,omitempty"`     // complaints from readers, admin only
+	Shadow    bool            `json:"shadow,omitempty" bson:"shadow,omitempty"`       // made by shadow-banned user, visible to the user and admins
 }
 
 // Locator keeps site and url of the post
@@ -36,6 +42,33 @@ type Edit struct {
 	Summary   string    `json:"summary"`
 }
 
+// Revision keeps a previous version of edited comment
+type Revision struct {
+	Timestamp time.Time `json:"time" bson:"time"`
+	Text      string    `json:"text"`
+	Orig      string    `json:"orig"`
+	Summary   string    `json:"summary,omitempty"`
+}
+
+// Report is a complaint about comment made by a reader
+type Report struct {
+	UserID    string    `json:"user_id" bson:"user_id"`
+	Reason    string    `json:"reason"`
+	Timestamp time.Time `json:"time" bson:"time"`
+}
+
+// Trash keeps payload of soft-deleted comment, allows to restore it till purged
+type Trash struct {
+	Timestamp time.Time       `json:"time" bson:"time"` // deletion time
+	Text      string          `json:"text"`
+	Orig      string          `json:"orig"`
+	Score     int             `json:"score"`
+	Votes     map[string]bool `json:"votes"`
+	Edit      *Edit           `json:"edit,omitempty" bson:"edit,omitempty"`
+	Pin       bool            `json:"pin,omitempty" bson:"pin,omitempty"`
+	Revisions []Revision      `json:"revisions,omitempty" bson:"revisions,omitempty"`
+}
+
 // PostInfo holds summary for given post url
 type PostInfo struct {
 	URL      string    `json:"url"`
@@ -74,19 +107,33 @@ func (c *Comment) PrepareUntrusted() {
 	c.Edit = nil
 	c.Pin = false
 	c.Deleted = false
+	c.Pending = false
+	c.Shadow = false
+	c.Revisions = nil
+	c.Trash = nil
+	c.Reports = nil
 }
 
-// SetDeleted clears comment info, reset to deleted state. hard flag will clear all user info as well
+// SetDeleted clears comment info, reset to deleted state. hard flag will clear all user info as well.
+// Soft delete moves cleared payload to trash, so the comment can be restored later.
 func (c *Comment) SetDeleted(mode DeleteMode) {
+	if mode == SoftDelete && !c.Deleted {
+		c.Trash = &Trash{Timestamp: time.Now(), Text: c.Text, Orig: c.Orig, Score: c.Score, Votes: c.Votes,
+			Edit: c.Edit, Pin: c.Pin, Revisions: c.Revisions}
+	}
+
 	c.Text = ""
 	c.Orig = ""
 	c.Score = 0
 	c.Votes = map[string]bool{}
 	c.Edit = nil
+	c.Revisions = nil
+	c.Reports = nil
 	c.Deleted = true
 	c.Pin = false
 
 	if mode == HardDelete {
+		c.Trash = nil
 		c.User.Name = "deleted"
 		c.User.ID = "deleted"
 		c.User.Picture = ""
@@ -94,6 +141,24 @@ func (c *Comment) SetDeleted(mode DeleteMode) {
 	}
 }
 
+// Restore brings soft-deleted comment back from the trash
+func (c *Comment) Restore() error {
+	if !c.Deleted {
+		return errors.Errorf("comment %s not deleted", c.ID)
+	}
+	if c.Trash == nil {
+		return errors.Errorf("comment %s can't be restored", c.ID)
+	}
+	c.Text, c.Orig, c.Score, c.Votes = c.Trash.Text, c.Trash.Orig, c.Trash.Score, c.Trash.Votes
+	c.Edit, c.Pin, c.Revisions = c.Trash.Edit, c.Trash.Pin, c.Trash.Revisions
+	if c.Votes == nil {
+		c.Votes = map[string]bool{}
+	}
+	c.Deleted = false
+	c.Trash = nil
+	return nil
+}
+
 // Sanitize clean dangerous html/js from the comment
 func (c *Comment) Sanitize() {
 	p := bluemonday.UGCPolicy()
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestComment_Sanitize(t *testing.T) {
@@ -52,8 +53,11 @@ func TestComment_PrepareUntrusted(t *testing.T) {
 		Score:     10,
 		Pin:       true,
 		Deleted:   true,
+		Pending:   true,
 		Timestamp: time.Date(2018, 1, 1, 9, 30, 0, 0, time.Local),
 		Votes:     map[string]bool{"uu": true},
+		Revisions: []Revision{{Text: "old", Orig: "old"}},
+		Reports:   []Report{{UserID: "u1", Reason: "spam"}},
 	}
 
 	comment.PrepareUntrusted()
@@ -64,7 +68,10 @@ func TestComment_PrepareUntrusted(t *testing.T) {
 	assert.Equal(t, false, comment.Pin)
 	assert.Equal(t, time.Time{}, comment.Timestamp)
 	assert.Equal(t, false, comment.Deleted)
+	assert.Equal(t, false, comment.Pending)
 	assert.Equal(t, make(map[string]bool), comment.Votes)
+	assert.Nil(t, comment.Revisions)
+	assert.Nil(t, comment.Reports)
 	assert.Equal(t, User{ID: "username"}, comment.User)
 
 }
@@ -81,6 +88,8 @@ func TestComment_SetDeleted(t *testing.T) {
 		Timestamp: time.Date(2018, 1, 1, 9, 30, 0, 0, time.Local),
 		Votes:     map[string]bool{"uu": true},
 		Pin:       true,
+		Revisions: []Revision{{Text: "old", Orig: "old"}},
+		Reports:   []Report{{UserID: "u1", Reason: "spam"}},
 	}
 
 	comment.SetDeleted(SoftDelete)
@@ -91,8 +100,22 @@ func TestComment_SetDeleted(t *testing.T) {
 	assert.Equal(t, 0, comment.Score)
 	assert.True(t, comment.Deleted)
 	assert.Nil(t, comment.Edit)
+	assert.Nil(t, comment.Revisions)
+	assert.Nil(t, comment.Reports)
 	assert.False(t, comment.Pin)
 	assert.Equal(t, User{Name: "username", ID: "userid", Picture: "pic", Admin: false, Blocked: false, IP: "123"}, comment.User)
+
+	require.NotNil(t, comment.Trash, "soft-deleted payload kept in trash")
+	assert.Equal(t, "blah", comment.Trash.Text)
+	assert.Equal(t, 10, comment.Trash.Score)
+	assert.Equal(t, map[string]bool{"uu": true}, comment.Trash.Votes)
+	assert.True(t, comment.Trash.Pin)
+	assert.Equal(t, []Revision{{Text: "old", Orig: "old"}}, comment.Trash.Revisions)
+	assert.True(t, time.Since(comment.Trash.Timestamp) < time.Second)
+
+	trash := comment.Trash
+	comment.SetDeleted(SoftDelete)
+	assert.Equal(t, trash, comment.Trash, "repeated delete keeps trash")
 }
 
 func TestComment_SetDeletedHard(t *testing.T) {
@@ -119,4 +142,30 @@ func TestComment_SetDeletedHard(t *testing.T) {
 	assert.Nil(t, comment.Edit)
 	assert.False(t, comment.Pin)
 	assert.Equal(t, User{Name: "deleted", ID: "deleted", Picture: "", Admin: false, Blocked: false, IP: ""}, comment.User)
+	assert.Nil(t, comment.Trash)
+}
+
+func TestComment_Restore(t *testing.T) {
+	comment := Comment{
+		ID:        "123",
+		Text:      `blah`,
+		Orig:      `blah orig`,
+		User:      User{ID: "userid", Name: "username"},
+		Locator:   Locator{SiteID: "site", URL: "url"},
+		Score:     10,
+		Timestamp: time.Date(2018, 1, 1, 9, 30, 0, 0, time.Local),
+		Votes:     map[string]bool{"uu": true},
+		Edit:      &Edit{Summary: "edit"},
+		Pin:       true,
+	}
+	orig := comment
+
+	assert.EqualError(t, comment.Restore(), "comment 123 not deleted")
+
+	comment.SetDeleted(SoftDelete)
+	require.Nil(t, comment.Restore())
+	assert.Equal(t, orig, comment)
+
+	comment.SetDeleted(HardDelete)
+	assert.EqualError(t, comment.Restore(), "comment 123 can't be restored")
 }
@@ -1,10 +1,13 @@
 package engine
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"log"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	bolt "github.com/coreos/bbolt"
@@ -24,8 +27,20 @@ import (
 //  - blocking info sits in "block" bucket. Key is userID, value - ts
 //  - counts per post to keep number of comments. Key is post url, value - count
 //  - readonly per post to keep status of manually set RO posts. Key is post url, value - ts
+//  - search index in "search" bucket. Key is word!!reference for each word of the comment, value - ts
+//  - comments waiting for approval in "pending" bucket. Key is ts, value - reference. Removed on approve
+//  - shadow-banned users in "shadow" bucket. Key is userID, value - ts
+//  - reply notifications opt-in in "notify" bucket. Key is userID, value - ReplyNotify
+//  - posts subscriptions in "subscriptions" bucket. Key is userID!!url, value - Subscription
+//  - threads of post in "threads" bucket. Each url makes its own bucket with r!ts!commentID keys of top-level comments
+//    and m!rootID!commentID keys of all comments in thread of rootID top-level comment, value - commentID
 type BoltDB struct {
-	dbs map[string]*bolt.DB
+	dbs     map[string]*bolt.DB // opened sites
+	files   map[string]string   // file names of all known sites, opened on the first access
+	closed  map[string]bool     // sites closed with CloseSite, not accessible till opened again
+	dir     string              // directory of sites added at runtime, empty if not allowed
+	options bolt.Options
+	lock    sync.RWMutex
 }
 
 const (
@@ -37,6 +52,12 @@ const (
 	infoBucketName     = "info"
 	readonlyBucketName = "readonly"
 	verifiedBucketName = "verified"
+	searchBucketName   = "search"
+	pendingBucketName  = "pending"
+	shadowBucketName   = "shadow"
+	notifyBucketName   = "notify"
+	subsBucketName     = "subscriptions"
+	threadsBucketName  = "threads"
 
 	tsNano = "2006-01-02T15:04:05.000000000Z07:00"
 )
@@ -50,32 +71,70 @@ type BoltSite struct {
 // NewBoltDB makes persistent boltdb-based store
 func NewBoltDB(options bolt.Options, sites ...BoltSite) (*BoltDB, error) {
 	log.Printf("[INFO] bolt store for sites %+v", sites)
-	result := BoltDB{dbs: make(map[string]*bolt.DB)}
+	result := BoltDB{dbs: make(map[string]*bolt.DB), files: make(map[string]string), closed: make(map[string]bool),
+		options: options}
 	for _, site := range sites {
-		db, err := bolt.Open(site.FileName, 0600, &options) // bolt.Options{Timeout: 30 * time.Second}
+		db, err := result.openDB(site.FileName)
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed to make boltdb for %s", site.FileName)
+			return nil, err
 		}
+		result.dbs[site.SiteID] = db
+		result.files[site.SiteID] = site.FileName
+	}
+	return &result, nil
+}
 
-		// make top-level buckets
-		topBuckets := []string{postsBucketName, lastBucketName, userBucketName, blocksBucketName,
-			infoBucketName, readonlyBucketName, verifiedBucketName}
-		err = db.Update(func(tx *bolt.Tx) error {
-			for _, bktName := range topBuckets {
-				if _, e := tx.CreateBucketIfNotExists([]byte(bktName)); e != nil {
-					return errors.Wrapf(err, "failed to create top level bucket %s", bktName)
-				}
-			}
-			return nil
-		})
+// NewBoltDBDir makes boltdb-based store with each site in {dir}/{site}.db file. Sites can be added, renamed
+// and removed at runtime, see SiteManager
+func NewBoltDBDir(options bolt.Options, dir string, siteIDs ...string) (*BoltDB, error) {
+	sites := make([]BoltSite, 0, len(siteIDs))
+	for _, siteID := range siteIDs {
+		sites = append(sites, BoltSite{SiteID: siteID, FileName: siteFileName(dir, siteID)})
+	}
+	result, err := NewBoltDB(options, sites...)
+	if err != nil {
+		return nil, err
+	}
+	result.dir = dir
+	return result, nil
+}
 
-		if err != nil {
-			return nil, errors.Wrap(err, "failed to create top level bucket)")
+// openDB opens boltdb file and makes top-level buckets
+func (b *BoltDB) openDB(fileName string) (*bolt.DB, error) {
+	options := b.options
+	db, err := bolt.Open(fileName, 0600, &options) // bolt.Options{Timeout: 30 * time.Second}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to make boltdb for %s", fileName)
+	}
+
+	// make top-level buckets
+	topBuckets := []string{postsBucketName, lastBucketName, userBucketName, blocksBucketName,
+		infoBucketName, readonlyBucketName, verifiedBucketName, searchBucketName, pendingBucketName, shadowBucketName, notifyBucketName,
+		subsBucketName, threadsBucketName}
+	err = db.Update(func(tx *bolt.Tx) error {
+		noIndex := tx.Bucket([]byte(searchBucketName)) == nil    // db made before search index added
+		noThreads := tx.Bucket([]byte(threadsBucketName)) == nil // db made before threads index added
+		for _, bktName := range topBuckets {
+			if _, e := tx.CreateBucketIfNotExists([]byte(bktName)); e != nil {
+				return errors.Wrapf(err, "failed to create top level bucket %s", bktName)
+			}
+		}
+		if noIndex {
+			if e := b.buildSearchIndex(tx); e != nil {
+				return e
+			}
 		}
+		if noThreads {
+			return b.buildThreadsIndex(tx)
+		}
+		return nil
+	})
 
-		result.dbs[site.SiteID] = db
+	if err != nil {
+		_ = db.Close()
+		return nil, errors.Wrap(err, "failed to create top level bucket)")
 	}
-	return &result, nil
+	return db, nil
 }
 
 // Create saves new comment to store. Adds to posts bucket, reference to last and user bucket and increments count bucket
@@ -107,6 +166,14 @@ func (b *BoltDB) Create(comment store.Comment) (commentID string, err error) {
 			return errors.Wrapf(e, "failed to put key %s to bucket %s", comment.ID, comment.Locator.URL)
 		}
 
+		if e = b.updateSearchIndex(tx, comment, true); e != nil {
+			return e
+		}
+
+		if e = b.addToThread(tx, postBkt, comment); e != nil {
+			return e
+		}
+
 		ref := b.makeRef(comment)
 
 		// add reference to comment to "last" bucket
@@ -127,6 +194,13 @@ func (b *BoltDB) Create(comment store.Comment) (commentID string, err error) {
 			return errors.Wrapf(e, "failed to put user comment %s for %s", comment.ID, comment.User.ID)
 		}
 
+		// add reference to "pending" bucket for comments waiting for approval
+		if comment.Pending {
+			if e = tx.Bucket([]byte(pendingBucketName)).Put(commentTs, ref); e != nil {
+				return errors.Wrapf(e, "can't put reference %s to %s", ref, pendingBucketName)
+			}
+		}
+
 		// set info with countfor post url
 		if _, e = b.setInfo(tx, comment); e != nil {
 			return errors.Wrapf(e, "failed to set info for %s", comment.Locator)
@@ -137,6 +211,19 @@ func (b *BoltDB) Create(comment store.Comment) (commentID string, err error) {
 	return comment.ID, err
 }
 
+// FindPage returns page of threads for post as seen with view, starting after cursor thread.
+// Only threads of the page loaded for time sorts, page for other sorts made from all comments of the post
+func (b *BoltDB) FindPage(locator store.Locator, sortFld, cursor string, limit int, view View) (Page, error) {
+	if limit > 0 && strings.HasSuffix(rootsSort(sortFld), "time") {
+		return readPage(b, locator, sortFld, cursor, limit, view)
+	}
+	comments, err := b.Find(locator, sortFld)
+	if err != nil {
+		return Page{}, err
+	}
+	return findPage(comments, sortFld, cursor, limit, view)
+}
+
 // Find returns all comments for post and sorts results
 func (b *BoltDB) Find(locator store.Locator, sortFld string) (comments []store.Comment, err error) {
 	comments = []store.Comment{}
@@ -167,6 +254,109 @@ func (b *BoltDB) Find(locator store.Locator, sortFld string) (comments []store.C
 	return comments, err
 }
 
+// roots returns top-level comments of the post after the key, sorted by time. Supports time sorts only.
+// All comments with the same time collected together and sorted by key, as keys of the threads bucket
+// ordered by id for the same time in both directions
+func (b *BoltDB) roots(locator store.Locator, sortFld string, after *pageCursor, limit int) (comments []store.Comment, err error) {
+	comments = []store.Comment{}
+	desc := rootsSort(sortFld) == "-time"
+
+	bdb, err := b.db(locator.SiteID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = bdb.View(func(tx *bolt.Tx) error {
+		threadsBkt := tx.Bucket([]byte(threadsBucketName)).Bucket([]byte(locator.URL))
+		if threadsBkt == nil {
+			return nil // no comments for the post
+		}
+		postBkt, e := b.getPostBucket(tx, locator.URL)
+		if e != nil {
+			return e
+		}
+
+		prefix := []byte("r!")
+		c := threadsBkt.Cursor()
+		next, k, v := c.Next, []byte(nil), []byte(nil)
+		switch {
+		case desc:
+			next = c.Prev
+			seek := []byte("r\"") // right after the last root key
+			if after != nil {
+				seek = append(b.rootKey(after.Time, ""), 0xff)
+			}
+			if k, _ = c.Seek(seek); k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		case after != nil:
+			k, v = c.Seek(b.rootKey(after.Time, ""))
+		default:
+			k, v = c.Seek(prefix)
+		}
+
+		for ; k != nil && bytes.HasPrefix(k, prefix); k, v = next() {
+			comment := store.Comment{}
+			if e = b.load(postBkt, v, &comment); e != nil {
+				return errors.Wrapf(e, "can't load thread %s of %s", v, locator.URL)
+			}
+			if after != nil && !after.before(pageCursor{Time: comment.Timestamp, ID: comment.ID}, sortFld) {
+				continue
+			}
+			if len(comments) >= limit && !comment.Timestamp.Equal(comments[len(comments)-1].Timestamp) {
+				break
+			}
+			comments = append(comments, comment)
+		}
+		return nil
+	})
+
+	sort.Slice(comments, func(i, j int) bool {
+		return pageCursor{Time: comments[i].Timestamp, ID: comments[i].ID}.
+			before(pageCursor{Time: comments[j].Timestamp, ID: comments[j].ID}, sortFld)
+	})
+	if len(comments) > limit {
+		comments = comments[:limit]
+	}
+	return comments, err
+}
+
+// threads returns all comments of threads with given top-level comments
+func (b *BoltDB) threads(locator store.Locator, rootIDs []string) (comments []store.Comment, err error) {
+	comments = []store.Comment{}
+
+	bdb, err := b.db(locator.SiteID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = bdb.View(func(tx *bolt.Tx) error {
+		threadsBkt := tx.Bucket([]byte(threadsBucketName)).Bucket([]byte(locator.URL))
+		if threadsBkt == nil {
+			return nil
+		}
+		postBkt, e := b.getPostBucket(tx, locator.URL)
+		if e != nil {
+			return e
+		}
+		for _, rootID := range rootIDs {
+			prefix := b.memberKey(rootID, "")
+			c := threadsBkt.Cursor()
+			for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+				comment := store.Comment{}
+				if e = b.load(postBkt, v, &comment); e != nil {
+					return errors.Wrapf(e, "can't load comment %s of %s", v, locator.URL)
+				}
+				comments = append(comments, comment)
+			}
+		}
+		return nil
+	})
+	return comments, err
+}
+
 // Last returns up to max last comments for given siteID
 func (b *BoltDB) Last(siteID string, max int) (comments []store.Comment, err error) {
 
@@ -197,7 +387,7 @@ func (b *BoltDB) Last(siteID string, max int) (comments []store.Comment, err err
 				log.Printf("[WARN] can't load comment for %s from store %s", commentID, url)
 				continue
 			}
-			if comment.Deleted {
+			if comment.Deleted || comment.Pending || comment.Shadow {
 				continue
 			}
 			comments = append(comments, comment)
@@ -230,7 +420,7 @@ func (b *BoltDB) Count(locator store.Locator) (count int, err error) {
 
 // List returns list of all commented posts with counters
 // uses count bucket to get number of comments
-func (b BoltDB) List(siteID string, limit, skip int) (list []store.PostInfo, err error) {
+func (b *BoltDB) List(siteID string, limit, skip int) (list []store.PostInfo, err error) {
 
 	bdb, err := b.db(siteID)
 	if err != nil {
@@ -264,6 +454,59 @@ func (b BoltDB) List(siteID string, limit, skip int) (list []store.PostInfo, err
 	return list, err
 }
 
+// Search returns comments matching all words of the query. Words looked up in search bucket by prefix, found comments
+// loaded and checked against other filters of the request
+func (b *BoltDB) Search(req SearchRequest) ([]store.Comment, error) {
+	words, err := req.queryWords()
+	if err != nil {
+		return nil, err
+	}
+	bdb, err := b.db(req.SiteID)
+	if err != nil {
+		return nil, err
+	}
+
+	comments := []store.Comment{}
+	err = bdb.View(func(tx *bolt.Tx) error {
+		refs := map[string]bool{} // references to comments with all words checked so far
+		for i, w := range words {
+			found := map[string]bool{}
+			prefix := []byte(w)
+			c := tx.Bucket([]byte(searchBucketName)).Cursor()
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				elems := strings.SplitN(string(k), "!!", 2)
+				if len(elems) == 2 && (i == 0 || refs[elems[1]]) {
+					found[elems[1]] = true
+				}
+			}
+			refs = found
+		}
+
+		for ref := range refs {
+			url, commentID, e := b.parseRef([]byte(ref))
+			if e != nil {
+				return e
+			}
+			postBkt, e := b.getPostBucket(tx, url)
+			if e != nil {
+				return e
+			}
+			comment := store.Comment{}
+			if e = b.load(postBkt, []byte(commentID), &comment); e != nil {
+				return errors.Wrapf(e, "can't load comment for %s", ref)
+			}
+			if req.matchFilters(comment) {
+				comments = append(comments, comment)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't search comments for %s", req.SiteID)
+	}
+	return req.paginate(comments), nil
+}
+
 // Info returns time range and count for locator
 func (b *BoltDB) Info(locator store.Locator, readOnlyAge int) (store.PostInfo, error) {
 	bdb, err := b.db(locator.SiteID)
@@ -404,12 +647,165 @@ func (b *BoltDB) Put(locator store.Locator, comment store.Comment) error {
 		if e != nil {
 			return e
 		}
+		// replace indexed words of the current text
+		curComment := store.Comment{}
+		if e = b.load(bucket, []byte(comment.ID), &curComment); e == nil {
+			if e = b.updateSearchIndex(tx, curComment, false); e != nil {
+				return e
+			}
+		}
+		if e = b.updateSearchIndex(tx, comment, true); e != nil {
+			return e
+		}
 		return b.save(bucket, []byte(comment.ID), comment)
 	})
 }
 
+// SetReplyNotify sets user's reply notifications, empty ReplyNotify removes them
+func (b *BoltDB) SetReplyNotify(siteID, userID string, rn store.ReplyNotify) error {
+	bdb, err := b.db(siteID)
+	if err != nil {
+		return err
+	}
+
+	return bdb.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(notifyBucketName))
+		if rn == (store.ReplyNotify{}) {
+			return errors.Wrapf(bucket.Delete([]byte(userID)), "failed to clean reply notify for %s", userID)
+		}
+		return errors.Wrapf(b.save(bucket, []byte(userID), rn), "failed to set reply notify for %s", userID)
+	})
+}
+
+// ReplyNotify returns user's reply notifications, empty if not set
+func (b *BoltDB) ReplyNotify(siteID, userID string) (rn store.ReplyNotify, err error) {
+	bdb, err := b.db(siteID)
+	if err != nil {
+		return rn, err
+	}
+
+	err = bdb.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(notifyBucketName))
+		if bucket.Get([]byte(userID)) == nil {
+			return nil
+		}
+		return b.load(bucket, []byte(userID), &rn)
+	})
+	return rn, err
+}
+
+// Subscribe adds user's subscription to the post or updates existing one
+func (b *BoltDB) Subscribe(sub store.Subscription) error {
+	bdb, err := b.db(sub.Locator.SiteID)
+	if err != nil {
+		return err
+	}
+
+	return bdb.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(subsBucketName))
+		return errors.Wrapf(b.save(bucket, b.subscriptionKey(sub.UserID, sub.Locator.URL), sub),
+			"failed to subscribe %s to %s", sub.UserID, sub.Locator.URL)
+	})
+}
+
+// Unsubscribe removes user's subscription to the post, or all user's subscriptions if locator's url is empty
+func (b *BoltDB) Unsubscribe(locator store.Locator, userID string) error {
+	bdb, err := b.db(locator.SiteID)
+	if err != nil {
+		return err
+	}
+
+	return bdb.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(subsBucketName))
+		if locator.URL != "" {
+			return errors.Wrapf(bucket.Delete(b.subscriptionKey(userID, locator.URL)),
+				"failed to unsubscribe %s from %s", userID, locator.URL)
+		}
+		prefix := b.subscriptionKey(userID, "")
+		keys := [][]byte{}
+		c := bucket.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		for _, k := range keys {
+			if e := bucket.Delete(k); e != nil {
+				return errors.Wrapf(e, "failed to unsubscribe %s", userID)
+			}
+		}
+		return nil
+	})
+}
+
+// Subscriptions returns user's subscriptions, or subscriptions of all users for empty userID. Sorted by user and url
+func (b *BoltDB) Subscriptions(siteID, userID string) (subs []store.Subscription, err error) {
+	bdb, err := b.db(siteID)
+	if err != nil {
+		return nil, err
+	}
+
+	subs = []store.Subscription{}
+	err = bdb.View(func(tx *bolt.Tx) error {
+		prefix := []byte{}
+		if userID != "" {
+			prefix = b.subscriptionKey(userID, "")
+		}
+		c := tx.Bucket([]byte(subsBucketName)).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			sub := store.Subscription{}
+			if e := json.Unmarshal(v, &sub); e != nil {
+				return errors.Wrapf(e, "failed to unmarshal subscription %s", k)
+			}
+			subs = append(subs, sub)
+		}
+		return nil
+	})
+	return subs, err
+}
+
+// MarkDigestSent sets digest sent time of user's subscription to the post, or of all user's subscriptions
+// if locator's url is empty. Missing subscriptions not created, user could unsubscribe while digest sent
+func (b *BoltDB) MarkDigestSent(locator store.Locator, userID string, sentAt time.Time) error {
+	bdb, err := b.db(locator.SiteID)
+	if err != nil {
+		return err
+	}
+
+	return bdb.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(subsBucketName))
+		keys := [][]byte{}
+		if locator.URL != "" {
+			if key := b.subscriptionKey(userID, locator.URL); bucket.Get(key) != nil {
+				keys = append(keys, key)
+			}
+		} else {
+			prefix := b.subscriptionKey(userID, "")
+			c := bucket.Cursor()
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				keys = append(keys, append([]byte{}, k...))
+			}
+		}
+		for _, k := range keys {
+			sub := store.Subscription{}
+			if e := b.load(bucket, k, &sub); e != nil {
+				return errors.Wrapf(e, "failed to load subscription %s", k)
+			}
+			sub.LastSent = sentAt
+			if e := b.save(bucket, k, sub); e != nil {
+				return errors.Wrapf(e, "failed to mark digest sent to %s", userID)
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltDB) subscriptionKey(userID, url string) []byte {
+	return []byte(userID + "!!" + url)
+}
+
 // Close boltdb store
 func (b *BoltDB) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
 	errs := new(multierror.Error)
 	for site, db := range b.dbs {
 		err := errors.Wrapf(db.Close(), "can't close site %s", site)
@@ -510,16 +906,164 @@ func (b *BoltDB) setInfo(tx *bolt.Tx, comment store.Comment) (store.PostInfo, er
 			LastTS:  comment.Timestamp,
 		}
 	}
-	info.Count++
+	if !comment.Pending && !comment.Shadow { // pending comments counted on approve, shadow ones never
+		info.Count++
+	}
 	info.LastTS = comment.Timestamp
 	return info, b.save(infoBkt, []byte(comment.Locator.URL), &info)
 }
 
+// updateSearchIndex adds or removes words of comment's text in search bucket, deleted comments not indexed
+func (b *BoltDB) updateSearchIndex(tx *bolt.Tx, comment store.Comment, add bool) error {
+	if comment.Deleted {
+		return nil
+	}
+	bkt := tx.Bucket([]byte(searchBucketName))
+	ref := b.makeRef(comment)
+	ts := []byte(comment.Timestamp.Format(tsNano))
+	for _, w := range searchWords(searchText(comment)) {
+		key := append([]byte(w+"!!"), ref...)
+		if add {
+			if err := bkt.Put(key, ts); err != nil {
+				return errors.Wrapf(err, "can't add %s to search index", key)
+			}
+			continue
+		}
+		if err := bkt.Delete(key); err != nil {
+			return errors.Wrapf(err, "can't remove %s from search index", key)
+		}
+	}
+	return nil
+}
+
+// addToThread adds comment to the thread of its top-level comment in threads bucket. Replies stored before
+// the comment, i.e. on import, moved to the thread of the comment
+func (b *BoltDB) addToThread(tx *bolt.Tx, postBkt *bolt.Bucket, comment store.Comment) error {
+	threadsBkt, err := tx.Bucket([]byte(threadsBucketName)).CreateBucketIfNotExists([]byte(comment.Locator.URL))
+	if err != nil {
+		return errors.Wrapf(err, "can't make threads bucket for %s", comment.Locator.URL)
+	}
+	rootID := b.threadRoot(postBkt, comment)
+	if rootID == comment.ID {
+		if err = threadsBkt.Put(b.rootKey(comment.Timestamp, comment.ID), []byte(comment.ID)); err != nil {
+			return errors.Wrapf(err, "can't add thread %s", comment.ID)
+		}
+	}
+	if err = threadsBkt.Put(b.memberKey(rootID, comment.ID), []byte(comment.ID)); err != nil {
+		return errors.Wrapf(err, "can't add %s to thread %s", comment.ID, rootID)
+	}
+	if rootID == comment.ID {
+		return nil
+	}
+
+	moved := map[string][]byte{}
+	prefix := b.memberKey(comment.ID, "")
+	c := threadsBkt.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		moved[string(k)] = v
+	}
+	for k, v := range moved {
+		if err = threadsBkt.Delete([]byte(k)); err != nil {
+			return errors.Wrapf(err, "can't remove %s from thread %s", v, comment.ID)
+		}
+		if err = threadsBkt.Put(b.memberKey(rootID, string(v)), v); err != nil {
+			return errors.Wrapf(err, "can't add %s to thread %s", v, rootID)
+		}
+	}
+	return nil
+}
+
+// threadRoot returns id of top-level comment of comment's thread, walking by parents.
+// Id of the first parent missing in the post used for replies to unknown comments
+func (b *BoltDB) threadRoot(postBkt *bolt.Bucket, comment store.Comment) string {
+	seen := map[string]bool{comment.ID: true}
+	for comment.ParentID != "" && !seen[comment.ParentID] {
+		seen[comment.ParentID] = true
+		parent := store.Comment{}
+		if err := b.load(postBkt, []byte(comment.ParentID), &parent); err != nil {
+			return comment.ParentID
+		}
+		comment = parent
+	}
+	return comment.ID
+}
+
+// rootKey makes key of top-level comment in threads bucket, time in UTC to keep keys ordered
+func (b *BoltDB) rootKey(ts time.Time, commentID string) []byte {
+	return []byte("r!" + ts.UTC().Format(tsNano) + "!" + commentID)
+}
+
+// memberKey makes key of comment in thread of top-level comment rootID
+func (b *BoltDB) memberKey(rootID, commentID string) []byte {
+	return []byte("m!" + rootID + "!" + commentID)
+}
+
+// buildThreadsIndex adds all stored comments to threads bucket
+func (b *BoltDB) buildThreadsIndex(tx *bolt.Tx) error {
+	log.Print("[INFO] build threads index")
+	postsBkt := tx.Bucket([]byte(postsBucketName))
+	return postsBkt.ForEach(func(postURL []byte, _ []byte) error {
+		postBkt := postsBkt.Bucket(postURL)
+		if postBkt == nil {
+			return nil
+		}
+		return postBkt.ForEach(func(_ []byte, v []byte) error {
+			comment := store.Comment{}
+			if err := json.Unmarshal(v, &comment); err != nil {
+				return errors.Wrapf(err, "failed to unmarshal comment from %s", postURL)
+			}
+			return b.addToThread(tx, postBkt, comment)
+		})
+	})
+}
+
+// buildSearchIndex indexes all stored comments
+func (b *BoltDB) buildSearchIndex(tx *bolt.Tx) error {
+	log.Print("[INFO] build search index")
+	postsBkt := tx.Bucket([]byte(postsBucketName))
+	return postsBkt.ForEach(func(postURL []byte, _ []byte) error {
+		postBkt := postsBkt.Bucket(postURL)
+		if postBkt == nil {
+			return nil
+		}
+		return postBkt.ForEach(func(_ []byte, v []byte) error {
+			comment := store.Comment{}
+			if err := json.Unmarshal(v, &comment); err != nil {
+				return errors.Wrapf(err, "failed to unmarshal comment from %s", postURL)
+			}
+			return b.updateSearchIndex(tx, comment, true)
+		})
+	})
+}
+
+// db returns boltdb of the site, opens it on the first access
 func (b *BoltDB) db(siteID string) (*bolt.DB, error) {
-	if res, ok := b.dbs[siteID]; ok {
+	b.lock.RLock()
+	res, ok := b.dbs[siteID]
+	b.lock.RUnlock()
+	if ok {
+		return res, nil
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if res, ok = b.dbs[siteID]; ok {
 		return res, nil
 	}
-	return nil, errors.Errorf("site %q not found", siteID)
+	fileName, ok := b.files[siteID]
+	if !ok {
+		return nil, errors.Errorf("site %q not found", siteID)
+	}
+	if b.closed[siteID] {
+		return nil, errors.Errorf("site %q closed", siteID)
+	}
+	res, err := b.openDB(fileName)
+	if err != nil {
+		return nil, err
+	}
+	b.dbs[siteID] = res
+	log.Printf("[INFO] bolt store for site %s opened, %s", siteID, fileName)
+	return res, nil
 }
 
 // makeRef creates reference combining url and comment id
@@ -342,6 +342,58 @@ func TestBoltDB_New(t *testing.T) {
 	assert.EqualError(t, err, "failed to make boltdb for /tmp/no-such-place/tmp.db: open /tmp/no-such-place/tmp.db: no such file or directory")
 }
 
+func TestBoltDB_Conformance(t *testing.T) {
+	defer os.Remove(testDb)
+	runConformance(t, func(t *testing.T) Interface {
+		os.Remove(testDb)
+		b, err := NewBoltDB(bolt.Options{}, BoltSite{FileName: testDb, SiteID: "radio-t"})
+		require.Nil(t, err)
+		return b
+	})
+}
+
+func TestBoltDB_SearchIndexRebuild(t *testing.T) {
+	defer os.Remove(testDb)
+	b := prep(t)
+
+	// drop index to simulate db made before search added
+	err := b.dbs["radio-t"].Update(func(tx *bolt.Tx) error { return tx.DeleteBucket([]byte(searchBucketName)) })
+	require.Nil(t, err)
+	require.Nil(t, b.Close())
+
+	b, err = NewBoltDB(bolt.Options{}, BoltSite{FileName: testDb, SiteID: "radio-t"})
+	require.Nil(t, err)
+	defer b.Close()
+	res, err := b.Search(SearchRequest{SiteID: "radio-t", Query: "text"})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"id-2", "id-1"}, commentIDs(res))
+
+	_, err = b.Search(SearchRequest{SiteID: "bad", Query: "text"})
+	assert.EqualError(t, err, `site "bad" not found`)
+}
+
+func TestBoltDB_ThreadsIndexRebuild(t *testing.T) {
+	defer os.Remove(testDb)
+	b := prep(t)
+
+	// drop index to simulate db made before threads index added
+	err := b.dbs["radio-t"].Update(func(tx *bolt.Tx) error { return tx.DeleteBucket([]byte(threadsBucketName)) })
+	require.Nil(t, err)
+	require.Nil(t, b.Close())
+
+	b, err = NewBoltDB(bolt.Options{}, BoltSite{FileName: testDb, SiteID: "radio-t"})
+	require.Nil(t, err)
+	defer b.Close()
+	loc := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+	page, err := b.FindPage(loc, "-time", "", 1, nil)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"id-2"}, commentIDs(page.Comments))
+	page, err = b.FindPage(loc, "-time", page.NextCursor, 1, nil)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"id-1"}, commentIDs(page.Comments))
+	assert.Empty(t, page.NextCursor)
+}
+
 // makes new boltdb, put two records
 func prep(t *testing.T) *BoltDB {
 	os.Remove(testDb)
@@ -32,6 +32,10 @@ func (b *BoltDB) Delete(locator store.Locator, commentID string, mode store.Dele
 		if err := b.load(postBkt, []byte(commentID), &comment); err != nil {
 			return errors.Wrapf(err, "can't load key %s from bucket %s", commentID, locator.URL)
 		}
+		if err := b.updateSearchIndex(tx, comment, false); err != nil {
+			return err
+		}
+
 		// set deleted status and clear fields
 		comment.SetDeleted(mode)
 
@@ -45,11 +49,172 @@ func (b *BoltDB) Delete(locator store.Locator, commentID string, mode store.Dele
 			return errors.Wrapf(err, "can't delete key %s from bucket %s", commentID, lastBucketName)
 		}
 
-		// decrement comments count for post url
-		if _, e = b.count(tx, comment.Locator.URL, -1); e != nil {
-			return errors.Wrapf(e, "failed to decrement count for %s", comment.Locator)
+		// decrement comments count for post url, pending and shadow comments not counted
+		if !comment.Pending && !comment.Shadow {
+			if _, e = b.count(tx, comment.Locator.URL, -1); e != nil {
+				return errors.Wrapf(e, "failed to decrement count for %s", comment.Locator)
+			}
+		}
+
+		return nil
+	})
+}
+
+// Restore brings soft-deleted comment back, with search index and post's count updated
+func (b *BoltDB) Restore(locator store.Locator, commentID string) error {
+
+	bdb, err := b.db(locator.SiteID)
+	if err != nil {
+		return err
+	}
+
+	return bdb.Update(func(tx *bolt.Tx) error {
+
+		postBkt, e := b.getPostBucket(tx, locator.URL)
+		if e != nil {
+			return e
+		}
+
+		comment := store.Comment{}
+		if err := b.load(postBkt, []byte(commentID), &comment); err != nil {
+			return errors.Wrapf(err, "can't load key %s from bucket %s", commentID, locator.URL)
+		}
+		if err := comment.Restore(); err != nil {
+			return err
+		}
+
+		if err := b.save(postBkt, []byte(commentID), comment); err != nil {
+			return errors.Wrapf(err, "can't save restored comment for key %s from bucket %s", commentID, locator.URL)
+		}
+		if err := b.updateSearchIndex(tx, comment, true); err != nil {
+			return err
 		}
 
+		// increment comments count for post url, pending and shadow comments not counted
+		if !comment.Pending && !comment.Shadow {
+			if _, e = b.count(tx, comment.Locator.URL, 1); e != nil {
+				return errors.Wrapf(e, "failed to increment count for %s", comment.Locator)
+			}
+		}
+		return nil
+	})
+}
+
+// Pending returns all not deleted comments waiting for approval, sorted by time
+func (b *BoltDB) Pending(siteID string) (comments []store.Comment, err error) {
+	comments = []store.Comment{}
+
+	bdb, err := b.db(siteID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = bdb.View(func(tx *bolt.Tx) error {
+		pendingBkt := tx.Bucket([]byte(pendingBucketName))
+		return pendingBkt.ForEach(func(k, v []byte) error {
+			url, commentID, e := b.parseRef(v)
+			if e != nil {
+				return e
+			}
+			postBkt, e := b.getPostBucket(tx, url)
+			if e != nil {
+				return e
+			}
+			comment := store.Comment{}
+			if e := b.load(postBkt, []byte(commentID), &comment); e != nil {
+				log.Printf("[WARN] can't load comment for %s from store %s", commentID, url)
+				return nil
+			}
+			if comment.Pending && !comment.Deleted {
+				comments = append(comments, comment)
+			}
+			return nil
+		})
+	})
+	return comments, err
+}
+
+// Approve publishes pending comment. Removes it from pending bucket and increments post's count
+func (b *BoltDB) Approve(locator store.Locator, commentID string) error {
+
+	bdb, err := b.db(locator.SiteID)
+	if err != nil {
+		return err
+	}
+
+	return bdb.Update(func(tx *bolt.Tx) error {
+
+		postBkt, e := b.getPostBucket(tx, locator.URL)
+		if e != nil {
+			return e
+		}
+
+		comment := store.Comment{}
+		if err := b.load(postBkt, []byte(commentID), &comment); err != nil {
+			return errors.Wrapf(err, "can't load key %s from bucket %s", commentID, locator.URL)
+		}
+		if !comment.Pending {
+			return errors.Errorf("comment %s not pending", commentID)
+		}
+		comment.Pending = false
+
+		if err := b.save(postBkt, []byte(commentID), comment); err != nil {
+			return errors.Wrapf(err, "can't save approved comment for key %s from bucket %s", commentID, locator.URL)
+		}
+
+		pendingBkt := tx.Bucket([]byte(pendingBucketName))
+		if err := pendingBkt.Delete([]byte(comment.Timestamp.Format(tsNano))); err != nil {
+			return errors.Wrapf(err, "can't delete key %s from bucket %s", commentID, pendingBucketName)
+		}
+
+		if !comment.Deleted && !comment.Shadow {
+			if _, e = b.count(tx, comment.Locator.URL, 1); e != nil {
+				return errors.Wrapf(e, "failed to increment count for %s", comment.Locator)
+			}
+		}
+		return nil
+	})
+}
+
+// Hold moves published comment back to pending. Adds it to pending bucket and decrements post's count
+func (b *BoltDB) Hold(locator store.Locator, commentID string) error {
+
+	bdb, err := b.db(locator.SiteID)
+	if err != nil {
+		return err
+	}
+
+	return bdb.Update(func(tx *bolt.Tx) error {
+
+		postBkt, e := b.getPostBucket(tx, locator.URL)
+		if e != nil {
+			return e
+		}
+
+		comment := store.Comment{}
+		if err := b.load(postBkt, []byte(commentID), &comment); err != nil {
+			return errors.Wrapf(err, "can't load key %s from bucket %s", commentID, locator.URL)
+		}
+		if comment.Pending {
+			return errors.Errorf("comment %s already pending", commentID)
+		}
+		comment.Pending = true
+
+		if err := b.save(postBkt, []byte(commentID), comment); err != nil {
+			return errors.Wrapf(err, "can't save held comment for key %s from bucket %s", commentID, locator.URL)
+		}
+
+		ref := b.makeRef(comment)
+		pendingBkt := tx.Bucket([]byte(pendingBucketName))
+		if err := pendingBkt.Put([]byte(comment.Timestamp.Format(tsNano)), ref); err != nil {
+			return errors.Wrapf(err, "can't put reference %s to %s", ref, pendingBucketName)
+		}
+
+		if !comment.Deleted && !comment.Shadow {
+			if _, e = b.count(tx, comment.Locator.URL, -1); e != nil {
+				return errors.Wrapf(e, "failed to decrement count for %s", comment.Locator)
+			}
+		}
 		return nil
 	})
 }
@@ -63,7 +228,8 @@ func (b *BoltDB) DeleteAll(siteID string) error {
 	}
 
 	// delete all buckets except blocked users
-	toDelete := []string{postsBucketName, lastBucketName, userBucketName, infoBucketName}
+	toDelete := []string{postsBucketName, lastBucketName, userBucketName, infoBucketName, searchBucketName,
+		pendingBucketName, threadsBucketName}
 
 	// delete top-level buckets
 	err = bdb.Update(func(tx *bolt.Tx) error {
@@ -321,6 +487,62 @@ func (b *BoltDB) IsVerified(siteID string, userID string) (verified bool) {
 	return verified
 }
 
+// SetShadowBan sets or resets shadow-ban flag. New comments of shadow-banned user visible to the user only
+func (b *BoltDB) SetShadowBan(siteID string, userID string, status bool) error {
+	bdb, err := b.db(siteID)
+	if err != nil {
+		return err
+	}
+
+	return bdb.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(shadowBucketName))
+		switch status {
+		case true:
+			if e := bucket.Put([]byte(userID), []byte(time.Now().Format(tsNano))); e != nil {
+				return errors.Wrapf(e, "failed to set shadow-ban status for %s", userID)
+			}
+		case false:
+			if e := bucket.Delete([]byte(userID)); e != nil {
+				return errors.Wrapf(e, "failed to clean shadow-ban status for %s", userID)
+			}
+		}
+		return nil
+	})
+}
+
+// IsShadowBanned checks if user shadow-banned
+func (b *BoltDB) IsShadowBanned(siteID string, userID string) (banned bool) {
+
+	bdb, err := b.db(siteID)
+	if err != nil {
+		return false
+	}
+
+	_ = bdb.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(shadowBucketName))
+		banned = bucket.Get([]byte(userID)) != nil
+		return nil
+	})
+	return banned
+}
+
+// ShadowBanned returns list of shadow-banned userIDs
+func (b *BoltDB) ShadowBanned(siteID string) (ids []string, err error) {
+	bdb, err := b.db(siteID)
+	if err != nil {
+		return nil, err
+	}
+	err = bdb.View(func(tx *bolt.Tx) error {
+		usersBkt := tx.Bucket([]byte(shadowBucketName))
+		_ = usersBkt.ForEach(func(k, _ []byte) error {
+			ids = append(ids, string(k))
+			return nil
+		})
+		return nil
+	})
+	return ids, err
+}
+
 // Verified returns list of verified userIDs
 func (b *BoltDB) Verified(siteID string) (ids []string, err error) {
 	bdb, err := b.db(siteID)
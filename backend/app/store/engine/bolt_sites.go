@@ -0,0 +1,179 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/pkg/errors"
+
+	"github.com/umputun/remark/backend/app/store"
+)
+
+// OpenSite allows access to the site, new site stored in {dir}/{site}.db. Storage opened on the first access
+func (b *BoltDB) OpenSite(siteID string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.closed, siteID)
+	if _, ok := b.files[siteID]; ok {
+		return nil
+	}
+	if b.dir == "" {
+		return errors.Errorf("can't add site %s, no sites directory", siteID)
+	}
+	b.files[siteID] = siteFileName(b.dir, siteID)
+	log.Printf("[INFO] site %s added to bolt store, %s", siteID, b.files[siteID])
+	return nil
+}
+
+// CloseSite closes storage of the site, the site not accessible till OpenSite
+func (b *BoltDB) CloseSite(siteID string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if _, ok := b.files[siteID]; !ok {
+		return errors.Errorf("site %q not found", siteID)
+	}
+	b.closed[siteID] = true
+	return b.closeDB(siteID)
+}
+
+// RenameSite moves file of the site to {dir}/{newID}.db and changes site id of all comments and subscriptions
+func (b *BoltDB) RenameSite(siteID, newID string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	fileName, ok := b.files[siteID]
+	if !ok {
+		return errors.Errorf("site %q not found", siteID)
+	}
+	if _, ok = b.files[newID]; ok {
+		return errors.Errorf("site %q already exists", newID)
+	}
+	if b.dir == "" {
+		return errors.Errorf("can't rename site %s, no sites directory", siteID)
+	}
+	newFileName := siteFileName(b.dir, newID)
+	if _, err := os.Stat(newFileName); err == nil {
+		return errors.Errorf("file %s already exists", newFileName)
+	}
+
+	if err := b.closeDB(siteID); err != nil {
+		return err
+	}
+	if err := os.Rename(fileName, newFileName); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "can't rename %s", fileName)
+	}
+	db, err := b.openDB(newFileName)
+	if err != nil {
+		return err
+	}
+	if err = db.Update(func(tx *bolt.Tx) error { return b.setSiteID(tx, newID) }); err != nil {
+		_ = db.Close()
+		return errors.Wrapf(err, "can't change site id of %s", newFileName)
+	}
+
+	b.dbs[newID], b.files[newID] = db, newFileName
+	if b.closed[siteID] {
+		b.closed[newID] = true
+		_ = b.closeDB(newID)
+	}
+	delete(b.files, siteID)
+	delete(b.closed, siteID)
+	log.Printf("[INFO] site %s renamed to %s, %s", siteID, newID, newFileName)
+	return nil
+}
+
+// RemoveSite closes storage of the site and deletes its file
+func (b *BoltDB) RemoveSite(siteID string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	fileName, ok := b.files[siteID]
+	if !ok {
+		return errors.Errorf("site %q not found", siteID)
+	}
+	if err := b.closeDB(siteID); err != nil {
+		return err
+	}
+	delete(b.files, siteID)
+	delete(b.closed, siteID)
+	if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "can't remove %s", fileName)
+	}
+	log.Printf("[INFO] site %s removed from bolt store, %s", siteID, fileName)
+	return nil
+}
+
+// closeDB closes opened boltdb of the site, no error if not opened. Should be called under lock
+func (b *BoltDB) closeDB(siteID string) error {
+	db, ok := b.dbs[siteID]
+	if !ok {
+		return nil
+	}
+	delete(b.dbs, siteID)
+	return errors.Wrapf(db.Close(), "can't close site %s", siteID)
+}
+
+// setSiteID changes site id in locators of all comments and subscriptions
+func (b *BoltDB) setSiteID(tx *bolt.Tx, siteID string) error {
+	postsBkt := tx.Bucket([]byte(postsBucketName))
+	postURLs := [][]byte{}
+	if err := postsBkt.ForEach(func(postURL []byte, _ []byte) error {
+		postURLs = append(postURLs, postURL)
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, postURL := range postURLs {
+		postBkt := postsBkt.Bucket(postURL)
+		if postBkt == nil {
+			continue
+		}
+		err := b.updateValues(postBkt, func(v []byte) (interface{}, error) {
+			comment := store.Comment{}
+			err := json.Unmarshal(v, &comment)
+			comment.Locator.SiteID = siteID
+			return comment, errors.Wrapf(err, "failed to unmarshal comment from %s", postURL)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return b.updateValues(tx.Bucket([]byte(subsBucketName)), func(v []byte) (interface{}, error) {
+		sub := store.Subscription{}
+		err := json.Unmarshal(v, &sub)
+		sub.Locator.SiteID = siteID
+		return sub, errors.Wrap(err, "failed to unmarshal subscription")
+	})
+}
+
+// updateValues replaces all values of the bucket with results of fn
+func (b *BoltDB) updateValues(bkt *bolt.Bucket, fn func(v []byte) (interface{}, error)) error {
+	updates := map[string]interface{}{}
+	err := bkt.ForEach(func(k, v []byte) error {
+		if v == nil { // nested bucket
+			return nil
+		}
+		res, err := fn(v)
+		if err != nil {
+			return err
+		}
+		updates[string(k)] = res
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for k, v := range updates {
+		if err = b.save(bkt, []byte(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// siteFileName makes file name of the site in the directory
+func siteFileName(dir, siteID string) string {
+	return fmt.Sprintf("%s/%s.db", dir, siteID)
+}
@@ -0,0 +1,86 @@
+package engine
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark/backend/app/store"
+)
+
+func TestBoltDB_Sites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remark-sites")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	b, err := NewBoltDBDir(bolt.Options{}, dir, "radio-t")
+	require.NoError(t, err)
+	defer b.Close()
+	var sm SiteManager = b
+
+	loc := store.Locator{URL: "https://example.com/post1", SiteID: "blog"}
+	_, err = b.Create(store.Comment{ID: "id-1", Text: "text", Locator: loc, User: store.User{ID: "user1"}})
+	assert.EqualError(t, err, `site "blog" not found`)
+
+	require.NoError(t, sm.OpenSite("blog"))
+	_, err = os.Stat(dir + "/blog.db")
+	assert.True(t, os.IsNotExist(err), "opened on the first access")
+	_, err = b.Create(store.Comment{ID: "id-1", Text: "text", Locator: loc, User: store.User{ID: "user1"},
+		Timestamp: time.Now()})
+	require.NoError(t, err)
+	require.NoError(t, b.Subscribe(store.Subscription{Locator: loc, UserID: "user1", Email: "u1@example.com",
+		Period: store.DigestDaily}))
+	_, err = os.Stat(dir + "/blog.db")
+	assert.NoError(t, err)
+
+	// closed site not accessible till opened again
+	require.NoError(t, sm.CloseSite("blog"))
+	_, err = b.Count(loc)
+	assert.EqualError(t, err, `site "blog" closed`)
+	require.NoError(t, sm.OpenSite("blog"))
+	count, err := b.Count(loc)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// rename moves file and changes site id of comments and subscriptions
+	assert.EqualError(t, sm.RenameSite("blog", "radio-t"), `site "radio-t" already exists`)
+	assert.EqualError(t, sm.RenameSite("no-such-site", "blog2"), `site "no-such-site" not found`)
+	require.NoError(t, sm.RenameSite("blog", "blog2"))
+	_, err = b.Count(loc)
+	assert.EqualError(t, err, `site "blog" not found`)
+	_, err = os.Stat(dir + "/blog.db")
+	assert.True(t, os.IsNotExist(err))
+	loc.SiteID = "blog2"
+	comments, err := b.Find(loc, "time")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(comments))
+	assert.Equal(t, "blog2", comments[0].Locator.SiteID)
+	subs, err := b.Subscriptions("blog2", "user1")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(subs))
+	assert.Equal(t, "blog2", subs[0].Locator.SiteID)
+
+	// renamed closed site stays closed
+	require.NoError(t, sm.CloseSite("blog2"))
+	require.NoError(t, sm.RenameSite("blog2", "blog3"))
+	_, err = b.Count(store.Locator{URL: loc.URL, SiteID: "blog3"})
+	assert.EqualError(t, err, `site "blog3" closed`)
+
+	require.NoError(t, sm.RemoveSite("blog3"))
+	_, err = os.Stat(dir + "/blog3.db")
+	assert.True(t, os.IsNotExist(err))
+	assert.EqualError(t, sm.RemoveSite("blog3"), `site "blog3" not found`)
+	assert.EqualError(t, sm.CloseSite("blog3"), `site "blog3" not found`)
+
+	// site without directory can't be added
+	b2, err := NewBoltDB(bolt.Options{}, BoltSite{FileName: testDb, SiteID: "radio-t"})
+	require.NoError(t, err)
+	defer os.Remove(testDb)
+	defer b2.Close()
+	assert.EqualError(t, b2.OpenSite("blog"), "can't add site blog, no sites directory")
+}
@@ -0,0 +1,858 @@
+package engine
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark/backend/app/store"
+)
+
+// conformance suite checks behaviour shared by all engine.Interface implementations.
+// newEngine should return fresh and empty engine serving "radio-t" site.
+func runConformance(t *testing.T, newEngine func(t *testing.T) Interface) {
+	tbl := []struct {
+		name string
+		fn   func(t *testing.T, e Interface)
+	}{
+		{"CreateAndFind", conformanceCreateAndFind},
+		{"Sort", conformanceSort},
+		{"FindPage", conformanceFindPage},
+		{"FindPageView", conformanceFindPageView},
+		{"Search", conformanceSearch},
+		{"GetAndPut", conformanceGetAndPut},
+		{"Last", conformanceLast},
+		{"User", conformanceUser},
+		{"List", conformanceList},
+		{"Info", conformanceInfo},
+		{"Delete", conformanceDelete},
+		{"Restore", conformanceRestore},
+		{"Pending", conformancePending},
+		{"Hold", conformanceHold},
+		{"DeleteAll", conformanceDeleteAll},
+		{"DeleteUser", conformanceDeleteUser},
+		{"Block", conformanceBlock},
+		{"BlockTTL", conformanceBlockTTL},
+		{"Verified", conformanceVerified},
+		{"ShadowBan", conformanceShadowBan},
+		{"ShadowComments", conformanceShadowComments},
+		{"ReplyNotify", conformanceReplyNotify},
+		{"Subscriptions", conformanceSubscriptions},
+		{"ReadOnly", conformanceReadOnly},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newEngine(t)
+			defer e.Close()
+			tt.fn(t, e)
+		})
+	}
+}
+
+// conformanceComment makes comment for radio-t site, i-th comment created i seconds after the base time
+func conformanceComment(id, url, userID string, i int) store.Comment {
+	return store.Comment{
+		ID:        id,
+		Text:      "text " + id,
+		Timestamp: time.Date(2017, 12, 20, 15, 18, 0, 0, time.Local).Add(time.Duration(i) * time.Second),
+		Locator:   store.Locator{URL: url, SiteID: "radio-t"},
+		User:      store.User{ID: userID, Name: "name " + userID},
+	}
+}
+
+func conformanceCreate(t *testing.T, e Interface, comments ...store.Comment) {
+	for _, c := range comments {
+		id, err := e.Create(c)
+		require.Nil(t, err)
+		require.Equal(t, c.ID, id)
+	}
+}
+
+func commentIDs(comments []store.Comment) (ids []string) {
+	for _, c := range comments {
+		ids = append(ids, c.ID)
+	}
+	return ids
+}
+
+func conformanceCreateAndFind(t *testing.T, e Interface) {
+	conformanceCreate(t, e,
+		conformanceComment("id-1", "https://radio-t.com/1", "user1", 1),
+		conformanceComment("id-2", "https://radio-t.com/1", "user2", 2),
+		conformanceComment("id-3", "https://radio-t.com/2", "user1", 3),
+	)
+
+	_, err := e.Create(conformanceComment("id-1", "https://radio-t.com/1", "user1", 4))
+	assert.NotNil(t, err, "reject dup")
+
+	res, err := e.Find(store.Locator{URL: "https://radio-t.com/1", SiteID: "radio-t"}, "time")
+	require.Nil(t, err)
+	require.Equal(t, []string{"id-1", "id-2"}, commentIDs(res))
+	assert.Equal(t, "text id-1", res[0].Text)
+	assert.Equal(t, store.User{ID: "user1", Name: "name user1"}, res[0].User)
+	assert.Equal(t, store.Locator{URL: "https://radio-t.com/1", SiteID: "radio-t"}, res[0].Locator)
+	assert.True(t, res[0].Timestamp.Equal(time.Date(2017, 12, 20, 15, 18, 1, 0, time.Local)))
+
+	count, err := e.Count(store.Locator{URL: "https://radio-t.com/1", SiteID: "radio-t"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+}
+
+func conformanceSort(t *testing.T, e Interface) {
+	for i, score := range []int{5, 4, 6, 7} {
+		c := conformanceComment(fmt.Sprintf("id-%d", i+1), "https://radio-t.com", "user1", i)
+		c.Score = score
+		conformanceCreate(t, e, c)
+	}
+
+	tbl := []struct {
+		sort string
+		ids  []string
+	}{
+		{"time", []string{"id-1", "id-2", "id-3", "id-4"}},
+		{"+time", []string{"id-1", "id-2", "id-3", "id-4"}},
+		{"-time", []string{"id-4", "id-3", "id-2", "id-1"}},
+		{"score", []string{"id-2", "id-1", "id-3", "id-4"}},
+		{"+score", []string{"id-2", "id-1", "id-3", "id-4"}},
+		{"-score", []string{"id-4", "id-3", "id-1", "id-2"}},
+	}
+
+	for _, tt := range tbl {
+		res, err := e.Find(store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}, tt.sort)
+		require.Nil(t, err)
+		assert.Equal(t, tt.ids, commentIDs(res), "sort %s", tt.sort)
+	}
+}
+
+func conformanceFindPage(t *testing.T, e Interface) {
+	for i := 1; i <= 5; i++ {
+		c := conformanceComment(fmt.Sprintf("id-%d", i), "https://radio-t.com", "user1", i)
+		if i%2 == 0 {
+			c.ParentID = fmt.Sprintf("id-%d", i-1)
+		}
+		conformanceCreate(t, e, c)
+	}
+	loc := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+
+	page, err := e.FindPage(loc, "time", "", 2, nil)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"id-1", "id-2", "id-3", "id-4"}, commentIDs(page.Comments))
+	require.NotEmpty(t, page.NextCursor)
+
+	page, err = e.FindPage(loc, "time", page.NextCursor, 2, nil)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"id-5"}, commentIDs(page.Comments))
+	assert.Empty(t, page.NextCursor)
+
+	page, err = e.FindPage(loc, "-time", "", 1, nil)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"id-5"}, commentIDs(page.Comments))
+
+	_, err = e.FindPage(loc, "time", "bad", 1, nil)
+	assert.NotNil(t, err, "invalid cursor")
+}
+
+// conformanceFindPageView checks pages made for all sorts match page of all comments of the post, with threads
+// hidden by view, deleted threads, roots with the same time and replies stored before their parents
+func conformanceFindPageView(t *testing.T, e Interface) {
+	url := "https://radio-t.com"
+	for i := 1; i <= 12; i++ {
+		c := conformanceComment(fmt.Sprintf("r-%02d", i), url, "user1", i)
+		c.Score = i * 7 % 5
+		c.Pending = i == 3 || i == 4 || i == 9
+		c.Deleted = i == 7
+		if i == 11 {
+			c.Timestamp = c.Timestamp.Add(-time.Second) // same time as r-10
+		}
+		conformanceCreate(t, e, c)
+	}
+	reply := func(id, parentID string, i int) store.Comment {
+		c := conformanceComment(id, url, "user2", i)
+		c.ParentID = parentID
+		return c
+	}
+	conformanceCreate(t, e, reply("re-02a", "r-02", 20), reply("re-02b", "re-02a", 21), reply("re-03a", "r-03", 22),
+		reply("re-05b", "re-05a", 24), reply("re-05a", "r-05", 23), reply("re-12a", "r-12", 25))
+
+	view := func(comments []store.Comment) (res []store.Comment) {
+		for _, c := range comments {
+			if !c.Pending {
+				res = append(res, c)
+			}
+		}
+		return res
+	}
+	loc := store.Locator{URL: url, SiteID: "radio-t"}
+	all, err := e.Find(loc, "time")
+	require.Nil(t, err)
+
+	for _, sortFld := range []string{"time", "+time", "-time", "score", "-score", "-active"} {
+		expected, err := findPage(all, sortFld, "", 0, view)
+		require.Nil(t, err)
+		for _, limit := range []int{1, 2, 3, 5} {
+			ids, cursor := []string{}, ""
+			for n := 0; n < 20; n++ {
+				page, err := e.FindPage(loc, sortFld, cursor, limit, view)
+				require.Nil(t, err)
+				ids = append(ids, commentIDs(page.Comments)...)
+				if cursor = page.NextCursor; cursor == "" {
+					break
+				}
+			}
+			assert.Equal(t, commentIDs(expected.Comments), ids, "sort %s, limit %d", sortFld, limit)
+		}
+	}
+}
+
+func conformanceSearch(t *testing.T, e Interface) {
+	texts := []string{"Hello remark world", "hello there", "another world", "WORLD hello again", "nothing here"}
+	for i, text := range texts {
+		c := conformanceComment(fmt.Sprintf("id-%d", i+1), fmt.Sprintf("https://radio-t.com/%d", i%2), fmt.Sprintf("user%d", i%2), i+1)
+		c.Orig = text
+		conformanceCreate(t, e, c)
+	}
+
+	tbl := []struct {
+		req SearchRequest
+		ids []string
+	}{
+		{SearchRequest{Query: "hello"}, []string{"id-4", "id-2", "id-1"}},
+		{SearchRequest{Query: "world HELLO"}, []string{"id-4", "id-1"}},
+		{SearchRequest{Query: "wor hel"}, []string{"id-4", "id-1"}},
+		{SearchRequest{Query: "orld"}, nil},
+		{SearchRequest{Query: "hello", UserID: "user1"}, []string{"id-4", "id-2"}},
+		{SearchRequest{Query: "world", URL: "https://radio-t.com/0"}, []string{"id-3", "id-1"}},
+		{SearchRequest{Query: "hello", From: time.Date(2017, 12, 20, 15, 18, 2, 0, time.Local),
+			To: time.Date(2017, 12, 20, 15, 18, 3, 0, time.Local)}, []string{"id-2"}},
+		{SearchRequest{Query: "hello", Limit: 2}, []string{"id-4", "id-2"}},
+		{SearchRequest{Query: "hello", Limit: 2, Skip: 2}, []string{"id-1"}},
+		{SearchRequest{Query: "missing"}, nil},
+	}
+	for _, tt := range tbl {
+		tt.req.SiteID = "radio-t"
+		res, err := e.Search(tt.req)
+		require.Nil(t, err)
+		assert.Equal(t, tt.ids, commentIDs(res), "%+v", tt.req)
+	}
+
+	loc := store.Locator{URL: "https://radio-t.com/0", SiteID: "radio-t"}
+	require.Nil(t, e.Delete(loc, "id-1", store.SoftDelete))
+	res, err := e.Search(SearchRequest{SiteID: "radio-t", Query: "hello"})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"id-4", "id-2"}, commentIDs(res), "deleted excluded")
+
+	c, err := e.Get(loc, "id-3")
+	require.Nil(t, err)
+	c.Orig = "edited text"
+	require.Nil(t, e.Put(loc, c))
+	res, err = e.Search(SearchRequest{SiteID: "radio-t", Query: "edited"})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"id-3"}, commentIDs(res), "found by edited text")
+	res, err = e.Search(SearchRequest{SiteID: "radio-t", Query: "another"})
+	require.Nil(t, err)
+	assert.Empty(t, res, "not found by text before edit")
+
+	_, err = e.Search(SearchRequest{SiteID: "radio-t", Query: " ! "})
+	assert.NotNil(t, err, "empty query")
+}
+
+func conformanceGetAndPut(t *testing.T, e Interface) {
+	conformanceCreate(t, e, conformanceComment("id-1", "https://radio-t.com", "user1", 1))
+	loc := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+
+	c, err := e.Get(loc, "id-1")
+	require.Nil(t, err)
+	assert.Equal(t, "text id-1", c.Text)
+
+	_, err = e.Get(loc, "id-bad")
+	assert.NotNil(t, err, "unknown comment")
+
+	c.Text = "updated text"
+	c.Score = 3
+	require.Nil(t, e.Put(loc, c))
+
+	c, err = e.Get(loc, "id-1")
+	require.Nil(t, err)
+	assert.Equal(t, "updated text", c.Text)
+	assert.Equal(t, 3, c.Score)
+	assert.Equal(t, "user1", c.User.ID)
+}
+
+func conformanceLast(t *testing.T, e Interface) {
+	for i := 1; i <= 5; i++ {
+		conformanceCreate(t, e, conformanceComment(fmt.Sprintf("id-%d", i), fmt.Sprintf("https://radio-t.com/%d", i%2), "user1", i))
+	}
+
+	res, err := e.Last("radio-t", 0)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"id-5", "id-4", "id-3", "id-2", "id-1"}, commentIDs(res), "all, sorted by time desc")
+
+	res, err = e.Last("radio-t", 2)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"id-5", "id-4"}, commentIDs(res), "limited")
+
+	require.Nil(t, e.Delete(store.Locator{URL: "https://radio-t.com/1", SiteID: "radio-t"}, "id-5", store.SoftDelete))
+	res, err = e.Last("radio-t", 2)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"id-4", "id-3"}, commentIDs(res), "deleted excluded")
+}
+
+func conformanceUser(t *testing.T, e Interface) {
+	for i := 1; i <= 5; i++ {
+		conformanceCreate(t, e, conformanceComment(fmt.Sprintf("id-%d", i), fmt.Sprintf("https://radio-t.com/%d", i%2), "user1", i))
+	}
+	conformanceCreate(t, e, conformanceComment("id-6", "https://radio-t.com/1", "user2", 6))
+
+	res, err := e.User("radio-t", "user1", 0, 0)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"id-5", "id-4", "id-3", "id-2", "id-1"}, commentIDs(res), "all, sorted by time desc")
+
+	res, err = e.User("radio-t", "user1", 2, 0)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"id-5", "id-4"}, commentIDs(res), "limited")
+
+	res, err = e.User("radio-t", "user1", 2, 2)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"id-3", "id-2"}, commentIDs(res), "limited and skipped")
+
+	res, err = e.User("radio-t", "user1", 10, 4)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"id-1"}, commentIDs(res), "skipped")
+
+	count, err := e.UserCount("radio-t", "user1")
+	require.Nil(t, err)
+	assert.Equal(t, 5, count)
+	count, err = e.UserCount("radio-t", "user2")
+	require.Nil(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func conformanceList(t *testing.T, e Interface) {
+	conformanceCreate(t, e,
+		conformanceComment("id-1", "https://radio-t.com/1", "user1", 1),
+		conformanceComment("id-2", "https://radio-t.com/1", "user1", 2),
+		conformanceComment("id-3", "https://radio-t.com/2", "user1", 3),
+		conformanceComment("id-4", "https://radio-t.com/3", "user1", 4),
+	)
+
+	urls := func(list []store.PostInfo) (res []string) {
+		for _, p := range list {
+			res = append(res, p.URL)
+		}
+		return res
+	}
+
+	res, err := e.List("radio-t", 0, 0)
+	require.Nil(t, err)
+	require.Equal(t, []string{"https://radio-t.com/3", "https://radio-t.com/2", "https://radio-t.com/1"}, urls(res),
+		"all posts, sorted by url desc")
+	assert.Equal(t, 2, res[2].Count)
+	assert.True(t, res[2].FirstTS.Equal(time.Date(2017, 12, 20, 15, 18, 1, 0, time.Local)))
+	assert.True(t, res[2].LastTS.Equal(time.Date(2017, 12, 20, 15, 18, 2, 0, time.Local)))
+
+	res, err = e.List("radio-t", 2, 0)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"https://radio-t.com/3", "https://radio-t.com/2"}, urls(res), "limited")
+
+	res, err = e.List("radio-t", 2, 1)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"https://radio-t.com/2", "https://radio-t.com/1"}, urls(res), "limited and skipped")
+
+	res, err = e.List("radio-t", 0, 2)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"https://radio-t.com/1"}, urls(res), "skipped")
+
+	res, err = e.List("radio-t", 0, 3)
+	require.Nil(t, err)
+	assert.Empty(t, res, "skipped all")
+
+	require.Nil(t, e.Delete(store.Locator{URL: "https://radio-t.com/1", SiteID: "radio-t"}, "id-1", store.SoftDelete))
+	res, err = e.List("radio-t", 1, 2)
+	require.Nil(t, err)
+	require.Equal(t, []string{"https://radio-t.com/1"}, urls(res))
+	assert.Equal(t, 1, res[0].Count, "deleted not counted")
+}
+
+func conformanceInfo(t *testing.T, e Interface) {
+	conformanceCreate(t, e,
+		conformanceComment("id-1", "https://radio-t.com", "user1", 1),
+		conformanceComment("id-2", "https://radio-t.com", "user2", 2),
+	)
+	loc := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+
+	info, err := e.Info(loc, 0)
+	require.Nil(t, err)
+	assert.Equal(t, "https://radio-t.com", info.URL)
+	assert.Equal(t, 2, info.Count)
+	assert.False(t, info.ReadOnly)
+	assert.True(t, info.FirstTS.Equal(time.Date(2017, 12, 20, 15, 18, 1, 0, time.Local)))
+	assert.True(t, info.LastTS.Equal(time.Date(2017, 12, 20, 15, 18, 2, 0, time.Local)))
+
+	info, err = e.Info(loc, 10)
+	require.Nil(t, err)
+	assert.True(t, info.ReadOnly, "old post is read-only by age")
+
+	require.Nil(t, e.Delete(loc, "id-2", store.SoftDelete))
+	info, err = e.Info(loc, 0)
+	require.Nil(t, err)
+	assert.Equal(t, 1, info.Count, "deleted not counted")
+
+	_, err = e.Info(store.Locator{URL: "https://radio-t.com/bad", SiteID: "radio-t"}, 0)
+	assert.NotNil(t, err, "unknown post")
+}
+
+func conformanceDelete(t *testing.T, e Interface) {
+	conformanceCreate(t, e,
+		conformanceComment("id-1", "https://radio-t.com", "user1", 1),
+		conformanceComment("id-2", "https://radio-t.com", "user1", 2),
+		conformanceComment("id-3", "https://radio-t.com", "user2", 3),
+	)
+	loc := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+
+	require.Nil(t, e.Delete(loc, "id-1", store.SoftDelete))
+	c, err := e.Get(loc, "id-1")
+	require.Nil(t, err)
+	assert.True(t, c.Deleted)
+	assert.Equal(t, "", c.Text)
+	assert.Equal(t, store.User{ID: "user1", Name: "name user1"}, c.User, "soft delete keeps user")
+
+	require.Nil(t, e.Delete(loc, "id-3", store.HardDelete))
+	c, err = e.Get(loc, "id-3")
+	require.Nil(t, err)
+	assert.True(t, c.Deleted)
+	assert.Equal(t, "", c.Text)
+	assert.Equal(t, store.User{ID: "deleted", Name: "deleted"}, c.User, "hard delete clears user")
+
+	res, err := e.Find(loc, "time")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"id-1", "id-2", "id-3"}, commentIDs(res), "deleted comments kept in the tree")
+
+	count, err := e.Count(loc)
+	require.Nil(t, err)
+	assert.Equal(t, 1, count, "deleted not counted")
+
+	assert.NotNil(t, e.Delete(loc, "id-bad", store.SoftDelete), "unknown comment")
+}
+
+func conformanceRestore(t *testing.T, e Interface) {
+	conformanceCreate(t, e,
+		conformanceComment("id-1", "https://radio-t.com", "user1", 1),
+		conformanceComment("id-2", "https://radio-t.com", "user1", 2),
+		conformanceComment("id-3", "https://radio-t.com", "user2", 3),
+	)
+	loc := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+
+	require.Nil(t, e.Delete(loc, "id-1", store.SoftDelete))
+	require.Nil(t, e.Restore(loc, "id-1"))
+	c, err := e.Get(loc, "id-1")
+	require.Nil(t, err)
+	assert.False(t, c.Deleted)
+	assert.Equal(t, "text id-1", c.Text)
+	assert.Nil(t, c.Trash)
+
+	count, err := e.Count(loc)
+	require.Nil(t, err)
+	assert.Equal(t, 3, count, "restored counted")
+	last, err := e.Last("radio-t", 10)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"id-3", "id-2", "id-1"}, commentIDs(last))
+	found, err := e.Search(SearchRequest{SiteID: "radio-t", Query: "text"})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"id-3", "id-2", "id-1"}, commentIDs(found), "restored searchable")
+
+	assert.NotNil(t, e.Restore(loc, "id-2"), "not deleted")
+	require.Nil(t, e.Delete(loc, "id-2", store.HardDelete))
+	assert.NotNil(t, e.Restore(loc, "id-2"), "hard deleted")
+	assert.NotNil(t, e.Restore(loc, "id-bad"), "unknown comment")
+
+	// trash dropped by put can't be restored
+	require.Nil(t, e.Delete(loc, "id-3", store.SoftDelete))
+	c, err = e.Get(loc, "id-3")
+	require.Nil(t, err)
+	require.NotNil(t, c.Trash)
+	c.Trash = nil
+	require.Nil(t, e.Put(loc, c))
+	assert.NotNil(t, e.Restore(loc, "id-3"), "purged")
+}
+
+func conformancePending(t *testing.T, e Interface) {
+	c2 := conformanceComment("id-2", "https://radio-t.com", "user2", 2)
+	c2.Pending = true
+	c3 := conformanceComment("id-3", "https://radio-t.com", "user2", 3)
+	c3.Pending = true
+	conformanceCreate(t, e, conformanceComment("id-1", "https://radio-t.com", "user1", 1), c2, c3)
+	loc := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+
+	pending, err := e.Pending("radio-t")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"id-2", "id-3"}, commentIDs(pending))
+
+	res, err := e.Find(loc, "time")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"id-1", "id-2", "id-3"}, commentIDs(res), "find returns pending")
+	last, err := e.Last("radio-t", 10)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"id-1"}, commentIDs(last), "pending not in last")
+	found, err := e.Search(SearchRequest{SiteID: "radio-t", Query: "text"})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"id-1"}, commentIDs(found), "pending not searchable")
+	count, err := e.Count(loc)
+	require.Nil(t, err)
+	assert.Equal(t, 1, count, "pending not counted")
+	info, err := e.Info(loc, 0)
+	require.Nil(t, err)
+	assert.Equal(t, 1, info.Count)
+
+	require.Nil(t, e.Approve(loc, "id-2"))
+	assert.NotNil(t, e.Approve(loc, "id-2"), "already approved")
+	assert.NotNil(t, e.Approve(loc, "id-1"), "never pending")
+	c, err := e.Get(loc, "id-2")
+	require.Nil(t, err)
+	assert.False(t, c.Pending)
+
+	// rejected pending comment deleted and stays pending
+	require.Nil(t, e.Delete(loc, "id-3", store.SoftDelete))
+
+	pending, err = e.Pending("radio-t")
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(pending))
+	count, err = e.Count(loc)
+	require.Nil(t, err)
+	assert.Equal(t, 2, count, "approved counted, rejected not")
+	last, err = e.Last("radio-t", 10)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"id-2", "id-1"}, commentIDs(last))
+	list, err := e.List("radio-t", 0, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(list))
+	assert.Equal(t, 2, list[0].Count)
+
+	// restored rejected comment back to the queue
+	require.Nil(t, e.Restore(loc, "id-3"))
+	pending, err = e.Pending("radio-t")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"id-3"}, commentIDs(pending))
+	count, err = e.Count(loc)
+	require.Nil(t, err)
+	assert.Equal(t, 2, count)
+}
+
+func conformanceHold(t *testing.T, e Interface) {
+	conformanceCreate(t, e, conformanceComment("id-1", "https://radio-t.com", "user1", 1),
+		conformanceComment("id-2", "https://radio-t.com", "user2", 2))
+	loc := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+
+	c, err := e.Get(loc, "id-1")
+	require.Nil(t, err)
+	c.Reports = []store.Report{{UserID: "user2", Reason: "spam", Timestamp: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)}}
+	require.Nil(t, e.Put(loc, c))
+
+	require.Nil(t, e.Hold(loc, "id-1"))
+	assert.NotNil(t, e.Hold(loc, "id-1"), "already pending")
+
+	c, err = e.Get(loc, "id-1")
+	require.Nil(t, err)
+	assert.True(t, c.Pending)
+	require.Equal(t, 1, len(c.Reports))
+	assert.Equal(t, "spam", c.Reports[0].Reason)
+
+	pending, err := e.Pending("radio-t")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"id-1"}, commentIDs(pending))
+	count, err := e.Count(loc)
+	require.Nil(t, err)
+	assert.Equal(t, 1, count, "held comment not counted")
+	info, err := e.Info(loc, 0)
+	require.Nil(t, err)
+	assert.Equal(t, 1, info.Count)
+	last, err := e.Last("radio-t", 10)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"id-2"}, commentIDs(last))
+
+	require.Nil(t, e.Approve(loc, "id-1"))
+	pending, err = e.Pending("radio-t")
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(pending))
+	info, err = e.Info(loc, 0)
+	require.Nil(t, err)
+	assert.Equal(t, 2, info.Count)
+}
+
+func conformanceDeleteAll(t *testing.T, e Interface) {
+	conformanceCreate(t, e,
+		conformanceComment("id-1", "https://radio-t.com/1", "user1", 1),
+		conformanceComment("id-2", "https://radio-t.com/2", "user1", 2),
+	)
+	require.Nil(t, e.SetBlock("radio-t", "user2", true, 0))
+
+	require.Nil(t, e.DeleteAll("radio-t"))
+
+	res, err := e.Last("radio-t", 0)
+	require.Nil(t, err)
+	assert.Empty(t, res)
+	list, err := e.List("radio-t", 0, 0)
+	require.Nil(t, err)
+	assert.Empty(t, list)
+
+	assert.True(t, e.IsBlocked("radio-t", "user2"), "blocked users kept")
+}
+
+func conformanceDeleteUser(t *testing.T, e Interface) {
+	conformanceCreate(t, e,
+		conformanceComment("id-1", "https://radio-t.com/1", "user1", 1),
+		conformanceComment("id-2", "https://radio-t.com/2", "user1", 2),
+		conformanceComment("id-3", "https://radio-t.com/2", "user2", 3),
+	)
+
+	require.Nil(t, e.DeleteUser("radio-t", "user1"))
+
+	res, err := e.Find(store.Locator{URL: "https://radio-t.com/2", SiteID: "radio-t"}, "time")
+	require.Nil(t, err)
+	require.Equal(t, []string{"id-2", "id-3"}, commentIDs(res))
+	assert.True(t, res[0].Deleted)
+	assert.Equal(t, "", res[0].Text)
+	assert.Equal(t, store.User{ID: "deleted", Name: "deleted"}, res[0].User, "user removed from comment")
+	assert.False(t, res[1].Deleted, "other user's comment untouched")
+
+	comments, _ := e.User("radio-t", "user1", 0, 0)
+	assert.Empty(t, comments, "no comments left for deleted user")
+
+	count, err := e.Count(store.Locator{URL: "https://radio-t.com/1", SiteID: "radio-t"})
+	require.Nil(t, err)
+	assert.Equal(t, 0, count)
+
+	assert.NotNil(t, e.DeleteUser("radio-t", "user-bad"), "unknown user")
+}
+
+func conformanceBlock(t *testing.T, e Interface) {
+	conformanceCreate(t, e, conformanceComment("id-1", "https://radio-t.com", "user1", 1))
+
+	assert.False(t, e.IsBlocked("radio-t", "user1"))
+	require.Nil(t, e.SetBlock("radio-t", "user1", true, 0))
+	require.Nil(t, e.SetBlock("radio-t", "user2", true, time.Hour))
+	assert.True(t, e.IsBlocked("radio-t", "user1"))
+	assert.True(t, e.IsBlocked("radio-t", "user2"))
+	assert.False(t, e.IsBlocked("radio-t", "user3"))
+
+	blocked, err := e.Blocked("radio-t")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(blocked))
+	assert.Equal(t, "user1", blocked[0].ID)
+	assert.Equal(t, "name user1", blocked[0].Name, "name taken from user's comment")
+	assert.True(t, blocked[0].Until.After(time.Now().AddDate(50, 0, 0)), "permanent block")
+	assert.Equal(t, "user2", blocked[1].ID)
+	assert.True(t, blocked[1].Until.Before(time.Now().Add(time.Hour+time.Second)), "block with ttl")
+
+	require.Nil(t, e.SetBlock("radio-t", "user1", false, 0))
+	assert.False(t, e.IsBlocked("radio-t", "user1"))
+	blocked, err = e.Blocked("radio-t")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(blocked))
+	assert.Equal(t, "user2", blocked[0].ID)
+}
+
+func conformanceBlockTTL(t *testing.T, e Interface) {
+	require.Nil(t, e.SetBlock("radio-t", "user1", true, 50*time.Millisecond))
+	require.Nil(t, e.SetBlock("radio-t", "user2", true, time.Hour))
+	assert.True(t, e.IsBlocked("radio-t", "user1"))
+
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, e.IsBlocked("radio-t", "user1"), "block expired")
+	assert.True(t, e.IsBlocked("radio-t", "user2"))
+
+	blocked, err := e.Blocked("radio-t")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(blocked), "expired block not listed")
+	assert.Equal(t, "user2", blocked[0].ID)
+}
+
+func conformanceVerified(t *testing.T, e Interface) {
+	assert.False(t, e.IsVerified("radio-t", "user1"))
+	require.Nil(t, e.SetVerified("radio-t", "user2", true))
+	require.Nil(t, e.SetVerified("radio-t", "user1", true))
+	assert.True(t, e.IsVerified("radio-t", "user1"))
+	assert.True(t, e.IsVerified("radio-t", "user2"))
+
+	ids, err := e.Verified("radio-t")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"user1", "user2"}, ids)
+
+	require.Nil(t, e.SetVerified("radio-t", "user1", false))
+	assert.False(t, e.IsVerified("radio-t", "user1"))
+	ids, err = e.Verified("radio-t")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"user2"}, ids)
+}
+
+func conformanceShadowBan(t *testing.T, e Interface) {
+	assert.False(t, e.IsShadowBanned("radio-t", "user1"))
+	require.Nil(t, e.SetVerified("radio-t", "user1", true))
+	require.Nil(t, e.SetShadowBan("radio-t", "user2", true))
+	require.Nil(t, e.SetShadowBan("radio-t", "user1", true))
+	assert.True(t, e.IsShadowBanned("radio-t", "user1"))
+	assert.True(t, e.IsShadowBanned("radio-t", "user2"))
+	assert.True(t, e.IsVerified("radio-t", "user1"), "verified flag kept")
+
+	ids, err := e.ShadowBanned("radio-t")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"user1", "user2"}, ids)
+
+	require.Nil(t, e.SetShadowBan("radio-t", "user1", false))
+	assert.False(t, e.IsShadowBanned("radio-t", "user1"))
+	assert.True(t, e.IsVerified("radio-t", "user1"))
+	ids, err = e.ShadowBanned("radio-t")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"user2"}, ids)
+}
+
+func conformanceReplyNotify(t *testing.T, e Interface) {
+	rn, err := e.ReplyNotify("radio-t", "user1")
+	require.Nil(t, err)
+	assert.Equal(t, store.ReplyNotify{}, rn, "empty if not set")
+
+	require.Nil(t, e.SetVerified("radio-t", "user1", true))
+	require.Nil(t, e.SetReplyNotify("radio-t", "user1", store.ReplyNotify{Email: "user1@example.com"}))
+	require.Nil(t, e.SetReplyNotify("radio-t", "user2", store.ReplyNotify{Webhook: "https://example.com/hook"}))
+
+	rn, err = e.ReplyNotify("radio-t", "user1")
+	require.Nil(t, err)
+	assert.Equal(t, store.ReplyNotify{Email: "user1@example.com"}, rn)
+	assert.True(t, e.IsVerified("radio-t", "user1"), "verified flag kept")
+	rn, err = e.ReplyNotify("radio-t", "user2")
+	require.Nil(t, err)
+	assert.Equal(t, store.ReplyNotify{Webhook: "https://example.com/hook"}, rn)
+
+	require.Nil(t, e.SetReplyNotify("radio-t", "user1", store.ReplyNotify{}))
+	rn, err = e.ReplyNotify("radio-t", "user1")
+	require.Nil(t, err)
+	assert.Equal(t, store.ReplyNotify{}, rn, "opted-out")
+	assert.True(t, e.IsVerified("radio-t", "user1"))
+}
+
+func conformanceSubscriptions(t *testing.T, e Interface) {
+	subs, err := e.Subscriptions("radio-t", "")
+	require.Nil(t, err)
+	assert.Equal(t, []store.Subscription{}, subs, "empty if not set")
+
+	ts := time.Date(2019, 1, 20, 12, 0, 0, 0, time.UTC)
+	loc1 := store.Locator{URL: "https://radio-t.com/1", SiteID: "radio-t"}
+	loc2 := store.Locator{URL: "https://radio-t.com/2", SiteID: "radio-t"}
+	require.Nil(t, e.Subscribe(store.Subscription{Locator: loc2, UserID: "user1", Email: "u1@example.com",
+		Period: store.DigestDaily, LastSent: ts}))
+	require.Nil(t, e.Subscribe(store.Subscription{Locator: loc1, UserID: "user1", Email: "u1@example.com",
+		Period: store.DigestDaily, LastSent: ts}))
+	require.Nil(t, e.Subscribe(store.Subscription{Locator: loc1, UserID: "user2", Email: "u2@example.com",
+		Period: store.DigestWeekly, LastSent: ts}))
+
+	// update existing
+	require.Nil(t, e.Subscribe(store.Subscription{Locator: loc1, UserID: "user1", Email: "u1@example.com",
+		Period: store.DigestWeekly, LastSent: ts.Add(time.Hour)}))
+
+	subs, err = e.Subscriptions("radio-t", "user1")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(subs))
+	assert.Equal(t, loc1, subs[0].Locator)
+	assert.Equal(t, "user1", subs[0].UserID)
+	assert.Equal(t, "u1@example.com", subs[0].Email)
+	assert.Equal(t, store.DigestWeekly, subs[0].Period)
+	assert.True(t, ts.Add(time.Hour).Equal(subs[0].LastSent), subs[0].LastSent.String())
+	assert.Equal(t, loc2, subs[1].Locator)
+	assert.Equal(t, store.DigestDaily, subs[1].Period)
+
+	subs, err = e.Subscriptions("radio-t", "")
+	require.Nil(t, err)
+	require.Equal(t, 3, len(subs), "all subscriptions of the site")
+	assert.Equal(t, "user2", subs[2].UserID)
+
+	sent := ts.Add(2 * time.Hour)
+	require.Nil(t, e.MarkDigestSent(loc2, "user1", sent))
+	require.Nil(t, e.MarkDigestSent(loc2, "user2", sent), "no error for missing")
+	require.Nil(t, e.MarkDigestSent(store.Locator{SiteID: "radio-t"}, "user2", sent), "all posts of the user")
+	subs, err = e.Subscriptions("radio-t", "")
+	require.Nil(t, err)
+	require.Equal(t, 3, len(subs), "missing not created")
+	assert.True(t, ts.Add(time.Hour).Equal(subs[0].LastSent), "other post not marked")
+	assert.True(t, sent.Equal(subs[1].LastSent), subs[1].LastSent.String())
+	assert.Equal(t, store.DigestDaily, subs[1].Period, "only sent time changed")
+	assert.True(t, sent.Equal(subs[2].LastSent), subs[2].LastSent.String())
+
+	require.Nil(t, e.Unsubscribe(loc1, "user1"))
+	require.Nil(t, e.Unsubscribe(loc1, "user1"), "no error for missing")
+	subs, err = e.Subscriptions("radio-t", "user1")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(subs))
+	assert.Equal(t, loc2, subs[0].Locator)
+
+	require.Nil(t, e.Unsubscribe(store.Locator{SiteID: "radio-t"}, "user2"), "unsubscribe from all posts")
+	subs, err = e.Subscriptions("radio-t", "")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(subs))
+	assert.Equal(t, "user1", subs[0].UserID)
+}
+
+func conformanceShadowComments(t *testing.T, e Interface) {
+	c2 := conformanceComment("id-2", "https://radio-t.com", "user2", 2)
+	c2.Shadow = true
+	conformanceCreate(t, e, conformanceComment("id-1", "https://radio-t.com", "user1", 1), c2)
+	loc := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+
+	res, err := e.Find(loc, "time")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"id-1", "id-2"}, commentIDs(res), "find returns shadow comments")
+	assert.True(t, res[1].Shadow)
+
+	checkCount := func(expected int, msg string) {
+		count, err := e.Count(loc)
+		require.Nil(t, err)
+		assert.Equal(t, expected, count, msg)
+		info, err := e.Info(loc, 0)
+		require.Nil(t, err)
+		assert.Equal(t, expected, info.Count, msg)
+		list, err := e.List("radio-t", 0, 0)
+		require.Nil(t, err)
+		require.Equal(t, 1, len(list))
+		assert.Equal(t, expected, list[0].Count, msg)
+	}
+	checkCount(1, "shadow comment not counted")
+
+	last, err := e.Last("radio-t", 1)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"id-1"}, commentIDs(last), "shadow comment not in last")
+	found, err := e.Search(SearchRequest{SiteID: "radio-t", Query: "text"})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"id-1"}, commentIDs(found), "shadow comment not found")
+
+	require.Nil(t, e.Delete(loc, "id-2", store.SoftDelete))
+	checkCount(1, "deleted shadow comment not counted")
+	require.Nil(t, e.Restore(loc, "id-2"))
+	checkCount(1, "restored shadow comment not counted")
+
+	require.Nil(t, e.Hold(loc, "id-2"))
+	require.Nil(t, e.Approve(loc, "id-2"))
+	checkCount(1, "approved shadow comment not counted")
+}
+
+func conformanceReadOnly(t *testing.T, e Interface) {
+	conformanceCreate(t, e, conformanceComment("id-1", "https://radio-t.com", "user1", 1))
+	loc := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+
+	assert.False(t, e.IsReadOnly(loc))
+	require.Nil(t, e.SetReadOnly(loc, true))
+	assert.True(t, e.IsReadOnly(loc))
+	assert.False(t, e.IsReadOnly(store.Locator{URL: "https://radio-t.com/2", SiteID: "radio-t"}))
+
+	_, err := e.Create(conformanceComment("id-2", "https://radio-t.com", "user1", 2))
+	assert.NotNil(t, err, "can't add comment to read-only post")
+
+	info, err := e.Info(loc, 0)
+	require.Nil(t, err)
+	assert.True(t, info.ReadOnly)
+
+	require.Nil(t, e.SetReadOnly(loc, false))
+	assert.False(t, e.IsReadOnly(loc))
+	conformanceCreate(t, e, conformanceComment("id-2", "https://radio-t.com", "user1", 2))
+}
@@ -3,9 +3,14 @@
 package engine
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"sort"
 	"strings"
 	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
 
 	"github.com/umputun/remark/backend/app/store"
 )
@@ -26,24 +31,89 @@ type UserRequest struct {
 	Skip   int
 }
 
+// SearchRequest is the request to search comments of the site by text. All words of the query should be found
+// in comment's text, as whole words or word prefixes. Optional filters applied if set.
+type SearchRequest struct {
+	SiteID string
+	Query  string
+	UserID string    // optional filter by user
+	URL    string    // optional filter by post url
+	From   time.Time // optional, comments created at or after
+	To     time.Time // optional, comments created at or before
+	Limit  int
+	Skip   int
+}
+
+// Page is a part of post's comments with up to limit threads (top-level comment and all replies to it)
+type Page struct {
+	Comments   []store.Comment
+	NextCursor string // opaque cursor for the next page, empty if no more threads
+}
+
+// View makes comments as seen by the reader, i.e. drops hidden and marks deleted ones. Applied before paging,
+// so page has up to limit threads visible to the reader. Nil view keeps comments as is
+type View func(comments []store.Comment) []store.Comment
+
+// pageCursor is the sort key of the last thread of the page, encoded to the opaque cursor.
+// Next page starts after the key, so removed or hidden cursor thread doesn't break paging
+type pageCursor struct {
+	Time  time.Time `json:"t"`
+	Score int       `json:"s,omitempty"`
+	ID    string    `json:"id"`
+}
+
+// before checks if the thread with key c goes before the thread with key o for given sort, ties ordered by id
+func (c pageCursor) before(o pageCursor, sortFld string) bool {
+	switch sortFld {
+	case "-time", "-active":
+		if !c.Time.Equal(o.Time) {
+			return c.Time.After(o.Time)
+		}
+	case "+score", "-score", "score":
+		if c.Score != o.Score {
+			return (c.Score > o.Score) == strings.HasPrefix(sortFld, "-")
+		}
+		if !c.Time.Equal(o.Time) {
+			return c.Time.Before(o.Time)
+		}
+	default:
+		if !c.Time.Equal(o.Time) {
+			return c.Time.Before(o.Time)
+		}
+	}
+	return c.ID < o.ID
+}
+
 // Accessor defines all usual access ops avail for regular user
 type Accessor interface {
-	Create(comment store.Comment) (commentID string, err error)           // create new comment, avoid dups by id
-	Get(locator store.Locator, commentID string) (store.Comment, error)   // get comment by id
-	Put(locator store.Locator, comment store.Comment) error               // update comment, mutable parts only
-	Find(locator store.Locator, sort string) ([]store.Comment, error)     // find comments for locator
-	Last(siteID string, limit int) ([]store.Comment, error)               // last comments for given site, sorted by time
-	User(siteID, userID string, limit, skip int) ([]store.Comment, error) // comments by user, sorted by time
-	UserCount(siteID, userID string) (int, error)                         // comments count by user
-	Count(locator store.Locator) (int, error)                             // number of comments for the post
-	List(siteID string, limit int, skip int) ([]store.PostInfo, error)    // list of commented posts
-	Info(locator store.Locator, readonlyAge int) (store.PostInfo, error)  // get post info
-	Close() error                                                         // close/stop engine
+	Create(comment store.Comment) (commentID string, err error)                              // create new comment, avoid dups by id
+	Get(locator store.Locator, commentID string) (store.Comment, error)                      // get comment by id
+	Put(locator store.Locator, comment store.Comment) error                                  // update comment, mutable parts only
+	Find(locator store.Locator, sort string) ([]store.Comment, error)                        // find comments for locator
+	FindPage(locator store.Locator, sort, cursor string, limit int, view View) (Page, error) // find page of threads for locator
+	Search(req SearchRequest) ([]store.Comment, error)                                       // search published comments by text, sorted by time desc
+	Last(siteID string, limit int) ([]store.Comment, error)                                  // last published comments for given site, sorted by time
+	User(siteID, userID string, limit, skip int) ([]store.Comment, error)                    // comments by user, sorted by time
+	UserCount(siteID, userID string) (int, error)                                            // comments count by user
+	Count(locator store.Locator) (int, error)                                                // number of comments for the post
+	List(siteID string, limit int, skip int) ([]store.PostInfo, error)                       // list of commented posts
+	Info(locator store.Locator, readonlyAge int) (store.PostInfo, error)                     // get post info
+	SetReplyNotify(siteID, userID string, rn store.ReplyNotify) error                        // set reply notifications, empty to opt-out
+	ReplyNotify(siteID, userID string) (store.ReplyNotify, error)                            // get reply notifications of user
+	Subscribe(sub store.Subscription) error                                                  // add or update subscription to the post
+	Unsubscribe(locator store.Locator, userID string) error                                  // remove subscription, all of site for empty url
+	Subscriptions(siteID, userID string) ([]store.Subscription, error)                       // subscriptions of user, all for empty userID
+	MarkDigestSent(locator store.Locator, userID string, sentAt time.Time) error             // set digest sent time of existing subscriptions, all of site for empty url
+	Close() error                                                                            // close/stop engine
 }
 
 // Admin defines all store ops avail for admin only
 type Admin interface {
 	Delete(locator store.Locator, commentID string, mode store.DeleteMode) error // delete comment by id
+	Restore(locator store.Locator, commentID string) error                       // restore soft-deleted comment
+	Pending(siteID string) ([]store.Comment, error)                              // comments waiting for approval
+	Approve(locator store.Locator, commentID string) error                       // approve pending comment
+	Hold(locator store.Locator, commentID string) error                          // move published comment back to pending
 	DeleteAll(siteID string) error                                               // delete all data from site
 	DeleteUser(siteID string, userID string) error                               // remove all comments from user
 	SetBlock(siteID string, userID string, status bool, ttl time.Duration) error // block or unblock user with TTL (0-permanent)
@@ -54,12 +124,25 @@ type Admin interface {
 	SetVerified(siteID string, userID string, status bool) error                 // set/reset verified flag
 	IsVerified(siteID string, userID string) bool                                // check verified status
 	Verified(siteID string) ([]string, error)                                    // list of verified user ids
+	SetShadowBan(siteID string, userID string, status bool) error                // set/reset shadow-ban flag
+	IsShadowBanned(siteID string, userID string) bool                            // check shadow-ban status
+	ShadowBanned(siteID string) ([]string, error)                                // list of shadow-banned user ids
+}
+
+// SiteManager defines ops of engines with separate storage per site, sites added and removed at runtime.
+// Engines keeping all sites in the same storage don't implement it
+type SiteManager interface {
+	OpenSite(siteID string) error          // allow access to site's storage, made on the first access if not exists
+	CloseSite(siteID string) error         // close site's storage, not accessible till opened again
+	RenameSite(siteID, newID string) error // move site's storage and data to new site id
+	RemoveSite(siteID string) error        // close and delete site's storage
 }
 
 const (
 	// limits
-	lastLimit = 1000
-	userLimit = 500
+	lastLimit   = 1000
+	userLimit   = 500
+	searchLimit = 500
 )
 
 // sortComments is for engines can't sort data internally
@@ -90,3 +173,253 @@ func sortComments(comments []store.Comment, sortFld string) []store.Comment {
 	})
 	return comments
 }
+
+// threadReader implemented by engines able to load post's threads in sort order without loading all comments of the post
+type threadReader interface {
+	// roots returns up to limit top-level comments of the post going after the key (all for nil key), sorted by rootsSort
+	roots(locator store.Locator, sortFld string, after *pageCursor, limit int) ([]store.Comment, error)
+	// threads returns all comments of threads with given top-level comments
+	threads(locator store.Locator, rootIDs []string) ([]store.Comment, error)
+}
+
+// pageThread is a top-level comment with all replies, key used to sort threads
+type pageThread struct {
+	key      pageCursor
+	comments []store.Comment
+}
+
+// rootsSort returns sort of threads defined by top-level comments only, normalized to +time, -time, +score or -score.
+// Returns empty string for "active" sort, as it depends on the latest reply in the thread
+func rootsSort(sortFld string) string {
+	switch sortFld {
+	case "-time":
+		return "-time"
+	case "+score", "score":
+		return "+score"
+	case "-score":
+		return "-score"
+	case "+active", "-active", "active":
+		return ""
+	default:
+		return "+time"
+	}
+}
+
+// findPage makes page of threads from all comments of the post as seen with view. Threads ordered the same way
+// as rest.Tree nodes for given sort, threads with all comments deleted are skipped. Cursor has sort key of the last
+// thread of the previous page, limit <= 0 returns all remaining threads.
+func findPage(comments []store.Comment, sortFld, cursor string, limit int, view View) (Page, error) {
+	after, err := parseCursor(cursor)
+	if err != nil {
+		return Page{}, err
+	}
+	visible := makeThreads(comments, sortFld, view)
+
+	start := 0
+	if after != nil {
+		start = sort.Search(len(visible), func(i int) bool { return after.before(visible[i].key, sortFld) })
+	}
+	end := len(visible)
+	if limit > 0 && start+limit < end {
+		end = start + limit
+	}
+
+	page := Page{Comments: []store.Comment{}}
+	for _, th := range visible[start:end] {
+		page.Comments = append(page.Comments, th.comments...)
+	}
+	if end < len(visible) {
+		if page.NextCursor, err = makeCursor(visible[end-1].key); err != nil {
+			return Page{}, err
+		}
+	}
+	return page, nil
+}
+
+// readPage makes the same page as findPage, but loads only threads needed for the page. Top-level comments read
+// in batches after the cursor till limit threads visible with view found, with one more to know if there is next page.
+// Limit should be positive and sort defined by top-level comments, see rootsSort
+func readPage(r threadReader, locator store.Locator, sortFld, cursor string, limit int, view View) (Page, error) {
+	after, err := parseCursor(cursor)
+	if err != nil {
+		return Page{}, err
+	}
+
+	page, found, last := Page{Comments: []store.Comment{}}, 0, pageCursor{}
+	for {
+		roots, e := r.roots(locator, sortFld, after, limit+1)
+		if e != nil {
+			return Page{}, e
+		}
+		if len(roots) == 0 {
+			return page, nil
+		}
+		ids := make([]string, 0, len(roots))
+		for _, c := range roots {
+			ids = append(ids, c.ID)
+		}
+		comments, e := r.threads(locator, ids)
+		if e != nil {
+			return Page{}, e
+		}
+		for _, th := range makeThreads(comments, sortFld, view) {
+			if found == limit { // one more visible thread, page has next one
+				page.NextCursor, e = makeCursor(last)
+				return page, e
+			}
+			page.Comments = append(page.Comments, th.comments...)
+			found, last = found+1, th.key
+		}
+		if len(roots) <= limit {
+			return page, nil
+		}
+		root := roots[len(roots)-1]
+		after = &pageCursor{Time: root.Timestamp, Score: root.Score, ID: root.ID}
+	}
+}
+
+// makeThreads splits comments as seen with view to threads, sorted for given sort.
+// Threads with all comments deleted skipped, as well as replies to comments hidden by view
+func makeThreads(comments []store.Comment, sortFld string, view View) []pageThread {
+	if view != nil {
+		comments = view(comments)
+	}
+
+	replies := map[string][]store.Comment{}
+	roots := []store.Comment{}
+	for _, c := range comments {
+		if c.ParentID == "" {
+			roots = append(roots, c)
+			continue
+		}
+		replies[c.ParentID] = append(replies[c.ParentID], c)
+	}
+
+	// collect all replies for each thread, recursively
+	var collect func(parentID string) []store.Comment
+	collect = func(parentID string) (res []store.Comment) {
+		for _, r := range replies[parentID] {
+			res = append(res, r)
+			res = append(res, collect(r.ID)...)
+		}
+		return res
+	}
+
+	visible := []pageThread{}
+	for _, root := range roots {
+		th := pageThread{key: pageCursor{Time: root.Timestamp, Score: root.Score, ID: root.ID},
+			comments: append([]store.Comment{root}, collect(root.ID)...)}
+		deleted := true
+		for _, c := range th.comments {
+			deleted = deleted && c.Deleted
+			// active sort uses time of the latest reply
+			if strings.HasSuffix(sortFld, "active") && c.Timestamp.After(th.key.Time) {
+				th.key.Time = c.Timestamp
+			}
+		}
+		if !deleted {
+			visible = append(visible, th)
+		}
+	}
+	sort.Slice(visible, func(i, j int) bool { return visible[i].key.before(visible[j].key, sortFld) })
+	return visible
+}
+
+// parseCursor decodes sort key of the cursor, nil for empty cursor
+func parseCursor(cursor string) (*pageCursor, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid cursor %s", cursor)
+	}
+	res := pageCursor{}
+	if err = json.Unmarshal(data, &res); err != nil || res.ID == "" {
+		return nil, errors.Errorf("invalid cursor %s", cursor)
+	}
+	return &res, nil
+}
+
+// makeCursor encodes sort key to the opaque cursor
+func makeCursor(key pageCursor) (string, error) {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return "", errors.Wrap(err, "can't make cursor")
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// searchWords splits text to unique lowercase words, too short words ignored
+func searchWords(text string) (words []string) {
+	seen := map[string]bool{}
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+	for _, w := range fields {
+		if len([]rune(w)) < 2 || seen[w] {
+			continue
+		}
+		seen[w] = true
+		words = append(words, w)
+	}
+	return words
+}
+
+// searchText returns the text used for search, original (markdown) text preferred
+func searchText(comment store.Comment) string {
+	if comment.Orig != "" {
+		return comment.Orig
+	}
+	return comment.Text
+}
+
+// queryWords returns words of the search query, rejects query without words
+func (r SearchRequest) queryWords() ([]string, error) {
+	words := searchWords(r.Query)
+	if len(words) == 0 {
+		return nil, errors.Errorf("empty search query %q", r.Query)
+	}
+	return words, nil
+}
+
+// matchFilters checks non-text filters of the request, deleted, pending and shadow comments never match
+func (r SearchRequest) matchFilters(comment store.Comment) bool {
+	switch {
+	case comment.Deleted, comment.Pending, comment.Shadow, comment.Locator.SiteID != r.SiteID:
+		return false
+	case r.UserID != "" && comment.User.ID != r.UserID:
+		return false
+	case r.URL != "" && comment.Locator.URL != r.URL:
+		return false
+	case !r.From.IsZero() && comment.Timestamp.Before(r.From):
+		return false
+	case !r.To.IsZero() && comment.Timestamp.After(r.To):
+		return false
+	}
+	return true
+}
+
+// bounds returns limit and skip of the request, limit is up to searchLimit
+func (r SearchRequest) bounds() (limit, skip int) {
+	limit, skip = r.Limit, r.Skip
+	if limit <= 0 || limit > searchLimit {
+		limit = searchLimit
+	}
+	if skip < 0 {
+		skip = 0
+	}
+	return limit, skip
+}
+
+// paginate sorts found comments by time desc and applies limit and skip of the request
+func (r SearchRequest) paginate(comments []store.Comment) []store.Comment {
+	sortComments(comments, "-time")
+	limit, skip := r.bounds()
+	if skip >= len(comments) {
+		return []store.Comment{}
+	}
+	comments = comments[skip:]
+	if len(comments) > limit {
+		comments = comments[:limit]
+	}
+	return comments
+}
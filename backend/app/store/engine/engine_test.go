@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/umputun/remark/backend/app/store"
 )
@@ -41,3 +42,130 @@ func TestEngine_sortComments(t *testing.T) {
 	assert.Equal(t, "1", cc[2].ID)
 	assert.Equal(t, "2", cc[3].ID)
 }
+
+func TestEngine_findPage(t *testing.T) {
+	ts := func(min int) time.Time { return time.Date(2018, 2, 5, 10, min, 0, 0, time.Local) }
+	cc := []store.Comment{
+		{ID: "1", Score: 1, Timestamp: ts(1)},
+		{ID: "2", Score: 3, Timestamp: ts(2)},
+		{ID: "2-1", ParentID: "2", Timestamp: ts(3)},
+		{ID: "3", Score: 2, Timestamp: ts(4)},
+		{ID: "1-1", ParentID: "1", Timestamp: ts(5)},
+		{ID: "1-1-1", ParentID: "1-1", Timestamp: ts(6)},
+		{ID: "4", Timestamp: ts(7), Deleted: true},
+		{ID: "5", Timestamp: ts(8), Deleted: true},
+		{ID: "5-1", ParentID: "5", Timestamp: ts(9)},
+	}
+
+	page, err := findPage(cc, "time", "", 2, nil)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"1", "1-1", "1-1-1", "2", "2-1"}, commentIDs(page.Comments))
+	assert.NotEmpty(t, page.NextCursor)
+
+	page, err = findPage(cc, "time", page.NextCursor, 2, nil)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"3", "5", "5-1"}, commentIDs(page.Comments), "thread with all comments deleted skipped")
+	assert.Empty(t, page.NextCursor, "last page")
+
+	page, err = findPage(cc, "-active", "", 0, nil)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"5", "5-1", "1", "1-1", "1-1-1", "3", "2", "2-1"}, commentIDs(page.Comments))
+	assert.Empty(t, page.NextCursor)
+
+	page, err = findPage(cc, "-score", "", 1, nil)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"2", "2-1"}, commentIDs(page.Comments))
+	page, err = findPage(cc, "-score", page.NextCursor, 1, nil)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"3"}, commentIDs(page.Comments))
+
+	page, err = findPage([]store.Comment{}, "time", "", 10, nil)
+	require.Nil(t, err)
+	assert.Empty(t, page.Comments)
+	assert.Empty(t, page.NextCursor)
+
+	// cursor thread removed, next page starts after its sort key
+	page, err = findPage(cc, "time", "", 1, nil)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"1", "1-1", "1-1-1"}, commentIDs(page.Comments))
+	page, err = findPage(cc[1:], "time", page.NextCursor, 1, nil)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"2", "2-1"}, commentIDs(page.Comments))
+
+	// threads with the same sort key ordered by id
+	same := []store.Comment{{ID: "b", Timestamp: ts(1)}, {ID: "a", Timestamp: ts(1)}, {ID: "c", Timestamp: ts(1)}}
+	page, err = findPage(same, "-time", "", 2, nil)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"a", "b"}, commentIDs(page.Comments))
+	page, err = findPage(same, "-time", page.NextCursor, 2, nil)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"c"}, commentIDs(page.Comments))
+
+	_, err = findPage(cc, "time", "bad cursor!", 2, nil)
+	assert.NotNil(t, err)
+	_, err = findPage(cc, "time", "eHl6", 2, nil)
+	assert.EqualError(t, err, "invalid cursor eHl6")
+}
+
+func TestEngine_findPageView(t *testing.T) {
+	ts := func(min int) time.Time { return time.Date(2018, 2, 5, 10, min, 0, 0, time.Local) }
+	cc := []store.Comment{
+		{ID: "1", Timestamp: ts(1)},
+		{ID: "2", Timestamp: ts(2), Pending: true},
+		{ID: "2-1", ParentID: "2", Timestamp: ts(3)},
+		{ID: "3", Timestamp: ts(4), Shadow: true},
+		{ID: "4", Timestamp: ts(5), User: store.User{ID: "blocked"}},
+		{ID: "5", Timestamp: ts(6)},
+		{ID: "6", Timestamp: ts(7)},
+	}
+	// view of regular reader, like rest's alterComments
+	view := func(comments []store.Comment) (res []store.Comment) {
+		for _, c := range comments {
+			if c.Pending || c.Shadow {
+				continue
+			}
+			if c.User.ID == "blocked" {
+				c.Deleted = true
+			}
+			res = append(res, c)
+		}
+		return res
+	}
+
+	page, err := findPage(cc, "time", "", 2, view)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"1", "5"}, commentIDs(page.Comments), "hidden threads don't take page's slots")
+	page, err = findPage(cc, "time", page.NextCursor, 2, view)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"6"}, commentIDs(page.Comments))
+	assert.Empty(t, page.NextCursor)
+
+	page, err = findPage(cc, "time", "", 0, nil)
+	require.Nil(t, err)
+	assert.Equal(t, 7, len(page.Comments), "all comments without view")
+}
+
+func TestEngine_searchWords(t *testing.T) {
+	assert.Equal(t, []string{"hello", "world", "привет", "42"}, searchWords("Hello, world! a <b>Привет</b> 42 hello"))
+	assert.Nil(t, searchWords(" ! a "))
+}
+
+func TestEngine_SearchRequestMatch(t *testing.T) {
+	c := store.Comment{Orig: "Some **text** here", Text: "<p>Some <span>text</span> here</p>", User: store.User{ID: "user1"},
+		Locator: store.Locator{SiteID: "radio-t", URL: "https://radio-t.com"}, Timestamp: time.Date(2018, 2, 5, 10, 1, 0, 0, time.Local)}
+
+	assert.True(t, SearchRequest{SiteID: "radio-t"}.matchFilters(c))
+	assert.True(t, SearchRequest{SiteID: "radio-t", UserID: "user1", URL: "https://radio-t.com",
+		From: c.Timestamp, To: c.Timestamp}.matchFilters(c))
+	assert.False(t, SearchRequest{SiteID: "radio-t2"}.matchFilters(c))
+	assert.False(t, SearchRequest{SiteID: "radio-t", UserID: "user2"}.matchFilters(c))
+	assert.False(t, SearchRequest{SiteID: "radio-t", URL: "https://radio-t.com/2"}.matchFilters(c))
+	assert.False(t, SearchRequest{SiteID: "radio-t", From: c.Timestamp.Add(time.Second)}.matchFilters(c))
+	assert.False(t, SearchRequest{SiteID: "radio-t", To: c.Timestamp.Add(-time.Second)}.matchFilters(c))
+	c.Pending = true
+	assert.False(t, SearchRequest{SiteID: "radio-t"}.matchFilters(c))
+	c.Pending, c.Deleted = false, true
+	assert.False(t, SearchRequest{SiteID: "radio-t"}.matchFilters(c))
+	c.Deleted, c.Shadow = false, true
+	assert.False(t, SearchRequest{SiteID: "radio-t"}.matchFilters(c))
+}
@@ -1,6 +1,7 @@
 package engine
 
 import (
+	"regexp"
 	"time"
 
 	"github.com/globalsign/mgo"
@@ -23,8 +24,19 @@ const (
 	mongoPosts     = "posts"
 	mongoMetaPosts = "meta_posts"
 	mongoMetaUsers = "meta_users"
+	mongoSubs      = "subscriptions"
 )
 
+// mongoCountActive is $group accumulator counting non-deleted, non-pending and non-shadow comments
+var mongoCountActive = bson.M{"$sum": bson.M{"$cond": []interface{}{
+	bson.M{"$or": []string{"$delete", "$pending", "$shadow"}}, 0, 1}}}
+
+// mongoNotPending matches comments published, i.e. approved or never pending
+var mongoNotPending = bson.M{"$ne": true}
+
+// mongoNotShadow matches comments made by users not shadow-banned at the time
+var mongoNotShadow = bson.M{"$ne": true}
+
 type metaPost struct {
 	ID       string `bson:"_id"` // url
 	SiteID   string `bson:"site"`
@@ -32,11 +44,13 @@ type metaPost struct {
 }
 
 type metaUser struct {
-	ID           string    `bson:"_id"` // user_id
-	SiteID       string    `bson:"site"`
-	Verified     bool      `bson:"verified"`
-	Blocked      bool      `bson:"blocked"`
-	BlockedUntil time.Time `bson:"blocked_until"`
+	ID           string            `bson:"_id"` // user_id
+	SiteID       string            `bson:"site"`
+	Verified     bool              `bson:"verified"`
+	Blocked      bool              `bson:"blocked"`
+	BlockedUntil time.Time         `bson:"blocked_until"`
+	ShadowBanned bool              `bson:"shadow_banned"`
+	ReplyNotify  store.ReplyNotify `bson:"reply_notify"`
 }
 
 // NewMongo makes mongo engine. bufferSize denies how many records will be buffered, 0 turns buffering off.
@@ -51,6 +65,9 @@ func NewMongo(conn *mongo.Connection, bufferSize int, flushDuration time.Duratio
 
 // Create new comment, write can be buffered and delayed.
 func (m *Mongo) Create(comment store.Comment) (commentID string, err error) {
+	if m.IsReadOnly(comment.Locator) {
+		return "", errors.Errorf("post %s is read-only", comment.Locator.URL)
+	}
 	// err = m.postWriter.Write(comment)
 	err = m.conn.WithCustomCollection(mongoPosts, func(coll *mgo.Collection) error {
 		return coll.Insert(&comment)
@@ -58,6 +75,15 @@ func (m *Mongo) Create(comment store.Comment) (commentID string, err error) {
 	return comment.ID, err
 }
 
+// FindPage returns page of threads for post as seen with view, starting after cursor thread
+func (m *Mongo) FindPage(locator store.Locator, sortFld, cursor string, limit int, view View) (Page, error) {
+	comments, err := m.Find(locator, sortFld)
+	if err != nil {
+		return Page{}, err
+	}
+	return findPage(comments, sortFld, cursor, limit, view)
+}
+
 // Find returns all comments for post and sorts results
 func (m *Mongo) Find(locator store.Locator, sortFld string) (comments []store.Comment, err error) {
 	comments = []store.Comment{}
@@ -82,12 +108,16 @@ func (m *Mongo) Put(locator store.Locator, comment store.Comment) error {
 	return m.conn.WithCustomCollection(mongoPosts, func(coll *mgo.Collection) error {
 		return coll.Update(bson.M{"_id": comment.ID, "locator.site": locator.SiteID, "locator.url": locator.URL},
 			bson.M{"$set": bson.M{
-				"text":    comment.Text,
-				"orig":    comment.Orig,
-				"score":   comment.Score,
-				"votes":   comment.Votes,
-				"pin":     comment.Pin,
-				"deleted": comment.Deleted,
+				"text":      comment.Text,
+				"orig":      comment.Orig,
+				"score":     comment.Score,
+				"votes":     comment.Votes,
+				"pin":       comment.Pin,
+				"deleted":   comment.Deleted,
+				"edit":      comment.Edit,
+				"revisions": comment.Revisions,
+				"trash":     comment.Trash,
+				"reports":   comment.Reports,
 			}})
 	})
 }
@@ -99,43 +129,89 @@ func (m *Mongo) Last(siteID string, max int) (comments []store.Comment, err erro
 		max = lastLimit
 	}
 	err = m.conn.WithCustomCollection(mongoPosts, func(coll *mgo.Collection) error {
-		query := bson.M{"locator.site": siteID, "delete": false}
+		query := bson.M{"locator.site": siteID, "delete": false, "pending": mongoNotPending, "shadow": mongoNotShadow}
 		return coll.Find(query).Sort("-time").Limit(max).All(&comments)
 	})
 	return comments, err
 }
 
+// Search returns comments matching all words of the query. Each word matched as a prefix of the words of orig text,
+// or text if orig is empty, the same way as search index of other engines
+func (m *Mongo) Search(req SearchRequest) (comments []store.Comment, err error) {
+	words, err := req.queryWords()
+	if err != nil {
+		return nil, err
+	}
+	matches := make([]bson.M, 0, len(words))
+	for _, w := range words {
+		// word starts at the beginning of the text or after non-letter and non-digit
+		re := bson.RegEx{Pattern: `(^|[^\p{L}\p{N}])` + regexp.QuoteMeta(w), Options: "i"}
+		matches = append(matches, bson.M{"$or": []bson.M{{"orig": re}, {"orig": "", "text": re}}})
+	}
+
+	query := bson.M{"$and": matches, "locator.site": req.SiteID, "delete": false, "pending": mongoNotPending,
+		"shadow": mongoNotShadow}
+	if req.UserID != "" {
+		query["user.id"] = req.UserID
+	}
+	if req.URL != "" {
+		query["locator.url"] = req.URL
+	}
+	if !req.From.IsZero() || !req.To.IsZero() {
+		tsQuery := bson.M{}
+		if !req.From.IsZero() {
+			tsQuery["$gte"] = req.From
+		}
+		if !req.To.IsZero() {
+			tsQuery["$lte"] = req.To
+		}
+		query["time"] = tsQuery
+	}
+
+	limit := req.Limit
+	if limit <= 0 || limit > searchLimit {
+		limit = searchLimit
+	}
+	comments = []store.Comment{}
+	err = m.conn.WithCustomCollection(mongoPosts, func(coll *mgo.Collection) error {
+		return m.setLimitAndSkip(coll.Find(query).Sort("-time"), limit, req.Skip).All(&comments)
+	})
+	return comments, errors.Wrapf(err, "can't search comments for %s", req.SiteID)
+}
+
 // Count returns number of comments for locator
 func (m *Mongo) Count(locator store.Locator) (count int, err error) {
 
 	e := m.conn.WithCustomCollection(mongoPosts, func(coll *mgo.Collection) error {
-		query := bson.M{"locator.site": locator.SiteID, "locator.url": locator.URL, "delete": false}
+		query := bson.M{"locator.site": locator.SiteID, "locator.url": locator.URL, "delete": false, "pending": mongoNotPending,
+			"shadow": mongoNotShadow}
 		count, err = coll.Find(query).Count()
 		return err
 	})
 	return count, e
 }
 
-// List returns list of all commented posts with counters
+// List returns list of all commented posts with counters, sorted by url in descending order
 func (m *Mongo) List(siteID string, limit, skip int) (list []store.PostInfo, err error) {
 	list = []store.PostInfo{}
 
-	if limit <= 0 {
-		limit = 1000
-	}
 	if skip < 0 {
 		skip = 0
 	}
 
 	err = m.conn.WithCustomCollection(mongoPosts, func(coll *mgo.Collection) error {
-		pipeline := coll.Pipe([]bson.M{
+		stages := []bson.M{
 			{"$match": bson.M{"locator.site": siteID}},
-			{"$project": bson.M{"locator.site": 1, "locator.url": 1, "time": 1}},
-			{"$group": bson.M{"_id": "$locator.url", "url": bson.M{"$first": "$locator.url"}, "count": bson.M{"$sum": 1},
+			{"$project": bson.M{"locator.site": 1, "locator.url": 1, "time": 1, "delete": 1, "pending": 1, "shadow": 1}},
+			{"$group": bson.M{"_id": "$locator.url", "url": bson.M{"$first": "$locator.url"}, "count": mongoCountActive,
 				"first_time": bson.M{"$min": "$time"}, "last_time": bson.M{"$max": "$time"}}},
+			{"$sort": bson.M{"_id": -1}},
 			{"$skip": skip},
-			{"$limit": limit},
-		})
+		}
+		if limit > 0 {
+			stages = append(stages, bson.M{"$limit": limit})
+		}
+		pipeline := coll.Pipe(stages)
 		return errors.Wrap(pipeline.AllowDiskUse().All(&list), "list pipeline failed")
 	})
 	return list, errors.Wrap(err, "can't get list")
@@ -147,8 +223,8 @@ func (m *Mongo) Info(locator store.Locator, readOnlyAge int) (info store.PostInf
 	err = m.conn.WithCustomCollection(mongoPosts, func(coll *mgo.Collection) error {
 		pipeline := coll.Pipe([]bson.M{
 			{"$match": bson.M{"locator.site": locator.SiteID, "locator.url": locator.URL}},
-			{"$project": bson.M{"locator.site": 1, "locator.url": 1, "time": 1}},
-			{"$group": bson.M{"_id": "$locator.url", "url": bson.M{"$first": "$locator.url"}, "count": bson.M{"$sum": 1},
+			{"$project": bson.M{"locator.site": 1, "locator.url": 1, "time": 1, "delete": 1, "pending": 1, "shadow": 1}},
+			{"$group": bson.M{"_id": "$locator.url", "url": bson.M{"$first": "$locator.url"}, "count": mongoCountActive,
 				"first_time": bson.M{"$min": "$time"}, "last_time": bson.M{"$max": "$time"}}},
 		})
 		return errors.Wrap(pipeline.AllowDiskUse().All(&list), "list pipeline failed")
@@ -226,7 +302,39 @@ func (m *Mongo) IsVerified(siteID string, userID string) (verified bool) {
 func (m *Mongo) Verified(siteID string) (ids []string, err error) {
 	metas := []metaUser{}
 	err = m.conn.WithCustomCollection(mongoMetaUsers, func(coll *mgo.Collection) error {
-		return coll.Find(bson.M{"site": siteID, "verified": true}).All(&metas)
+		return coll.Find(bson.M{"site": siteID, "verified": true}).Sort("_id").All(&metas)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range metas {
+		ids = append(ids, m.ID)
+	}
+	return ids, nil
+}
+
+// SetShadowBan sets or resets shadow-ban flag. New comments of shadow-banned user visible to the user only
+func (m *Mongo) SetShadowBan(siteID string, userID string, status bool) error {
+	return m.conn.WithCustomCollection(mongoMetaUsers, func(coll *mgo.Collection) error {
+		_, e := coll.Upsert(bson.M{"_id": userID, "site": siteID}, bson.M{"$set": bson.M{"shadow_banned": status}})
+		return e
+	})
+}
+
+// IsShadowBanned checks if user shadow-banned
+func (m *Mongo) IsShadowBanned(siteID string, userID string) (banned bool) {
+	meta := metaUser{}
+	err := m.conn.WithCustomCollection(mongoMetaUsers, func(coll *mgo.Collection) error {
+		return coll.Find(bson.M{"_id": userID, "site": siteID}).One(&meta)
+	})
+	return err == nil && meta.ShadowBanned
+}
+
+// ShadowBanned returns list of shadow-banned user IDs
+func (m *Mongo) ShadowBanned(siteID string) (ids []string, err error) {
+	metas := []metaUser{}
+	err = m.conn.WithCustomCollection(mongoMetaUsers, func(coll *mgo.Collection) error {
+		return coll.Find(bson.M{"site": siteID, "shadow_banned": true}).Sort("_id").All(&metas)
 	})
 	if err != nil {
 		return nil, err
@@ -270,7 +378,7 @@ func (m *Mongo) Blocked(siteID string) (users []store.BlockedUser, err error) {
 	metas := []metaUser{}
 	err = m.conn.WithCustomCollection(mongoMetaUsers, func(coll *mgo.Collection) error {
 		return coll.Find(bson.M{"site": siteID,
-			"blocked": true, "blocked_until": bson.M{"$gt": time.Now()}}).All(&metas)
+			"blocked": true, "blocked_until": bson.M{"$gt": time.Now()}}).Sort("_id").All(&metas)
 	})
 	if err != nil {
 		return users, errors.Wrapf(err, "can't get blocked users for site for %s", siteID)
@@ -301,6 +409,116 @@ func (m *Mongo) Delete(locator store.Locator, commentID string, mode store.Delet
 	return errors.Wrapf(err, "can't delete %s", commentID)
 }
 
+// Restore brings soft-deleted comment back
+func (m *Mongo) Restore(locator store.Locator, commentID string) error {
+	comment := store.Comment{}
+	err := m.conn.WithCustomCollection(mongoPosts, func(coll *mgo.Collection) error {
+		e := coll.Find(bson.M{"locator.site": locator.SiteID, "locator.url": locator.URL, "_id": commentID}).One(&comment)
+		if e != nil {
+			return e
+		}
+		if e = comment.Restore(); e != nil {
+			return e
+		}
+		return coll.Update(bson.M{"locator.site": locator.SiteID, "locator.url": locator.URL, "_id": commentID}, comment)
+	})
+	return errors.Wrapf(err, "can't restore %s", commentID)
+}
+
+// SetReplyNotify sets user's reply notifications, empty ReplyNotify removes them
+func (m *Mongo) SetReplyNotify(siteID, userID string, rn store.ReplyNotify) error {
+	return m.conn.WithCustomCollection(mongoMetaUsers, func(coll *mgo.Collection) error {
+		_, e := coll.Upsert(bson.M{"_id": userID, "site": siteID}, bson.M{"$set": bson.M{"reply_notify": rn}})
+		return errors.Wrapf(e, "failed to set reply notify for %s", userID)
+	})
+}
+
+// ReplyNotify returns user's reply notifications, empty if not set
+func (m *Mongo) ReplyNotify(siteID, userID string) (store.ReplyNotify, error) {
+	meta := metaUser{}
+	err := m.conn.WithCustomCollection(mongoMetaUsers, func(coll *mgo.Collection) error {
+		return coll.Find(bson.M{"_id": userID, "site": siteID}).One(&meta)
+	})
+	if err == mgo.ErrNotFound {
+		return store.ReplyNotify{}, nil
+	}
+	return meta.ReplyNotify, errors.Wrapf(err, "can't get reply notify for %s", userID)
+}
+
+// Subscribe adds user's subscription to the post or updates existing one
+func (m *Mongo) Subscribe(sub store.Subscription) error {
+	return m.conn.WithCustomCollection(mongoSubs, func(coll *mgo.Collection) error {
+		_, e := coll.Upsert(bson.M{"locator.site": sub.Locator.SiteID, "locator.url": sub.Locator.URL, "user_id": sub.UserID},
+			bson.M{"$set": sub})
+		return errors.Wrapf(e, "failed to subscribe %s to %s", sub.UserID, sub.Locator.URL)
+	})
+}
+
+// Unsubscribe removes user's subscription to the post, or all user's subscriptions if locator's url is empty
+func (m *Mongo) Unsubscribe(locator store.Locator, userID string) error {
+	query := bson.M{"locator.site": locator.SiteID, "user_id": userID}
+	if locator.URL != "" {
+		query["locator.url"] = locator.URL
+	}
+	return m.conn.WithCustomCollection(mongoSubs, func(coll *mgo.Collection) error {
+		_, e := coll.RemoveAll(query)
+		return errors.Wrapf(e, "failed to unsubscribe %s", userID)
+	})
+}
+
+// MarkDigestSent sets digest sent time of user's subscription to the post, or of all user's subscriptions
+// if locator's url is empty. Missing subscriptions not created, user could unsubscribe while digest sent
+func (m *Mongo) MarkDigestSent(locator store.Locator, userID string, sentAt time.Time) error {
+	query := bson.M{"locator.site": locator.SiteID, "user_id": userID}
+	if locator.URL != "" {
+		query["locator.url"] = locator.URL
+	}
+	return m.conn.WithCustomCollection(mongoSubs, func(coll *mgo.Collection) error {
+		_, e := coll.UpdateAll(query, bson.M{"$set": bson.M{"last_sent": sentAt}})
+		return errors.Wrapf(e, "failed to mark digest sent to %s", userID)
+	})
+}
+
+// Subscriptions returns user's subscriptions, or subscriptions of all users for empty userID. Sorted by user and url
+func (m *Mongo) Subscriptions(siteID, userID string) (subs []store.Subscription, err error) {
+	query := bson.M{"locator.site": siteID}
+	if userID != "" {
+		query["user_id"] = userID
+	}
+	subs = []store.Subscription{}
+	err = m.conn.WithCustomCollection(mongoSubs, func(coll *mgo.Collection) error {
+		return coll.Find(query).Sort("user_id", "locator.url").All(&subs)
+	})
+	return subs, errors.Wrapf(err, "can't get subscriptions for site %s", siteID)
+}
+
+// Pending returns all not deleted comments waiting for approval, sorted by time
+func (m *Mongo) Pending(siteID string) (comments []store.Comment, err error) {
+	comments = []store.Comment{}
+	err = m.conn.WithCustomCollection(mongoPosts, func(coll *mgo.Collection) error {
+		return coll.Find(bson.M{"locator.site": siteID, "pending": true, "delete": false}).Sort("time").All(&comments)
+	})
+	return comments, errors.Wrapf(err, "can't get pending comments for %s", siteID)
+}
+
+// Approve publishes pending comment
+func (m *Mongo) Approve(locator store.Locator, commentID string) error {
+	err := m.conn.WithCustomCollection(mongoPosts, func(coll *mgo.Collection) error {
+		return coll.Update(bson.M{"locator.site": locator.SiteID, "locator.url": locator.URL, "_id": commentID, "pending": true},
+			bson.M{"$set": bson.M{"pending": false}})
+	})
+	return errors.Wrapf(err, "can't approve %s", commentID)
+}
+
+// Hold moves published comment back to pending
+func (m *Mongo) Hold(locator store.Locator, commentID string) error {
+	err := m.conn.WithCustomCollection(mongoPosts, func(coll *mgo.Collection) error {
+		return coll.Update(bson.M{"locator.site": locator.SiteID, "locator.url": locator.URL, "_id": commentID,
+			"pending": mongoNotPending}, bson.M{"$set": bson.M{"pending": true}})
+	})
+	return errors.Wrapf(err, "can't hold %s", commentID)
+}
+
 // DeleteAll removes all info about siteID
 func (m *Mongo) DeleteAll(siteID string) error {
 	err := m.conn.WithCustomCollection(mongoPosts, func(coll *mgo.Collection) error {
@@ -319,6 +537,9 @@ func (m *Mongo) DeleteUser(siteID string, userID string) error {
 		if e != nil {
 			return e
 		}
+		if len(comments) == 0 {
+			return errors.Errorf("unknown user %s", userID)
+		}
 		for _, c := range comments {
 			if e = m.Delete(c.Locator, c.ID, store.HardDelete); e != nil {
 				return e
@@ -359,12 +580,20 @@ func (m *Mongo) prepare() error {
 		return e
 	}
 
-	return m.conn.WithCustomCollection(mongoMetaUsers, func(coll *mgo.Collection) error {
+	e = m.conn.WithCustomCollection(mongoMetaUsers, func(coll *mgo.Collection) error {
 		errs = multierror.Append(errs, coll.EnsureIndexKey("_id", "site"))
 		errs = multierror.Append(errs, coll.EnsureIndexKey("site", "blocked"))
 		errs = multierror.Append(errs, coll.EnsureIndexKey("site", "verified"))
 		return errors.Wrapf(errs.ErrorOrNil(), "can't create index for %s", mongoMetaUsers)
 	})
+	if e != nil {
+		return e
+	}
+
+	return m.conn.WithCustomCollection(mongoSubs, func(coll *mgo.Collection) error {
+		errs = multierror.Append(errs, coll.EnsureIndexKey("locator.site", "user_id", "locator.url"))
+		return errors.Wrapf(errs.ErrorOrNil(), "can't create index for %s", mongoSubs)
+	})
 }
 
 func (m *Mongo) setLimitAndSkip(q *mgo.Query, limit, skip int) *mgo.Query {
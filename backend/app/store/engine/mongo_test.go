@@ -541,6 +541,16 @@ func TestMongo_Parallel(t *testing.T) {
 	}
 }
 
+func TestMongo_Conformance(t *testing.T) {
+	if _, skip := prepMongo(t, false); skip {
+		return
+	}
+	runConformance(t, func(t *testing.T) Interface {
+		m, _ := prepMongo(t, false)
+		return m
+	})
+}
+
 func prepMongo(t *testing.T, writeRecs bool) (*Mongo, bool) {
 	conn, err := mongo.MakeTestConnection(t)
 	if err != nil {
@@ -0,0 +1,596 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark/backend/app/store"
+)
+
+var testSQLiteDb = "/tmp/test-remark.sqlite"
+
+func TestSQL_CreateAndFind(t *testing.T) {
+	var s Interface = prepSQL(t)
+	defer s.Close()
+
+	res, err := s.Find(store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}, "time")
+	assert.Nil(t, err)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, `some text, <a href="http://radio-t.com">link</a>`, res[0].Text)
+	assert.Equal(t, "user1", res[0].User.ID)
+
+	_, err = s.Create(store.Comment{ID: res[0].ID, Locator: store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}})
+	assert.NotNil(t, err, "reject dup")
+
+	id, err := s.Create(store.Comment{ID: "id-3", Locator: store.Locator{URL: "https://radio-t2.com", SiteID: "radio-t2"}})
+	assert.Nil(t, err)
+	assert.Equal(t, "id-3", id)
+	res, err = s.Find(store.Locator{URL: "https://radio-t2.com", SiteID: "radio-t2"}, "time")
+	assert.Nil(t, err)
+	require.Equal(t, 1, len(res))
+
+	res, err = s.Find(store.Locator{URL: "https://radio-t.com", SiteID: "radio-t-bad"}, "time")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(res))
+}
+
+func TestSQL_CreateReadOnly(t *testing.T) {
+	s := prepSQL(t)
+	defer s.Close()
+
+	comment := store.Comment{
+		ID:        "id-ro",
+		Text:      `some text, <a href="http://radio-t.com">link</a>`,
+		Timestamp: time.Date(2017, 12, 20, 15, 18, 22, 0, time.Local),
+		Locator:   store.Locator{URL: "https://radio-t.com/ro", SiteID: "radio-t"},
+		User:      store.User{ID: "user1", Name: "user name"},
+	}
+	require.NoError(t, s.SetReadOnly(comment.Locator, true))
+
+	_, err := s.Create(comment)
+	assert.EqualError(t, err, "post https://radio-t.com/ro is read-only")
+
+	require.NoError(t, s.SetReadOnly(comment.Locator, false))
+	_, err = s.Create(comment)
+	assert.Nil(t, err)
+}
+
+func TestSQL_Find(t *testing.T) {
+	s := prepSQL(t)
+	defer s.Close()
+
+	loc := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+	c, err := s.Get(loc, "id-1")
+	require.NoError(t, err)
+	c.Score = 5
+	require.NoError(t, s.Put(loc, c))
+
+	res, err := s.Find(loc, "-time")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, "id-2", res[0].ID)
+
+	res, err = s.Find(loc, "-score")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, "id-1", res[0].ID)
+
+	res, err = s.Find(loc, "+score")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, "id-2", res[0].ID)
+}
+
+func TestSQL_Get(t *testing.T) {
+	s := prepSQL(t)
+	defer s.Close()
+
+	comment, err := s.Get(store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}, "id-2")
+	assert.Nil(t, err)
+	assert.Equal(t, "some text2", comment.Text)
+
+	_, err = s.Get(store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}, "1234567")
+	assert.NotNil(t, err, "not found")
+}
+
+func TestSQL_Put(t *testing.T) {
+	s := prepSQL(t)
+	defer s.Close()
+
+	loc := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+	res, err := s.Find(loc, "time")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(res))
+
+	comment := res[0]
+	comment.Text = "abc 123"
+	comment.Score = 100
+	comment.User.ID = "user-changed"
+	err = s.Put(loc, comment)
+	assert.Nil(t, err)
+
+	comment, err = s.Get(loc, res[0].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "abc 123", comment.Text)
+	assert.Equal(t, res[0].ID, comment.ID)
+	assert.Equal(t, 100, comment.Score)
+	assert.Equal(t, "user1", comment.User.ID, "immutable user")
+
+	err = s.Put(store.Locator{URL: "https://radio-t.com-bad", SiteID: "radio-t"}, comment)
+	assert.NotNil(t, err)
+}
+
+func TestSQL_Last(t *testing.T) {
+	s := prepSQL(t)
+	defer s.Close()
+
+	res, err := s.Last("radio-t", 0)
+	assert.Nil(t, err)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, "some text2", res[0].Text)
+
+	res, err = s.Last("radio-t", 1)
+	assert.Nil(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, "some text2", res[0].Text)
+
+	res, err = s.Last("bad", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(res))
+}
+
+func TestSQL_Count(t *testing.T) {
+	s := prepSQL(t)
+	defer s.Close()
+
+	c, err := s.Count(store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, c)
+
+	c, err = s.Count(store.Locator{URL: "https://radio-t.com-xxx", SiteID: "radio-t"})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, c)
+}
+
+func TestSQL_List(t *testing.T) {
+	s := prepSQL(t) // two comments for https://radio-t.com
+	defer s.Close()
+
+	// add one more for https://radio-t.com/2
+	comment := store.Comment{
+		ID:        "12345",
+		Text:      `some text, <a href="http://radio-t.com">link</a>`,
+		Timestamp: time.Date(2017, 12, 20, 15, 18, 22, 0, time.Local),
+		Locator:   store.Locator{URL: "https://radio-t.com/2", SiteID: "radio-t"},
+		User:      store.User{ID: "user1", Name: "user name"},
+	}
+	_, err := s.Create(comment)
+	require.Nil(t, err)
+
+	ts := func(sec int) time.Time { return time.Date(2017, 12, 20, 15, 18, sec, 0, time.Local) }
+
+	res, err := s.List("radio-t", 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []store.PostInfo{{URL: "https://radio-t.com/2", Count: 1, FirstTS: ts(22), LastTS: ts(22)},
+		{URL: "https://radio-t.com", Count: 2, FirstTS: ts(22), LastTS: ts(23)}}, res)
+
+	res, err = s.List("radio-t", -1, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(res))
+
+	res, err = s.List("radio-t", 1, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []store.PostInfo{{URL: "https://radio-t.com/2", Count: 1, FirstTS: ts(22), LastTS: ts(22)}}, res)
+
+	res, err = s.List("radio-t", 1, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []store.PostInfo{{URL: "https://radio-t.com", Count: 2, FirstTS: ts(22), LastTS: ts(23)}}, res)
+
+	res, err = s.List("bad", 1, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(res))
+}
+
+func TestSQL_Info(t *testing.T) {
+	s := prepSQL(t) // two comments for https://radio-t.com
+	defer s.Close()
+
+	ts := func(sec int) time.Time { return time.Date(2017, 12, 20, 15, 18, sec, 0, time.Local) }
+
+	// add one more for https://radio-t.com/2
+	comment := store.Comment{
+		ID:        "12345",
+		Text:      `some text, <a href="http://radio-t.com">link</a>`,
+		Timestamp: time.Date(2017, 12, 20, 15, 18, 24, 0, time.Local),
+		Locator:   store.Locator{URL: "https://radio-t.com/2", SiteID: "radio-t"},
+		User:      store.User{ID: "user1", Name: "user name"},
+	}
+	_, err := s.Create(comment)
+	require.Nil(t, err)
+
+	r, err := s.Info(store.Locator{URL: "https://radio-t.com/2", SiteID: "radio-t"}, 0)
+	require.Nil(t, err)
+	assert.Equal(t, store.PostInfo{URL: "https://radio-t.com/2", Count: 1, FirstTS: ts(24), LastTS: ts(24)}, r)
+
+	r, err = s.Info(store.Locator{URL: "https://radio-t.com/2", SiteID: "radio-t"}, 10)
+	require.Nil(t, err)
+	assert.Equal(t, store.PostInfo{URL: "https://radio-t.com/2", Count: 1, FirstTS: ts(24), LastTS: ts(24), ReadOnly: true}, r)
+
+	r, err = s.Info(store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}, 0)
+	require.Nil(t, err)
+	assert.Equal(t, store.PostInfo{URL: "https://radio-t.com", Count: 2, FirstTS: ts(22), LastTS: ts(23)}, r)
+
+	_, err = s.Info(store.Locator{URL: "https://radio-t.com/error", SiteID: "radio-t"}, 0)
+	require.NotNil(t, err)
+
+	err = s.SetReadOnly(store.Locator{URL: "https://radio-t.com/2", SiteID: "radio-t"}, true)
+	require.Nil(t, err)
+	r, err = s.Info(store.Locator{URL: "https://radio-t.com/2", SiteID: "radio-t"}, 0)
+	require.Nil(t, err)
+	assert.Equal(t, store.PostInfo{URL: "https://radio-t.com/2", Count: 1, FirstTS: ts(24), LastTS: ts(24), ReadOnly: true}, r)
+}
+
+func TestSQL_GetForUser(t *testing.T) {
+	s := prepSQL(t)
+	defer s.Close()
+
+	res, err := s.User("radio-t", "user1", 5, 0)
+	assert.Nil(t, err)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, "some text2", res[0].Text, "sorted by -time")
+
+	res, err = s.User("radio-t", "user1", 1, 1)
+	assert.Nil(t, err)
+	require.Equal(t, 1, len(res), "allow 1 comment")
+	assert.Equal(t, `some text, <a href="http://radio-t.com">link</a>`, res[0].Text, "second comment")
+
+	res, err = s.User("radio-t", "userZ", 1, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(res))
+
+	count, err := s.UserCount("radio-t", "user1")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+}
+
+func TestSQL_GetForUserPagination(t *testing.T) {
+	s := prepSQL(t)
+	defer s.Close()
+
+	c := store.Comment{
+		Locator: store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"},
+		User:    store.User{ID: "user2", Name: "user name"},
+	}
+
+	// write 200 comments
+	for i := 0; i < 200; i++ {
+		c.ID = fmt.Sprintf("uid-%d", i)
+		c.Text = fmt.Sprintf("text #%d", i)
+		c.Timestamp = time.Date(2017, 12, 20, 15, 18, i, 0, time.Local)
+		_, err := s.Create(c)
+		require.Nil(t, err)
+	}
+
+	res, err := s.User("radio-t", "user2", 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, len(res))
+	assert.Equal(t, "uid-199", res[0].ID)
+
+	res, err = s.User("radio-t", "user2", 3, 10)
+	assert.Nil(t, err)
+	require.Equal(t, 3, len(res))
+	assert.Equal(t, "uid-189", res[0].ID)
+	assert.Equal(t, "uid-187", res[2].ID)
+
+	res, err = s.User("radio-t", "user2", 10, 195)
+	assert.Nil(t, err)
+	require.Equal(t, 5, len(res))
+	assert.Equal(t, "uid-4", res[0].ID)
+	assert.Equal(t, "uid-0", res[4].ID)
+
+	res, err = s.User("radio-t", "user2", 10, 255)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(res))
+}
+
+func TestSQL_Delete(t *testing.T) {
+	s := prepSQL(t)
+	defer s.Close()
+
+	loc := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+	err := s.Delete(loc, "id-1", store.SoftDelete)
+	assert.Nil(t, err)
+
+	res, err := s.Find(loc, "time")
+	assert.Nil(t, err)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, "", res[0].Text)
+	assert.True(t, res[0].Deleted, "marked deleted")
+	assert.Equal(t, store.User{Name: "user name", ID: "user1"}, res[0].User)
+	assert.Equal(t, "some text2", res[1].Text)
+	assert.False(t, res[1].Deleted)
+
+	comments, err := s.Last("radio-t", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(comments), "1 in last, 1 removed")
+
+	c, err := s.Count(loc)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, c)
+
+	err = s.Delete(loc, "123456", store.SoftDelete)
+	assert.NotNil(t, err)
+
+	err = s.Delete(loc, "id-2", store.HardDelete)
+	assert.Nil(t, err)
+	comment, err := s.Get(loc, "id-2")
+	assert.Nil(t, err)
+	assert.Equal(t, store.User{Name: "deleted", ID: "deleted"}, comment.User)
+	count, err := s.UserCount("radio-t", "deleted")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count, "user_id column updated")
+}
+
+func TestSQL_DeleteAll(t *testing.T) {
+	s := prepSQL(t)
+	defer s.Close()
+
+	assert.Nil(t, s.DeleteAll("radio-t"))
+
+	comments, err := s.Last("radio-t", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(comments), "nothing left")
+
+	c, err := s.Count(store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, c, "0 count")
+}
+
+func TestSQL_DeleteUser(t *testing.T) {
+	s := prepSQL(t)
+	defer s.Close()
+
+	require.NoError(t, s.DeleteUser("radio-t", "user1"))
+
+	loc := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+	res, err := s.Find(loc, "time")
+	assert.Nil(t, err)
+	require.Equal(t, 2, len(res), "2 comments with deleted info")
+	assert.Equal(t, store.User{Name: "deleted", ID: "deleted"}, res[0].User)
+	assert.Equal(t, store.User{Name: "deleted", ID: "deleted"}, res[1].User)
+
+	c, err := s.Count(loc)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, c, "0 count")
+
+	res, err = s.User("radio-t", "user1", 5, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(res))
+
+	assert.EqualError(t, s.DeleteUser("radio-t", "user1"), "unknown user user1")
+}
+
+func TestSQL_BlockUser(t *testing.T) {
+	s := prepSQL(t)
+	defer s.Close()
+
+	assert.False(t, s.IsBlocked("radio-t", "user1"), "nothing blocked")
+
+	assert.NoError(t, s.SetBlock("radio-t", "user1", true, 0))
+	assert.True(t, s.IsBlocked("radio-t", "user1"), "user1 blocked")
+	assert.False(t, s.IsBlocked("radio-t", "user2"), "user2 still unblocked")
+	assert.False(t, s.IsBlocked("radio-t-bad", "user1"), "nothing blocked on wrong site")
+
+	assert.NoError(t, s.SetBlock("radio-t", "user1", false, 0))
+	assert.False(t, s.IsBlocked("radio-t", "user1"), "user1 unblocked")
+
+	assert.NoError(t, s.SetBlock("radio-t", "user1", true, 50*time.Millisecond))
+	assert.True(t, s.IsBlocked("radio-t", "user1"), "user1 blocked")
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, s.IsBlocked("radio-t", "user1"), "user1 un-blocked automatically")
+}
+
+func TestSQL_BlockList(t *testing.T) {
+	s := prepSQL(t)
+	defer s.Close()
+
+	assert.NoError(t, s.SetBlock("radio-t", "user1", true, 0))
+	assert.NoError(t, s.SetBlock("radio-t", "user2", true, 50*time.Millisecond))
+	assert.NoError(t, s.SetBlock("radio-t", "user3", false, 0))
+
+	ids, err := s.Blocked("radio-t")
+	assert.NoError(t, err)
+	require.Equal(t, 2, len(ids))
+	assert.Equal(t, "user1", ids[0].ID)
+	assert.Equal(t, "user name", ids[0].Name)
+	assert.Equal(t, "user2", ids[1].ID)
+
+	time.Sleep(50 * time.Millisecond)
+	ids, err = s.Blocked("radio-t")
+	assert.NoError(t, err)
+	require.Equal(t, 1, len(ids))
+	assert.Equal(t, "user1", ids[0].ID)
+}
+
+func TestSQL_ReadOnly(t *testing.T) {
+	s := prepSQL(t)
+	defer s.Close()
+
+	assert.False(t, s.IsReadOnly(store.Locator{SiteID: "radio-t", URL: "url-1"}), "nothing ro")
+
+	assert.NoError(t, s.SetReadOnly(store.Locator{SiteID: "radio-t", URL: "url-1"}, true))
+	assert.True(t, s.IsReadOnly(store.Locator{SiteID: "radio-t", URL: "url-1"}), "url-1 ro")
+	assert.False(t, s.IsReadOnly(store.Locator{SiteID: "radio-t", URL: "url-2"}), "url-2 still writable")
+	assert.False(t, s.IsReadOnly(store.Locator{SiteID: "radio-t-bad", URL: "url-1"}), "nothing ro on wrong site")
+
+	assert.NoError(t, s.SetReadOnly(store.Locator{SiteID: "radio-t", URL: "url-1"}, false))
+	assert.False(t, s.IsReadOnly(store.Locator{SiteID: "radio-t", URL: "url-1"}), "url-1 writable")
+}
+
+func TestSQL_Verified(t *testing.T) {
+	s := prepSQL(t)
+	defer s.Close()
+
+	assert.False(t, s.IsVerified("radio-t", "u1"), "nothing verified")
+
+	assert.NoError(t, s.SetVerified("radio-t", "u1", true))
+	assert.True(t, s.IsVerified("radio-t", "u1"), "u1 verified")
+	assert.False(t, s.IsVerified("radio-t", "u2"), "u2 still not verified")
+	assert.False(t, s.IsVerified("radio-t-bad", "u1"), "nothing verified on wrong site")
+
+	assert.NoError(t, s.SetVerified("radio-t", "u1", false))
+	assert.False(t, s.IsVerified("radio-t", "u1"), "u1 not verified anymore")
+
+	assert.NoError(t, s.SetVerified("radio-t", "u1", true))
+	assert.NoError(t, s.SetVerified("radio-t", "u2", true))
+	assert.NoError(t, s.SetVerified("radio-t", "u3", false))
+
+	ids, err := s.Verified("radio-t")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"u1", "u2"}, ids, "verified 2 ids")
+
+	// verified and blocked flags kept independently
+	assert.NoError(t, s.SetBlock("radio-t", "u1", true, 0))
+	assert.True(t, s.IsVerified("radio-t", "u1"))
+	assert.True(t, s.IsBlocked("radio-t", "u1"))
+}
+
+func TestSQL_rebind(t *testing.T) {
+	s := SQL{dialect: postgresDialect}
+	assert.Equal(t, "SELECT a FROM t WHERE b = $1 AND c = $2", s.rebind("SELECT a FROM t WHERE b = ? AND c = ?"))
+	assert.Equal(t, "SELECT 1", s.rebind("SELECT 1"))
+}
+
+func TestSQL_Conformance(t *testing.T) {
+	runConformance(t, func(t *testing.T) Interface { return newTestSQL(t) })
+}
+
+// prepSQL makes empty test engine and puts two records
+func prepSQL(t *testing.T) *SQL {
+	s := newTestSQL(t)
+	fillSQL(t, s)
+	return s
+}
+
+func TestSQL_SearchIndex(t *testing.T) {
+	s := prepSQL(t)
+	defer s.Close()
+	search := func(query string) []string {
+		res, err := s.Search(SearchRequest{SiteID: "radio-t", Query: query})
+		require.Nil(t, err)
+		return commentIDs(res)
+	}
+	assert.Equal(t, []string{"id-2", "id-1"}, search("some"))
+	assert.Equal(t, []string{"id-2"}, search("text2 so"), "prefixes of all words")
+
+	c, err := s.Get(store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}, "id-2")
+	require.Nil(t, err)
+	c.Text = "edited"
+	require.Nil(t, s.Put(c.Locator, c))
+	assert.Equal(t, []string{"id-2"}, search("edit"))
+	assert.Equal(t, []string{"id-1"}, search("some"), "old words removed")
+
+	require.Nil(t, s.Delete(c.Locator, "id-2", store.SoftDelete))
+	assert.Empty(t, search("edit"), "deleted comment not indexed")
+
+	// index made for db created before search index added
+	_, err = s.db.Exec("DROP TABLE search_words")
+	require.Nil(t, err)
+	require.Nil(t, s.Close())
+	s = openTestSQL(t)
+	assert.Equal(t, []string{"id-1"}, search("some"))
+}
+
+func TestSQL_UpdateShadow(t *testing.T) {
+	s := prepSQL(t)
+	defer s.Close()
+
+	loc := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+	c, err := s.Get(loc, "id-1")
+	require.Nil(t, err)
+	c.Shadow = true
+	require.Nil(t, s.Put(loc, c))
+
+	count, err := s.Count(loc)
+	require.Nil(t, err)
+	assert.Equal(t, 1, count, "shadow comment not counted")
+	info, err := s.Info(loc, 0)
+	require.Nil(t, err)
+	assert.Equal(t, 1, info.Count)
+}
+
+func TestSQL_UpdateRollback(t *testing.T) {
+	s := prepSQL(t)
+	defer s.Close()
+
+	// break search index, comment's update should be rolled back with failed index update
+	_, err := s.db.Exec("DROP TABLE search_words")
+	require.Nil(t, err)
+	loc := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+	c, err := s.Get(loc, "id-1")
+	require.Nil(t, err)
+	c.Text = "changed"
+	assert.NotNil(t, s.Put(loc, c))
+
+	c, err = s.Get(loc, "id-1")
+	require.Nil(t, err)
+	assert.Equal(t, `some text, <a href="http://radio-t.com">link</a>`, c.Text)
+
+	_, err = s.Create(conformanceComment("id-3", "https://radio-t.com", "user1", 3))
+	assert.NotNil(t, err)
+	_, err = s.Get(loc, "id-3")
+	assert.NotNil(t, err, "comment not created without index")
+}
+
+// newTestSQL makes engine with openTestSQL and cleans all tables
+func newTestSQL(t *testing.T) *SQL {
+	if os.Getenv("POSTGRES_TEST") == "" {
+		os.Remove(testSQLiteDb)
+	}
+	s := openTestSQL(t)
+	for _, tbl := range []string{"comments", "meta_posts", "meta_users", "subscriptions", "search_words"} {
+		_, err := s.db.Exec("DELETE FROM " + tbl)
+		require.Nil(t, err)
+	}
+	return s
+}
+
+// openTestSQL makes postgres engine for POSTGRES_TEST url or sqlite engine if POSTGRES_TEST not defined
+func openTestSQL(t *testing.T) *SQL {
+	if connURL := os.Getenv("POSTGRES_TEST"); connURL != "" {
+		s, err := NewPostgres(connURL)
+		require.Nil(t, err)
+		return s
+	}
+	s, err := NewSQLite(testSQLiteDb)
+	require.Nil(t, err)
+	return s
+}
+
+// fillSQL puts two records to the engine
+func fillSQL(t *testing.T, s *SQL) {
+	comment := store.Comment{
+		ID:        "id-1",
+		Text:      `some text, <a href="http://radio-t.com">link</a>`,
+		Timestamp: time.Date(2017, 12, 20, 15, 18, 22, 0, time.Local),
+		Locator:   store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"},
+		User:      store.User{ID: "user1", Name: "user name"},
+	}
+	_, err := s.Create(comment)
+	assert.Nil(t, err)
+
+	comment = store.Comment{
+		ID:        "id-2",
+		Text:      "some text2",
+		Timestamp: time.Date(2017, 12, 20, 15, 18, 23, 0, time.Local),
+		Locator:   store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"},
+		User:      store.User{ID: "user1", Name: "user name"},
+	}
+	_, err = s.Create(comment)
+	assert.Nil(t, err)
+}
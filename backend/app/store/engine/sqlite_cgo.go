@@ -0,0 +1,7 @@
+//go:build cgo
+// +build cgo
+
+package engine
+
+// sqliteSupported set for binaries built with cgo, required by sqlite driver
+const sqliteSupported = true
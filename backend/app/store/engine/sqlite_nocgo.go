@@ -0,0 +1,7 @@
+//go:build !cgo
+// +build !cgo
+
+package engine
+
+// sqliteSupported not set for binaries built without cgo, sqlite driver is a stub in this case
+const sqliteSupported = false
@@ -0,0 +1,182 @@
+// Package registry implements registry of sites served by remark, sites can be added, renamed, disabled
+// and deleted at runtime
+package registry
+
+import (
+	"encoding/json"
+	"log"
+	"regexp"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/pkg/errors"
+)
+
+// Site is a registered site
+type Site struct {
+	ID       string    `json:"site"`
+	Disabled bool      `json:"disabled"`
+	Created  time.Time `json:"created"`
+}
+
+// Registry keeps sites in boltdb, "sites" bucket with site ID as key and json of Site as value
+type Registry struct {
+	db *bolt.DB
+}
+
+const sitesBucketName = "sites"
+
+// site ids used as file names by bolt engine, so limited to safe characters
+var reValidID = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,63}$`)
+
+// New makes registry in the given file, initial sites registered if not known yet
+func New(fileName string, options bolt.Options, initial ...string) (*Registry, error) {
+	db, err := bolt.Open(fileName, 0600, &options)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to make boltdb for %s", fileName)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		bkt, e := tx.CreateBucketIfNotExists([]byte(sitesBucketName))
+		if e != nil {
+			return errors.Wrapf(e, "failed to create top level bucket %s", sitesBucketName)
+		}
+		for _, siteID := range initial {
+			if bkt.Get([]byte(siteID)) != nil {
+				continue
+			}
+			if e = put(bkt, Site{ID: siteID, Created: time.Now()}); e != nil {
+				return e
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	log.Printf("[INFO] sites registry in %s, initial sites %+v", fileName, initial)
+	return &Registry{db: db}, nil
+}
+
+// Sites returns all registered sites, sorted by id
+func (r *Registry) Sites() (sites []Site, err error) {
+	sites = []Site{}
+	err = r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(sitesBucketName)).ForEach(func(k, v []byte) error {
+			site := Site{}
+			if e := json.Unmarshal(v, &site); e != nil {
+				return errors.Wrapf(e, "failed to unmarshal site %s", string(k))
+			}
+			sites = append(sites, site)
+			return nil
+		})
+	})
+	return sites, err
+}
+
+// Enabled returns ids of registered sites not disabled
+func (r *Registry) Enabled() (ids []string, err error) {
+	sites, err := r.Sites()
+	if err != nil {
+		return nil, err
+	}
+	ids = []string{}
+	for _, site := range sites {
+		if !site.Disabled {
+			ids = append(ids, site.ID)
+		}
+	}
+	return ids, nil
+}
+
+// Site returns registered site by id
+func (r *Registry) Site(siteID string) (site Site, err error) {
+	err = r.db.View(func(tx *bolt.Tx) error {
+		site, err = get(tx.Bucket([]byte(sitesBucketName)), siteID)
+		return err
+	})
+	return site, err
+}
+
+// Add registers new site
+func (r *Registry) Add(siteID string) (site Site, err error) {
+	if !reValidID.MatchString(siteID) {
+		return Site{}, errors.Errorf("invalid site id %q", siteID)
+	}
+	err = r.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(sitesBucketName))
+		if bkt.Get([]byte(siteID)) != nil {
+			return errors.Errorf("site %q already registered", siteID)
+		}
+		site = Site{ID: siteID, Created: time.Now()}
+		return put(bkt, site)
+	})
+	return site, err
+}
+
+// Rename changes id of the registered site
+func (r *Registry) Rename(siteID, newID string) (site Site, err error) {
+	if !reValidID.MatchString(newID) {
+		return Site{}, errors.Errorf("invalid site id %q", newID)
+	}
+	err = r.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(sitesBucketName))
+		if site, err = get(bkt, siteID); err != nil {
+			return err
+		}
+		if bkt.Get([]byte(newID)) != nil {
+			return errors.Errorf("site %q already registered", newID)
+		}
+		if err = bkt.Delete([]byte(siteID)); err != nil {
+			return errors.Wrapf(err, "failed to delete site %s", siteID)
+		}
+		site.ID = newID
+		return put(bkt, site)
+	})
+	return site, err
+}
+
+// SetDisabled disables or enables the registered site
+func (r *Registry) SetDisabled(siteID string, disabled bool) (site Site, err error) {
+	err = r.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(sitesBucketName))
+		if site, err = get(bkt, siteID); err != nil {
+			return err
+		}
+		site.Disabled = disabled
+		return put(bkt, site)
+	})
+	return site, err
+}
+
+// Delete removes the site from registry
+func (r *Registry) Delete(siteID string) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(sitesBucketName))
+		if _, err := get(bkt, siteID); err != nil {
+			return err
+		}
+		return errors.Wrapf(bkt.Delete([]byte(siteID)), "failed to delete site %s", siteID)
+	})
+}
+
+// Close boltdb
+func (r *Registry) Close() error {
+	return errors.Wrap(r.db.Close(), "failed to close sites registry")
+}
+
+func get(bkt *bolt.Bucket, siteID string) (site Site, err error) {
+	value := bkt.Get([]byte(siteID))
+	if value == nil {
+		return Site{}, errors.Errorf("site %q not registered", siteID)
+	}
+	return site, errors.Wrapf(json.Unmarshal(value, &site), "failed to unmarshal site %s", siteID)
+}
+
+func put(bkt *bolt.Bucket, site Site) error {
+	value, err := json.Marshal(site)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal site %s", site.ID)
+	}
+	return errors.Wrapf(bkt.Put([]byte(site.ID), value), "failed to put site %s", site.ID)
+}
@@ -0,0 +1,74 @@
+package registry
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	fileName := "/tmp/test-remark-sites.db"
+	defer os.Remove(fileName)
+	os.Remove(fileName)
+
+	r, err := New(fileName, bolt.Options{}, "remark", "radio-t")
+	require.NoError(t, err)
+
+	sites, err := r.Sites()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(sites))
+	assert.Equal(t, "radio-t", sites[0].ID)
+	assert.Equal(t, "remark", sites[1].ID)
+	assert.WithinDuration(t, time.Now(), sites[0].Created, time.Second)
+
+	site, err := r.Add("blog")
+	require.NoError(t, err)
+	assert.Equal(t, "blog", site.ID)
+	_, err = r.Add("blog")
+	assert.EqualError(t, err, `site "blog" already registered`)
+	_, err = r.Add("../etc")
+	assert.EqualError(t, err, `invalid site id "../etc"`)
+	_, err = r.Add("")
+	assert.EqualError(t, err, `invalid site id ""`)
+
+	site, err = r.SetDisabled("blog", true)
+	require.NoError(t, err)
+	assert.True(t, site.Disabled)
+	ids, err := r.Enabled()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"radio-t", "remark"}, ids)
+	_, err = r.SetDisabled("no-such-site", true)
+	assert.EqualError(t, err, `site "no-such-site" not registered`)
+
+	site, err = r.Rename("blog", "new-blog")
+	require.NoError(t, err)
+	assert.Equal(t, "new-blog", site.ID)
+	assert.True(t, site.Disabled, "disabled kept")
+	_, err = r.Site("blog")
+	assert.EqualError(t, err, `site "blog" not registered`)
+	_, err = r.Rename("new-blog", "remark")
+	assert.EqualError(t, err, `site "remark" already registered`)
+	_, err = r.Rename("new-blog", "bad/id")
+	assert.EqualError(t, err, `invalid site id "bad/id"`)
+	_, err = r.Rename("no-such-site", "blog")
+	assert.EqualError(t, err, `site "no-such-site" not registered`)
+
+	require.NoError(t, r.Delete("remark"))
+	assert.EqualError(t, r.Delete("remark"), `site "remark" not registered`)
+
+	// reopen, initial site re-registered, others kept
+	require.NoError(t, r.Close())
+	r, err = New(fileName, bolt.Options{}, "remark")
+	require.NoError(t, err)
+	defer r.Close()
+	sites, err = r.Sites()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(sites))
+	site, err = r.Site("new-blog")
+	require.NoError(t, err)
+	assert.True(t, site.Disabled)
+}
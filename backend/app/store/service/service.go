@@ -1,17 +1,22 @@
 package service
 
 import (
+	"fmt"
+	"log"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	multierror "github.com/hashicorp/go-multierror"
 	"github.com/pkg/errors"
+	"github.com/pmezard/go-difflib/difflib"
 
 	"github.com/umputun/remark/backend/app/store"
 	"github.com/umputun/remark/backend/app/store/admin"
 	"github.com/umputun/remark/backend/app/store/engine"
+	"github.com/umputun/remark/backend/app/store/registry"
 )
 
 // DataStore wraps store.Interface with additional methods
@@ -21,6 +26,11 @@ type DataStore struct {
 	AdminStore     admin.Store
 	MaxCommentSize int
 	MaxVotes       int
+	RetainDeleted  time.Duration // soft-deleted comments restorable within this window, purged after
+	PreModeration  PreModeration
+	Anonymous      Anonymous
+	ReportLimit    int                // number of reports to hide comment for review, 0 - never hide
+	Registry       *registry.Registry // sites changed at runtime, sites fixed if nil
 
 	// granular locks
 	scopedLocks struct {
@@ -28,8 +38,35 @@ type DataStore struct {
 		sync.Once
 		locks map[string]sync.Locker
 	}
+
+	// time of the last anonymous comment by hash of site and ip, for strict sites
+	anonIPs struct {
+		sync.Mutex
+		last map[string]time.Time
+	}
+}
+
+// PreModeration defines which new comments wait for admin approval before being published
+type PreModeration struct {
+	Mode    string   // PreModAll or PreModUntrusted, disabled for anything else
+	Sites   []string // sites with pre-moderation, all sites if empty
+	Trusted int      // approved comments needed to skip pre-moderation in PreModUntrusted mode
+}
+
+// Anonymous defines restrictions for anonymous users
+type Anonymous struct {
+	VoteSites      []string      // sites allowing anonymous users to vote, no votes if empty
+	StrictSites    []string      // sites with stricter limits for anonymous comments
+	MaxCommentSize int           // max size of anonymous comment on strict sites
+	Interval       time.Duration // min interval between comments of the same anonymous user on strict sites
 }
 
+// pre-moderation modes
+const (
+	PreModAll       = "all"       // comments of all users except admins
+	PreModUntrusted = "untrusted" // comments of not verified users with less than Trusted approved comments
+)
+
 // UserMetaData keeps info about user flags
 type UserMetaData struct {
 	ID      string `json:"id"`
@@ -37,7 +74,8 @@ type UserMetaData struct {
 		Status bool      `json:"status"`
 		Until  time.Time `json:"until"`
 	} `json:"blocked"`
-	Verified bool `json:"verified"`
+	Verified     bool `json:"verified"`
+	ShadowBanned bool `json:"shadow_banned,omitempty"`
 }
 
 // PostMetaData keeps info about post flags
@@ -48,17 +86,31 @@ type PostMetaData struct {
 
 const defaultCommentMaxSize = 2000
 
+// maxReportReason limits length of report's reason in runes, longer reasons truncated
+const maxReportReason = 256
+
+// maxRevisions limits number of kept revisions per comment, the oldest dropped first
+const maxRevisions = 50
+
 // UnlimitedVotes doesn't restrict MaxVotes
 const UnlimitedVotes = -1
 
 // Create prepares comment and forward to Interface.Create
 func (s *DataStore) Create(comment store.Comment) (commentID string, err error) {
+	if s.IsSiteDisabled(comment.Locator.SiteID) {
+		return "", errors.Errorf("site %s disabled", comment.Locator.SiteID)
+	}
 
+	ip := comment.User.IP // raw ip, hashed on preparation
 	if comment, err = s.prepareNewComment(comment); err != nil {
 		return "", errors.Wrap(err, "failed to prepare comment")
 	}
 
-	return s.Interface.Create(comment)
+	if commentID, err = s.Interface.Create(comment); err != nil {
+		return "", err
+	}
+	s.anonymousCommented(comment, ip)
+	return commentID, nil
 }
 
 // prepareNewComment sets new comment fields, hashing and sanitizing data
@@ -110,6 +162,10 @@ func (s *DataStore) Vote(locator store.Locator, commentID string, userID string,
 		return comment, errors.Errorf("user %s can not vote for his own comment %s", userID, commentID)
 	}
 
+	if store.IsAnonymous(userID) && !contains(locator.SiteID, s.Anonymous.VoteSites) {
+		return comment, errors.Errorf("anonymous user %s can not vote on site %s", userID, locator.SiteID)
+	}
+
 	if comment.Votes == nil {
 		comment.Votes = make(map[string]bool)
 	}
@@ -173,6 +229,7 @@ func (s *DataStore) EditComment(locator store.Locator, commentID string, req Edi
 		return comment, s.Delete(locator, commentID, store.SoftDelete)
 	}
 
+	comment.Revisions = addRevision(comment.Revisions, revisionOf(comment))
 	comment.Text = req.Text
 	comment.Orig = req.Orig
 	comment.Edit = &store.Edit{
@@ -185,6 +242,270 @@ func (s *DataStore) EditComment(locator store.Locator, commentID string, req Edi
 	return comment, err
 }
 
+// Revisions returns all versions of the comment, from the original one to the current
+func (s *DataStore) Revisions(locator store.Locator, commentID string) ([]store.Revision, error) {
+	comment, err := s.Get(locator, commentID)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]store.Revision, 0, len(comment.Revisions)+1)
+	res = append(res, comment.Revisions...)
+	return append(res, revisionOf(comment)), nil
+}
+
+// DiffRevisions makes unified diff of orig text between two revisions of the comment.
+// Revisions numbered as returned by Revisions, i.e. the last one is the current version.
+func (s *DataStore) DiffRevisions(locator store.Locator, commentID string, from, to int) (string, error) {
+	revs, err := s.Revisions(locator, commentID)
+	if err != nil {
+		return "", err
+	}
+	for _, n := range []int{from, to} {
+		if n < 0 || n >= len(revs) {
+			return "", errors.Errorf("no revision %d for %s", n, commentID)
+		}
+	}
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(revs[from].Orig),
+		B:        difflib.SplitLines(revs[to].Orig),
+		FromFile: fmt.Sprintf("revision %d", from),
+		ToFile:   fmt.Sprintf("revision %d", to),
+		Context:  3,
+	})
+}
+
+// RevertComment rolls comment back to one of its previous revisions.
+// Current version kept as a new revision, so revert can be reverted too.
+func (s *DataStore) RevertComment(locator store.Locator, commentID string, revision int) (comment store.Comment, err error) {
+	comment, err = s.Get(locator, commentID)
+	if err != nil {
+		return comment, err
+	}
+	if comment.Deleted {
+		return comment, errors.Errorf("can't revert deleted comment %s", commentID)
+	}
+	if revision < 0 || revision >= len(comment.Revisions) {
+		return comment, errors.Errorf("no revision %d for %s", revision, commentID)
+	}
+
+	rev := comment.Revisions[revision]
+	comment.Revisions = addRevision(comment.Revisions, revisionOf(comment))
+	comment.Text = rev.Text
+	comment.Orig = rev.Orig
+	comment.Edit = &store.Edit{
+		Timestamp: time.Now(),
+		Summary:   fmt.Sprintf("reverted to revision %d", revision),
+	}
+	return comment, s.Put(locator, comment)
+}
+
+// revisionOf makes revision from the current state of the comment
+func revisionOf(comment store.Comment) store.Revision {
+	rev := store.Revision{Timestamp: comment.Timestamp, Text: comment.Text, Orig: comment.Orig}
+	if comment.Edit != nil {
+		rev.Timestamp = comment.Edit.Timestamp
+		rev.Summary = comment.Edit.Summary
+	}
+	return rev
+}
+
+// addRevision appends revision and drops the oldest ones above maxRevisions
+func addRevision(revs []store.Revision, rev store.Revision) []store.Revision {
+	revs = append(revs, rev)
+	if len(revs) > maxRevisions {
+		revs = revs[len(revs)-maxRevisions:]
+	}
+	return revs
+}
+
+// RestoreComment brings soft-deleted comment back if it is still within retention window
+func (s *DataStore) RestoreComment(locator store.Locator, commentID string) (comment store.Comment, err error) {
+	if comment, err = s.Get(locator, commentID); err != nil {
+		return comment, err
+	}
+	if comment.Deleted && comment.Trash != nil && s.isExpired(*comment.Trash) {
+		return comment, errors.Errorf("retention window expired for %s", commentID)
+	}
+	if err = s.Restore(locator, commentID); err != nil {
+		return comment, err
+	}
+	return s.Get(locator, commentID)
+}
+
+// PurgeDeleted makes deletion permanent for all soft-deleted comments of the site with retention window expired.
+// Returns number of purged comments.
+func (s *DataStore) PurgeDeleted(siteID string) (int, error) {
+	posts, err := s.List(siteID, 0, 0)
+	if err != nil {
+		return 0, errors.Wrapf(err, "can't list posts for %s", siteID)
+	}
+	purged := 0
+	for _, post := range posts {
+		locator := store.Locator{SiteID: siteID, URL: post.URL}
+		comments, err := s.Find(locator, "time")
+		if err != nil {
+			return purged, errors.Wrapf(err, "can't get comments for %s", post.URL)
+		}
+		for _, c := range comments {
+			if !c.Deleted || c.Trash == nil || !s.isExpired(*c.Trash) {
+				continue
+			}
+			c.Trash = nil
+			if err = s.Put(locator, c); err != nil {
+				return purged, errors.Wrapf(err, "can't purge %s", c.ID)
+			}
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (s *DataStore) isExpired(trash store.Trash) bool {
+	return time.Now().After(trash.Timestamp.Add(s.RetainDeleted))
+}
+
+// NeedsApproval checks if new comment should be created as pending, according to pre-moderation settings
+func (s *DataStore) NeedsApproval(comment store.Comment) bool {
+	siteID, userID := comment.Locator.SiteID, comment.User.ID
+	pm := s.PreModeration
+	if pm.Mode != PreModAll && pm.Mode != PreModUntrusted {
+		return false
+	}
+	if len(pm.Sites) > 0 && !contains(siteID, pm.Sites) {
+		return false
+	}
+	if comment.User.Admin || s.IsAdmin(siteID, userID) || s.IsModerator(siteID, userID) {
+		return false
+	}
+	if pm.Mode == PreModAll {
+		return true
+	}
+	if s.IsVerified(siteID, userID) {
+		return false
+	}
+
+	comments, err := s.User(siteID, userID, 0, 0)
+	if err != nil { // no comments for user
+		return pm.Trusted > 0
+	}
+	approved := 0
+	for _, c := range comments {
+		if !c.Pending && !c.Deleted {
+			approved++
+		}
+	}
+	return approved < pm.Trusted
+}
+
+// ApproveComment publishes pending comment
+func (s *DataStore) ApproveComment(locator store.Locator, commentID string) (comment store.Comment, err error) {
+	if comment, err = s.Get(locator, commentID); err != nil {
+		return comment, err
+	}
+	if comment.Deleted {
+		return comment, errors.Errorf("can't approve deleted comment %s", commentID)
+	}
+	if len(comment.Reports) > 0 { // approved comment reviewed, reports not relevant anymore
+		comment.Reports = nil
+		if err = s.Put(locator, comment); err != nil {
+			return comment, err
+		}
+	}
+	if err = s.Approve(locator, commentID); err != nil {
+		return comment, err
+	}
+	return s.Get(locator, commentID)
+}
+
+// RejectComment deletes pending comment. It stays pending, so can be restored to the queue while in retention window
+func (s *DataStore) RejectComment(locator store.Locator, commentID string) error {
+	comment, err := s.Get(locator, commentID)
+	if err != nil {
+		return err
+	}
+	if !comment.Pending || comment.Deleted {
+		return errors.Errorf("comment %s not pending", commentID)
+	}
+	return s.Delete(locator, commentID, store.SoftDelete)
+}
+
+// ReportComment adds user's report about the comment. Each user can report a comment once.
+// Comment reported ReportLimit times moved to pending, i.e. hidden till reviewed by admin.
+func (s *DataStore) ReportComment(locator store.Locator, commentID string, userID string, reason string) (comment store.Comment, err error) {
+
+	cLock := s.getsScopedLocks(locator.URL) // get lock for URL scope
+	cLock.Lock()                            // prevents race on reporting
+	defer cLock.Unlock()
+
+	if comment, err = s.Get(locator, commentID); err != nil {
+		return comment, err
+	}
+	if comment.Deleted || comment.Pending {
+		return comment, errors.Errorf("can't report comment %s", commentID)
+	}
+	if comment.User.ID == userID {
+		return comment, errors.Errorf("user %s can not report his own comment %s", userID, commentID)
+	}
+	for _, r := range comment.Reports {
+		if r.UserID == userID {
+			return comment, errors.Errorf("user %s already reported %s", userID, commentID)
+		}
+	}
+
+	if runes := []rune(reason); len(runes) > maxReportReason {
+		reason = string(runes[:maxReportReason])
+	}
+	comment.Reports = append(comment.Reports, store.Report{UserID: userID, Reason: reason, Timestamp: time.Now()})
+	if err = s.Put(locator, comment); err != nil {
+		return comment, err
+	}
+
+	if s.ReportLimit > 0 && len(comment.Reports) >= s.ReportLimit {
+		if err = s.Hold(locator, commentID); err != nil {
+			return comment, err
+		}
+		comment.Pending = true
+	}
+	return comment, nil
+}
+
+// Reported returns all not deleted comments with reports, the most reported first
+func (s *DataStore) Reported(siteID string) ([]store.Comment, error) {
+	posts, err := s.List(siteID, 0, 0)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't list posts for %s", siteID)
+	}
+	res := []store.Comment{}
+	for _, post := range posts {
+		comments, err := s.Find(store.Locator{SiteID: siteID, URL: post.URL}, "time")
+		if err != nil {
+			return nil, errors.Wrapf(err, "can't get comments for %s", post.URL)
+		}
+		for _, c := range comments {
+			if len(c.Reports) > 0 && !c.Deleted {
+				res = append(res, c)
+			}
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool { return len(res[i].Reports) > len(res[j].Reports) })
+	return res, nil
+}
+
+// DismissReports clears reports of the comment and publishes it back if it was hidden by reports
+func (s *DataStore) DismissReports(locator store.Locator, commentID string) (comment store.Comment, err error) {
+	if comment, err = s.Get(locator, commentID); err != nil {
+		return comment, err
+	}
+	if len(comment.Reports) == 0 {
+		return comment, errors.Errorf("comment %s not reported", commentID)
+	}
+	if comment.Pending { // only published comments can be reported, so it was hidden by reports
+		return s.ApproveComment(locator, commentID)
+	}
+	comment.Reports = nil
+	return comment, s.Put(locator, comment)
+}
+
 // Counts returns postID+count list for given comments
 func (s *DataStore) Counts(siteID string, postIDs []string) ([]store.PostInfo, error) {
 	res := []store.PostInfo{}
@@ -211,9 +532,87 @@ func (s *DataStore) ValidateComment(c *store.Comment) error {
 	if c.User.ID == "" || c.User.Name == "" {
 		return errors.Errorf("empty user info")
 	}
+	if s.isStrictAnonymous(*c) && s.Anonymous.MaxCommentSize > 0 && len([]rune(c.Orig)) > s.Anonymous.MaxCommentSize {
+		return errors.Errorf("anonymous comment text exceeded max allowed size %d (%d)",
+			s.Anonymous.MaxCommentSize, len([]rune(c.Orig)))
+	}
 	return nil
 }
 
+// TooFrequent checks if anonymous user commented within the interval on the site with strict limits.
+// Checked for the user and for user's ip, as the same ip gets new anonymous user with another name.
+// Comment counted for the ip once created
+func (s *DataStore) TooFrequent(comment store.Comment) bool {
+	if !s.isStrictAnonymous(comment) || s.Anonymous.Interval <= 0 {
+		return false
+	}
+	comments, err := s.User(comment.Locator.SiteID, comment.User.ID, 1, 0)
+	if err == nil && len(comments) > 0 && time.Since(comments[0].Timestamp) < s.Anonymous.Interval {
+		return true
+	}
+	return s.tooFrequentIP(comment)
+}
+
+// tooFrequentIP checks time of the last anonymous comment from comment's raw ip
+func (s *DataStore) tooFrequentIP(comment store.Comment) bool {
+	if comment.User.IP == "" {
+		return false
+	}
+	s.anonIPs.Lock()
+	defer s.anonIPs.Unlock()
+	last, ok := s.anonIPs.last[anonIPKey(comment.Locator.SiteID, comment.User.IP)]
+	return ok && time.Since(last) < s.Anonymous.Interval
+}
+
+// anonymousCommented sets time of the last anonymous comment from the raw ip on the site with strict limits.
+// Kept in memory only, by hash of site and ip, and dropped once the interval passed
+func (s *DataStore) anonymousCommented(comment store.Comment, ip string) {
+	if ip == "" || !s.isStrictAnonymous(comment) || s.Anonymous.Interval <= 0 {
+		return
+	}
+	s.anonIPs.Lock()
+	defer s.anonIPs.Unlock()
+	now := time.Now()
+	if s.anonIPs.last == nil {
+		s.anonIPs.last = map[string]time.Time{}
+	}
+	for k, last := range s.anonIPs.last {
+		if now.Sub(last) >= s.Anonymous.Interval {
+			delete(s.anonIPs.last, k)
+		}
+	}
+	s.anonIPs.last[anonIPKey(comment.Locator.SiteID, ip)] = now
+}
+
+func anonIPKey(siteID, ip string) string {
+	return store.EncodeID(siteID + "!!" + ip)
+}
+
+// IsReservedName checks if name, case-insensitive, used by site's admin, moderator or verified user
+func (s *DataStore) IsReservedName(siteID, name string) (bool, error) {
+	verified, err := s.Verified(siteID)
+	if err != nil {
+		return false, errors.Wrapf(err, "can't get verified users of site %s", siteID)
+	}
+	name = strings.TrimSpace(name)
+	privileged := append(append([]string{}, s.AdminStore.Admins(siteID)...), s.AdminStore.Moderators(siteID)...)
+	for _, userID := range append(privileged, verified...) {
+		comments, e := s.User(siteID, userID, 1, 0)
+		if e != nil || len(comments) == 0 { // no comments, user's name unknown
+			continue
+		}
+		if strings.EqualFold(strings.TrimSpace(comments[0].User.Name), name) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isStrictAnonymous checks if comment made by anonymous user on the site with strict limits
+func (s *DataStore) isStrictAnonymous(comment store.Comment) bool {
+	return store.IsAnonymous(comment.User.ID) && contains(comment.Locator.SiteID, s.Anonymous.StrictSites)
+}
+
 // IsAdmin checks if usesID in the list of admins
 func (s *DataStore) IsAdmin(siteID string, userID string) bool {
 	for _, a := range s.AdminStore.Admins(siteID) {
@@ -224,6 +623,153 @@ func (s *DataStore) IsAdmin(siteID string, userID string) bool {
 	return false
 }
 
+// IsModerator checks if userID in the list of site's moderators
+func (s *DataStore) IsModerator(siteID string, userID string) bool {
+	for _, m := range s.AdminStore.Moderators(siteID) {
+		if m == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// IsIPStale checks if ip hash of the comment made with site's key before the last key rotation. Raw ips not stored,
+// so such hashes can't be re-derived and can't be compared to hashes made with the current key
+func (s *DataStore) IsIPStale(comment store.Comment) bool {
+	rotator, ok := s.AdminStore.(admin.Rotator)
+	if !ok || comment.User.IP == "" {
+		return false
+	}
+	rotated := rotator.KeyRotated(comment.Locator.SiteID)
+	return !rotated.IsZero() && comment.Timestamp.Before(rotated)
+}
+
+// AddSite registers new site and opens its storage
+func (s *DataStore) AddSite(siteID string) (registry.Site, error) {
+	if s.Registry == nil {
+		return registry.Site{}, errors.New("no sites registry")
+	}
+	site, err := s.Registry.Add(siteID)
+	if err != nil {
+		return registry.Site{}, err
+	}
+	if sm, ok := s.Interface.(engine.SiteManager); ok {
+		if err = sm.OpenSite(siteID); err != nil {
+			if e := s.Registry.Delete(siteID); e != nil {
+				log.Printf("[WARN] can't remove site %s from registry, %v", siteID, e)
+			}
+			return registry.Site{}, errors.Wrapf(err, "can't open storage of site %s", siteID)
+		}
+	}
+	return site, nil
+}
+
+// RenameSite changes id of the site, moves its storage and admins info, if admin store allows changes.
+// Api tokens of the site revoked, so tokens of the old id can't be used by a site registered with it later.
+// Supported by engines with storage per site only
+func (s *DataStore) RenameSite(siteID, newID string) (registry.Site, error) {
+	if s.Registry == nil {
+		return registry.Site{}, errors.New("no sites registry")
+	}
+	sm, ok := s.Interface.(engine.SiteManager)
+	if !ok {
+		return registry.Site{}, errors.New("site rename not supported by the store")
+	}
+	site, err := s.Registry.Rename(siteID, newID)
+	if err != nil {
+		return registry.Site{}, err
+	}
+	if err = sm.RenameSite(siteID, newID); err != nil {
+		if _, e := s.Registry.Rename(newID, siteID); e != nil {
+			log.Printf("[WARN] can't rename site %s back in registry, %v", newID, e)
+		}
+		return registry.Site{}, errors.Wrapf(err, "can't rename storage of site %s", siteID)
+	}
+
+	if updater, ok := s.AdminStore.(admin.Updater); ok {
+		if err = moveAdminInfo(updater, siteID, newID); err != nil {
+			return registry.Site{}, errors.Wrapf(err, "can't move admins info of site %s", siteID)
+		}
+	}
+	return site, nil
+}
+
+// SetSiteDisabled disables or enables the site. Storage of disabled site closed, new comments rejected
+func (s *DataStore) SetSiteDisabled(siteID string, disabled bool) (registry.Site, error) {
+	if s.Registry == nil {
+		return registry.Site{}, errors.New("no sites registry")
+	}
+	site, err := s.Registry.SetDisabled(siteID, disabled)
+	if err != nil {
+		return registry.Site{}, err
+	}
+	if sm, ok := s.Interface.(engine.SiteManager); ok {
+		if disabled {
+			err = sm.CloseSite(siteID)
+		} else {
+			err = sm.OpenSite(siteID)
+		}
+	}
+	return site, errors.Wrapf(err, "can't change storage of site %s", siteID)
+}
+
+// DeleteSite removes the site from registry with all its data, admins info and api tokens
+func (s *DataStore) DeleteSite(siteID string) error {
+	if s.Registry == nil {
+		return errors.New("no sites registry")
+	}
+	if _, err := s.Registry.Site(siteID); err != nil {
+		return err
+	}
+	var err error
+	if sm, ok := s.Interface.(engine.SiteManager); ok {
+		err = sm.RemoveSite(siteID)
+	} else {
+		err = s.Interface.DeleteAll(siteID)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "can't delete data of site %s", siteID)
+	}
+	if updater, ok := s.AdminStore.(admin.Updater); ok {
+		if err = updater.DeleteSite(siteID); err != nil {
+			return errors.Wrapf(err, "can't delete admins info of site %s", siteID)
+		}
+	}
+	return s.Registry.Delete(siteID)
+}
+
+// IsSiteDisabled checks if the site disabled in registry, always false without registry
+func (s *DataStore) IsSiteDisabled(siteID string) bool {
+	if s.Registry == nil {
+		return false
+	}
+	site, err := s.Registry.Site(siteID)
+	return err == nil && site.Disabled
+}
+
+// moveAdminInfo moves admins info of the site, stored in admin store, to the new site id
+func moveAdminInfo(updater admin.Updater, siteID, newID string) error {
+	ids, err := updater.Sites()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if id != siteID {
+			continue
+		}
+		info, err := updater.Site(siteID)
+		if err != nil {
+			return err
+		}
+		info.SiteID = newID
+		if err = updater.SetSite(info); err != nil {
+			return err
+		}
+		break
+	}
+	return updater.DeleteSite(siteID) // revokes api tokens of the old id too
+}
+
 // Metas returns metadata for users and posts
 func (s *DataStore) Metas(siteID string) (umetas []UserMetaData, pmetas []PostMetaData, err error) {
 	umetas = []UserMetaData{}
@@ -272,6 +818,20 @@ func (s *DataStore) Metas(siteID string) (umetas []UserMetaData, pmetas []PostMe
 		m[v] = val
 	}
 
+	// process shadow-banned users
+	banned, err := s.ShadowBanned(siteID)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "can't get list of shadow-banned users for %s", siteID)
+	}
+	for _, b := range banned {
+		val, ok := m[b]
+		if !ok {
+			val = UserMetaData{ID: b}
+		}
+		val.ShadowBanned = true
+		m[b] = val
+	}
+
 	for _, u := range m {
 		umetas = append(umetas, u)
 	}
@@ -299,6 +859,9 @@ func (s *DataStore) SetMetas(siteID string, umetas []UserMetaData, pmetas []Post
 		if um.Verified {
 			errs = multierror.Append(errs, s.SetVerified(siteID, um.ID, true))
 		}
+		if um.ShadowBanned {
+			errs = multierror.Append(errs, s.SetShadowBan(siteID, um.ID, true))
+		}
 	}
 
 	return errs.ErrorOrNil()
@@ -318,3 +881,12 @@ func (s *DataStore) getsScopedLocks(id string) (lock sync.Locker) {
 
 	return lock
 }
+
+func contains(s string, list []string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -2,6 +2,7 @@ package service
 
 import (
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"strings"
@@ -17,6 +18,7 @@ import (
 
 	"github.com/umputun/remark/backend/app/store"
 	"github.com/umputun/remark/backend/app/store/engine"
+	"github.com/umputun/remark/backend/app/store/registry"
 )
 
 var testDb = "/tmp/test-remark.db"
@@ -279,11 +281,100 @@ func TestService_EditComment(t *testing.T) {
 	assert.Equal(t, "my edit", c.Edit.Summary)
 	assert.Equal(t, "xxx", c.Text)
 
+	require.Equal(t, 1, len(c.Revisions), "original version kept as revision")
+	assert.Equal(t, res[0].Text, c.Revisions[0].Text)
+	assert.Equal(t, res[0].Orig, c.Revisions[0].Orig)
+	assert.Equal(t, res[0].Timestamp.Unix(), c.Revisions[0].Timestamp.Unix())
+	assert.Equal(t, "", c.Revisions[0].Summary)
+
 	_, err = b.EditComment(store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}, res[0].ID,
 		EditRequest{Orig: "yyy", Text: "xxx", Summary: "my edit"})
 	assert.Nil(t, err, "allow second edit")
 }
 
+func TestService_Revisions(t *testing.T) {
+	defer os.Remove(testDb)
+	b := DataStore{Interface: prepStoreEngine(t), AdminStore: admin.NewStaticKeyStore("secret 123")}
+	locator := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+
+	res, err := b.Last("radio-t", 0)
+	require.Nil(t, err)
+	id := res[0].ID
+
+	revs, err := b.Revisions(locator, id)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(revs), "not edited comment has current version only")
+	assert.Equal(t, res[0].Orig, revs[0].Orig)
+
+	_, err = b.EditComment(locator, id, EditRequest{Orig: "line 1\nline 2", Text: "<p>line 1\nline 2</p>", Summary: "edit 1"})
+	require.Nil(t, err)
+	_, err = b.EditComment(locator, id, EditRequest{Orig: "line 1\nline 22", Text: "<p>line 1\nline 22</p>", Summary: "edit 2"})
+	require.Nil(t, err)
+
+	revs, err = b.Revisions(locator, id)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(revs))
+	assert.Equal(t, res[0].Orig, revs[0].Orig)
+	assert.Equal(t, "", revs[0].Summary)
+	assert.Equal(t, "line 1\nline 2", revs[1].Orig)
+	assert.Equal(t, "edit 1", revs[1].Summary)
+	assert.Equal(t, "line 1\nline 22", revs[2].Orig)
+	assert.Equal(t, "edit 2", revs[2].Summary)
+
+	diff, err := b.DiffRevisions(locator, id, 1, 2)
+	require.Nil(t, err)
+	assert.Equal(t, "--- revision 1\n+++ revision 2\n@@ -1,2 +1,2 @@\n line 1\n-line 2\n+line 22\n", diff)
+
+	_, err = b.DiffRevisions(locator, id, 0, 3)
+	assert.EqualError(t, err, "no revision 3 for "+id)
+
+	_, err = b.Revisions(locator, "bad-id")
+	assert.NotNil(t, err)
+}
+
+func TestService_RevertComment(t *testing.T) {
+	defer os.Remove(testDb)
+	b := DataStore{Interface: prepStoreEngine(t), AdminStore: admin.NewStaticKeyStore("secret 123")}
+	locator := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+
+	res, err := b.Last("radio-t", 0)
+	require.Nil(t, err)
+	id := res[0].ID
+
+	_, err = b.RevertComment(locator, id, 0)
+	assert.EqualError(t, err, "no revision 0 for "+id, "nothing to revert for not edited comment")
+
+	_, err = b.EditComment(locator, id, EditRequest{Orig: "yyy", Text: "xxx", Summary: "my edit"})
+	require.Nil(t, err)
+
+	c, err := b.RevertComment(locator, id, 0)
+	require.Nil(t, err)
+	assert.Equal(t, res[0].Text, c.Text)
+	assert.Equal(t, res[0].Orig, c.Orig)
+	assert.Equal(t, "reverted to revision 0", c.Edit.Summary)
+
+	c, err = b.Get(locator, id)
+	require.Nil(t, err)
+	assert.Equal(t, res[0].Text, c.Text)
+	require.Equal(t, 2, len(c.Revisions), "reverted version kept as revision")
+	assert.Equal(t, "yyy", c.Revisions[1].Orig)
+
+	_, err = b.EditComment(locator, id, EditRequest{Delete: true})
+	require.Nil(t, err)
+	_, err = b.RevertComment(locator, id, 0)
+	assert.EqualError(t, err, "can't revert deleted comment "+id)
+}
+
+func TestService_addRevision(t *testing.T) {
+	var revs []store.Revision
+	for i := 0; i < maxRevisions+5; i++ {
+		revs = addRevision(revs, store.Revision{Orig: fmt.Sprintf("rev %d", i)})
+	}
+	assert.Equal(t, maxRevisions, len(revs))
+	assert.Equal(t, "rev 5", revs[0].Orig, "oldest revisions dropped")
+	assert.Equal(t, fmt.Sprintf("rev %d", maxRevisions+4), revs[maxRevisions-1].Orig)
+}
+
 func TestService_DeleteComment(t *testing.T) {
 	defer os.Remove(testDb)
 	b := DataStore{Interface: prepStoreEngine(t), AdminStore: admin.NewStaticKeyStore("secret 123")}
@@ -303,6 +394,198 @@ func TestService_DeleteComment(t *testing.T) {
 	t.Logf("%+v", c)
 }
 
+func TestService_RestoreComment(t *testing.T) {
+	defer os.Remove(testDb)
+	b := DataStore{Interface: prepStoreEngine(t), AdminStore: admin.NewStaticKeyStore("secret 123"), RetainDeleted: time.Hour}
+	locator := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+
+	res, err := b.Last("radio-t", 0)
+	require.Nil(t, err)
+	id := res[0].ID
+
+	_, err = b.EditComment(locator, id, EditRequest{Delete: true})
+	require.Nil(t, err)
+
+	c, err := b.RestoreComment(locator, id)
+	require.Nil(t, err)
+	assert.False(t, c.Deleted)
+	assert.Equal(t, res[0].Text, c.Text)
+
+	_, err = b.RestoreComment(locator, id)
+	assert.EqualError(t, err, "comment "+id+" not deleted")
+
+	require.Nil(t, b.Delete(locator, id, store.SoftDelete))
+	b.RetainDeleted = 0
+	_, err = b.RestoreComment(locator, id)
+	assert.EqualError(t, err, "retention window expired for "+id)
+}
+
+func TestService_PurgeDeleted(t *testing.T) {
+	defer os.Remove(testDb)
+	b := DataStore{Interface: prepStoreEngine(t), AdminStore: admin.NewStaticKeyStore("secret 123"), RetainDeleted: time.Hour}
+	locator := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+
+	res, err := b.Last("radio-t", 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(res))
+	require.Nil(t, b.Delete(locator, res[0].ID, store.SoftDelete))
+	require.Nil(t, b.Delete(locator, res[1].ID, store.SoftDelete))
+
+	n, err := b.PurgeDeleted("radio-t")
+	require.Nil(t, err)
+	assert.Equal(t, 0, n, "nothing expired")
+
+	// make the first one expired
+	c, err := b.Get(locator, res[0].ID)
+	require.Nil(t, err)
+	c.Trash.Timestamp = time.Now().Add(-2 * time.Hour)
+	require.Nil(t, b.Put(locator, c))
+
+	n, err = b.PurgeDeleted("radio-t")
+	require.Nil(t, err)
+	assert.Equal(t, 1, n)
+
+	c, err = b.Get(locator, res[0].ID)
+	require.Nil(t, err)
+	assert.True(t, c.Deleted)
+	assert.Nil(t, c.Trash)
+	_, err = b.RestoreComment(locator, res[0].ID)
+	assert.NotNil(t, err, "purged can't be restored")
+
+	_, err = b.RestoreComment(locator, res[1].ID)
+	assert.Nil(t, err, "not expired restored")
+}
+
+func TestService_NeedsApproval(t *testing.T) {
+	defer os.Remove(testDb)
+	b := DataStore{Interface: prepStoreEngine(t),
+		AdminStore: admin.NewStaticStore("secret 123", []string{"admin1"}, []string{"moderator1"}, "")}
+	comment := func(userID string) store.Comment {
+		return store.Comment{Locator: store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}, User: store.User{ID: userID}}
+	}
+	require.Nil(t, b.SetVerified("radio-t", "verified1", true))
+
+	tbl := []struct {
+		premod PreModeration
+		user   string
+		res    bool
+	}{
+		{PreModeration{}, "user2", false},
+		{PreModeration{Mode: "none"}, "user2", false},
+		{PreModeration{Mode: PreModAll}, "user1", true},
+		{PreModeration{Mode: PreModAll}, "admin1", false},
+		{PreModeration{Mode: PreModAll}, "moderator1", false},
+		{PreModeration{Mode: PreModAll, Sites: []string{"radio-t", "other"}}, "user1", true},
+		{PreModeration{Mode: PreModAll, Sites: []string{"other"}}, "user1", false},
+		{PreModeration{Mode: PreModUntrusted, Trusted: 2}, "user1", false}, // 2 approved comments
+		{PreModeration{Mode: PreModUntrusted, Trusted: 3}, "user1", true},
+		{PreModeration{Mode: PreModUntrusted, Trusted: 3}, "user2", true},
+		{PreModeration{Mode: PreModUntrusted, Trusted: 3}, "verified1", false},
+		{PreModeration{Mode: PreModUntrusted, Trusted: 0}, "user2", false},
+	}
+	for i, tt := range tbl {
+		b.PreModeration = tt.premod
+		assert.Equal(t, tt.res, b.NeedsApproval(comment(tt.user)), "check #%d", i)
+	}
+
+	// pending comments not counted as approved
+	b.PreModeration = PreModeration{Mode: PreModUntrusted, Trusted: 3}
+	c := comment("user1")
+	c.ID, c.Text, c.Pending = "id-3", "pending", true
+	_, err := b.Create(c)
+	require.Nil(t, err)
+	assert.True(t, b.NeedsApproval(comment("user1")))
+	_, err = b.ApproveComment(c.Locator, "id-3")
+	require.Nil(t, err)
+	assert.False(t, b.NeedsApproval(comment("user1")))
+}
+
+func TestService_ApproveAndRejectComment(t *testing.T) {
+	defer os.Remove(testDb)
+	b := DataStore{Interface: prepStoreEngine(t), AdminStore: admin.NewStaticKeyStore("secret 123"), RetainDeleted: time.Hour}
+	locator := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+
+	for _, id := range []string{"id-3", "id-4"} {
+		_, err := b.Create(store.Comment{ID: id, Text: "pending " + id, Locator: locator, Pending: true,
+			User: store.User{ID: "user2", Name: "user2"}})
+		require.Nil(t, err)
+	}
+	pending, err := b.Pending("radio-t")
+	require.Nil(t, err)
+	assert.Equal(t, 2, len(pending))
+
+	c, err := b.ApproveComment(locator, "id-3")
+	require.Nil(t, err)
+	assert.False(t, c.Pending)
+	_, err = b.ApproveComment(locator, "id-3")
+	assert.EqualError(t, err, "comment id-3 not pending")
+
+	assert.EqualError(t, b.RejectComment(locator, "id-3"), "comment id-3 not pending")
+	require.Nil(t, b.RejectComment(locator, "id-4"))
+	assert.EqualError(t, b.RejectComment(locator, "id-4"), "comment id-4 not pending", "already rejected")
+	_, err = b.ApproveComment(locator, "id-4")
+	assert.EqualError(t, err, "can't approve deleted comment id-4")
+
+	pending, err = b.Pending("radio-t")
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(pending))
+	count, err := b.Count(locator)
+	require.Nil(t, err)
+	assert.Equal(t, 3, count)
+}
+
+func TestService_ReportComment(t *testing.T) {
+	defer os.Remove(testDb)
+	b := DataStore{Interface: prepStoreEngine(t), AdminStore: admin.NewStaticKeyStore("secret 123"), ReportLimit: 2}
+	locator := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+
+	_, err := b.ReportComment(locator, "id-1", "user1", "spam")
+	assert.EqualError(t, err, "user user1 can not report his own comment id-1")
+	c, err := b.ReportComment(locator, "id-1", "user2", "spam")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(c.Reports))
+	assert.Equal(t, "user2", c.Reports[0].UserID)
+	assert.Equal(t, "spam", c.Reports[0].Reason)
+	assert.False(t, c.Pending)
+	_, err = b.ReportComment(locator, "id-1", "user2", "spam again")
+	assert.EqualError(t, err, "user user2 already reported id-1")
+
+	c, err = b.ReportComment(locator, "id-1", "user3", strings.Repeat("я", 300))
+	require.Nil(t, err)
+	assert.True(t, c.Pending, "hidden on reports limit")
+	assert.Equal(t, strings.Repeat("я", 256), c.Reports[1].Reason, "truncated by runes")
+	_, err = b.ReportComment(locator, "id-1", "user4", "spam")
+	assert.EqualError(t, err, "can't report comment id-1", "hidden comment can't be reported")
+	count, err := b.Count(locator)
+	require.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	_, err = b.ReportComment(locator, "id-2", "user3", "offtopic")
+	require.Nil(t, err)
+	reported, err := b.Reported("radio-t")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(reported))
+	assert.Equal(t, "id-1", reported[0].ID, "the most reported first")
+	assert.Equal(t, "id-2", reported[1].ID)
+
+	c, err = b.DismissReports(locator, "id-1")
+	require.Nil(t, err)
+	assert.False(t, c.Pending, "published back")
+	assert.Nil(t, c.Reports)
+	_, err = b.DismissReports(locator, "id-1")
+	assert.EqualError(t, err, "comment id-1 not reported")
+	c, err = b.DismissReports(locator, "id-2")
+	require.Nil(t, err)
+	assert.Nil(t, c.Reports)
+
+	reported, err = b.Reported("radio-t")
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(reported))
+	count, err = b.Count(locator)
+	require.Nil(t, err)
+	assert.Equal(t, 2, count)
+}
+
 func TestService_EditCommentDurationFailed(t *testing.T) {
 	defer os.Remove(testDb)
 	b := DataStore{Interface: prepStoreEngine(t), EditDuration: 100 * time.Millisecond, AdminStore: admin.NewStaticKeyStore("secret 123")}
@@ -345,6 +628,216 @@ func TestService_ValidateComment(t *testing.T) {
 	}
 }
 
+func TestService_Anonymous(t *testing.T) {
+	defer os.Remove(testDb)
+	b := DataStore{Interface: prepStoreEngine(t), MaxCommentSize: 2000, MaxVotes: UnlimitedVotes,
+		AdminStore: admin.NewStaticKeyStore("secret 123"),
+		Anonymous:  Anonymous{VoteSites: []string{"other"}, StrictSites: []string{"radio-t"}, MaxCommentSize: 10, Interval: time.Hour}}
+	anon := store.User{ID: store.AnonymousPrefix + "123", Name: "anon"}
+	locator := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+
+	_, err := b.Vote(locator, "id-1", anon.ID, true)
+	assert.EqualError(t, err, "anonymous user anonymous_123 can not vote on site radio-t")
+	b.Anonymous.VoteSites = append(b.Anonymous.VoteSites, "radio-t")
+	c, err := b.Vote(locator, "id-1", anon.ID, true)
+	require.Nil(t, err)
+	assert.Equal(t, 1, c.Score)
+
+	err = b.ValidateComment(&store.Comment{Orig: "some long text", Locator: locator, User: anon})
+	assert.EqualError(t, err, "anonymous comment text exceeded max allowed size 10 (14)")
+	assert.Nil(t, b.ValidateComment(&store.Comment{Orig: "short text", Locator: locator, User: anon}))
+	assert.Nil(t, b.ValidateComment(&store.Comment{Orig: "some long text", Locator: locator, User: store.User{ID: "user1",
+		Name: "user name"}}), "not anonymous")
+	assert.Nil(t, b.ValidateComment(&store.Comment{Orig: "some long text", Locator: store.Locator{SiteID: "other"},
+		User: anon}), "not strict site")
+
+	comment := store.Comment{Text: "short text", Locator: locator, User: anon}
+	assert.False(t, b.TooFrequent(comment), "no comments yet")
+	_, err = b.Create(comment)
+	require.Nil(t, err)
+	assert.True(t, b.TooFrequent(comment))
+	assert.False(t, b.TooFrequent(store.Comment{Locator: locator, User: store.User{ID: "user1"}}), "not anonymous")
+	b.Anonymous.Interval = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+	assert.False(t, b.TooFrequent(comment), "interval passed")
+	b.Anonymous.Interval, b.Anonymous.StrictSites = time.Hour, nil
+	assert.False(t, b.TooFrequent(comment), "no strict sites")
+
+	// limited per ip, for any anonymous user
+	b.Anonymous.StrictSites = []string{"radio-t"}
+	withIP := func(userID, ip string) store.Comment {
+		return store.Comment{Text: "short text", Locator: locator, User: store.User{ID: store.AnonymousPrefix + userID,
+			Name: "anon " + userID, IP: ip}}
+	}
+	assert.False(t, b.TooFrequent(withIP("1", "10.0.0.1")))
+	assert.False(t, b.TooFrequent(withIP("1", "10.0.0.1")), "not counted till created")
+	_, err = b.Create(withIP("1", "10.0.0.1"))
+	require.Nil(t, err)
+	assert.True(t, b.TooFrequent(withIP("2", "10.0.0.1")), "other name from the same ip")
+	assert.False(t, b.TooFrequent(withIP("3", "10.0.0.2")), "other ip")
+	_, err = b.Create(withIP("3", "10.0.0.2"))
+	require.Nil(t, err)
+	b.Anonymous.Interval = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+	assert.False(t, b.TooFrequent(withIP("4", "10.0.0.1")), "interval passed")
+	_, err = b.Create(withIP("4", "10.0.0.1"))
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(b.anonIPs.last), "expired ips dropped")
+}
+
+func TestService_IsIPStale(t *testing.T) {
+	fileName := "/tmp/test-remark-admin.db"
+	defer os.Remove(fileName)
+	os.Remove(fileName)
+	bs, err := admin.NewBoltStore(fileName, bolt.Options{}, admin.SiteInfo{Key: "secret 123"})
+	require.Nil(t, err)
+	defer bs.Close()
+
+	c := store.Comment{Locator: store.Locator{SiteID: "radio-t"}, User: store.User{IP: "hashed-ip"},
+		Timestamp: time.Now().Add(-time.Minute)}
+	b := DataStore{AdminStore: admin.NewStaticKeyStore("secret 123")}
+	assert.False(t, b.IsIPStale(c), "no rotation in static store")
+
+	b.AdminStore = bs
+	assert.False(t, b.IsIPStale(c), "not rotated")
+	_, err = bs.RotateKey("radio-t", "new key", time.Hour)
+	require.Nil(t, err)
+	assert.True(t, b.IsIPStale(c))
+	c.Timestamp = time.Now()
+	assert.False(t, b.IsIPStale(c), "after rotation")
+	c.User.IP = ""
+	c.Timestamp = time.Now().Add(-time.Minute)
+	assert.False(t, b.IsIPStale(c), "no ip")
+}
+
+func TestService_Sites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remark-sites")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	eng, err := engine.NewBoltDBDir(bolt.Options{}, dir, "radio-t")
+	require.Nil(t, err)
+	reg, err := registry.New(dir+"/sites.db", bolt.Options{}, "radio-t")
+	require.Nil(t, err)
+	defer reg.Close()
+	adminStore, err := admin.NewBoltStore(dir+"/admin.db", bolt.Options{}, admin.SiteInfo{Key: "secret 123"})
+	require.Nil(t, err)
+	defer adminStore.Close()
+	b := DataStore{Interface: eng, AdminStore: adminStore}
+	defer b.Close()
+
+	_, err = b.AddSite("blog")
+	assert.EqualError(t, err, "no sites registry")
+	assert.False(t, b.IsSiteDisabled("blog"))
+
+	b.Registry = reg
+	site, err := b.AddSite("blog")
+	require.Nil(t, err)
+	assert.Equal(t, "blog", site.ID)
+	_, err = b.AddSite("blog")
+	assert.EqualError(t, err, `site "blog" already registered`)
+	loc := store.Locator{URL: "https://example.com/post1", SiteID: "blog"}
+	_, err = b.Create(store.Comment{Text: "text", Locator: loc, User: store.User{ID: "user1"}})
+	require.Nil(t, err)
+	require.Nil(t, adminStore.SetSite(admin.SiteInfo{SiteID: "blog", Admins: []string{"a1"}}))
+
+	// disabled site rejects new comments and storage closed
+	_, err = b.SetSiteDisabled("blog", true)
+	require.Nil(t, err)
+	assert.True(t, b.IsSiteDisabled("blog"))
+	_, err = b.Create(store.Comment{Text: "text", Locator: loc, User: store.User{ID: "user1"}})
+	assert.EqualError(t, err, "site blog disabled")
+	_, err = b.Count(loc)
+	assert.EqualError(t, err, `site "blog" closed`)
+	_, err = b.SetSiteDisabled("blog", false)
+	require.Nil(t, err)
+	count, err := b.Count(loc)
+	require.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	// rename moves comments and admins info, revokes api tokens
+	oldTkn, _, err := adminStore.CreateToken("blog", "stats", []string{admin.ScopeRead})
+	require.Nil(t, err)
+	site, err = b.RenameSite("blog", "new-blog")
+	require.Nil(t, err)
+	_, err = adminStore.CheckToken(oldTkn)
+	assert.Error(t, err, "token of the old id revoked")
+	assert.Equal(t, "new-blog", site.ID)
+	loc.SiteID = "new-blog"
+	count, err = b.Count(loc)
+	require.Nil(t, err)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, []string{"a1"}, adminStore.Admins("new-blog"))
+	sites, err := adminStore.Sites()
+	require.Nil(t, err)
+	assert.Equal(t, []string{"new-blog"}, sites)
+	_, err = b.RenameSite("new-blog", "radio-t")
+	assert.EqualError(t, err, `site "radio-t" already registered`)
+
+	newTkn, _, err := adminStore.CreateToken("new-blog", "stats", []string{admin.ScopeRead})
+	require.Nil(t, err)
+	require.Nil(t, b.DeleteSite("new-blog"))
+	_, err = os.Stat(dir + "/new-blog.db")
+	assert.True(t, os.IsNotExist(err), "storage removed")
+	sites, err = adminStore.Sites()
+	require.Nil(t, err)
+	assert.Equal(t, []string{}, sites)
+	assert.EqualError(t, b.DeleteSite("new-blog"), `site "new-blog" not registered`)
+	regSites, err := reg.Enabled()
+	require.Nil(t, err)
+	assert.Equal(t, []string{"radio-t"}, regSites)
+
+	// tokens of deleted site not valid for the site registered with the same id
+	_, err = b.AddSite("new-blog")
+	require.Nil(t, err)
+	_, err = adminStore.CheckToken(newTkn)
+	assert.Error(t, err, "token of deleted site revoked")
+	_, err = adminStore.CheckToken(oldTkn)
+	assert.Error(t, err)
+	require.Nil(t, b.DeleteSite("new-blog"))
+
+	// engine without storage per site can't rename
+	b.Interface = struct{ engine.Interface }{eng}
+	_, err = b.RenameSite("radio-t", "radio-t2")
+	assert.EqualError(t, err, "site rename not supported by the store")
+}
+
+func TestService_IsReservedName(t *testing.T) {
+	defer os.Remove(testDb)
+	b := DataStore{Interface: prepStoreEngine(t),
+		AdminStore: admin.NewStaticStore("secret 123", []string{"user1"}, []string{"user4"}, "")}
+	_, err := b.Create(store.Comment{ID: "id-3", Text: "text", Locator: store.Locator{URL: "https://radio-t.com",
+		SiteID: "radio-t"}, User: store.User{ID: "user2", Name: "Verified User"}})
+	require.Nil(t, err)
+	_, err = b.Create(store.Comment{ID: "id-4", Text: "text", Locator: store.Locator{URL: "https://radio-t.com",
+		SiteID: "radio-t"}, User: store.User{ID: "user4", Name: "Moderator"}})
+	require.Nil(t, err)
+
+	tbl := []struct {
+		name     string
+		reserved bool
+	}{
+		{"user name", true},
+		{" User Name ", true},
+		{"verified user", false},
+		{"moderator", true},
+		{"other name", false},
+	}
+	for i, tt := range tbl {
+		res, err := b.IsReservedName("radio-t", tt.name)
+		require.Nil(t, err)
+		assert.Equal(t, tt.reserved, res, "admin and moderator, case #%d", i)
+	}
+
+	require.Nil(t, b.SetVerified("radio-t", "user2", true))
+	res, err := b.IsReservedName("radio-t", "verified user")
+	require.Nil(t, err)
+	assert.True(t, res, "verified user")
+	res, err = b.IsReservedName("radio-t", "user3")
+	require.Nil(t, err)
+	assert.False(t, res)
+}
+
 func TestService_Counts(t *testing.T) {
 	defer os.Remove(testDb)
 	b := prepStoreEngine(t) // two comments for https://radio-t.com
@@ -388,6 +881,7 @@ func TestService_GetMetas(t *testing.T) {
 	assert.NoError(t, b.SetVerified("radio-t", "user1", true))
 	assert.NoError(t, b.SetBlock("radio-t", "user1", true, time.Hour))
 	assert.NoError(t, b.SetBlock("radio-t", "user2", true, time.Hour))
+	assert.NoError(t, b.SetShadowBan("radio-t", "user2", true))
 	assert.NoError(t, b.SetReadOnly(store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}, true))
 
 	um, pm, err = b.Metas("radio-t")
@@ -399,6 +893,8 @@ func TestService_GetMetas(t *testing.T) {
 	assert.Equal(t, true, um[0].Blocked.Status)
 	assert.Equal(t, false, um[1].Verified)
 	assert.Equal(t, true, um[1].Blocked.Status)
+	assert.Equal(t, false, um[0].ShadowBanned)
+	assert.Equal(t, true, um[1].ShadowBanned)
 
 	assert.Equal(t, 1, len(pm))
 	assert.Equal(t, "https://radio-t.com", pm[0].URL)
@@ -416,7 +912,7 @@ func TestService_SetMetas(t *testing.T) {
 	assert.NoError(t, err, "empty metas")
 
 	um1 := UserMetaData{ID: "user1", Verified: true}
-	um2 := UserMetaData{ID: "user2"}
+	um2 := UserMetaData{ID: "user2", ShadowBanned: true}
 	um2.Blocked.Status = true
 	um2.Blocked.Until = time.Now().AddDate(0, 1, 1)
 
@@ -427,16 +923,23 @@ func TestService_SetMetas(t *testing.T) {
 	assert.True(t, b.IsReadOnly(store.Locator{SiteID: "radio-t", URL: "https://radio-t.com"}))
 	assert.True(t, b.IsVerified("radio-t", "user1"))
 	assert.True(t, b.IsBlocked("radio-t", "user2"))
+	assert.True(t, b.IsShadowBanned("radio-t", "user2"))
+	assert.False(t, b.IsShadowBanned("radio-t", "user1"))
 }
 
 func TestService_IsAdmin(t *testing.T) {
 	defer os.Remove(testDb)
 	// two comments for https://radio-t.com
 	b := DataStore{Interface: prepStoreEngine(t), EditDuration: 100 * time.Millisecond,
-		AdminStore: admin.NewStaticStore("secret 123", []string{"user2"}, "user@email.com")}
+		AdminStore: admin.NewStaticStore("secret 123", []string{"user2"}, []string{"user3"}, "user@email.com")}
 
 	assert.False(t, b.IsAdmin("radio-t", "user1"))
 	assert.True(t, b.IsAdmin("radio-t", "user2"))
+	assert.False(t, b.IsAdmin("radio-t", "user3"))
+
+	assert.False(t, b.IsModerator("radio-t", "user1"))
+	assert.False(t, b.IsModerator("radio-t", "user2"), "admin is not listed as moderator")
+	assert.True(t, b.IsModerator("radio-t", "user3"))
 }
 
 // makes new boltdb, put two records
@@ -10,17 +10,50 @@ import (
 	"io"
 	"log"
 	"regexp"
+	"strings"
+	"time"
 )
 
 // User holds user-related info
 type User struct {
-	Name     string `json:"name"`
-	ID       string `json:"id"`
-	Picture  string `json:"picture"`
-	IP       string `json:"ip,omitempty"`
-	Admin    bool   `json:"admin"`
-	Blocked  bool   `json:"block,omitempty"`
-	Verified bool   `json:"verified,omitempty"`
+	Name      string `json:"name"`
+	ID        string `json:"id"`
+	Picture   string `json:"picture"`
+	IP        string `json:"ip,omitempty"`
+	IPStale   bool   `json:"ip_stale,omitempty"` // ip hashed with the site's key before the last rotation
+	Admin     bool   `json:"admin"`
+	Moderator bool   `json:"moderator,omitempty"`
+	Blocked   bool   `json:"block,omitempty"`
+	Verified  bool   `json:"verified,omitempty"`
+}
+
+// ReplyNotify defines where user wants to be notified about replies to own comments, opted-out if empty
+type ReplyNotify struct {
+	Email   string `json:"email,omitempty" bson:"email,omitempty"`
+	Webhook string `json:"webhook,omitempty" bson:"webhook,omitempty"`
+}
+
+// Subscription defines user's subscription to new comments of the post, sent in periodic digest
+type Subscription struct {
+	Locator  Locator   `json:"locator" bson:"locator"`
+	UserID   string    `json:"user_id" bson:"user_id"`
+	Email    string    `json:"email" bson:"email"`
+	Period   string    `json:"period" bson:"period"`       // DigestDaily or DigestWeekly
+	LastSent time.Time `json:"last_sent" bson:"last_sent"` // comments after it go to the next digest
+}
+
+// enum of digest periods
+const (
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+)
+
+// AnonymousPrefix starts IDs of users logged in anonymously, with name only
+const AnonymousPrefix = "anonymous_"
+
+// IsAnonymous checks if user logged in anonymously
+func IsAnonymous(userID string) bool {
+	return strings.HasPrefix(userID, AnonymousPrefix)
 }
 
 var reValidSha = regexp.MustCompile("^[a-fA-F0-9]{40}$")